@@ -0,0 +1,66 @@
+package tstorage
+
+import (
+	"fmt"
+	"io"
+)
+
+// Allocator allocates large byte buffers used by the storage, which are buffers to write
+// data files when flushing partitions, and ones to read data files that aren't memory-mapped.
+// See WithAllocator
+type Allocator interface {
+	// Get gives back a buffer of length n.
+	Get(n int) []byte
+	// Put releases the buffer given by Get. It is never called twice for the same buffer,
+	// and the storage doesn't touch the buffer after that.
+	Put(b []byte)
+}
+
+// defaultAllocator allocates buffers on the Go heap, and leaves released ones to the GC.
+var defaultAllocator Allocator = &heapAllocator{}
+
+type heapAllocator struct{}
+
+func (a *heapAllocator) Get(n int) []byte {
+	return make([]byte, n)
+}
+
+func (a *heapAllocator) Put(_ []byte) {}
+
+// The default size of the buffer to write a data file.
+const defaultFlushBufferSize = 1 << 20
+
+// allocatedWriter buffers writes to the underlying writer with a buffer given by an Allocator.
+type allocatedWriter struct {
+	w   io.Writer
+	buf []byte
+	n   int
+}
+
+func (w *allocatedWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		if w.n == len(w.buf) {
+			if err := w.flush(); err != nil {
+				return written, err
+			}
+		}
+		n := copy(w.buf[w.n:], p)
+		w.n += n
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// flush writes the buffered bytes to the underlying writer.
+func (w *allocatedWriter) flush() error {
+	if w.n == 0 {
+		return nil
+	}
+	if _, err := w.w.Write(w.buf[:w.n]); err != nil {
+		return fmt.Errorf("failed to write buffered bytes: %w", err)
+	}
+	w.n = 0
+	return nil
+}
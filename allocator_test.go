@@ -0,0 +1,170 @@
+package tstorage
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type countingAllocator struct {
+	mu   sync.Mutex
+	gets int
+	puts int
+	// sizes of all buffers given so far.
+	sizes []int
+	// sizes of the buffers given but not released yet, keyed by their addresses.
+	inUse map[*byte]int
+}
+
+func (a *countingAllocator) Get(n int) []byte {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	b := make([]byte, n)
+	a.gets++
+	a.sizes = append(a.sizes, n)
+	a.inUse[&b[0]] = n
+	return b
+}
+
+func (a *countingAllocator) Put(b []byte) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.puts++
+	delete(a.inUse, &b[0])
+}
+
+func (a *countingAllocator) inUseSizes() []int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	sizes := make([]int, 0, len(a.inUse))
+	for _, n := range a.inUse {
+		sizes = append(sizes, n)
+	}
+	return sizes
+}
+
+func Test_storage_withAllocator(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tstorage-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	allocator := &countingAllocator{inUse: make(map[*byte]int)}
+	s, err := NewStorage(WithDataPath(tmpDir), WithTimestampPrecision(Seconds), WithAllocator(allocator), WithMmap(false))
+	require.NoError(t, err)
+	for i := int64(1); i <= 10; i++ {
+		require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: i, Value: float64(i)}}}))
+	}
+	// Close flushes the partition with a buffer to write the data file, which isn't read until selecting.
+	require.NoError(t, s.Close())
+	assert.Equal(t, 1, allocator.gets)
+	assert.Equal(t, 1, allocator.puts)
+	assert.Empty(t, allocator.inUseSizes())
+
+	// Selecting reads the data file into another buffer.
+	require.NoError(t, s.Reopen())
+	got, err := s.Select("metric1", nil, 1, 11)
+	require.NoError(t, err)
+	assert.Len(t, got, 10)
+	assert.Equal(t, 2, allocator.gets)
+	assert.Equal(t, 1, allocator.puts)
+	info, err := os.Stat(filepath.Join(tmpDir, "p-1-10", dataFileName))
+	require.NoError(t, err)
+	assert.Equal(t, []int{int(info.Size())}, allocator.inUseSizes())
+
+	// The buffer holding the data file is put back when closing the partition.
+	require.NoError(t, s.Close())
+	require.NoError(t, s.Reopen())
+	assert.Equal(t, 2, allocator.gets)
+	assert.Equal(t, 2, allocator.puts)
+	assert.Empty(t, allocator.inUseSizes())
+	require.NoError(t, s.Close())
+}
+
+func Test_storage_withFlushBufferSize(t *testing.T) {
+	tmpDir := t.TempDir()
+	allocator := &countingAllocator{inUse: make(map[*byte]int)}
+	opts := []Option{WithDataPath(tmpDir), WithTimestampPrecision(Seconds), WithAllocator(allocator), WithFlushBufferSize(16)}
+	s, err := NewStorage(opts...)
+	require.NoError(t, err)
+	for i := int64(1); i <= 100; i++ {
+		require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: i, Value: float64(i)}}}))
+	}
+	require.NoError(t, s.Close())
+	assert.Equal(t, []int{16}, allocator.sizes)
+	info, err := os.Stat(filepath.Join(tmpDir, "p-1-100", dataFileName))
+	require.NoError(t, err)
+	// The data file is written in chunks of the buffer.
+	assert.Greater(t, info.Size(), int64(16))
+
+	s, err = NewStorage(opts...)
+	require.NoError(t, err)
+	defer s.Close()
+	got, err := s.Select("metric1", nil, 1, 101)
+	require.NoError(t, err)
+	assert.Len(t, got, 100)
+
+	_, err = NewStorage(WithFlushBufferSize(0))
+	assert.Error(t, err)
+}
+
+func Test_diskPartition_clean_releasesBuffer(t *testing.T) {
+	tmpDir := t.TempDir()
+	s, err := NewStorage(WithDataPath(tmpDir), WithTimestampPrecision(Seconds))
+	require.NoError(t, err)
+	require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1, Value: 0.1}}}))
+	require.NoError(t, s.Close())
+	dirPath := filepath.Join(tmpDir, "p-1-1")
+
+	tests := []struct {
+		name   string
+		pinned bool
+	}{
+		{name: "not pinned", pinned: false},
+		{name: "released by the last unpin", pinned: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Copy it since cleaning removes the files.
+			dir := filepath.Join(t.TempDir(), "p-1-1")
+			require.NoError(t, copyPartitionFiles(dirPath, dir))
+			allocator := &countingAllocator{inUse: make(map[*byte]int)}
+			part, err := openDiskPartition(defaultFileSystem, dir, time.Hour, false, allocator)
+			require.NoError(t, err)
+			d := part.(*diskPartition)
+			_, err = d.selectDataPoints("metric1", nil, 1, 2)
+			require.NoError(t, err)
+			assert.Equal(t, 1, allocator.gets)
+
+			if tt.pinned {
+				require.True(t, d.pin())
+			}
+			require.NoError(t, d.clean())
+			if tt.pinned {
+				// Still readable by the one pinning it.
+				assert.Equal(t, 0, allocator.puts)
+				require.NoError(t, d.unpin())
+			}
+			assert.Equal(t, 1, allocator.puts)
+			assert.Empty(t, allocator.inUseSizes())
+			assert.Nil(t, d.mappedFile)
+		})
+	}
+}
+
+// copyPartitionFiles copies the files of the partition placed at src into dst.
+func copyPartitionFiles(src, dst string) error {
+	if err := os.MkdirAll(dst, defaultDirPerm); err != nil {
+		return err
+	}
+	for _, name := range []string{dataFileName, metaFileName} {
+		if err := copyFile(filepath.Join(src, name), filepath.Join(dst, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
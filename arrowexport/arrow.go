@@ -0,0 +1,58 @@
+// Package arrowexport gives back data points selected from a tstorage.Reader as Apache Arrow records,
+// so that they can be handed to Arrow-based tools without being converted row by row.
+// It lives in a separate module so that the core package doesn't depend on Arrow.
+package arrowexport
+
+import (
+	"github.com/apache/arrow/go/v12/arrow"
+	"github.com/apache/arrow/go/v12/arrow/array"
+	"github.com/apache/arrow/go/v12/arrow/memory"
+	"github.com/nakabonne/tstorage"
+)
+
+const (
+	// TimestampField is the name of the column holding timestamps.
+	TimestampField = "timestamp"
+	// ValueField is the name of the column holding values.
+	ValueField = "value"
+	// MetricMetadataKey is the key of the schema metadata holding the metric name.
+	MetricMetadataKey = "tstorage.metric"
+)
+
+// Schema gives back the schema of records given back by SelectArrow for the given metric.
+func Schema(metric string) *arrow.Schema {
+	md := arrow.NewMetadata([]string{MetricMetadataKey}, []string{metric})
+	return arrow.NewSchema([]arrow.Field{
+		{Name: TimestampField, Type: arrow.PrimitiveTypes.Int64},
+		{Name: ValueField, Type: arrow.PrimitiveTypes.Float64},
+	}, &md)
+}
+
+// SelectArrow gives back the data points within the given range as a record with timestamp and value columns,
+// in ascending order. The columns are built on top of the slices given back by SelectColumns without being copied.
+// The caller must call Release on the record once it's done.
+//
+//	rec, err := arrowexport.SelectArrow(storage, "metric1", nil, start, end)
+//	if err != nil {
+//		return err
+//	}
+//	defer rec.Release()
+func SelectArrow(r tstorage.Reader, metric string, labels []tstorage.Label, start, end int64) (arrow.Record, error) {
+	timestamps, values, err := r.SelectColumns(metric, labels, start, end)
+	if err != nil {
+		return nil, err
+	}
+	n := len(timestamps)
+	tsData := array.NewData(arrow.PrimitiveTypes.Int64, n,
+		[]*memory.Buffer{nil, memory.NewBufferBytes(arrow.Int64Traits.CastToBytes(timestamps))}, nil, 0, 0)
+	defer tsData.Release()
+	valueData := array.NewData(arrow.PrimitiveTypes.Float64, n,
+		[]*memory.Buffer{nil, memory.NewBufferBytes(arrow.Float64Traits.CastToBytes(values))}, nil, 0, 0)
+	defer valueData.Release()
+
+	tsColumn := array.NewInt64Data(tsData)
+	defer tsColumn.Release()
+	valueColumn := array.NewFloat64Data(valueData)
+	defer valueColumn.Release()
+	return array.NewRecord(Schema(metric), []arrow.Array{tsColumn, valueColumn}, int64(n)), nil
+}
@@ -0,0 +1,61 @@
+package arrowexport
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/apache/arrow/go/v12/arrow"
+	"github.com/apache/arrow/go/v12/arrow/array"
+	"github.com/apache/arrow/go/v12/arrow/ipc"
+	"github.com/nakabonne/tstorage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelectArrow(t *testing.T) {
+	s, err := tstorage.NewStorage(tstorage.WithTimestampPrecision(tstorage.Seconds))
+	require.NoError(t, err)
+	defer s.Close()
+	require.NoError(t, s.InsertRows([]tstorage.Row{
+		{Metric: "metric1", DataPoint: tstorage.DataPoint{Timestamp: 1, Value: 0.1}},
+		{Metric: "metric1", DataPoint: tstorage.DataPoint{Timestamp: 2, Value: 0.2}},
+		{Metric: "metric1", DataPoint: tstorage.DataPoint{Timestamp: 3, Value: 0.3}},
+		{Metric: "metric1", DataPoint: tstorage.DataPoint{Timestamp: 4, Value: 0.4}},
+	}))
+
+	rec, err := SelectArrow(s, "metric1", nil, 2, 5)
+	require.NoError(t, err)
+	defer rec.Release()
+	assert.True(t, Schema("metric1").Equal(rec.Schema()))
+
+	// Round-trip through the IPC stream format.
+	var buf bytes.Buffer
+	w := ipc.NewWriter(&buf, ipc.WithSchema(rec.Schema()))
+	require.NoError(t, w.Write(rec))
+	require.NoError(t, w.Close())
+	r, err := ipc.NewReader(&buf)
+	require.NoError(t, err)
+	defer r.Release()
+	require.True(t, r.Next())
+	got := r.Record()
+
+	metric, ok := got.Schema().Metadata().GetValue(MetricMetadataKey)
+	require.True(t, ok)
+	assert.Equal(t, "metric1", metric)
+	assert.Equal(t, []arrow.Field{
+		{Name: TimestampField, Type: arrow.PrimitiveTypes.Int64},
+		{Name: ValueField, Type: arrow.PrimitiveTypes.Float64},
+	}, got.Schema().Fields())
+	assert.Equal(t, []int64{2, 3, 4}, got.Column(0).(*array.Int64).Int64Values())
+	assert.Equal(t, []float64{0.2, 0.3, 0.4}, got.Column(1).(*array.Float64).Float64Values())
+	assert.False(t, r.Next())
+	require.NoError(t, r.Err())
+}
+
+func TestSelectArrow_noDataPoints(t *testing.T) {
+	s, err := tstorage.NewStorage(tstorage.WithTimestampPrecision(tstorage.Seconds))
+	require.NoError(t, err)
+	defer s.Close()
+	_, err = SelectArrow(s, "metric1", nil, 1, 4)
+	assert.ErrorIs(t, err, tstorage.ErrNoDataPoints)
+}
@@ -0,0 +1,209 @@
+package tstorage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Block is a chunk of compressed data points of a series. See Reader.SelectBlocks
+type Block struct {
+	MinTimestamp  int64
+	MaxTimestamp  int64
+	NumDataPoints int
+	// Codec is the compression algorithm Data is encoded with.
+	Codec Codec
+	// TimestampBase is what the timestamps encoded in Data are offsets from. See WithRelativeTimestamps
+	TimestampBase int64
+	// Data holds the compressed data points, as stored in disk partitions.
+	Data []byte
+}
+
+// DataPoints decodes all data points in the block.
+func (b *Block) DataPoints() ([]*DataPoint, error) {
+	decoder, err := newCodecDecoderFromBytes(b.Codec, b.Data, b.TimestampBase)
+	if err != nil {
+		return nil, err
+	}
+	points := make([]*DataPoint, 0, b.NumDataPoints)
+	for i := 0; i < b.NumDataPoints; i++ {
+		point := &DataPoint{}
+		if err := decoder.decodePoint(point); err != nil {
+			return nil, fmt.Errorf("failed to decode point: %w", err)
+		}
+		points = append(points, point)
+	}
+	return points, nil
+}
+
+// SeriesBlocks is the blocks of a series. See Reader.SelectSeriesBlocks.
+type SeriesBlocks struct {
+	Labels []Label
+	Blocks []*Block
+}
+
+func (s *storage) SelectSeriesBlocks(metric string, labels []Label, start, end int64) ([]SeriesBlocks, error) {
+	metric = s.normalizeMetricName(metric)
+	if metric == "" {
+		return nil, fmt.Errorf("metric must be set")
+	}
+	if start >= end {
+		return nil, fmt.Errorf("the given start is greater than end")
+	}
+	names, err := s.matchingSeries(metric, labels, start, end)
+	if err != nil {
+		return nil, err
+	}
+	series := make([]SeriesBlocks, 0, len(names))
+	for _, name := range names {
+		_, seriesLabels, _ := unmarshalMetricName(name)
+		blocks, err := s.SelectBlocks(metric, seriesLabels, start, end)
+		if errors.Is(err, ErrNoDataPoints) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		series = append(series, SeriesBlocks{Labels: seriesLabels, Blocks: blocks})
+	}
+	if len(series) == 0 {
+		return nil, ErrNoDataPoints
+	}
+	return series, nil
+}
+
+func (s *storage) SelectBlocks(metric string, labels []Label, start, end int64) ([]*Block, error) {
+	metric = s.normalizeMetricName(metric)
+	if metric == "" {
+		return nil, fmt.Errorf("metric must be set")
+	}
+	if start >= end {
+		return nil, fmt.Errorf("the given start is greater than end")
+	}
+	parts, release, err := s.pinnedPartitions(start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	name := marshalMetricName(metric, labels)
+	blocks := make([]*Block, 0)
+	// Iterate from the oldest one, to keep the order in ascending.
+	for i := len(parts) - 1; i >= 0; i-- {
+		var bs []*Block
+		var err error
+		switch p := parts[i].(type) {
+		case *diskPartition:
+			bs, err = p.selectBlocks(name, start, end)
+		default:
+			bs, err = encodeBlock(p, s.codecFor(metric), metric, labels, start, end)
+		}
+		if errors.Is(err, ErrNoDataPoints) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to select blocks: %w", err)
+		}
+		blocks = append(blocks, bs...)
+	}
+	if len(blocks) == 0 {
+		return nil, ErrNoDataPoints
+	}
+	return blocks, nil
+}
+
+// selectBlocks gives back copies of the blocks overlapping the given range as they are.
+func (d *diskPartition) selectBlocks(name string, start, end int64) ([]*Block, error) {
+	if d.expired() {
+		return nil, fmt.Errorf("this partition is expired: %w", ErrNoDataPoints)
+	}
+	mt, ok := d.meta.Metrics[name]
+	if !ok {
+		return nil, ErrNoDataPoints
+	}
+	blocks := overlappingBlocks(mt.blocks(), start, end)
+	if len(blocks) == 0 {
+		return nil, ErrNoDataPoints
+	}
+	data, release, err := d.data()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	res := make([]*Block, 0, len(blocks))
+	for _, b := range blocks {
+		size, err := d.blockSize(data, b.Offset)
+		if err != nil {
+			return nil, fmt.Errorf("invalid block of metric %q in %q: %w", name, d.dirPath, err)
+		}
+		res = append(res, &Block{
+			MinTimestamp:  b.MinTimestamp,
+			MaxTimestamp:  b.MaxTimestamp,
+			NumDataPoints: int(b.NumDataPoints),
+			Codec:         b.codec(),
+			TimestampBase: d.meta.TimestampBase,
+			Data:          append([]byte(nil), data[b.Offset:b.Offset+size]...),
+		})
+	}
+	return res, nil
+}
+
+// blockSize gives back the byte size of the block beginning at the given offset in the given data file.
+// Blocks are written sequentially, hence a block ends where the next one begins.
+func (d *diskPartition) blockSize(data []byte, offset int64) (int64, error) {
+	if offset < 0 || offset > int64(len(data)) {
+		return 0, fmt.Errorf("offset %d is out of range", offset)
+	}
+	d.offsetsOnce.Do(func() {
+		for _, mt := range d.meta.Metrics {
+			for _, b := range mt.blocks() {
+				d.offsets = append(d.offsets, b.Offset)
+			}
+		}
+		sort.Slice(d.offsets, func(i, j int) bool {
+			return d.offsets[i] < d.offsets[j]
+		})
+	})
+	i := sort.Search(len(d.offsets), func(i int) bool {
+		return d.offsets[i] > offset
+	})
+	if i == len(d.offsets) || d.offsets[i] > int64(len(data)) {
+		return int64(len(data)) - offset, nil
+	}
+	return d.offsets[i] - offset, nil
+}
+
+// encodeBlock encodes the data points within the given range in the given partition into a block.
+func encodeBlock(p partition, codec Codec, metric string, labels []Label, start, end int64) ([]*Block, error) {
+	points, err := p.selectDataPoints(metric, labels, start, end)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	encoder, err := newCodecEncoder(codec, &buf, 0)
+	if err != nil {
+		return nil, err
+	}
+	b := &Block{Codec: codec}
+	for _, point := range points {
+		if point.Timestamp >= end {
+			break
+		}
+		if err := encoder.encodePoint(point); err != nil {
+			return nil, fmt.Errorf("failed to encode point: %w", err)
+		}
+		if b.NumDataPoints == 0 {
+			b.MinTimestamp = point.Timestamp
+		}
+		b.MaxTimestamp = point.Timestamp
+		b.NumDataPoints++
+	}
+	if b.NumDataPoints == 0 {
+		return nil, ErrNoDataPoints
+	}
+	if err := encoder.flush(); err != nil {
+		return nil, fmt.Errorf("failed to flush encoded points: %w", err)
+	}
+	b.Data = buf.Bytes()
+	return []*Block{b}, nil
+}
@@ -0,0 +1,142 @@
+package tstorage
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_storage_SelectBlocks(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tstorage-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	s, err := NewStorage(WithDataPath(tmpDir), WithTimestampPrecision(Seconds), WithPointsPerBlock(2))
+	require.NoError(t, err)
+	for i := int64(1); i <= 10; i++ {
+		require.NoError(t, s.InsertRows([]Row{
+			{Metric: "metric1", DataPoint: DataPoint{Timestamp: i, Value: float64(i)}},
+			{Metric: "metric2", DataPoint: DataPoint{Timestamp: i, Value: float64(-i)}},
+		}))
+	}
+	require.NoError(t, s.Close())
+
+	// Points from 1 to 10 are on the disk, and 11 and 12 are in the memory.
+	s, err = NewStorage(WithDataPath(tmpDir), WithTimestampPrecision(Seconds), WithPointsPerBlock(2))
+	require.NoError(t, err)
+	defer s.Close()
+	for i := int64(11); i <= 12; i++ {
+		require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: i, Value: float64(i)}}}))
+	}
+
+	tests := []struct {
+		name       string
+		metric     string
+		start      int64
+		end        int64
+		wantBlocks [][2]int64
+		wantPoints []*DataPoint
+		wantErr    error
+	}{
+		{
+			name:       "within a block",
+			metric:     "metric1",
+			start:      3,
+			end:        4,
+			wantBlocks: [][2]int64{{3, 4}},
+			wantPoints: []*DataPoint{{Timestamp: 3, Value: 3}, {Timestamp: 4, Value: 4}},
+		},
+		{
+			name:       "across partitions",
+			metric:     "metric1",
+			start:      8,
+			end:        12,
+			wantBlocks: [][2]int64{{7, 8}, {9, 10}, {11, 11}},
+			wantPoints: []*DataPoint{
+				{Timestamp: 7, Value: 7}, {Timestamp: 8, Value: 8},
+				{Timestamp: 9, Value: 9}, {Timestamp: 10, Value: 10},
+				{Timestamp: 11, Value: 11},
+			},
+		},
+		{
+			name:       "last metric in the file",
+			metric:     "metric2",
+			start:      9,
+			end:        100,
+			wantBlocks: [][2]int64{{9, 10}},
+			wantPoints: []*DataPoint{{Timestamp: 9, Value: -9}, {Timestamp: 10, Value: -10}},
+		},
+		{
+			name:    "unknown metric",
+			metric:  "unknown",
+			start:   0,
+			end:     100,
+			wantErr: ErrNoDataPoints,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			blocks, err := s.SelectBlocks(tt.metric, nil, tt.start, tt.end)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			gotBlocks := make([][2]int64, 0, len(blocks))
+			gotPoints := make([]*DataPoint, 0)
+			for _, b := range blocks {
+				gotBlocks = append(gotBlocks, [2]int64{b.MinTimestamp, b.MaxTimestamp})
+				points, err := b.DataPoints()
+				require.NoError(t, err)
+				gotPoints = append(gotPoints, points...)
+			}
+			assert.Equal(t, tt.wantBlocks, gotBlocks)
+			assert.Equal(t, tt.wantPoints, gotPoints)
+		})
+	}
+}
+
+func Test_storage_SelectSeriesBlocks(t *testing.T) {
+	s, err := NewStorage(WithDataPath(t.TempDir()), WithTimestampPrecision(Seconds), WithPointsPerBlock(2))
+	require.NoError(t, err)
+	defer s.Close()
+	get := []Label{{Name: "method", Value: "GET"}}
+	post := []Label{{Name: "method", Value: "POST"}}
+	for i := int64(1); i <= 3; i++ {
+		require.NoError(t, s.InsertRows([]Row{
+			{Metric: "http_requests", Labels: post, DataPoint: DataPoint{Timestamp: i, Value: float64(i)}},
+			{Metric: "http_requests", Labels: get, DataPoint: DataPoint{Timestamp: i, Value: float64(-i)}},
+			{Metric: "other", Labels: get, DataPoint: DataPoint{Timestamp: i, Value: 0}},
+		}))
+	}
+
+	got, err := s.SelectSeriesBlocks("http_requests", nil, 2, 4)
+	require.NoError(t, err)
+	require.Len(t, got, 2)
+	for i, want := range []struct {
+		labels []Label
+		points []*DataPoint
+	}{
+		{labels: get, points: []*DataPoint{{Timestamp: 2, Value: -2}, {Timestamp: 3, Value: -3}}},
+		{labels: post, points: []*DataPoint{{Timestamp: 2, Value: 2}, {Timestamp: 3, Value: 3}}},
+	} {
+		assert.Equal(t, want.labels, got[i].Labels)
+		var points []*DataPoint
+		for _, b := range got[i].Blocks {
+			ps, err := b.DataPoints()
+			require.NoError(t, err)
+			points = append(points, ps...)
+		}
+		assert.Equal(t, want.points, points)
+	}
+
+	got, err = s.SelectSeriesBlocks("http_requests", post, 2, 4)
+	require.NoError(t, err)
+	require.Len(t, got, 1)
+	assert.Equal(t, post, got[0].Labels)
+
+	_, err = s.SelectSeriesBlocks("http_requests", []Label{{Name: "method", Value: "PUT"}}, 2, 4)
+	assert.ErrorIs(t, err, ErrNoDataPoints)
+}
@@ -0,0 +1,56 @@
+// Command tstorage provides utilities to inspect data directories of tstorage.
+//
+// Usage:
+//
+//	tstorage dump-wal <data path>
+//	tstorage manifest <data path>
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/nakabonne/tstorage"
+)
+
+const usage = `Usage: tstorage <command> [arguments]
+
+Commands:
+  dump-wal <data path>  print all records in the WAL without replaying them
+  manifest <data path>  print the settings the data path was created with
+`
+
+func main() {
+	if err := run(os.Args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string) error {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	switch args[0] {
+	case "dump-wal":
+		if len(args) != 2 {
+			return fmt.Errorf("dump-wal requires exactly one data path")
+		}
+		return tstorage.DumpWAL(args[1], os.Stdout)
+	case "manifest":
+		if len(args) != 2 {
+			return fmt.Errorf("manifest requires exactly one data path")
+		}
+		m, err := tstorage.ReadManifest(args[1])
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(m)
+	default:
+		return fmt.Errorf("unknown command %q\n\n%s", args[0], usage)
+	}
+}
@@ -0,0 +1,312 @@
+package tstorage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"path"
+)
+
+// Codec represents the compression algorithm used to encode data points of a metric in disk partitions.
+// See WithMetricCodec
+type Codec string
+
+const (
+	// CodecGorilla is the Gorilla's compression, which suits regularly sampled gauges.
+	// See: http://www.vldb.org/pvldb/vol8/p1816-teller.pdf
+	CodecGorilla Codec = "gorilla"
+	// CodecDelta encodes deltas of timestamps and integral values into varints,
+	// which suits counters and sparse metrics sampled at irregular intervals.
+	CodecDelta Codec = "delta"
+	// CodecState encodes boolean series, such as up/down or feature flags, as runs of the same value,
+	// which suits series whose value rarely changes. Only 0 and 1 are accepted as values of the metrics using it;
+	// others are rejected with ErrNotBoolean on insert. See also Reader.SelectStateChanges and Reader.StateAt
+	CodecState Codec = "state"
+)
+
+// metricCodec is a pair of a metric name pattern and the codec used for the metrics matching it.
+type metricCodec struct {
+	pattern string
+	codec   Codec
+}
+
+func (c Codec) valid() bool {
+	return c == CodecGorilla || c == CodecDelta || c == CodecState
+}
+
+// codecFor gives back the codec used for the given metric.
+func (s *storage) codecFor(metric string) Codec {
+	for _, mc := range s.metricCodecs {
+		if ok, _ := path.Match(mc.pattern, metric); ok {
+			return mc.codec
+		}
+	}
+	return CodecGorilla
+}
+
+// newCodecEncoder gives back an encoder that encodes timestamps as offsets from the given base.
+func newCodecEncoder(codec Codec, w io.Writer, base int64) (seriesEncoder, error) {
+	var e seriesEncoder
+	switch codec {
+	case "", CodecGorilla:
+		e = newSeriesEncoder(w)
+	case CodecDelta:
+		e = &deltaEncoder{w: w}
+	case CodecState:
+		e = &stateEncoder{w: w}
+	default:
+		return nil, fmt.Errorf("unknown codec %q", codec)
+	}
+	if base == 0 {
+		return e, nil
+	}
+	return &relativeEncoder{seriesEncoder: e, base: base}, nil
+}
+
+// newCodecDecoderFromBytes gives back a decoder that decodes the given bytes in place,
+// adding the given base to timestamps.
+// An empty codec is regarded as CodecGorilla, which was the only one before codecs were introduced.
+func newCodecDecoderFromBytes(codec Codec, b []byte, base int64) (seriesDecoder, error) {
+	var d seriesDecoder
+	switch codec {
+	case "", CodecGorilla:
+		d = newSeriesDecoderFromBytes(b)
+	case CodecDelta:
+		d = &deltaDecoder{b: b}
+	case CodecState:
+		d = &stateDecoder{b: b}
+	default:
+		return nil, fmt.Errorf("unknown codec %q", codec)
+	}
+	if base == 0 {
+		return d, nil
+	}
+	return &relativeDecoder{seriesDecoder: d, base: base}, nil
+}
+
+// relativeEncoder encodes timestamps as offsets from base, which makes the leading timestamp of each block
+// fit in fewer bytes than the absolute one. See WithRelativeTimestamps
+type relativeEncoder struct {
+	seriesEncoder
+	base int64
+	// reused not to allocate for every data point
+	point DataPoint
+}
+
+func (e *relativeEncoder) encodePoint(point *DataPoint) error {
+	e.point = *point
+	e.point.Timestamp -= e.base
+	return e.seriesEncoder.encodePoint(&e.point)
+}
+
+// relativeDecoder decodes data points encoded by relativeEncoder.
+type relativeDecoder struct {
+	seriesDecoder
+	base int64
+}
+
+func (d *relativeDecoder) decodePoint(dst *DataPoint) error {
+	if err := d.seriesDecoder.decodePoint(dst); err != nil {
+		return err
+	}
+	dst.Timestamp += d.base
+	return nil
+}
+
+// The lowest bit of each encoded value tells whether it is followed by the raw bits of a float64,
+// or the rest of bits are the zigzag-encoded delta from the previous integral value.
+const deltaRawValue = 1
+
+// The largest magnitude of integral values that float64 can represent exactly.
+const maxExactInt = 1 << 53
+
+// deltaEncoder implements CodecDelta.
+type deltaEncoder struct {
+	w   io.Writer
+	buf []byte
+
+	// whether the first point of the current block has been encoded
+	started bool
+	t       int64
+	v       float64
+}
+
+// encodePoint is not goroutine safe. It's caller's responsibility to lock it.
+func (e *deltaEncoder) encodePoint(point *DataPoint) error {
+	if !e.started {
+		e.buf = binary.AppendVarint(e.buf, point.Timestamp)
+		e.started = true
+	} else {
+		e.buf = binary.AppendVarint(e.buf, point.Timestamp-e.t)
+	}
+	if isExactInt(point.Value) && isExactInt(e.v) {
+		delta := int64(point.Value) - int64(e.v)
+		// Zigzag encoding, to make small negative deltas small too.
+		e.buf = binary.AppendUvarint(e.buf, uint64((delta<<1)^(delta>>63))<<1)
+	} else {
+		e.buf = binary.AppendUvarint(e.buf, deltaRawValue)
+		e.buf = binary.LittleEndian.AppendUint64(e.buf, math.Float64bits(point.Value))
+	}
+	e.t = point.Timestamp
+	e.v = point.Value
+	return nil
+}
+
+// flush writes the buffered data into the backend writer, and then resets the state for a new block.
+func (e *deltaEncoder) flush() error {
+	if _, err := e.w.Write(e.buf); err != nil {
+		return fmt.Errorf("failed to flush buffered bytes: %w", err)
+	}
+	e.buf = e.buf[:0]
+	e.started = false
+	e.t = 0
+	e.v = 0
+	return nil
+}
+
+// isExactInt reports whether the given value is an integer that survives a round-trip through int64.
+func isExactInt(v float64) bool {
+	return v == math.Trunc(v) && v > -maxExactInt && v < maxExactInt && !(v == 0 && math.Signbit(v))
+}
+
+// deltaDecoder decodes data points encoded by deltaEncoder.
+type deltaDecoder struct {
+	b   []byte
+	off int
+
+	started bool
+	t       int64
+	v       float64
+}
+
+func (d *deltaDecoder) decodePoint(dst *DataPoint) error {
+	t, n := binary.Varint(d.b[d.off:])
+	if n <= 0 {
+		return fmt.Errorf("failed to read timestamp: %w", io.ErrUnexpectedEOF)
+	}
+	d.off += n
+	if d.started {
+		t += d.t
+	}
+	x, n := binary.Uvarint(d.b[d.off:])
+	if n <= 0 {
+		return fmt.Errorf("failed to read value: %w", io.ErrUnexpectedEOF)
+	}
+	d.off += n
+	var v float64
+	if x&deltaRawValue != 0 {
+		if len(d.b)-d.off < 8 {
+			return fmt.Errorf("failed to read raw value: %w", io.ErrUnexpectedEOF)
+		}
+		v = math.Float64frombits(binary.LittleEndian.Uint64(d.b[d.off:]))
+		d.off += 8
+	} else {
+		x >>= 1
+		delta := int64(x>>1) ^ -int64(x&1)
+		v = float64(int64(d.v) + delta)
+	}
+	d.started = true
+	d.t = t
+	d.v = v
+	dst.Timestamp = t
+	dst.Value = v
+	return nil
+}
+
+// stateEncoder implements CodecState. Each run of the same value is encoded as its header, which is the uvarint of
+// the number of data points in the run shifted left by one with the value in the lowest bit, followed by
+// the timestamps of them encoded into varints as the deltas from the previous one.
+// Runs never span blocks.
+type stateEncoder struct {
+	w   io.Writer
+	buf []byte
+
+	// timestamps of the current run, which are written once the run ends.
+	run   []int64
+	state bool
+	// the last timestamp written, which the next one is encoded as the delta from
+	t       int64
+	started bool
+}
+
+// encodePoint is not goroutine safe. It's caller's responsibility to lock it.
+func (e *stateEncoder) encodePoint(point *DataPoint) error {
+	state := point.Value != 0
+	if len(e.run) > 0 && state != e.state {
+		e.writeRun()
+	}
+	e.state = state
+	e.run = append(e.run, point.Timestamp)
+	return nil
+}
+
+func (e *stateEncoder) writeRun() {
+	header := uint64(len(e.run)) << 1
+	if e.state {
+		header |= 1
+	}
+	e.buf = binary.AppendUvarint(e.buf, header)
+	for _, t := range e.run {
+		if e.started {
+			e.buf = binary.AppendVarint(e.buf, t-e.t)
+		} else {
+			e.buf = binary.AppendVarint(e.buf, t)
+			e.started = true
+		}
+		e.t = t
+	}
+	e.run = e.run[:0]
+}
+
+// flush writes the buffered data into the backend writer, and then resets the state for a new block.
+func (e *stateEncoder) flush() error {
+	if len(e.run) > 0 {
+		e.writeRun()
+	}
+	if _, err := e.w.Write(e.buf); err != nil {
+		return fmt.Errorf("failed to flush buffered bytes: %w", err)
+	}
+	e.buf = e.buf[:0]
+	e.started = false
+	e.t = 0
+	return nil
+}
+
+// stateDecoder decodes data points encoded by stateEncoder.
+type stateDecoder struct {
+	b   []byte
+	off int
+
+	// the number of data points left in the current run
+	remaining uint64
+	value     float64
+	started   bool
+	t         int64
+}
+
+func (d *stateDecoder) decodePoint(dst *DataPoint) error {
+	if d.remaining == 0 {
+		header, n := binary.Uvarint(d.b[d.off:])
+		if n <= 0 || header>>1 == 0 {
+			return fmt.Errorf("failed to read run: %w", io.ErrUnexpectedEOF)
+		}
+		d.off += n
+		d.remaining = header >> 1
+		d.value = float64(header & 1)
+	}
+	t, n := binary.Varint(d.b[d.off:])
+	if n <= 0 {
+		return fmt.Errorf("failed to read timestamp: %w", io.ErrUnexpectedEOF)
+	}
+	d.off += n
+	if d.started {
+		t += d.t
+	}
+	d.started = true
+	d.t = t
+	d.remaining--
+	dst.Timestamp = t
+	dst.Value = d.value
+	return nil
+}
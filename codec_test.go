@@ -0,0 +1,250 @@
+package tstorage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_codecs_roundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		points []*DataPoint
+	}{
+		{
+			name:   "one data point",
+			points: []*DataPoint{{Timestamp: 1600000000, Value: 0.1}},
+		},
+		{
+			name: "counter",
+			points: []*DataPoint{
+				{Timestamp: 1600000000, Value: 100},
+				{Timestamp: 1600000015, Value: 120},
+				{Timestamp: 1600000030, Value: 121},
+				{Timestamp: 1600000045, Value: 3},
+			},
+		},
+		{
+			name: "sparse gauge",
+			points: []*DataPoint{
+				{Timestamp: 1600000000, Value: 0.5},
+				{Timestamp: 1600003700, Value: -2},
+				{Timestamp: 1600003701, Value: -2.25},
+				{Timestamp: 1600090000, Value: 1e300},
+			},
+		},
+		{
+			name: "special values",
+			points: []*DataPoint{
+				{Timestamp: 1, Value: math.Copysign(0, -1)},
+				{Timestamp: 50, Value: math.Inf(1)},
+				{Timestamp: 100, Value: 1 << 60},
+				{Timestamp: 200, Value: -(1 << 52)},
+			},
+		},
+		{
+			name: "starting at zero",
+			points: []*DataPoint{
+				{Timestamp: 0, Value: 0.1},
+				{Timestamp: 15, Value: 0.2},
+				{Timestamp: 30, Value: 0.3},
+			},
+		},
+	}
+	for _, codec := range []Codec{CodecGorilla, CodecDelta} {
+		for _, tt := range tests {
+			// Relative to the first timestamp, the base of a partition usually, or to a later one.
+			for _, base := range []int64{0, tt.points[0].Timestamp, 1600000030} {
+				testCodecRoundTrip(t, codec, base, tt.name, tt.points)
+			}
+		}
+	}
+}
+
+func Test_stateCodec_roundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		points []*DataPoint
+		// The number of bytes encoded at most.
+		wantMaxSize int
+	}{
+		{
+			name:        "one data point",
+			points:      []*DataPoint{{Timestamp: 1600000000, Value: 1}},
+			wantMaxSize: 6,
+		},
+		{
+			name: "transitions",
+			points: []*DataPoint{
+				{Timestamp: 1600000000, Value: 1},
+				{Timestamp: 1600000015, Value: 1},
+				{Timestamp: 1600000030, Value: 0},
+				{Timestamp: 1600000045, Value: 0},
+				{Timestamp: 1600000060, Value: 0},
+				{Timestamp: 1600000075, Value: 1},
+			},
+			wantMaxSize: 13,
+		},
+		{
+			name: "long run",
+			points: func() []*DataPoint {
+				points := make([]*DataPoint, 1000)
+				for i := range points {
+					points[i] = &DataPoint{Timestamp: int64(i * 15)}
+				}
+				return points
+			}(),
+			// A byte for each timestamp.
+			wantMaxSize: 1003,
+		},
+	}
+	for _, tt := range tests {
+		for _, base := range []int64{0, tt.points[0].Timestamp} {
+			testCodecRoundTrip(t, CodecState, base, tt.name, tt.points)
+		}
+		var buf bytes.Buffer
+		encoder, err := newCodecEncoder(CodecState, &buf, 0)
+		require.NoError(t, err)
+		for _, p := range tt.points {
+			require.NoError(t, encoder.encodePoint(p))
+		}
+		require.NoError(t, encoder.flush())
+		assert.LessOrEqual(t, buf.Len(), tt.wantMaxSize, tt.name)
+	}
+}
+
+func testCodecRoundTrip(t *testing.T, codec Codec, base int64, name string, points []*DataPoint) {
+	t.Run(fmt.Sprintf("%s/%s/base=%d", codec, name, base), func(t *testing.T) {
+		var buf bytes.Buffer
+		encoder, err := newCodecEncoder(codec, &buf, base)
+		require.NoError(t, err)
+		for _, p := range points {
+			require.NoError(t, encoder.encodePoint(p))
+		}
+		require.NoError(t, encoder.flush())
+
+		decoder, err := newCodecDecoderFromBytes(codec, buf.Bytes(), base)
+		require.NoError(t, err)
+		for _, want := range points {
+			got := &DataPoint{}
+			require.NoError(t, decoder.decodePoint(got))
+			assert.Equal(t, want.Timestamp, got.Timestamp)
+			assert.Equal(t, math.Float64bits(want.Value), math.Float64bits(got.Value))
+		}
+	})
+}
+
+func Test_storage_withMetricCodec(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tstorage-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	s, err := NewStorage(
+		WithDataPath(tmpDir),
+		WithPointsPerBlock(2),
+		WithMetricCodec("*_total", CodecDelta),
+		WithMetricCodec("requests_*", CodecGorilla),
+	)
+	require.NoError(t, err)
+	for i := int64(1); i <= 5; i++ {
+		require.NoError(t, s.InsertRows([]Row{
+			{Metric: "requests_total", Labels: []Label{{Name: "host", Value: "a"}}, DataPoint: DataPoint{Timestamp: i, Value: float64(i * 10)}},
+			{Metric: "requests_latency", DataPoint: DataPoint{Timestamp: i, Value: float64(i) / 3}},
+		}))
+	}
+	require.NoError(t, s.Close())
+
+	dirs, err := filepath.Glob(filepath.Join(tmpDir, "p-*"))
+	require.NoError(t, err)
+	require.Len(t, dirs, 1)
+	b, err := os.ReadFile(filepath.Join(dirs[0], metaFileName))
+	require.NoError(t, err)
+	m := &meta{}
+	require.NoError(t, json.Unmarshal(b, m))
+	for name, mt := range m.Metrics {
+		metric, _, _ := unmarshalMetricName(name)
+		want := CodecGorilla
+		if metric == "requests_total" {
+			want = CodecDelta
+		}
+		for _, b := range mt.Blocks {
+			assert.Equal(t, want, b.codec(), name)
+		}
+	}
+
+	s, err = NewStorage(WithDataPath(tmpDir), WithMetricCodec("*_total", CodecDelta))
+	require.NoError(t, err)
+	defer s.Close()
+	got, err := s.Select("requests_total", []Label{{Name: "host", Value: "a"}}, 2, 5)
+	require.NoError(t, err)
+	assert.Equal(t, []*DataPoint{{Timestamp: 2, Value: 20}, {Timestamp: 3, Value: 30}, {Timestamp: 4, Value: 40}}, got)
+	got, err = s.Select("requests_latency", nil, 2, 4)
+	require.NoError(t, err)
+	assert.Equal(t, []*DataPoint{{Timestamp: 2, Value: 2.0 / 3}, {Timestamp: 3, Value: 1}}, got)
+}
+
+func Test_storage_withRelativeTimestamps(t *testing.T) {
+	const base = 1600000000000000000
+	dataSize := func(relative bool) int64 {
+		tmpDir := t.TempDir()
+		s, err := NewStorage(WithDataPath(tmpDir), WithPointsPerBlock(4), WithRelativeTimestamps(relative))
+		require.NoError(t, err)
+		rows := make([]Row, 0, 100)
+		for i := int64(0); i < 100; i++ {
+			rows = append(rows, Row{Metric: "metric1", DataPoint: DataPoint{Timestamp: base + i*int64(time.Second), Value: float64(i)}})
+		}
+		require.NoError(t, s.InsertRows(rows))
+		require.NoError(t, s.Close())
+
+		dirs, err := filepath.Glob(filepath.Join(tmpDir, "p-*"))
+		require.NoError(t, err)
+		require.Len(t, dirs, 1)
+		b, err := os.ReadFile(filepath.Join(dirs[0], metaFileName))
+		require.NoError(t, err)
+		m := &meta{}
+		require.NoError(t, json.Unmarshal(b, m))
+		if relative {
+			assert.Equal(t, int64(base), m.TimestampBase)
+		} else {
+			assert.Zero(t, m.TimestampBase)
+		}
+
+		// It can be read regardless of the option.
+		s, err = NewStorage(WithDataPath(tmpDir), WithRetention(100*365*24*time.Hour))
+		require.NoError(t, err)
+		defer s.Close()
+		got, err := s.Select("metric1", nil, base+10*int64(time.Second), base+13*int64(time.Second))
+		require.NoError(t, err)
+		assert.Equal(t, []*DataPoint{
+			{Timestamp: base + 10*int64(time.Second), Value: 10},
+			{Timestamp: base + 11*int64(time.Second), Value: 11},
+			{Timestamp: base + 12*int64(time.Second), Value: 12},
+		}, got)
+		blocks, err := s.SelectBlocks("metric1", nil, base, base+4*int64(time.Second))
+		require.NoError(t, err)
+		require.Len(t, blocks, 1)
+		points, err := blocks[0].DataPoints()
+		require.NoError(t, err)
+		assert.Equal(t, int64(base), points[0].Timestamp)
+
+		info, err := os.Stat(filepath.Join(dirs[0], dataFileName))
+		require.NoError(t, err)
+		return info.Size()
+	}
+	assert.Less(t, dataSize(true), dataSize(false))
+}
+
+func Test_NewStorage_withInvalidMetricCodec(t *testing.T) {
+	_, err := NewStorage(WithMetricCodec("[", CodecDelta))
+	assert.Error(t, err)
+	_, err = NewStorage(WithMetricCodec("*", Codec("unknown")))
+	assert.Error(t, err)
+}
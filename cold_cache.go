@@ -0,0 +1,197 @@
+package tstorage
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Prefix of the files being downloaded into the cold cache.
+const coldCacheTmpPrefix = ".download-"
+
+// WithColdCache regards the FileSystem given by WithFileSystem as cold storage, such as one backed by object storage,
+// and copies the data file of a disk partition into the local directory dir when it gets read for the first time.
+// The data file is then read from the copy, and so are subsequent reads even after reopening.
+// Copies are evicted in least-recently-used order once their total size exceeds bytes.
+// Meta files are always read from the FileSystem since they are small.
+// It is ignored in the in-memory mode.
+//
+// Defaults to no cache, which reads data files from the FileSystem directly.
+func WithColdCache(dir string, bytes int64) Option {
+	return func(s *storage) {
+		s.coldCache = &coldCache{dir: dir, maxBytes: bytes}
+	}
+}
+
+// coldCache holds local copies of data files of disk partitions, which are evicted in LRU order.
+type coldCache struct {
+	dir      string
+	maxBytes int64
+
+	mu   sync.Mutex
+	size int64
+	// lru holds *coldCacheEntry, the most recently used one at the front.
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+type coldCacheEntry struct {
+	name string
+	size int64
+}
+
+// open loads the copies left in the directory, regarding ones modified more recently as used more recently.
+func (c *coldCache) open(perm os.FileMode) error {
+	if err := os.MkdirAll(c.dir, perm); err != nil {
+		return fmt.Errorf("failed to make cold cache directory %s: %w", c.dir, err)
+	}
+	dirEntries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return fmt.Errorf("failed to open cold cache directory: %w", err)
+	}
+	infos := make([]os.FileInfo, 0, len(dirEntries))
+	for _, e := range dirEntries {
+		if e.IsDir() {
+			continue
+		}
+		if strings.HasPrefix(e.Name(), coldCacheTmpPrefix) {
+			// Left by an interrupted download.
+			os.Remove(filepath.Join(c.dir, e.Name()))
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return fmt.Errorf("failed to fetch file info: %w", err)
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ModTime().After(infos[j].ModTime())
+	})
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lru = list.New()
+	c.entries = make(map[string]*list.Element, len(infos))
+	c.size = 0
+	for _, info := range infos {
+		c.entries[info.Name()] = c.lru.PushBack(&coldCacheEntry{name: info.Name(), size: info.Size()})
+		c.size += info.Size()
+	}
+	return c.evict()
+}
+
+// key gives back the name of the copy of the given partition's data file.
+// It includes when the partition was persisted, since a directory may be reused for a different partition.
+func (c *coldCache) key(d *diskPartition) string {
+	return fmt.Sprintf("%s-%d", filepath.Base(d.dirPath), d.meta.CreatedAt.UnixNano())
+}
+
+// fetch opens the copy of the given partition's data file, which gets copied if not cached yet.
+// The copy is opened before it can be evicted, so that it stays readable even if evicted in the meantime.
+func (c *coldCache) fetch(d *diskPartition) (*os.File, error) {
+	name := c.key(d)
+	path := filepath.Join(c.dir, name)
+	c.mu.Lock()
+	if e, ok := c.entries[name]; ok {
+		c.lru.MoveToFront(e)
+		f, err := os.Open(path)
+		c.mu.Unlock()
+		if err != nil {
+			return nil, fmt.Errorf("failed to open cached data file: %w", err)
+		}
+		// Keep the recency across reopening.
+		now := time.Now()
+		os.Chtimes(path, now, now)
+		return f, nil
+	}
+	c.mu.Unlock()
+
+	// Copy outside of the lock because it may take a while.
+	f, size, err := c.download(d, path)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[name]; !ok {
+		c.entries[name] = c.lru.PushFront(&coldCacheEntry{name: name, size: size})
+		c.size += size
+	}
+	if err := c.evict(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// download copies the data file of the given partition to path, and gives back the copy opened.
+func (c *coldCache) download(d *diskPartition, path string) (*os.File, int64, error) {
+	src, err := d.fsys.OpenFile(filepath.Join(d.dirPath, dataFileName), os.O_RDONLY, 0)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read data file: %w", err)
+	}
+	defer src.Close()
+	// Download to a temporary file first, not to leave a partial copy.
+	tmp, err := os.CreateTemp(c.dir, coldCacheTmpPrefix)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to create file in cold cache: %w", err)
+	}
+	size, err := io.Copy(tmp, src)
+	if err == nil {
+		// Read it from the beginning through the same file, which stays readable wherever it gets renamed or removed.
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, 0, fmt.Errorf("failed to copy data file of %s: %w", d.dirPath, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, 0, fmt.Errorf("failed to rename %s to %s: %w", tmp.Name(), path, err)
+	}
+	return tmp, size, nil
+}
+
+// remove drops the copy of the given partition's data file if cached.
+func (c *coldCache) remove(d *diskPartition) error {
+	name := c.key(d)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[name]
+	if !ok {
+		return nil
+	}
+	c.lru.Remove(e)
+	delete(c.entries, name)
+	c.size -= e.Value.(*coldCacheEntry).size
+	if err := os.Remove(filepath.Join(c.dir, name)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove cached data file: %w", err)
+	}
+	return nil
+}
+
+// evict removes the least recently used copies until the total size fits in maxBytes, yet keeps the most recent one
+// even if it alone exceeds. Copies still being read stay readable after removed since they are opened already.
+// It must be called with mu held.
+func (c *coldCache) evict() error {
+	for c.size > c.maxBytes && c.lru.Len() > 1 {
+		e := c.lru.Back()
+		entry := e.Value.(*coldCacheEntry)
+		c.lru.Remove(e)
+		delete(c.entries, entry.name)
+		c.size -= entry.size
+		if err := os.Remove(filepath.Join(c.dir, entry.name)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to evict cached data file: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package tstorage
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingFileSystem counts how many times data files of partitions get opened for reading.
+type countingFileSystem struct {
+	FileSystem
+	dataReads int
+}
+
+func (c *countingFileSystem) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	if filepath.Base(name) == dataFileName && flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		c.dataReads++
+	}
+	return c.FileSystem.OpenFile(name, flag, perm)
+}
+
+func writeColdPartitions(t *testing.T, dataPath string) {
+	s, err := NewStorage(WithDataPath(dataPath), WithPartitionDuration(time.Hour), WithTimestampPrecision(Seconds))
+	require.NoError(t, err)
+	require.NoError(t, s.InsertRows([]Row{
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1, Value: 0.1}},
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 5000, Value: 0.2}},
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 10000, Value: 0.3}},
+	}))
+	require.NoError(t, s.Close())
+}
+
+func cachedFiles(t *testing.T, dir string) []string {
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+func Test_storage_withColdCache(t *testing.T) {
+	dataPath := t.TempDir()
+	cacheDir := filepath.Join(t.TempDir(), "cache")
+	writeColdPartitions(t, dataPath)
+
+	fsys := &countingFileSystem{FileSystem: defaultFileSystem}
+	s, err := NewStorage(WithDataPath(dataPath), WithTimestampPrecision(Seconds), WithRetention(100*365*24*time.Hour),
+		WithFileSystem(fsys), WithColdCache(cacheDir, 1<<20))
+	require.NoError(t, err)
+	points, err := s.Select("metric1", nil, 1, 5001)
+	require.NoError(t, err)
+	assert.Equal(t, []*DataPoint{{Timestamp: 1, Value: 0.1}, {Timestamp: 5000, Value: 0.2}}, points)
+	assert.Equal(t, 1, fsys.dataReads)
+	assert.Len(t, cachedFiles(t, cacheDir), 1)
+	require.NoError(t, s.Close())
+
+	// The second read after reopening is served by the local copy.
+	fsys = &countingFileSystem{FileSystem: defaultFileSystem}
+	s, err = NewStorage(WithDataPath(dataPath), WithTimestampPrecision(Seconds), WithRetention(100*365*24*time.Hour),
+		WithFileSystem(fsys), WithColdCache(cacheDir, 1<<20))
+	require.NoError(t, err)
+	defer s.Close()
+	points, err = s.Select("metric1", nil, 1, 5001)
+	require.NoError(t, err)
+	assert.Equal(t, []*DataPoint{{Timestamp: 1, Value: 0.1}, {Timestamp: 5000, Value: 0.2}}, points)
+	assert.Equal(t, 0, fsys.dataReads)
+	assert.Len(t, cachedFiles(t, cacheDir), 1)
+}
+
+func Test_storage_withColdCache_eviction(t *testing.T) {
+	dataPath := t.TempDir()
+	cacheDir := t.TempDir()
+	writeColdPartitions(t, dataPath)
+
+	// Too small to hold both copies.
+	s, err := NewStorage(WithDataPath(dataPath), WithTimestampPrecision(Seconds), WithRetention(100*365*24*time.Hour),
+		WithColdCache(cacheDir, 1))
+	require.NoError(t, err)
+	defer s.Close()
+	points, err := s.Select("metric1", nil, 1, 10001)
+	require.NoError(t, err)
+	assert.Len(t, points, 3)
+	assert.Len(t, cachedFiles(t, cacheDir), 1)
+}
+
+func Test_storage_withColdCache_invalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		dir   string
+		bytes int64
+	}{
+		{name: "empty directory", dir: "", bytes: 1},
+		{name: "non-positive size", dir: "cache", bytes: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewStorage(WithDataPath(t.TempDir()), WithColdCache(tt.dir, tt.bytes))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func Test_coldCache_fetch_evictedWhileOpened(t *testing.T) {
+	dataPath := t.TempDir()
+	cacheDir := t.TempDir()
+	// Persist a partition on each close.
+	for _, ts := range []int64{1, 10000} {
+		s, err := NewStorage(WithDataPath(dataPath), WithTimestampPrecision(Seconds))
+		require.NoError(t, err)
+		require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: ts, Value: 0.1}}}))
+		require.NoError(t, s.Close())
+	}
+
+	// Too small to hold both copies.
+	s, err := NewStorage(WithDataPath(dataPath), WithTimestampPrecision(Seconds), WithRetention(100*365*24*time.Hour),
+		WithColdCache(cacheDir, 1))
+	require.NoError(t, err)
+	defer s.Close()
+	ss := s.(*storage)
+	var parts []*diskPartition
+	iterator := ss.partitionList.newIterator()
+	for iterator.next() {
+		if d, ok := iterator.value().(*diskPartition); ok {
+			parts = append(parts, d)
+		}
+	}
+	require.Len(t, parts, 2)
+
+	f, err := ss.coldCache.fetch(parts[0])
+	require.NoError(t, err)
+	defer f.Close()
+	// Fetching the other one evicts the copy opened above.
+	other, err := ss.coldCache.fetch(parts[1])
+	require.NoError(t, err)
+	require.NoError(t, other.Close())
+	assert.Equal(t, []string{ss.coldCache.key(parts[1])}, cachedFiles(t, cacheDir))
+
+	// It's still readable.
+	got, err := io.ReadAll(f)
+	require.NoError(t, err)
+	want, err := os.ReadFile(filepath.Join(parts[0].dirPath, dataFileName))
+	require.NoError(t, err)
+	assert.Equal(t, want, got)
+}
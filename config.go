@@ -0,0 +1,123 @@
+package tstorage
+
+import (
+	"io/fs"
+	"time"
+)
+
+// StorageConfig is a snapshot of the configuration in effect, resolved from the options given to NewStorage
+// and their defaults. Options taking functions, such as hooks, aren't included.
+type StorageConfig struct {
+	// The path to the data directory, which is empty in the in-memory mode.
+	DataPath string
+	// Whether data points are kept only in memory.
+	InMemory          bool
+	PartitionDuration time.Duration
+	Retention         time.Duration
+	// Whether the retention is measured by the timestamps of data points as well.
+	RetentionByTimestamp bool
+	TimestampPrecision   TimestampPrecision
+	WriteTimeout         time.Duration
+	// The maximum number of goroutines inserting rows at the same time.
+	WorkersLimit int
+	// Negative if the WAL is disabled.
+	WALBufferedSize int
+	WALCompression  WALCompression
+	WALFullPolicy   WALFullPolicy
+	// The number of rows and the delay to buffer inserts for, which are zero if not buffered.
+	WriteBufferMaxRows  int
+	WriteBufferMaxDelay time.Duration
+	DirPerm             fs.FileMode
+	FilePerm            fs.FileMode
+	Mmap                bool
+	OutOfOrderPolicy    OutOfOrderPolicy
+	EnforceMonotonic    bool
+	DedupeWindow        time.Duration
+	DedupePolicy        DedupePolicy
+	DuplicateIDPolicy   DuplicateIDPolicy
+	WindowGapPolicy     WindowGapPolicy
+	PartitionSharding   PartitionSharding
+	TimestampAutofill   bool
+	ZeroCopyStrings     bool
+	PartialInsert       bool
+	PanicRecovery       bool
+
+	SelectParallelismThreshold int
+	HotPartitions              int
+	ReadRepair                 bool
+	ScrubInterval              time.Duration
+	StartupFlush               bool
+	// The maximum number of concurrent selects, which is zero if unlimited.
+	MaxConcurrentSelects int
+	SelectTimeout        time.Duration
+
+	PointsPerBlock     int
+	RelativeTimestamps bool
+	MinFlushPoints     int
+	FlushBufferSize    int
+	// The number of attempts to persist a partition, including the first one.
+	FlushRetryAttempts  int
+	FlushRetryBackoff   time.Duration
+	MemoryBudget        int64
+	DropActivePartition bool
+	// The directory and the size in bytes of the cold cache, which are zero if not cached.
+	ColdCacheDir   string
+	ColdCacheBytes int64
+}
+
+func (s *storage) Config() StorageConfig {
+	c := StorageConfig{
+		DataPath:                   s.dataPath,
+		InMemory:                   s.inMemoryMode(),
+		PartitionDuration:          s.partitionDuration,
+		Retention:                  s.retention,
+		RetentionByTimestamp:       s.retentionByTimestamp,
+		TimestampPrecision:         s.timestampPrecision,
+		WriteTimeout:               s.writeTimeout,
+		WorkersLimit:               cap(s.workersLimitCh),
+		WALBufferedSize:            s.walBufferedSize,
+		WALCompression:             s.walCompression,
+		WALFullPolicy:              s.walFullPolicy,
+		DirPerm:                    s.dirPerm,
+		FilePerm:                   s.filePerm,
+		Mmap:                       s.useMmap,
+		OutOfOrderPolicy:           s.outOfOrderPolicy,
+		EnforceMonotonic:           s.enforceMonotonic,
+		DedupeWindow:               s.dedupeWindow,
+		DedupePolicy:               s.dedupePolicy,
+		DuplicateIDPolicy:          s.duplicateIDPolicy,
+		WindowGapPolicy:            s.windowGapPolicy,
+		PartitionSharding:          s.partitionSharding,
+		TimestampAutofill:          s.timestampAutofill,
+		ZeroCopyStrings:            s.zeroCopyStrings,
+		PartialInsert:              s.partialInsert,
+		PanicRecovery:              s.panicRecovery,
+		SelectParallelismThreshold: s.selectParallelismThreshold,
+		MaxConcurrentSelects:       cap(s.selectsLimitCh),
+		SelectTimeout:              s.selectTimeout,
+		HotPartitions:              s.hotPartitions.max,
+		ReadRepair:                 s.readRepair,
+		ScrubInterval:              s.scrubInterval,
+		StartupFlush:               s.startupFlush,
+		PointsPerBlock:             s.pointsPerBlock,
+		RelativeTimestamps:         s.relativeTimestamps,
+		MinFlushPoints:             s.minFlushPoints,
+		FlushBufferSize:            s.flushBufferSize,
+		FlushRetryAttempts:         s.flushRetryAttempts,
+		FlushRetryBackoff:          s.flushRetryBackoff,
+		MemoryBudget:               s.memoryBudget,
+		DropActivePartition:        s.dropActivePartition,
+	}
+	if c.FlushRetryAttempts == 0 {
+		c.FlushRetryAttempts = 1
+	}
+	if s.writeBuffer != nil {
+		c.WriteBufferMaxRows = s.writeBuffer.maxRows
+		c.WriteBufferMaxDelay = s.writeBuffer.maxDelay
+	}
+	if s.coldCache != nil {
+		c.ColdCacheDir = s.coldCache.dir
+		c.ColdCacheBytes = s.coldCache.maxBytes
+	}
+	return c
+}
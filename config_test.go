@@ -0,0 +1,51 @@
+package tstorage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_storage_Config(t *testing.T) {
+	s, err := NewStorage()
+	require.NoError(t, err)
+	defer s.Close()
+	c := s.Config()
+	assert.True(t, c.InMemory)
+	assert.Empty(t, c.DataPath)
+	assert.Equal(t, defaultPartitionDuration, c.PartitionDuration)
+	assert.Equal(t, defaultRetention, c.Retention)
+	assert.Equal(t, Nanoseconds, c.TimestampPrecision)
+	assert.Equal(t, defaultWorkersLimit, c.WorkersLimit)
+	assert.Equal(t, defaultPointsPerBlock, c.PointsPerBlock)
+	assert.Equal(t, 1, c.FlushRetryAttempts)
+	assert.False(t, c.PanicRecovery)
+
+	dataPath := t.TempDir()
+	s, err = NewStorage(
+		WithDataPath(dataPath),
+		WithPartitionDuration(2*time.Hour),
+		WithTimestampPrecision(Seconds),
+		WithWriteBuffer(100, time.Second),
+		WithFlushRetry(3, time.Millisecond),
+		WithReadRepair(true),
+	)
+	require.NoError(t, err)
+	defer s.Close()
+	c = s.Config()
+	assert.False(t, c.InMemory)
+	assert.Equal(t, dataPath, c.DataPath)
+	assert.Equal(t, 2*time.Hour, c.PartitionDuration)
+	assert.Equal(t, Seconds, c.TimestampPrecision)
+	assert.Equal(t, 100, c.WriteBufferMaxRows)
+	assert.Equal(t, time.Second, c.WriteBufferMaxDelay)
+	assert.Equal(t, 3, c.FlushRetryAttempts)
+	assert.Equal(t, time.Millisecond, c.FlushRetryBackoff)
+	assert.True(t, c.ReadRepair)
+
+	// It is a snapshot.
+	c.Retention = time.Minute
+	assert.Equal(t, defaultRetention, s.Config().Retention)
+}
@@ -0,0 +1,279 @@
+package tstorage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ErrPrecisionLoss is returned by ConvertPrecision if some timestamps can't be represented in the target precision.
+var ErrPrecisionLoss = errors.New("precision loss")
+
+const (
+	// Name of the directory ConvertPrecision stages partitions in, which isn't regarded as a partition.
+	convertingDirName = "converting"
+	// Marker files placed in the staging directory once the corresponding step has been done.
+	convertStagedMarker  = "staged"
+	convertSwappedMarker = "swapped"
+)
+
+// ConvertPrecision rewrites the disk partitions under dataPath, whose timestamps are in from, into ones in to,
+// and records to in the manifest, so that the data path can be opened with WithTimestampPrecision(to).
+// Partition directories are renamed after their new time range.
+// It is an offline operation; the directory may not be opened by a Storage while converting, and WAL must
+// have been replayed beforehand, which closing the storage does.
+//
+// Converting into a coarser precision gives back ErrPrecisionLoss if any timestamp isn't a multiple of the new unit,
+// unless force is true, in which case timestamps are rounded down. Then data points of a series rounded down to
+// the same timestamp collide, and only the oldest of them is kept; the others are dropped without being reported,
+// so check beforehand that timestamps don't fall in the same unit if they all matter.
+//
+// All partitions are converted into a staging directory first, and then take the place of the original ones,
+// so that the data path never ends up with a mix of precisions. If interrupted, just call it again with
+// the same arguments to resume, even after the manifest has been updated.
+func ConvertPrecision(dataPath string, from, to TimestampPrecision, force bool) error {
+	fromUnit, ok := precisionUnit(from)
+	if !ok {
+		return fmt.Errorf("unknown timestamp precision %q", from)
+	}
+	toUnit, ok := precisionUnit(to)
+	if !ok {
+		return fmt.Errorf("unknown timestamp precision %q", to)
+	}
+	stagingDir := filepath.Join(dataPath, convertingDirName)
+	newDir := filepath.Join(stagingDir, "new")
+	oldDir := filepath.Join(stagingDir, "old")
+	m, err := readManifest(defaultFileSystem, dataPath)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		m = &Manifest{FormatVersion: CurrentFormatVersion}
+	case err != nil:
+		return err
+	case m.TimestampPrecision == to && from != to && fileExists(filepath.Join(stagingDir, convertSwappedMarker)):
+		// Interrupted after the manifest got written, so all that's left is removing the original partitions.
+		return removeStagingDir(stagingDir)
+	case m.TimestampPrecision != "" && m.TimestampPrecision != from:
+		return fmt.Errorf("%w: %s was created with %q, but %q given", ErrTimestampPrecisionMismatch, dataPath, m.TimestampPrecision, from)
+	}
+	if from == to {
+		return nil
+	}
+	if err := checkWALReplayed(dataPath); err != nil {
+		return err
+	}
+
+	if !fileExists(filepath.Join(stagingDir, convertStagedMarker)) {
+		// Start over since what has been staged may be broken.
+		if err := os.RemoveAll(stagingDir); err != nil {
+			return fmt.Errorf("failed to remove %s: %w", stagingDir, err)
+		}
+		names, err := listPartitionDirs(defaultFileSystem, dataPath)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if err := convertPartition(dataPath, newDir, name, fromUnit, toUnit, force); err != nil {
+				return err
+			}
+		}
+		if err := writeMarker(stagingDir, convertStagedMarker); err != nil {
+			return err
+		}
+	}
+
+	// Move the original ones away first, so that they never get mixed up with converted ones.
+	if !fileExists(filepath.Join(stagingDir, convertSwappedMarker)) {
+		if err := movePartitionDirs(dataPath, oldDir); err != nil {
+			return err
+		}
+		if err := writeMarker(stagingDir, convertSwappedMarker); err != nil {
+			return err
+		}
+	}
+	if fileExists(newDir) {
+		if err := movePartitionDirs(newDir, dataPath); err != nil {
+			return err
+		}
+	}
+
+	m.TimestampPrecision = to
+	b, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %w", err)
+	}
+	path := filepath.Join(dataPath, manifestFileName)
+	if err := writeFileAtomic(defaultFileSystem, path, b, defaultFilePerm); err != nil {
+		return fmt.Errorf("failed to write manifest to %s: %w", path, err)
+	}
+	return removeStagingDir(stagingDir)
+}
+
+// removeStagingDir removes the staging directory along with the original partitions moved into it.
+func removeStagingDir(stagingDir string) error {
+	if err := os.RemoveAll(stagingDir); err != nil {
+		return fmt.Errorf("failed to remove %s: %w", stagingDir, err)
+	}
+	return nil
+}
+
+// convertPartition rewrites the partition at name under dataPath into stagingDir, converting its timestamps.
+func convertPartition(dataPath, stagingDir, name string, fromUnit, toUnit time.Duration, force bool) error {
+	dirPath := filepath.Join(dataPath, name)
+	p, err := openDiskPartition(defaultFileSystem, dirPath, math.MaxInt64, true, defaultAllocator)
+	if errors.Is(err, ErrNoDataPoints) || errors.Is(err, errInvalidPartition) {
+		// Nothing to be converted.
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open disk partition for %s: %w", dirPath, err)
+	}
+	part := p.(*diskPartition)
+	defer part.close()
+
+	m := newMemoryPartition(nil, 0, "").(*memoryPartition)
+	m.createdAt = part.meta.PartitionCreatedAt
+	if !part.meta.LastWriteAt.IsZero() {
+		m.lastWriteAt = part.meta.LastWriteAt.UnixNano()
+	}
+	if m.minT, err = convertTimestamp(part.minTimestamp(), fromUnit, toUnit, true); err != nil {
+		return fmt.Errorf("failed to convert %s: %w", dirPath, err)
+	}
+	if m.maxT, err = convertTimestamp(part.maxTimestamp(), fromUnit, toUnit, true); err != nil {
+		return fmt.Errorf("failed to convert %s: %w", dirPath, err)
+	}
+	for metric := range part.meta.Metrics {
+		points, err := part.selectDataPointsByName(metric, math.MinInt64, math.MaxInt64)
+		if err != nil {
+			return fmt.Errorf("failed to select data points of %q from %s: %w", metric, dirPath, err)
+		}
+		mt := m.getMetric(metric)
+		for _, p := range points {
+			ts, err := convertTimestamp(p.Timestamp, fromUnit, toUnit, force)
+			if err != nil {
+				return fmt.Errorf("failed to convert data point of %q at %d in %s: %w", metric, p.Timestamp, dirPath, err)
+			}
+			if mt.size > 0 && mt.points[mt.size-1].Timestamp == ts {
+				// Rounded down to the same timestamp as the previous one, which is kept as ConvertPrecision documents.
+				continue
+			}
+			mt.insertPoint(&DataPoint{Timestamp: ts, Value: p.Value}, true)
+			m.numPoints++
+		}
+	}
+
+	newName := fmt.Sprintf("p-%d-%d", m.minT, m.maxT)
+	if matches := partitionIDRegex.FindStringSubmatch(filepath.Base(name)); matches != nil {
+		newName += "-" + matches[1]
+	}
+	newPath := filepath.Join(stagingDir, filepath.Dir(name), newName)
+	s := &storage{
+		dirPerm:         defaultDirPerm,
+		filePerm:        defaultFilePerm,
+		pointsPerBlock:  defaultPointsPerBlock,
+		allocator:       defaultAllocator,
+		flushBufferSize: defaultFlushBufferSize,
+		fsys:            defaultFileSystem,
+		logger:          &nopLogger{},
+	}
+	if err := s.flush(newPath, m); err != nil {
+		return fmt.Errorf("failed to rewrite %s: %w", dirPath, err)
+	}
+	// Retention is based on when the partition was persisted originally.
+	return updateMeta(newPath, func(mt *meta) {
+		mt.CreatedAt = part.meta.CreatedAt
+	})
+}
+
+// convertTimestamp converts ts in fromUnit into the one in toUnit.
+// Unless force is true, it fails if ts isn't a multiple of toUnit.
+func convertTimestamp(ts int64, fromUnit, toUnit time.Duration, force bool) (int64, error) {
+	if fromUnit >= toUnit {
+		factor := int64(fromUnit / toUnit)
+		if ts > math.MaxInt64/factor || ts < math.MinInt64/factor {
+			return 0, fmt.Errorf("timestamp %d overflows", ts)
+		}
+		return ts * factor, nil
+	}
+	factor := int64(toUnit / fromUnit)
+	if ts%factor != 0 && !force {
+		return 0, fmt.Errorf("%w: timestamp %d isn't a multiple of %s", ErrPrecisionLoss, ts, toUnit)
+	}
+	q := ts / factor
+	if ts%factor < 0 {
+		// Round down, not toward zero.
+		q--
+	}
+	return q, nil
+}
+
+// precisionUnit gives back the length of a unit of the given precision.
+func precisionUnit(precision TimestampPrecision) (time.Duration, bool) {
+	switch precision {
+	case Nanoseconds:
+		return time.Nanosecond, true
+	case Microseconds:
+		return time.Microsecond, true
+	case Milliseconds:
+		return time.Millisecond, true
+	case Seconds:
+		return time.Second, true
+	default:
+		return 0, false
+	}
+}
+
+// checkWALReplayed makes sure WAL under dataPath has no records left, which would be replayed in the old precision.
+func checkWALReplayed(dataPath string) error {
+	reader, err := newDiskWALReader(defaultFileSystem, WALDir(dataPath))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := reader.readAll(); err != nil {
+		return fmt.Errorf("failed to read WAL: %w", err)
+	}
+	if len(reader.rowsToInsert) > 0 {
+		return fmt.Errorf("WAL under %s has rows yet to be replayed; open and close the storage first", dataPath)
+	}
+	return nil
+}
+
+// movePartitionDirs moves all partition directories under src to dst, keeping their relative paths.
+func movePartitionDirs(src, dst string) error {
+	names, err := listPartitionDirs(defaultFileSystem, src)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		to := filepath.Join(dst, name)
+		if err := os.MkdirAll(filepath.Dir(to), defaultDirPerm); err != nil {
+			return fmt.Errorf("failed to make directory for %s: %w", to, err)
+		}
+		if err := os.Rename(filepath.Join(src, name), to); err != nil {
+			return fmt.Errorf("failed to rename %s to %s: %w", filepath.Join(src, name), to, err)
+		}
+	}
+	return nil
+}
+
+func writeMarker(dir, name string) error {
+	if err := os.MkdirAll(dir, defaultDirPerm); err != nil {
+		return fmt.Errorf("failed to make directory %s: %w", dir, err)
+	}
+	path := filepath.Join(dir, name)
+	if err := writeFile(defaultFileSystem, path, nil, defaultFilePerm); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return nil
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
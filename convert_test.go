@@ -0,0 +1,164 @@
+package tstorage
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConvertPrecision(t *testing.T) {
+	retention := WithRetention(100 * 365 * 24 * time.Hour)
+	populate := func(t *testing.T, dataPath string, timestamps ...int64) {
+		s, err := NewStorage(WithDataPath(dataPath), WithTimestampPrecision(Milliseconds), WithPartitionDuration(time.Hour), retention)
+		require.NoError(t, err)
+		for i, ts := range timestamps {
+			require.NoError(t, s.InsertRows([]Row{
+				{Metric: "metric1", DataPoint: DataPoint{Timestamp: ts, Value: float64(i)}},
+				{Metric: "metric2", Labels: []Label{{Name: "host", Value: "a"}}, DataPoint: DataPoint{Timestamp: ts, Value: float64(-i)}},
+			}))
+		}
+		require.NoError(t, s.Close())
+	}
+
+	tests := []struct {
+		name       string
+		timestamps []int64
+		to         TimestampPrecision
+		force      bool
+		wantErr    error
+		// The timestamps and values of metric1 at the new precision.
+		want    []*DataPoint
+		wantDir string
+	}{
+		{
+			name:       "into finer",
+			timestamps: []int64{1000, 2000, 3000},
+			to:         Microseconds,
+			want: []*DataPoint{
+				{Timestamp: 1000000, Value: 0},
+				{Timestamp: 2000000, Value: 1},
+				{Timestamp: 3000000, Value: 2},
+			},
+			wantDir: "p-1000000-3000000",
+		},
+		{
+			name:       "into coarser",
+			timestamps: []int64{1000, 2000, 3000},
+			to:         Seconds,
+			want: []*DataPoint{
+				{Timestamp: 1, Value: 0},
+				{Timestamp: 2, Value: 1},
+				{Timestamp: 3, Value: 2},
+			},
+			wantDir: "p-1-3",
+		},
+		{
+			name:       "losing precision",
+			timestamps: []int64{1000, 1500, 2000},
+			to:         Seconds,
+			wantErr:    ErrPrecisionLoss,
+		},
+		{
+			name:       "losing precision by force",
+			timestamps: []int64{1000, 1500, 2000},
+			to:         Seconds,
+			force:      true,
+			want: []*DataPoint{
+				{Timestamp: 1, Value: 0},
+				{Timestamp: 2, Value: 2},
+			},
+			wantDir: "p-1-2",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dataPath := t.TempDir()
+			populate(t, dataPath, tt.timestamps...)
+
+			err := ConvertPrecision(dataPath, Milliseconds, tt.to, tt.force)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				// Left as it was.
+				m, err := ReadManifest(dataPath)
+				require.NoError(t, err)
+				assert.Equal(t, Milliseconds, m.TimestampPrecision)
+				return
+			}
+			require.NoError(t, err)
+			assert.DirExists(t, filepath.Join(dataPath, tt.wantDir))
+			assert.NoDirExists(t, filepath.Join(dataPath, convertingDirName))
+
+			m, err := ReadManifest(dataPath)
+			require.NoError(t, err)
+			assert.Equal(t, tt.to, m.TimestampPrecision)
+
+			_, err = NewStorage(WithDataPath(dataPath), WithTimestampPrecision(Milliseconds), WithPartitionDuration(time.Hour), retention)
+			assert.ErrorIs(t, err, ErrTimestampPrecisionMismatch)
+			s, err := NewStorage(WithDataPath(dataPath), WithTimestampPrecision(tt.to), WithPartitionDuration(time.Hour), retention)
+			require.NoError(t, err)
+			defer s.Close()
+			got, err := s.Select("metric1", nil, 0, tt.want[len(tt.want)-1].Timestamp+1)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+			got, err = s.Select("metric2", []Label{{Name: "host", Value: "a"}}, 0, tt.want[len(tt.want)-1].Timestamp+1)
+			require.NoError(t, err)
+			assert.Len(t, got, len(tt.want))
+		})
+	}
+}
+
+func TestConvertPrecision_interrupted(t *testing.T) {
+	dataPath := t.TempDir()
+	s, err := NewStorage(WithDataPath(dataPath), WithTimestampPrecision(Seconds), WithRetention(100*365*24*time.Hour))
+	require.NoError(t, err)
+	require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1, Value: 0.1}}}))
+	require.NoError(t, s.Close())
+
+	// As if interrupted right after the original partitions were moved away.
+	stagingDir := filepath.Join(dataPath, convertingDirName)
+	require.NoError(t, convertPartition(dataPath, filepath.Join(stagingDir, "new"), "p-1-1", time.Second, time.Millisecond, false))
+	require.NoError(t, writeMarker(stagingDir, convertStagedMarker))
+	require.NoError(t, movePartitionDirs(dataPath, filepath.Join(stagingDir, "old")))
+	require.NoError(t, writeMarker(stagingDir, convertSwappedMarker))
+
+	require.NoError(t, ConvertPrecision(dataPath, Seconds, Milliseconds, false))
+	assert.DirExists(t, filepath.Join(dataPath, "p-1000-1000"))
+	assert.NoDirExists(t, filepath.Join(dataPath, "p-1-1"))
+	assert.NoDirExists(t, stagingDir)
+
+	s, err = NewStorage(WithDataPath(dataPath), WithTimestampPrecision(Milliseconds), WithRetention(100*365*24*time.Hour))
+	require.NoError(t, err)
+	defer s.Close()
+	got, err := s.Select("metric1", nil, 0, 1001)
+	require.NoError(t, err)
+	assert.Equal(t, []*DataPoint{{Timestamp: 1000, Value: 0.1}}, got)
+}
+
+func TestConvertPrecision_interruptedAfterManifest(t *testing.T) {
+	dataPath := t.TempDir()
+	s, err := NewStorage(WithDataPath(dataPath), WithTimestampPrecision(Seconds), WithRetention(100*365*24*time.Hour))
+	require.NoError(t, err)
+	require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1, Value: 0.1}}}))
+	require.NoError(t, s.Close())
+	require.NoError(t, ConvertPrecision(dataPath, Seconds, Milliseconds, false))
+
+	// As if interrupted right after the manifest was written, leaving the original partitions behind.
+	stagingDir := filepath.Join(dataPath, convertingDirName)
+	require.NoError(t, copyPartitionFiles(filepath.Join(dataPath, "p-1000-1000"), filepath.Join(stagingDir, "old", "p-1-1")))
+	require.NoError(t, writeMarker(stagingDir, convertStagedMarker))
+	require.NoError(t, writeMarker(stagingDir, convertSwappedMarker))
+
+	require.NoError(t, ConvertPrecision(dataPath, Seconds, Milliseconds, false))
+	assert.NoDirExists(t, stagingDir)
+	assert.DirExists(t, filepath.Join(dataPath, "p-1000-1000"))
+
+	s, err = NewStorage(WithDataPath(dataPath), WithTimestampPrecision(Milliseconds), WithRetention(100*365*24*time.Hour))
+	require.NoError(t, err)
+	defer s.Close()
+	got, err := s.Select("metric1", nil, 0, 1001)
+	require.NoError(t, err)
+	assert.Equal(t, []*DataPoint{{Timestamp: 1000, Value: 0.1}}, got)
+}
@@ -0,0 +1,34 @@
+package tstorage
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"math"
+	"sort"
+)
+
+func (s *storage) SelectDigest(metric string, labels []Label, start, end int64) (uint64, error) {
+	pointsList, n, err := s.selectPartitionPoints(metric, labels, start, end)
+	if err != nil {
+		return 0, err
+	}
+	points := make([]*DataPoint, 0, n)
+	for _, ps := range pointsList {
+		points = append(points, ps...)
+	}
+	// Partitions may overlap, so sort them to be independent of how data points are split into partitions.
+	sort.SliceStable(points, func(i, j int) bool {
+		if points[i].Timestamp != points[j].Timestamp {
+			return points[i].Timestamp < points[j].Timestamp
+		}
+		return math.Float64bits(points[i].Value) < math.Float64bits(points[j].Value)
+	})
+	h := fnv.New64a()
+	var buf [16]byte
+	for _, p := range points {
+		binary.LittleEndian.PutUint64(buf[:8], uint64(p.Timestamp))
+		binary.LittleEndian.PutUint64(buf[8:], math.Float64bits(p.Value))
+		h.Write(buf[:])
+	}
+	return h.Sum64(), nil
+}
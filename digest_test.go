@@ -0,0 +1,51 @@
+package tstorage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_storage_SelectDigest(t *testing.T) {
+	timestamps := []int64{1, 5000, 10000, 15000, 20000}
+	digest := func(t *testing.T, opts []Option, value func(ts int64) float64) uint64 {
+		s, err := NewStorage(append(opts, WithTimestampPrecision(Seconds))...)
+		require.NoError(t, err)
+		for _, ts := range timestamps {
+			require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: ts, Value: value(ts)}}}))
+		}
+		if dataPath := s.(*storage).dataPath; dataPath != "" {
+			// Select from disk partitions.
+			require.NoError(t, s.Close())
+			s, err = NewStorage(append(opts, WithTimestampPrecision(Seconds))...)
+			require.NoError(t, err)
+		}
+		defer s.Close()
+		d, err := s.SelectDigest("metric1", nil, 1, 20001)
+		require.NoError(t, err)
+		return d
+	}
+	value := func(ts int64) float64 { return float64(ts) / 10 }
+
+	// A single memory partition.
+	want := digest(t, []Option{WithPartitionDuration(24 * time.Hour)}, value)
+	// Split into multiple disk partitions.
+	got := digest(t, []Option{WithDataPath(t.TempDir()), WithPartitionDuration(time.Hour)}, value)
+	assert.Equal(t, want, got)
+
+	changed := digest(t, []Option{WithPartitionDuration(24 * time.Hour)}, func(ts int64) float64 {
+		if ts == 10000 {
+			return 0
+		}
+		return value(ts)
+	})
+	assert.NotEqual(t, want, changed)
+
+	s, err := NewStorage()
+	require.NoError(t, err)
+	defer s.Close()
+	_, err = s.SelectDigest("metric1", nil, 1, 2)
+	assert.ErrorIs(t, err, ErrNoDataPoints)
+}
@@ -1,13 +1,15 @@
 package tstorage
 
 import (
-	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"os"
 	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/nakabonne/tstorage/internal/syscall"
@@ -20,30 +22,81 @@ const (
 
 var (
 	errInvalidPartition = errors.New("invalid partition")
+	errEmptyPartition   = errors.New("empty partition")
+	errPartitionClosed  = errors.New("partition closed")
 )
 
 // A disk partition implements a partition that uses local disk as a storage.
-// It mainly has two files, data file and meta file.
-// The data file is memory-mapped and read only; no need to lock at all.
+// It mainly has two files, data file and meta file. The meta file serves as the index of the data file;
+// it holds metrics, their time ranges and the offsets of their blocks.
+// Opening a partition reads only the meta file, and the data file is loaded on the first read of data points.
+// The data file is memory-mapped and read only; it's locked only to be loaded and released.
+// On platforms where mmap isn't available, the data file is read into the heap instead.
 type diskPartition struct {
+	fsys    FileSystem
 	dirPath string
 	meta    meta
-	// file descriptor of data file
-	f *os.File
-	// memory-mapped file backed by f
+	// whether to memory-map the data file.
+	useMmap bool
+	// memory-mapped data file, or the entire content of it if it's not memory-mapped.
+	// It must be accessed through data, which loads it only once.
 	mappedFile []byte
+	// whether mappedFile is memory-mapped and needs to be unmapped.
+	mmapped bool
+	// loadMu guards mappedFile and the fields below, so that it doesn't get released while being loaded.
+	loadMu  sync.RWMutex
+	loaded  bool
+	loadErr error
+	// whether mappedFile has been released by close, after which it can't be read anymore.
+	closed bool
+	// stats counts whether reads find the data file loaded. It is nil unless opened by a storage.
+	stats *storageStats
+	// allocator that gave mappedFile if it's not memory-mapped.
+	allocator Allocator
+	// coldCache, if not nil, holds the local copy of the data file, which is read instead of the one in fsys.
+	coldCache *coldCache
+	// offsets of all blocks in ascending order, which is lazily built.
+	offsets     []int64
+	offsetsOnce sync.Once
 	// duration to store data
 	retention time.Duration
+
+	pinMu sync.Mutex
+	// the number of readers pinning the partition, such as iterators.
+	pins int
+	// whether the files have been removed, or will be once the last pin gets released.
+	removed bool
+	// corruptErr holds the error found by the scrubber, which fails all subsequent reads.
+	corruptErr atomic.Value
 }
 
 // meta is a mapper for a meta file, which is put for each partition.
 // Note that the CreatedAt is surely timestamped by tstorage but Min/Max Timestamps are likely to do by other process.
+// CreatedAt is when the disk partition was created, whereas PartitionCreatedAt is when the original
+// memory partition was created.
 type meta struct {
-	MinTimestamp  int64                 `json:"minTimestamp"`
-	MaxTimestamp  int64                 `json:"maxTimestamp"`
-	NumDataPoints int                   `json:"numDataPoints"`
-	Metrics       map[string]diskMetric `json:"metrics"`
-	CreatedAt     time.Time             `json:"createdAt"`
+	// Version is the format version of the partition, which is missing for formatVersionLegacy.
+	Version            int                   `json:"version,omitempty"`
+	MinTimestamp       int64                 `json:"minTimestamp"`
+	MaxTimestamp       int64                 `json:"maxTimestamp"`
+	NumDataPoints      int                   `json:"numDataPoints"`
+	Metrics            map[string]diskMetric `json:"metrics"`
+	CreatedAt          time.Time             `json:"createdAt"`
+	PartitionCreatedAt time.Time             `json:"partitionCreatedAt"`
+	LastWriteAt        time.Time             `json:"lastWriteAt"`
+	// Checksum is the CRC-32C of the data file, which is missing for partitions flushed by older versions.
+	Checksum uint32 `json:"checksum,omitempty"`
+	// TimestampBase is what the timestamps in the data file are offsets from, which is 0 unless flushed
+	// with WithRelativeTimestamps.
+	TimestampBase int64 `json:"timestampBase,omitempty"`
+}
+
+// version gives back the format version of the partition.
+func (m *meta) version() int {
+	if m.Version == 0 {
+		return formatVersionLegacy
+	}
+	return m.Version
 }
 
 // diskMetric holds meta data to access actual data from the memory-mapped file.
@@ -53,41 +106,119 @@ type diskMetric struct {
 	MinTimestamp  int64  `json:"minTimestamp"`
 	MaxTimestamp  int64  `json:"maxTimestamp"`
 	NumDataPoints int64  `json:"numDataPoints"`
+	// Blocks is the index of blocks in order by timestamp.
+	// It is empty if the partition was persisted before blocks were introduced.
+	Blocks []diskBlock `json:"blocks,omitempty"`
+}
+
+// diskBlock is a chunk of data points of a metric that can be decoded independently of other blocks.
+type diskBlock struct {
+	Offset        int64 `json:"offset"`
+	MinTimestamp  int64 `json:"minTimestamp"`
+	MaxTimestamp  int64 `json:"maxTimestamp"`
+	NumDataPoints int64 `json:"numDataPoints"`
+	// Codec is empty if the block is encoded with CodecGorilla.
+	Codec Codec `json:"codec,omitempty"`
+}
+
+// codec gives back the codec the block is encoded with.
+func (b *diskBlock) codec() Codec {
+	if b.Codec == "" {
+		return CodecGorilla
+	}
+	return b.Codec
 }
 
-// openDiskPartition first maps the data file into memory with memory-mapping.
-func openDiskPartition(dirPath string, retention time.Duration) (partition, error) {
+// blocks gives back the index of blocks. A metric without the index is regarded as a single block.
+func (m *diskMetric) blocks() []diskBlock {
+	if len(m.Blocks) > 0 {
+		return m.Blocks
+	}
+	return []diskBlock{{
+		Offset:        m.Offset,
+		MinTimestamp:  m.MinTimestamp,
+		MaxTimestamp:  m.MaxTimestamp,
+		NumDataPoints: m.NumDataPoints,
+	}}
+}
+
+// blockEncoder cuts a series into blocks of at most pointsPerBlock data points while encoding,
+// and builds the index of them. It encodes all data points into a single block if pointsPerBlock is 0 or less.
+type blockEncoder struct {
+	encoder seriesEncoder
+	// codec the encoder implements, which is recorded to each block.
+	codec          Codec
+	w              *offsetWriter
+	pointsPerBlock int
+	blocks         []diskBlock
+}
+
+// encodePoint expects data points to be given in order by timestamp.
+func (e *blockEncoder) encodePoint(point *DataPoint) error {
+	n := len(e.blocks)
+	if n == 0 || (e.pointsPerBlock > 0 && e.blocks[n-1].NumDataPoints >= int64(e.pointsPerBlock)) {
+		// Flushing resets the encoder, so that the next block can be decoded from its own offset.
+		if err := e.encoder.flush(); err != nil {
+			return err
+		}
+		block := diskBlock{
+			Offset:       e.w.offset,
+			MinTimestamp: point.Timestamp,
+		}
+		if e.codec != CodecGorilla {
+			block.Codec = e.codec
+		}
+		e.blocks = append(e.blocks, block)
+		n++
+	}
+	if err := e.encoder.encodePoint(point); err != nil {
+		return err
+	}
+	e.blocks[n-1].MaxTimestamp = point.Timestamp
+	e.blocks[n-1].NumDataPoints++
+	return nil
+}
+
+func (e *blockEncoder) flush() error {
+	return e.encoder.flush()
+}
+
+// offsetWriter keeps track of the number of bytes written to the underlying writer.
+type offsetWriter struct {
+	w      io.Writer
+	offset int64
+}
+
+func (w *offsetWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.offset += int64(n)
+	return n, err
+}
+
+// openDiskPartition reads the meta file of the partition placed at dirPath.
+// The data file is loaded lazily; see data.
+func openDiskPartition(fsys FileSystem, dirPath string, retention time.Duration, useMmap bool, allocator Allocator) (partition, error) {
 	if dirPath == "" {
 		return nil, fmt.Errorf("dir path is required")
 	}
 	metaFilePath := filepath.Join(dirPath, metaFileName)
-	_, err := os.Stat(metaFilePath)
+	_, err := fsys.Stat(metaFilePath)
 	if errors.Is(err, os.ErrNotExist) {
 		return nil, errInvalidPartition
 	}
 
-	// Map data to the memory
-	dataPath := filepath.Join(dirPath, dataFileName)
-	f, err := os.Open(dataPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read data file: %w", err)
-	}
-	defer f.Close()
-	info, err := f.Stat()
+	// Just make sure the data file exists, without reading it.
+	info, err := fsys.Stat(filepath.Join(dirPath, dataFileName))
 	if err != nil {
 		return nil, fmt.Errorf("failed to fetch file info: %w", err)
 	}
 	if info.Size() == 0 {
 		return nil, ErrNoDataPoints
 	}
-	mapped, err := syscall.Mmap(int(f.Fd()), int(info.Size()))
-	if err != nil {
-		return nil, fmt.Errorf("failed to perform mmap: %w", err)
-	}
 
 	// Read metadata to the heap
 	m := meta{}
-	mf, err := os.Open(metaFilePath)
+	mf, err := fsys.OpenFile(metaFilePath, os.O_RDONLY, 0)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read metadata: %w", err)
 	}
@@ -96,20 +227,155 @@ func openDiskPartition(dirPath string, retention time.Duration) (partition, erro
 	if err := decoder.Decode(&m); err != nil {
 		return nil, fmt.Errorf("failed to decode metadata: %w", err)
 	}
+	if m.version() > CurrentFormatVersion {
+		return nil, fmt.Errorf("unsupported format version %d, the latest one is %d", m.version(), CurrentFormatVersion)
+	}
+	if m.MinTimestamp > m.MaxTimestamp {
+		return nil, fmt.Errorf("inconsistent metadata: min timestamp %d is greater than max timestamp %d", m.MinTimestamp, m.MaxTimestamp)
+	}
 	return &diskPartition{
-		dirPath:    dirPath,
-		meta:       m,
-		f:          f,
-		mappedFile: mapped,
-		retention:  retention,
+		fsys:      fsys,
+		dirPath:   dirPath,
+		meta:      m,
+		useMmap:   useMmap,
+		allocator: allocator,
+		retention: retention,
 	}, nil
 }
 
+// data gives back the content of the data file, which is loaded on the first call.
+// It keeps the content from being released by close until the given release gets called,
+// and fails with errPartitionClosed once closed.
+func (d *diskPartition) data() (data []byte, release func(), err error) {
+	if err := d.corruption(); err != nil {
+		return nil, nil, err
+	}
+	hit := d.ensureLoaded()
+	if d.stats != nil {
+		if hit {
+			atomic.AddInt64(&d.stats.partitionCacheHits, 1)
+		} else {
+			atomic.AddInt64(&d.stats.partitionCacheMisses, 1)
+		}
+	}
+	return d.acquire()
+}
+
+// ensureLoaded loads the data file unless it has been loaded or closed, and gives back whether it didn't have to.
+func (d *diskPartition) ensureLoaded() bool {
+	d.loadMu.RLock()
+	done := d.loaded || d.closed
+	d.loadMu.RUnlock()
+	if done {
+		return true
+	}
+	d.loadMu.Lock()
+	defer d.loadMu.Unlock()
+	if d.loaded || d.closed {
+		return true
+	}
+	d.load()
+	d.loaded = true
+	return false
+}
+
+// acquire gives back the loaded data file, keeping it from being released until release gets called.
+func (d *diskPartition) acquire() (data []byte, release func(), err error) {
+	d.loadMu.RLock()
+	switch {
+	case d.closed:
+		err = errPartitionClosed
+	case d.loadErr != nil:
+		err = d.loadErr
+	}
+	if err != nil {
+		d.loadMu.RUnlock()
+		return nil, nil, err
+	}
+	return d.mappedFile, d.loadMu.RUnlock, nil
+}
+
+// load maps the data file into memory with memory-mapping. If useMmap is false or mmap isn't supported,
+// it reads the whole data file into a buffer given by allocator instead. It must be called with loadMu held.
+func (d *diskPartition) load() {
+	var f File
+	var err error
+	if d.coldCache != nil {
+		var cached *os.File
+		cached, err = d.coldCache.fetch(d)
+		if err != nil {
+			d.loadErr = fmt.Errorf("failed to fetch data file into cold cache: %w", err)
+			return
+		}
+		f = cached
+	} else {
+		f, err = d.fsys.OpenFile(filepath.Join(d.dirPath, dataFileName), os.O_RDONLY, 0)
+	}
+	if err != nil {
+		d.loadErr = fmt.Errorf("failed to read data file: %w", err)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		d.loadErr = fmt.Errorf("failed to fetch file info: %w", err)
+		return
+	}
+	var mapped []byte
+	if osf, ok := f.(*os.File); ok && d.useMmap {
+		mapped, err = syscall.Mmap(int(osf.Fd()), int(info.Size()))
+		if err != nil && !errors.Is(err, syscall.ErrNotSupported) {
+			d.loadErr = fmt.Errorf("failed to perform mmap: %w", err)
+			return
+		}
+	}
+	d.mmapped = mapped != nil
+	if mapped == nil {
+		mapped = d.allocator.Get(int(info.Size()))
+		if _, err := io.ReadFull(f, mapped); err != nil {
+			d.allocator.Put(mapped)
+			d.loadErr = fmt.Errorf("failed to read data file: %w", err)
+			return
+		}
+	}
+	d.mappedFile = mapped
+}
+
+// close releases the memory-mapped data file, or gives the buffer holding it back to the allocator,
+// if it has been loaded. Reads of data points fail with errPartitionClosed after that.
+func (d *diskPartition) close() error {
+	d.loadMu.Lock()
+	defer d.loadMu.Unlock()
+	d.closed = true
+	if d.mappedFile == nil {
+		return nil
+	}
+	if !d.mmapped {
+		d.allocator.Put(d.mappedFile)
+		d.mappedFile = nil
+		return nil
+	}
+	if err := syscall.Munmap(d.mappedFile); err != nil {
+		return fmt.Errorf("failed to unmap data file of %q: %w", d.dirPath, err)
+	}
+	d.mappedFile = nil
+	d.mmapped = false
+	return nil
+}
+
 func (d *diskPartition) insertRows(_ []Row) ([]Row, error) {
 	return nil, fmt.Errorf("can't insert rows into disk partition")
 }
 
 func (d *diskPartition) selectDataPoints(metric string, labels []Label, start, end int64) ([]*DataPoint, error) {
+	if d.expired() {
+		return nil, fmt.Errorf("this partition is expired: %w", ErrNoDataPoints)
+	}
+	return d.selectDataPointsByName(marshalMetricName(metric, labels), start, end)
+}
+
+// selectDataPointsWhere is like selectDataPoints, but gives back only data points whose value satisfies pred.
+func (d *diskPartition) selectDataPointsWhere(metric string, labels []Label, start, end int64, pred func(value float64) bool) ([]*DataPoint, error) {
 	if d.expired() {
 		return nil, fmt.Errorf("this partition is expired: %w", ErrNoDataPoints)
 	}
@@ -118,19 +384,107 @@ func (d *diskPartition) selectDataPoints(metric string, labels []Label, start, e
 	if !ok {
 		return nil, ErrNoDataPoints
 	}
-	r := bytes.NewReader(d.mappedFile)
-	if _, err := r.Seek(mt.Offset, io.SeekStart); err != nil {
-		return nil, fmt.Errorf("failed to seek: %w", err)
+	points := make([]*DataPoint, 0)
+	for _, b := range overlappingBlocks(mt.blocks(), start, end) {
+		var err error
+		points, err = d.decodeBlockWhere(name, b, start, end, points, pred)
+		if err != nil {
+			return nil, err
+		}
 	}
-	decoder, err := newSeriesDecoder(r)
-	if err != nil {
-		return nil, fmt.Errorf("failed to generate decoder for metric %q in %q: %w", name, d.dirPath, err)
+	return points, nil
+}
+
+// selectDataPointsByName is like selectDataPoints but takes the marshaled metric name.
+func (d *diskPartition) selectDataPointsByName(name string, start, end int64) ([]*DataPoint, error) {
+	mt, ok := d.meta.Metrics[name]
+	if !ok {
+		return nil, ErrNoDataPoints
+	}
+	// Only the blocks overlapping the given range are decoded.
+	blocks := overlappingBlocks(mt.blocks(), start, end)
+	var numPoints int64
+	for i := range blocks {
+		numPoints += blocks[i].NumDataPoints
+	}
+	points := make([]*DataPoint, 0, numPoints)
+	for _, b := range blocks {
+		var err error
+		points, err = d.decodeBlock(name, b, start, end, points)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return points, nil
+}
+
+// tailStart gives back the minimum timestamp of the blocks holding the latest n data points of the given series,
+// so that selecting from it decodes only the blocks needed.
+func (d *diskPartition) tailStart(name string, n int) int64 {
+	mt, ok := d.meta.Metrics[name]
+	if !ok {
+		return math.MinInt64
+	}
+	blocks := mt.blocks()
+	var numPoints int64
+	for i := len(blocks) - 1; i >= 0; i-- {
+		numPoints += blocks[i].NumDataPoints
+		if numPoints >= int64(n) {
+			return blocks[i].MinTimestamp
+		}
+	}
+	return math.MinInt64
+}
+
+func (d *diskPartition) countDataPoints(metric string, labels []Label, start, end int64) (int, error) {
+	if d.expired() {
+		return 0, fmt.Errorf("this partition is expired: %w", ErrNoDataPoints)
+	}
+	name := marshalMetricName(metric, labels)
+	mt, ok := d.meta.Metrics[name]
+	if !ok {
+		return 0, ErrNoDataPoints
 	}
+	var n int
+	for _, b := range overlappingBlocks(mt.blocks(), start, end) {
+		if start <= b.MinTimestamp && b.MaxTimestamp < end {
+			// No need to decode the block entirely within the range.
+			n += int(b.NumDataPoints)
+			continue
+		}
+		points, err := d.decodeBlock(name, b, start, end, nil)
+		if err != nil {
+			return 0, err
+		}
+		n += len(points)
+	}
+	return n, nil
+}
+
+// decodeBlock appends the data points within the given range in the block to dst.
+func (d *diskPartition) decodeBlock(name string, b diskBlock, start, end int64, dst []*DataPoint) ([]*DataPoint, error) {
+	return d.decodeBlockWhere(name, b, start, end, dst, nil)
+}
 
-	// TODO: Divide fixed-lengh chunks when flushing, and index it.
-	points := make([]*DataPoint, 0, mt.NumDataPoints)
-	for i := 0; i < int(mt.NumDataPoints); i++ {
-		point := &DataPoint{}
+// decodeBlockWhere is like decodeBlock, but appends only data points whose value satisfies pred.
+// A data point gets allocated only when appended, since skipped ones are decoded into the same one.
+// All data points are appended if pred is nil.
+func (d *diskPartition) decodeBlockWhere(name string, b diskBlock, start, end int64, dst []*DataPoint, pred func(value float64) bool) ([]*DataPoint, error) {
+	data, release, err := d.data()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	if b.Offset < 0 || b.Offset > int64(len(data)) {
+		return nil, fmt.Errorf("invalid offset %d of metric %q in %q", b.Offset, name, d.dirPath)
+	}
+	// Decode directly from the mapped bytes so that only the pages actually touched get read.
+	decoder, err := newCodecDecoderFromBytes(b.Codec, data[b.Offset:], d.meta.TimestampBase)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode block of metric %q in %q: %w", name, d.dirPath, err)
+	}
+	point := &DataPoint{}
+	for i := 0; i < int(b.NumDataPoints); i++ {
 		if err := decoder.decodePoint(point); err != nil {
 			return nil, fmt.Errorf("failed to decode point of metric %q in %q: %w", name, d.dirPath, err)
 		}
@@ -140,9 +494,25 @@ func (d *diskPartition) selectDataPoints(metric string, labels []Label, start, e
 		if point.Timestamp >= end {
 			break
 		}
-		points = append(points, point)
+		if pred != nil && !pred(point.Value) {
+			continue
+		}
+		dst = append(dst, point)
+		point = &DataPoint{}
 	}
-	return points, nil
+	return dst, nil
+}
+
+// overlappingBlocks gives back the blocks overlapping the given range.
+func overlappingBlocks(blocks []diskBlock, start, end int64) []diskBlock {
+	lo, hi := 0, len(blocks)
+	for lo < hi && blocks[lo].MaxTimestamp < start {
+		lo++
+	}
+	for hi > lo && blocks[hi-1].MinTimestamp >= end {
+		hi--
+	}
+	return blocks[lo:hi]
 }
 
 func (d *diskPartition) minTimestamp() int64 {
@@ -163,11 +533,52 @@ func (d *diskPartition) active() bool {
 }
 
 func (d *diskPartition) clean() error {
-	if err := os.RemoveAll(d.dirPath); err != nil {
-		return fmt.Errorf("failed to remove all files inside the partition (%d~%d): %w", d.minTimestamp(), d.maxTimestamp(), err)
+	d.pinMu.Lock()
+	defer d.pinMu.Unlock()
+	d.removed = true
+	if d.pins > 0 {
+		// The last unpin removes them.
+		return nil
 	}
+	return d.removeFiles()
+}
 
-	return nil
+// pin keeps the files from being removed by clean until unpin gets called.
+// It gives back false if they have been already removed.
+func (d *diskPartition) pin() bool {
+	d.pinMu.Lock()
+	defer d.pinMu.Unlock()
+	if d.removed {
+		return false
+	}
+	d.pins++
+	return true
+}
+
+// unpin releases the pin, and removes the files if clean was called while pinned.
+func (d *diskPartition) unpin() error {
+	d.pinMu.Lock()
+	defer d.pinMu.Unlock()
+	d.pins--
+	if d.pins > 0 || !d.removed {
+		return nil
+	}
+	return d.removeFiles()
+}
+
+// removeFiles releases the loaded data file, and then removes the files. It must be called with pinMu held.
+func (d *diskPartition) removeFiles() error {
+	// No one reads it anymore.
+	closeErr := d.close()
+	if err := d.fsys.RemoveAll(d.dirPath); err != nil {
+		return fmt.Errorf("failed to remove all files inside the partition (%d~%d): %w", d.minTimestamp(), d.maxTimestamp(), err)
+	}
+	if d.coldCache != nil {
+		if err := d.coldCache.remove(d); err != nil {
+			return err
+		}
+	}
+	return closeErr
 }
 
 func (d *diskPartition) expired() bool {
@@ -1,10 +1,15 @@
 package tstorage
 
 import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestOpenDiskPartition(t *testing.T) {
@@ -30,9 +35,163 @@ func TestOpenDiskPartition(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := openDiskPartition(tt.dirPath, tt.retention)
+			got, err := openDiskPartition(defaultFileSystem, tt.dirPath, tt.retention, true, defaultAllocator)
 			assert.Equal(t, tt.wantErr, err != nil)
 			assert.Equal(t, tt.want, got)
 		})
 	}
 }
+
+func Test_diskPartition_selectDataPoints(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tstorage-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	s, err := NewStorage(
+		WithDataPath(tmpDir),
+		WithTimestampPrecision(Seconds),
+	)
+	require.NoError(t, err)
+	err = s.InsertRows([]Row{
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000000, Value: 0.1}},
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000001, Value: 0.2}},
+		{Metric: "metric2", DataPoint: DataPoint{Timestamp: 1600000001, Value: 0.3}},
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000002, Value: 0.4}},
+	})
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+
+	want := []*DataPoint{
+		{Timestamp: 1600000001, Value: 0.2},
+		{Timestamp: 1600000002, Value: 0.4},
+	}
+	for _, useMmap := range []bool{true, false} {
+		t.Run(fmt.Sprintf("mmap=%t", useMmap), func(t *testing.T) {
+			part, err := openDiskPartition(defaultFileSystem, filepath.Join(tmpDir, "p-1600000000-1600000002"), time.Hour, useMmap, defaultAllocator)
+			require.NoError(t, err)
+			d := part.(*diskPartition)
+			defer d.close()
+			// Only the meta file is read until selecting.
+			assert.Nil(t, d.mappedFile)
+			got, err := part.selectDataPoints("metric1", nil, 1600000001, 1600000003)
+			require.NoError(t, err)
+			assert.Equal(t, want, got)
+			assert.NotNil(t, d.mappedFile)
+		})
+	}
+}
+
+func Test_diskPartition_close(t *testing.T) {
+	tmpDir := t.TempDir()
+	s, err := NewStorage(
+		WithDataPath(tmpDir),
+		WithTimestampPrecision(Seconds),
+	)
+	require.NoError(t, err)
+	rows := make([]Row, 0, 1000)
+	for i := int64(0); i < 1000; i++ {
+		rows = append(rows, Row{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000000 + i, Value: float64(i)}})
+	}
+	require.NoError(t, s.InsertRows(rows))
+	require.NoError(t, s.Close())
+
+	for _, useMmap := range []bool{true, false} {
+		t.Run(fmt.Sprintf("mmap=%t", useMmap), func(t *testing.T) {
+			part, err := openDiskPartition(defaultFileSystem, filepath.Join(tmpDir, "p-1600000000-1600000999"), time.Hour, useMmap, defaultAllocator)
+			require.NoError(t, err)
+			d := part.(*diskPartition)
+
+			// Selects racing with close either read all points or fail as closed.
+			var wg sync.WaitGroup
+			for i := 0; i < 4; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for j := 0; j < 50; j++ {
+						got, err := part.selectDataPoints("metric1", nil, 1600000000, 1600001000)
+						if err != nil {
+							assert.ErrorIs(t, err, errPartitionClosed)
+							return
+						}
+						assert.Len(t, got, 1000)
+					}
+				}()
+			}
+			require.NoError(t, d.close())
+			wg.Wait()
+
+			_, err = part.selectDataPoints("metric1", nil, 1600000000, 1600001000)
+			assert.ErrorIs(t, err, errPartitionClosed)
+			_, err = d.selectBlocks("metric1", 1600000000, 1600001000)
+			assert.ErrorIs(t, err, errPartitionClosed)
+			assert.Nil(t, d.mappedFile)
+		})
+	}
+}
+
+func Test_diskPartition_selectDataPoints_blocks(t *testing.T) {
+	tests := []struct {
+		name           string
+		pointsPerBlock int
+		dropIndex      bool
+		wantNumBlocks  int
+	}{
+		{
+			name:           "single block",
+			pointsPerBlock: 0,
+			wantNumBlocks:  1,
+		},
+		{
+			name:           "multiple blocks",
+			pointsPerBlock: 2,
+			wantNumBlocks:  3,
+		},
+		{
+			name:           "without block index",
+			pointsPerBlock: 0,
+			dropIndex:      true,
+			wantNumBlocks:  1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir, err := os.MkdirTemp("", "tstorage-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(tmpDir)
+
+			s, err := NewStorage(
+				WithDataPath(tmpDir),
+				WithTimestampPrecision(Seconds),
+				WithPointsPerBlock(tt.pointsPerBlock),
+			)
+			require.NoError(t, err)
+			for i := int64(0); i < 5; i++ {
+				err := s.InsertRows([]Row{
+					{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000000 + i, Value: float64(i)}},
+				})
+				require.NoError(t, err)
+			}
+			require.NoError(t, s.Close())
+
+			part, err := openDiskPartition(defaultFileSystem, filepath.Join(tmpDir, "p-1600000000-1600000004"), time.Hour, true, defaultAllocator)
+			require.NoError(t, err)
+			d := part.(*diskPartition)
+			mt := d.meta.Metrics["metric1"]
+			assert.Len(t, mt.Blocks, tt.wantNumBlocks)
+			if tt.dropIndex {
+				// Partitions persisted before blocks were introduced have no index.
+				mt.Blocks = nil
+				d.meta.Metrics["metric1"] = mt
+			}
+
+			got, err := part.selectDataPoints("metric1", nil, 1600000001, 1600000004)
+			require.NoError(t, err)
+			want := []*DataPoint{
+				{Timestamp: 1600000001, Value: 1},
+				{Timestamp: 1600000002, Value: 2},
+				{Timestamp: 1600000003, Value: 3},
+			}
+			assert.Equal(t, want, got)
+		})
+	}
+}
@@ -2,6 +2,8 @@ package tstorage
 
 import (
 	"bufio"
+	"bytes"
+	"compress/flate"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -10,6 +12,7 @@ import (
 	"math"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"sync"
 	"sync/atomic"
@@ -24,119 +27,307 @@ import (
   └── 1
 */
 type diskWAL struct {
+	fsys         FileSystem
 	dir          string
 	bufferedSize int
-	// Buffered-writer to the active segment
-	w *bufio.Writer
+	dirPerm      fs.FileMode
+	filePerm     fs.FileMode
+	compression  WALCompression
+	// Records buffered to be written to the active segment, which are already acknowledged to callers.
+	// They are kept until written even if writing them fails, so that the next write picks them up.
+	buf []byte
 	// File descriptor to the active segment
-	fd    *os.File
-	index uint32
-	mu    sync.Mutex
+	fd File
+	// The size written to the active segment.
+	written int64
+	// failed holds the error that left a torn record at the end of the active segment,
+	// which fails all subsequent appends until a new segment is created.
+	failed error
+	index  uint32
+	// The index of the oldest segment which may have records not committed by sync.
+	unsyncedIndex uint32
+	mu            sync.Mutex
+
+	// Buffers and compressor for records to be compressed, which are reused across appends.
+	recordBuf   bytes.Buffer
+	compressBuf bytes.Buffer
+	compressor  *flate.Writer
 }
 
-func newDiskWAL(dir string, bufferedSize int) (wal, error) {
-	if err := os.MkdirAll(dir, fs.ModePerm); err != nil {
+func newDiskWAL(fsys FileSystem, dir string, bufferedSize int, dirPerm, filePerm fs.FileMode, compression WALCompression) (wal, error) {
+	switch compression {
+	case "", WALCompressionNone, WALCompressionFlate:
+	default:
+		return nil, fmt.Errorf("unknown WAL compression %q", compression)
+	}
+	if err := mkdirAll(fsys, dir, dirPerm); err != nil {
 		return nil, fmt.Errorf("failed to make WAL dir: %w", err)
 	}
 	w := &diskWAL{
+		fsys:         fsys,
 		dir:          dir,
 		bufferedSize: bufferedSize,
+		dirPerm:      dirPerm,
+		filePerm:     filePerm,
+		compression:  compression,
+		buf:          make([]byte, 0, bufferedSize),
 	}
-	f, err := w.createSegmentFile(dir)
-	if err != nil {
+	if err := w.switchSegment(); err != nil {
 		return nil, err
 	}
-	w.fd = f
-	w.w = bufio.NewWriterSize(f, bufferedSize)
 
 	return w, nil
 }
 
 // append appends the given entry to the end of a file via the file descriptor it has.
+// If it fails, none of the records of the given rows remain in the segment, so that
+// it can be retried after transient errors like a full disk.
 func (w *diskWAL) append(op walOperation, rows []Row) error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
+	if w.failed != nil {
+		return w.failed
+	}
 
+	var records []byte
 	switch op {
 	case operationInsert:
+		w.recordBuf.Reset()
 		for _, row := range rows {
-			// Write the operation type
-			if err := w.w.WriteByte(byte(op)); err != nil {
-				return fmt.Errorf("failed to write operation: %w", err)
-			}
-			name := marshalMetricName(row.Metric, row.Labels)
-			// Write the length of the metric name
-			lBuf := make([]byte, binary.MaxVarintLen64)
-			n := binary.PutUvarint(lBuf, uint64(len(name)))
-			if _, err := w.w.Write(lBuf[:n]); err != nil {
-				return fmt.Errorf("failed to write the length of the metric name: %w", err)
+			if err := writeInsertRecord(&w.recordBuf, row); err != nil {
+				return err
 			}
-			// Write the metric name
-			if _, err := w.w.WriteString(name); err != nil {
-				return fmt.Errorf("failed to write the metric name: %w", err)
-			}
-			// Write the timestamp
-			tsBuf := make([]byte, binary.MaxVarintLen64)
-			n = binary.PutVarint(tsBuf, row.DataPoint.Timestamp)
-			if _, err := w.w.Write(tsBuf[:n]); err != nil {
-				return fmt.Errorf("failed to write the timestamp: %w", err)
-			}
-			// Write the value
-			vBuf := make([]byte, binary.MaxVarintLen64)
-			n = binary.PutUvarint(vBuf, math.Float64bits(row.DataPoint.Value))
-			if _, err := w.w.Write(vBuf[:n]); err != nil {
-				return fmt.Errorf("failed to write the value: %w", err)
+		}
+		records = w.recordBuf.Bytes()
+		if w.compression == WALCompressionFlate {
+			var err error
+			if records, err = w.compress(records); err != nil {
+				return err
 			}
 		}
 	default:
 		return fmt.Errorf("unknown operation %v given", op)
 	}
-	if w.bufferedSize == 0 {
-		return w.flush()
+	if len(w.buf)+len(records) <= w.bufferedSize {
+		w.buf = append(w.buf, records...)
+		return nil
+	}
+	// Write the records acknowledged earlier first, to keep the order.
+	if err := w.flush(); err != nil {
+		return err
+	}
+	if len(records) <= w.bufferedSize {
+		w.buf = append(w.buf, records...)
+		return nil
 	}
+	return w.writeRecords(records)
+}
 
+// writeRecords writes the given records straight to the active segment. If it fails partway through,
+// the segment gets truncated back to where it was, or gets marked as failed if it can't.
+func (w *diskWAL) writeRecords(records []byte) error {
+	n, err := w.fd.Write(records)
+	if err == nil {
+		w.written += int64(n)
+		return nil
+	}
+	err = fmt.Errorf("failed to write records into the WAL file: %w", err)
+	if n == 0 {
+		return err
+	}
+	truncater, ok := w.fd.(interface{ Truncate(size int64) error })
+	if !ok {
+		w.failed = fmt.Errorf("torn record left in the WAL segment: %w", err)
+		return err
+	}
+	if terr := truncater.Truncate(w.written); terr != nil {
+		w.failed = fmt.Errorf("torn record left in the WAL segment: %w: failed to truncate: %v", err, terr)
+	}
+	return err
+}
+
+// compress compresses the given records all together, and then gives back a single record holding them.
+func (w *diskWAL) compress(records []byte) ([]byte, error) {
+	w.compressBuf.Reset()
+	if w.compressor == nil {
+		c, err := flate.NewWriter(&w.compressBuf, flate.BestSpeed)
+		if err != nil {
+			return nil, fmt.Errorf("failed to make compressor: %w", err)
+		}
+		w.compressor = c
+	} else {
+		w.compressor.Reset(&w.compressBuf)
+	}
+	if _, err := w.compressor.Write(records); err != nil {
+		return nil, fmt.Errorf("failed to compress records: %w", err)
+	}
+	if err := w.compressor.Close(); err != nil {
+		return nil, fmt.Errorf("failed to compress records: %w", err)
+	}
+
+	// Reuse recordBuf for the record, which is no longer needed.
+	w.recordBuf.Reset()
+	w.recordBuf.WriteByte(byte(operationCompressed))
+	lBuf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(lBuf, uint64(w.compressBuf.Len()))
+	w.recordBuf.Write(lBuf[:n])
+	w.recordBuf.Write(w.compressBuf.Bytes())
+	return w.recordBuf.Bytes(), nil
+}
+
+type recordWriter interface {
+	io.Writer
+	io.ByteWriter
+	io.StringWriter
+}
+
+// writeInsertRecord writes a record for operationInsert of the given row.
+func writeInsertRecord(w recordWriter, row Row) error {
+	// Write the operation type
+	if err := w.WriteByte(byte(operationInsert)); err != nil {
+		return fmt.Errorf("failed to write operation: %w", err)
+	}
+	name := marshalMetricName(row.Metric, row.Labels)
+	// Write the length of the metric name
+	lBuf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(lBuf, uint64(len(name)))
+	if _, err := w.Write(lBuf[:n]); err != nil {
+		return fmt.Errorf("failed to write the length of the metric name: %w", err)
+	}
+	// Write the metric name
+	if _, err := w.WriteString(name); err != nil {
+		return fmt.Errorf("failed to write the metric name: %w", err)
+	}
+	// Write the timestamp
+	tsBuf := make([]byte, binary.MaxVarintLen64)
+	n = binary.PutVarint(tsBuf, row.DataPoint.Timestamp)
+	if _, err := w.Write(tsBuf[:n]); err != nil {
+		return fmt.Errorf("failed to write the timestamp: %w", err)
+	}
+	// Write the value
+	vBuf := make([]byte, binary.MaxVarintLen64)
+	n = binary.PutUvarint(vBuf, math.Float64bits(row.DataPoint.Value))
+	if _, err := w.Write(vBuf[:n]); err != nil {
+		return fmt.Errorf("failed to write the value: %w", err)
+	}
 	return nil
 }
 
 // flush flushes all buffered entries to the underlying file.
+// What isn't written remains buffered to be resumed by the next flush, since the entries are already acknowledged.
 func (w *diskWAL) flush() error {
-	if err := w.w.Flush(); err != nil {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	n, err := w.fd.Write(w.buf)
+	w.written += int64(n)
+	w.buf = w.buf[:copy(w.buf, w.buf[n:])]
+	if err != nil {
 		return fmt.Errorf("failed to flush buffered-data into the underlying WAL file: %w", err)
 	}
 	return nil
 }
 
-// punctuate set boundary and creates a new segment.
-func (w *diskWAL) punctuate() error {
+func (w *diskWAL) sync() error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 	if err := w.flush(); err != nil {
 		return err
 	}
-	if err := w.fd.Close(); err != nil {
+	activeIndex := atomic.LoadUint32(&w.index) - 1
+	if w.unsyncedIndex < activeIndex {
+		// Segments punctuated since the last sync may hold records waited by the caller.
+		if err := w.syncSegments(w.unsyncedIndex, activeIndex); err != nil {
+			return err
+		}
+	}
+	if err := syncFile(w.fd); err != nil {
 		return err
 	}
-	f, err := w.createSegmentFile(w.dir)
+	w.unsyncedIndex = activeIndex
+	return nil
+}
+
+// syncSegments commits the remaining segments whose index is within [from, to) to stable storage.
+func (w *diskWAL) syncSegments(from, to uint32) error {
+	files, err := w.fsys.ReadDir(w.dir)
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to read WAL directory: %w", err)
+	}
+	for _, file := range files {
+		index, err := strconv.ParseUint(file.Name(), 10, 32)
+		if err != nil || uint32(index) < from || uint32(index) >= to {
+			continue
+		}
+		f, err := w.fsys.OpenFile(filepath.Join(w.dir, file.Name()), os.O_RDONLY, 0)
+		if errors.Is(err, fs.ErrNotExist) {
+			// Removed since its partition got persisted.
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to open segment file: %w", err)
+		}
+		err = syncFile(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
 	}
-	w.fd = f
-	w.w = bufio.NewWriterSize(f, w.bufferedSize)
 	return nil
 }
 
+// syncFile commits the given file to stable storage if it supports, as *os.File does.
+func syncFile(f File) error {
+	syncer, ok := f.(interface{ Sync() error })
+	if !ok {
+		return nil
+	}
+	if err := syncer.Sync(); err != nil {
+		return fmt.Errorf("failed to sync the WAL file: %w", err)
+	}
+	return nil
+}
+
+// punctuate set boundary and creates a new segment.
+func (w *diskWAL) punctuate() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.flush(); err != nil {
+		return err
+	}
+	if err := w.fd.Close(); err != nil {
+		return err
+	}
+	return w.switchSegment()
+}
+
 // truncateOldest removes only the oldest segment.
 func (w *diskWAL) removeOldest() error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
-	files, err := os.ReadDir(w.dir)
+	files, err := w.fsys.ReadDir(w.dir)
 	if err != nil {
 		return fmt.Errorf("failed to read WAL directory: %w", err)
 	}
 	if len(files) == 0 {
 		return fmt.Errorf("no segment found")
 	}
-	return os.RemoveAll(filepath.Join(w.dir, files[0].Name()))
+	sortSegments(files)
+	return w.fsys.RemoveAll(filepath.Join(w.dir, files[0].Name()))
+}
+
+// sortSegments sorts the given segment files in the order they are written, which
+// differs from the order of their names once the index reaches 10.
+func sortSegments(files []fs.DirEntry) {
+	// Segments are named with sequential numbers.
+	sort.SliceStable(files, func(i, j int) bool {
+		a, errA := strconv.Atoi(files[i].Name())
+		b, errB := strconv.Atoi(files[j].Name())
+		if errA != nil || errB != nil {
+			return errA == nil
+		}
+		return a < b
+	})
 }
 
 // removeAll removes all segment files.
@@ -146,10 +337,10 @@ func (w *diskWAL) removeAll() error {
 	if err := w.fd.Close(); err != nil {
 		return err
 	}
-	if err := os.RemoveAll(w.dir); err != nil {
+	if err := w.fsys.RemoveAll(w.dir); err != nil {
 		return fmt.Errorf("failed to remove files under %q: %w", w.dir, err)
 	}
-	return os.MkdirAll(w.dir, fs.ModePerm)
+	return mkdirAll(w.fsys, w.dir, w.dirPerm)
 }
 
 // refresh removes all segment files and make a new segment.
@@ -159,23 +350,52 @@ func (w *diskWAL) refresh() error {
 	}
 	w.mu.Lock()
 	defer w.mu.Unlock()
+	// The buffered records belong to the removed segments.
+	w.buf = w.buf[:0]
+	return w.switchSegment()
+}
 
+// discardActive removes the active segment including what is buffered, and creates a new segment.
+// The number of segments remains the same, so that each of them still corresponds to a partition.
+func (w *diskWAL) discardActive() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	// Drop the buffered records without writing them.
+	w.buf = w.buf[:0]
+	if err := w.fd.Close(); err != nil {
+		return err
+	}
+	name := strconv.Itoa(int(atomic.LoadUint32(&w.index)) - 1)
+	if err := w.fsys.RemoveAll(filepath.Join(w.dir, name)); err != nil {
+		return fmt.Errorf("failed to remove the active segment: %w", err)
+	}
+	return w.switchSegment()
+}
+
+// switchSegment creates a new segment, and makes it active.
+func (w *diskWAL) switchSegment() error {
 	f, err := w.createSegmentFile(w.dir)
 	if err != nil {
 		return err
 	}
 	w.fd = f
-	w.w = bufio.NewWriterSize(f, w.bufferedSize)
+	w.written = 0
+	w.failed = nil
 	return nil
 }
 
 // createSegmentFile creates a new file with the name of the numbering index.
-func (w *diskWAL) createSegmentFile(dir string) (*os.File, error) {
+func (w *diskWAL) createSegmentFile(dir string) (File, error) {
 	name := strconv.Itoa(int(atomic.LoadUint32(&w.index)))
-	f, err := os.OpenFile(filepath.Join(dir, name), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	f, err := openFile(w.fsys, filepath.Join(dir, name), os.O_APPEND|os.O_CREATE|os.O_WRONLY, w.filePerm)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create segment file: %w", err)
 	}
+	// Sync the dir too, otherwise the synced records may get lost along with the segment itself.
+	if err := syncDir(w.fsys, dir); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to sync the WAL dir: %w", err)
+	}
 	atomic.AddUint32(&w.index, 1)
 	return f, nil
 }
@@ -186,18 +406,21 @@ type walRecord struct {
 }
 
 type diskWALReader struct {
+	fsys         FileSystem
 	dir          string
-	files        []os.DirEntry
+	files        []fs.DirEntry
 	rowsToInsert []Row
 }
 
-func newDiskWALReader(dir string) (*diskWALReader, error) {
-	files, err := os.ReadDir(dir)
+func newDiskWALReader(fsys FileSystem, dir string) (*diskWALReader, error) {
+	files, err := fsys.ReadDir(dir)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read the WAL dir: %w", err)
 	}
+	sortSegments(files)
 
 	return &diskWALReader{
+		fsys:         fsys,
 		dir:          dir,
 		files:        files,
 		rowsToInsert: make([]Row, 0),
@@ -210,7 +433,7 @@ func (f *diskWALReader) readAll() error {
 		if file.IsDir() {
 			return fmt.Errorf("unexpected directory found under the WAL directory: %s", file.Name())
 		}
-		fd, err := os.Open(filepath.Join(f.dir, file.Name()))
+		fd, err := f.fsys.OpenFile(filepath.Join(f.dir, file.Name()), os.O_RDONLY, 0)
 		if err != nil {
 			return fmt.Errorf("failed to open WAL segment file: %w", err)
 		}
@@ -232,7 +455,8 @@ func (f *diskWALReader) readAll() error {
 		err = segment.error()
 		if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
 			// It is not unusual for a line to be invalid, as it may well terminate in the middle of writing to the WAL.
-			return nil
+			// Later segments are still read since a failed write may have left it torn at the end of the segment.
+			continue
 		}
 		if err != nil {
 			return fmt.Errorf("encounter an error while reading WAL segment file %q: %w", file.Name(), segment.error())
@@ -243,14 +467,27 @@ func (f *diskWALReader) readAll() error {
 
 // segment represents a segment file.
 type segment struct {
-	file *os.File
+	file File
 	r    *bufio.Reader
 	// FIXME: Use interface to support other operation type
 	current walRecord
 	err     error
+	// records decompressed from the operationCompressed record being read
+	compressed *segment
 }
 
 func (f *segment) next() bool {
+	if f.compressed != nil {
+		if f.compressed.next() {
+			f.current = f.compressed.current
+			return true
+		}
+		if err := f.compressed.error(); err != nil {
+			f.err = fmt.Errorf("broken compressed records: %w", err)
+			return false
+		}
+		f.compressed = nil
+	}
 	op, err := f.r.ReadByte()
 	if errors.Is(err, io.EOF) {
 		return false
@@ -295,6 +532,22 @@ func (f *segment) next() bool {
 				},
 			},
 		}
+	case operationCompressed:
+		size, err := binary.ReadUvarint(f.r)
+		if err != nil {
+			f.err = fmt.Errorf("failed to read the length of compressed records: %w", err)
+			return false
+		}
+		b := make([]byte, int(size))
+		if _, err := io.ReadFull(f.r, b); err != nil {
+			f.err = fmt.Errorf("failed to read compressed records: %w", err)
+			return false
+		}
+		// Subsequent calls read the decompressed records one by one.
+		f.compressed = &segment{
+			r: bufio.NewReader(flate.NewReader(bytes.NewReader(b))),
+		}
+		return f.next()
 	default:
 		f.err = fmt.Errorf("unknown operation %v found", op)
 		return false
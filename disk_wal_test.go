@@ -4,6 +4,7 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"syscall"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -26,7 +27,7 @@ func Test_diskWAL_append_read(t *testing.T) {
 	require.NoError(t, err)
 	path := filepath.Join(tmpDir, "wal")
 
-	wal, err := newDiskWAL(path, 4096)
+	wal, err := newDiskWAL(defaultFileSystem, path, 4096, defaultDirPerm, defaultFilePerm, WALCompressionNone)
 	require.NoError(t, err)
 
 	// Append into two segments
@@ -43,7 +44,7 @@ func Test_diskWAL_append_read(t *testing.T) {
 	require.NoError(t, err)
 
 	// Recover rows.
-	reader, err := newDiskWALReader(path)
+	reader, err := newDiskWALReader(defaultFileSystem, path)
 	require.NoError(t, err)
 	err = reader.readAll()
 	require.NoError(t, err)
@@ -54,21 +55,220 @@ func Test_diskWAL_append_read(t *testing.T) {
 func Test_diskWAL_removeOldest(t *testing.T) {
 	tmpDir, err := os.MkdirTemp("", "tstorage-test")
 	require.NoError(t, err)
-	for i := 0; i < 3; i++ {
+	for _, i := range []int{1, 2, 10} {
 		err := os.Mkdir(filepath.Join(tmpDir, strconv.Itoa(i)), os.ModePerm)
 		require.NoError(t, err)
 	}
 	w := &diskWAL{
-		dir: tmpDir,
+		fsys: defaultFileSystem,
+		dir:  tmpDir,
 	}
+	// Segments are removed in the order they are written, not by name.
+	err = w.removeOldest()
+	require.NoError(t, err)
 	err = w.removeOldest()
 	require.NoError(t, err)
 	files, err := os.ReadDir(w.dir)
 	require.NoError(t, err)
-	want := []string{"1", "2"}
+	want := []string{"10"}
 	got := []string{}
 	for _, f := range files {
 		got = append(got, f.Name())
 	}
 	assert.Equal(t, want, got)
 }
+
+func Test_diskWAL_append_read_manySegments(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal")
+	wal, err := newDiskWAL(defaultFileSystem, path, 4096, defaultDirPerm, defaultFilePerm, WALCompressionNone)
+	require.NoError(t, err)
+	var rows []Row
+	for i := 0; i < 12; i++ {
+		row := Row{Metric: "metric-1", DataPoint: DataPoint{Value: float64(i), Timestamp: 1600000000 + int64(i)}}
+		rows = append(rows, row)
+		require.NoError(t, wal.append(operationInsert, []Row{row}))
+		require.NoError(t, wal.punctuate())
+	}
+
+	// Rows are recovered in the order they are written, even though segment "10" precedes "2" by name.
+	reader, err := newDiskWALReader(defaultFileSystem, path)
+	require.NoError(t, err)
+	require.NoError(t, reader.readAll())
+	assert.Equal(t, rows, reader.rowsToInsert)
+}
+
+func Test_diskWAL_append_read_withCompression(t *testing.T) {
+	rows := []Row{
+		{Metric: "metric-1", DataPoint: DataPoint{Value: 0.1, Timestamp: 1600000000}},
+		{Metric: "metric-2", Labels: []Label{{Name: "host", Value: "a"}}, DataPoint: DataPoint{Value: 0.2, Timestamp: 1600000001}},
+		{Metric: "metric-1", DataPoint: DataPoint{Value: 0.1, Timestamp: 1600000001}},
+		{Metric: "metric-2", DataPoint: DataPoint{Value: 0.2, Timestamp: 1600000003}},
+	}
+	tmpDir, err := os.MkdirTemp("", "tstorage-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	path := filepath.Join(tmpDir, "wal")
+
+	// Mix compressed and uncompressed records, which happens when the option gets changed.
+	wal, err := newDiskWAL(defaultFileSystem, path, 4096, defaultDirPerm, defaultFilePerm, WALCompressionFlate)
+	require.NoError(t, err)
+	require.NoError(t, wal.append(operationInsert, rows[:2]))
+	require.NoError(t, wal.append(operationInsert, rows[2:3]))
+	require.NoError(t, wal.flush())
+	wal.(*diskWAL).compression = WALCompressionNone
+	require.NoError(t, wal.append(operationInsert, rows[3:]))
+	require.NoError(t, wal.flush())
+
+	reader, err := newDiskWALReader(defaultFileSystem, path)
+	require.NoError(t, err)
+	require.NoError(t, reader.readAll())
+	want := []Row{
+		{Metric: "metric-1", DataPoint: DataPoint{Value: 0.1, Timestamp: 1600000000}},
+		{Metric: marshalMetricName("metric-2", []Label{{Name: "host", Value: "a"}}), DataPoint: DataPoint{Value: 0.2, Timestamp: 1600000001}},
+		{Metric: "metric-1", DataPoint: DataPoint{Value: 0.1, Timestamp: 1600000001}},
+		{Metric: "metric-2", DataPoint: DataPoint{Value: 0.2, Timestamp: 1600000003}},
+	}
+	assert.Equal(t, want, reader.rowsToInsert)
+}
+
+func Test_newDiskWAL_unknownCompression(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tstorage-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	_, err = newDiskWAL(defaultFileSystem, filepath.Join(tmpDir, "wal"), 0, defaultDirPerm, defaultFilePerm, WALCompression("snappy"))
+	assert.Error(t, err)
+}
+
+func Test_diskWAL_sync(t *testing.T) {
+	fsys := &syncCountingFileSystem{FileSystem: defaultFileSystem}
+	wal, err := newDiskWAL(fsys, filepath.Join(t.TempDir(), "wal"), 4096, defaultDirPerm, defaultFilePerm, WALCompressionNone)
+	require.NoError(t, err)
+	rows := []Row{{Metric: "metric-1", DataPoint: DataPoint{Value: 0.1, Timestamp: 1600000000}}}
+
+	require.NoError(t, wal.append(operationInsert, rows))
+	require.NoError(t, wal.sync())
+	assert.Equal(t, int32(1), fsys.syncs)
+
+	// The segment punctuated after appending gets committed as well.
+	require.NoError(t, wal.append(operationInsert, rows))
+	require.NoError(t, wal.punctuate())
+	assert.Equal(t, int32(1), fsys.syncs)
+	require.NoError(t, wal.sync())
+	assert.Equal(t, int32(3), fsys.syncs)
+
+	require.NoError(t, wal.sync())
+	assert.Equal(t, int32(4), fsys.syncs)
+}
+
+// failingWriteFile fails writes after writing the first partial bytes while fails is true.
+type failingWriteFile struct {
+	File
+	fails   bool
+	partial int
+}
+
+func (f *failingWriteFile) Write(p []byte) (int, error) {
+	if !f.fails {
+		return f.File.Write(p)
+	}
+	n := f.partial
+	if n > len(p) {
+		n = len(p)
+	}
+	n, _ = f.File.Write(p[:n])
+	return n, &os.PathError{Op: "write", Path: "wal", Err: syscall.ENOSPC}
+}
+
+type truncatableFailingWriteFile struct {
+	*failingWriteFile
+}
+
+func (f *truncatableFailingWriteFile) Truncate(size int64) error {
+	return f.File.(*os.File).Truncate(size)
+}
+
+func Test_diskWAL_append_failed(t *testing.T) {
+	rows := []Row{
+		{Metric: "metric-1", DataPoint: DataPoint{Value: 0.1, Timestamp: 1600000000}},
+		{Metric: "metric-2", DataPoint: DataPoint{Value: 0.2, Timestamp: 1600000001}},
+		{Metric: "metric-3", DataPoint: DataPoint{Value: 0.3, Timestamp: 1600000002}},
+		{Metric: "metric-4", DataPoint: DataPoint{Value: 0.4, Timestamp: 1600000003}},
+	}
+	tests := []struct {
+		name         string
+		bufferedSize int
+		truncatable  bool
+		// whether appends keep failing after the write recovers, until punctuated.
+		wantFailed bool
+	}{
+		{
+			name:         "buffered records written after a failed flush",
+			bufferedSize: 64,
+			truncatable:  true,
+		},
+		{
+			name:         "torn record truncated",
+			bufferedSize: 0,
+			truncatable:  true,
+		},
+		{
+			name:         "torn record failing appends until punctuated",
+			bufferedSize: 0,
+			truncatable:  false,
+			wantFailed:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "wal")
+			w, err := newDiskWAL(defaultFileSystem, path, tt.bufferedSize, defaultDirPerm, defaultFilePerm, WALCompressionNone)
+			require.NoError(t, err)
+			dw := w.(*diskWAL)
+			f := &failingWriteFile{File: dw.fd, partial: 3}
+			dw.fd = f
+			if tt.truncatable {
+				dw.fd = &truncatableFailingWriteFile{f}
+			}
+
+			require.NoError(t, w.append(operationInsert, rows[:1]))
+			f.fails = true
+			// Overflows the buffer to be written.
+			assert.Error(t, w.append(operationInsert, rows[1:3]))
+			f.fails = false
+			if tt.wantFailed {
+				assert.Error(t, w.append(operationInsert, rows[3:]))
+				require.NoError(t, w.punctuate())
+			}
+			require.NoError(t, w.append(operationInsert, rows[3:]))
+			require.NoError(t, w.flush())
+
+			// The rejected rows are absent, whereas the acknowledged ones are all present.
+			reader, err := newDiskWALReader(defaultFileSystem, path)
+			require.NoError(t, err)
+			require.NoError(t, reader.readAll())
+			assert.Equal(t, []Row{rows[0], rows[3]}, reader.rowsToInsert)
+		})
+	}
+}
+
+// dirSyncCountingFileSystem counts how many times each directory gets synced.
+type dirSyncCountingFileSystem struct {
+	osFileSystem
+	synced map[string]int
+}
+
+func (f *dirSyncCountingFileSystem) syncDir(name string) error {
+	f.synced[name]++
+	return f.osFileSystem.syncDir(name)
+}
+
+func Test_diskWAL_syncsDirOnNewSegment(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "wal")
+	fsys := &dirSyncCountingFileSystem{synced: make(map[string]int)}
+	wal, err := newDiskWAL(fsys, dir, 4096, defaultDirPerm, defaultFilePerm, WALCompressionNone)
+	require.NoError(t, err)
+	assert.Equal(t, 1, fsys.synced[dir])
+
+	require.NoError(t, wal.punctuate())
+	assert.Equal(t, 2, fsys.synced[dir])
+}
@@ -0,0 +1,46 @@
+package tstorage
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrDropNotEnabled is returned by DropActivePartition unless enabled with WithDropActivePartition.
+var ErrDropNotEnabled = errors.New("dropping the active partition is not enabled")
+
+// WithDropActivePartition allows DropActivePartition to be called.
+// It guards against losing data by accident, since dropping can't be undone; keep it disabled in production
+// unless you intend to recover from a poisoned partition by hand.
+//
+// Defaults to false.
+func WithDropActivePartition(enabled bool) Option {
+	return func(s *storage) {
+		s.dropActivePartition = enabled
+	}
+}
+
+func (s *storage) DropActivePartition() error {
+	if !s.dropActivePartition {
+		return ErrDropNotEnabled
+	}
+	// Keep flushes from picking up the partition list in the middle.
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+
+	head := s.partitionList.getHead()
+	if head == nil {
+		return nil
+	}
+	if _, ok := head.(*memoryPartition); !ok {
+		return fmt.Errorf("the head partition isn't in memory")
+	}
+	if err := s.partitionList.remove(head); err != nil {
+		return fmt.Errorf("failed to remove the active partition: %w", err)
+	}
+	s.recordEvent(PartitionEventDropped, newPartitionInfo(head), nil)
+	// The active WAL segment holds the records of the head, so it gets replaced rather than punctuated.
+	if err := s.wal.discardActive(); err != nil {
+		return fmt.Errorf("failed to discard WAL records: %w", err)
+	}
+	return s.newPartition(nil, false)
+}
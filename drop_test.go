@@ -0,0 +1,34 @@
+package tstorage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_storage_DropActivePartition(t *testing.T) {
+	s, err := NewStorage()
+	require.NoError(t, err)
+	defer s.Close()
+	assert.ErrorIs(t, s.DropActivePartition(), ErrDropNotEnabled)
+
+	tmpDir := t.TempDir()
+	opts := []Option{WithDataPath(tmpDir), WithWALBufferedSize(0), WithDropActivePartition(true)}
+	s, err = NewStorage(opts...)
+	require.NoError(t, err)
+	defer s.Close()
+	require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000000, Value: 0.1}}}))
+	require.NoError(t, s.DropActivePartition())
+	_, err = s.Select("metric1", nil, 1600000000, 1600000001)
+	assert.ErrorIs(t, err, ErrNoDataPoints)
+	require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000001, Value: 0.2}}}))
+
+	// Open another one as if the process crashed, to see what is recovered from the WAL.
+	recovered, err := NewStorage(opts...)
+	require.NoError(t, err)
+	defer recovered.Close()
+	points, err := recovered.Select("metric1", nil, 1600000000, 1600000002)
+	require.NoError(t, err)
+	assert.Equal(t, []*DataPoint{{Timestamp: 1600000001, Value: 0.2}}, points)
+}
@@ -0,0 +1,142 @@
+package tstorage
+
+import (
+	"fmt"
+	"math"
+	"path/filepath"
+	"regexp"
+	"sort"
+)
+
+var partitionIDRegex = regexp.MustCompile(`^p--?[0-9]+--?[0-9]+-(.+)$`)
+
+// DuplicatePartition describes a disk partition holding exactly the same data points as another one,
+// which can be left by a bad restore for instance.
+type DuplicatePartition struct {
+	PartitionInfo
+	// Original is the partition holding the same data points, which remains available.
+	Original PartitionInfo
+}
+
+// excludeDuplicatePartitions gives back the given partitions except for ones holding exactly the same data points
+// as another one, and remembers the excluded ones. partitions must be sorted by the minimum timestamp.
+//
+// Partitions are compared only if their metadata agree, and then regarded as duplicates only if all data points
+// are identical, so that partitions legitimately overlapping, like ones holding out-of-order data points, are never excluded.
+func (s *storage) excludeDuplicatePartitions(partitions []partition) []partition {
+	kept := make([]partition, 0, len(partitions))
+	for _, p := range partitions {
+		d, ok := p.(*diskPartition)
+		if !ok {
+			kept = append(kept, p)
+			continue
+		}
+		var original *diskPartition
+		// Only the ones with the same minimum timestamp can be identical.
+		for i := len(kept) - 1; i >= 0 && kept[i].minTimestamp() == d.minTimestamp(); i-- {
+			if k, ok := kept[i].(*diskPartition); ok && sameDiskPartitions(k, d) {
+				original = k
+				break
+			}
+		}
+		if original == nil {
+			kept = append(kept, p)
+			continue
+		}
+		dup := DuplicatePartition{PartitionInfo: newPartitionInfo(d), Original: newPartitionInfo(original)}
+		s.logger.Printf("partition %s is a duplicate of %s, excluded from queries\n", dup.DirPath, dup.Original.DirPath)
+		if err := d.close(); err != nil {
+			s.logger.Printf("failed to close duplicate partition %s: %v\n", dup.DirPath, err)
+		}
+		s.duplicatePartitions = append(s.duplicatePartitions, dup)
+	}
+	return kept
+}
+
+// sameDiskPartitions reports whether the given partitions hold exactly the same data points.
+// It regards them as different if failed to read them.
+func sameDiskPartitions(x, y *diskPartition) bool {
+	if x.minTimestamp() != y.minTimestamp() || x.maxTimestamp() != y.maxTimestamp() || x.size() != y.size() ||
+		len(x.meta.Metrics) != len(y.meta.Metrics) {
+		return false
+	}
+	for name, xm := range x.meta.Metrics {
+		ym, ok := y.meta.Metrics[name]
+		if !ok || xm.NumDataPoints != ym.NumDataPoints || xm.MinTimestamp != ym.MinTimestamp || xm.MaxTimestamp != ym.MaxTimestamp {
+			return false
+		}
+	}
+	for name := range x.meta.Metrics {
+		xs, err := x.selectDataPointsByName(name, math.MinInt64, math.MaxInt64)
+		if err != nil {
+			return false
+		}
+		ys, err := y.selectDataPointsByName(name, math.MinInt64, math.MaxInt64)
+		if err != nil || len(xs) != len(ys) {
+			return false
+		}
+		for i := range xs {
+			if *xs[i] != *ys[i] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// checkPartitionIDs finds partition directories sharing an ID given by WithIDGenerator among the given ones,
+// which are relative to the data path, and handles them according to the DuplicateIDPolicy.
+// It gives back the directories to be quarantined.
+func (s *storage) checkPartitionIDs(dirs []string) (map[string]struct{}, error) {
+	if s.idGenerator == nil {
+		return nil, nil
+	}
+	names := make(map[string][]string)
+	for _, dir := range dirs {
+		m := partitionIDRegex.FindStringSubmatch(filepath.Base(dir))
+		if m == nil {
+			continue
+		}
+		names[m[1]] = append(names[m[1]], dir)
+	}
+	quarantined := make(map[string]struct{})
+	for id, dirs := range names {
+		if len(dirs) < 2 {
+			continue
+		}
+		sort.Strings(dirs)
+		switch s.duplicateIDPolicy {
+		case DuplicateIDQuarantine:
+			for _, dir := range dirs[1:] {
+				s.logger.Printf("partition %s shares ID %q with %s, excluded from queries\n", dir, id, dirs[0])
+				quarantined[dir] = struct{}{}
+			}
+		default:
+			return nil, fmt.Errorf("%w: %q shared by %v", ErrDuplicatePartitionID, id, dirs)
+		}
+	}
+	return quarantined, nil
+}
+
+func (s *storage) DuplicatePartitions() []DuplicatePartition {
+	s.duplicatePartitionsMu.Lock()
+	defer s.duplicatePartitionsMu.Unlock()
+	dups := make([]DuplicatePartition, len(s.duplicatePartitions))
+	copy(dups, s.duplicatePartitions)
+	return dups
+}
+
+func (s *storage) DeduplicatePartitions() (int, error) {
+	s.duplicatePartitionsMu.Lock()
+	defer s.duplicatePartitionsMu.Unlock()
+	removed := 0
+	for _, dup := range s.duplicatePartitions {
+		if err := s.fsys.RemoveAll(dup.DirPath); err != nil {
+			s.duplicatePartitions = s.duplicatePartitions[removed:]
+			return removed, fmt.Errorf("failed to remove duplicate partition %s: %w", dup.DirPath, err)
+		}
+		removed++
+	}
+	s.duplicatePartitions = nil
+	return removed, nil
+}
@@ -0,0 +1,122 @@
+package tstorage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_storage_DeduplicatePartitions(t *testing.T) {
+	dataPath := t.TempDir()
+	writePartition := func(name string, rows []Row) {
+		m := newMemoryPartition(nil, 0, Seconds).(*memoryPartition)
+		_, err := m.insertRows(rows)
+		require.NoError(t, err)
+		s := &storage{dirPerm: defaultDirPerm, filePerm: defaultFilePerm, allocator: defaultAllocator, flushBufferSize: defaultFlushBufferSize, fsys: defaultFileSystem, logger: &nopLogger{}}
+		require.NoError(t, s.flush(filepath.Join(dataPath, name), m))
+	}
+	rows := []Row{
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1, Value: 0.1}},
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 2, Value: 0.2}},
+	}
+	writePartition("p-1-2", rows)
+	writePartition("p-1-2-1", rows)
+	// Overlapping out-of-order data points, which must not be regarded as a duplicate.
+	writePartition("p-1-2-2", []Row{
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1, Value: 0.3}},
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 2, Value: 0.4}},
+	})
+
+	s, err := NewStorage(WithDataPath(dataPath), WithTimestampPrecision(Seconds), WithRetention(100*365*24*time.Hour))
+	require.NoError(t, err)
+	defer s.Close()
+
+	dups := s.DuplicatePartitions()
+	require.Len(t, dups, 1)
+	assert.Equal(t, filepath.Join(dataPath, "p-1-2"), dups[0].Original.DirPath)
+	assert.Equal(t, filepath.Join(dataPath, "p-1-2-1"), dups[0].DirPath)
+
+	points, err := s.Select("metric1", nil, 1, 3)
+	require.NoError(t, err)
+	assert.Len(t, points, 4)
+
+	n, err := s.DeduplicatePartitions()
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Empty(t, s.DuplicatePartitions())
+	_, err = os.Stat(filepath.Join(dataPath, "p-1-2-1"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	_, err = os.Stat(filepath.Join(dataPath, "p-1-2-2"))
+	assert.NoError(t, err)
+}
+
+func Test_storage_withDuplicateIDPolicy(t *testing.T) {
+	newDataPath := func(t *testing.T) string {
+		dataPath := t.TempDir()
+		writePartition := func(name string, rows []Row) {
+			m := newMemoryPartition(nil, 0, Seconds).(*memoryPartition)
+			_, err := m.insertRows(rows)
+			require.NoError(t, err)
+			s := &storage{dirPerm: defaultDirPerm, filePerm: defaultFilePerm, allocator: defaultAllocator, flushBufferSize: defaultFlushBufferSize, fsys: defaultFileSystem, logger: &nopLogger{}}
+			require.NoError(t, s.flush(filepath.Join(dataPath, name), m))
+		}
+		writePartition("p-1-2-abc", []Row{
+			{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1, Value: 0.1}},
+			{Metric: "metric1", DataPoint: DataPoint{Timestamp: 2, Value: 0.2}},
+		})
+		// Copied by mistake along with its ID.
+		writePartition("p-10-11-abc", []Row{
+			{Metric: "metric1", DataPoint: DataPoint{Timestamp: 10, Value: 1}},
+			{Metric: "metric1", DataPoint: DataPoint{Timestamp: 11, Value: 1.1}},
+		})
+		writePartition("p-20-21-def", []Row{
+			{Metric: "metric1", DataPoint: DataPoint{Timestamp: 20, Value: 2}},
+		})
+		return dataPath
+	}
+	idGenerator := func() string { return "id" }
+
+	t.Run("reject by default", func(t *testing.T) {
+		_, err := NewStorage(WithDataPath(newDataPath(t)), WithTimestampPrecision(Seconds), WithRetention(100*365*24*time.Hour),
+			WithIDGenerator(idGenerator))
+		assert.ErrorIs(t, err, ErrDuplicatePartitionID)
+	})
+
+	t.Run("quarantine", func(t *testing.T) {
+		dataPath := newDataPath(t)
+		s, err := NewStorage(WithDataPath(dataPath), WithTimestampPrecision(Seconds), WithRetention(100*365*24*time.Hour),
+			WithIDGenerator(idGenerator), WithDuplicateIDPolicy(DuplicateIDQuarantine))
+		require.NoError(t, err)
+		defer s.Close()
+
+		points, err := s.Select("metric1", nil, 0, 30)
+		require.NoError(t, err)
+		assert.Equal(t, []*DataPoint{
+			{Timestamp: 1, Value: 0.1},
+			{Timestamp: 2, Value: 0.2},
+			{Timestamp: 20, Value: 2},
+		}, points)
+
+		_, err = s.SelectStrict("metric1", nil, 0, 30)
+		var partialErr *PartialResultError
+		require.ErrorAs(t, err, &partialErr)
+		require.Len(t, partialErr.Skipped, 1)
+		assert.Equal(t, filepath.Join(dataPath, "p-10-11-abc"), partialErr.Skipped[0].DirPath)
+		assert.ErrorIs(t, partialErr.Skipped[0].Err, ErrDuplicatePartitionID)
+		// Left on the disk.
+		assert.DirExists(t, filepath.Join(dataPath, "p-10-11-abc"))
+	})
+
+	t.Run("not checked without ID generator", func(t *testing.T) {
+		s, err := NewStorage(WithDataPath(newDataPath(t)), WithTimestampPrecision(Seconds), WithRetention(100*365*24*time.Hour))
+		require.NoError(t, err)
+		defer s.Close()
+		points, err := s.Select("metric1", nil, 0, 30)
+		require.NoError(t, err)
+		assert.Len(t, points, 5)
+	})
+}
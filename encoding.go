@@ -52,6 +52,8 @@ type gorillaEncoder struct {
 
 	// buffer to be used while encoding
 	buf *bstream
+	// the number of data points encoded, up to 2, since a timestamp of 0 can't tell whether t_0 and t_1 are set
+	numEncoded int
 
 	// Calculate the delta of delta:
 	// D = (t_n − t_n−1) − (t_n−1 − t_n−2)
@@ -80,7 +82,7 @@ func (e *gorillaEncoder) encodePoint(point *DataPoint) error {
 
 	// Borrowed from https://github.com/prometheus/prometheus/blob/39d79c3cfb86c47d6bc06a9e9317af582f1833bb/tsdb/chunkenc/xor.go#L150
 	switch {
-	case e.t0 == 0:
+	case e.numEncoded == 0:
 		// Write timestamp directly.
 		buf := make([]byte, binary.MaxVarintLen64)
 		for _, b := range buf[:binary.PutVarint(buf, point.Timestamp)] {
@@ -89,7 +91,8 @@ func (e *gorillaEncoder) encodePoint(point *DataPoint) error {
 		// Write value directly.
 		e.buf.writeBits(math.Float64bits(point.Value), 64)
 		e.t0 = point.Timestamp
-	case e.t1 == 0:
+		e.numEncoded++
+	case e.numEncoded == 1:
 		// Write delta of timestamp.
 		tDelta = uint64(point.Timestamp - e.t0)
 
@@ -100,6 +103,7 @@ func (e *gorillaEncoder) encodePoint(point *DataPoint) error {
 		// Write value delta.
 		e.writeVDelta(point.Value)
 		e.t1 = point.Timestamp
+		e.numEncoded++
 	default:
 		// Write delta-of-delta of timestamp.
 		tDelta = uint64(point.Timestamp - e.t)
@@ -140,6 +144,7 @@ func (e *gorillaEncoder) flush() error {
 	}
 
 	e.buf.reset()
+	e.numEncoded = 0
 	e.t0 = 0
 	e.t1 = 0
 	e.t = 0
@@ -203,6 +208,14 @@ func newSeriesDecoder(r io.Reader) (seriesDecoder, error) {
 	}, nil
 }
 
+// newSeriesDecoderFromBytes gives back a decoder that decodes the given bytes in place.
+// Unlike newSeriesDecoder, it doesn't copy them at all, which is suitable for memory-mapped bytes.
+func newSeriesDecoderFromBytes(b []byte) seriesDecoder {
+	return &gorillaDecoder{
+		br: newBReader(b),
+	}
+}
+
 type gorillaDecoder struct {
 	br      bstreamReader
 	numRead uint16
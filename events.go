@@ -0,0 +1,127 @@
+package tstorage
+
+import (
+	"sync"
+	"time"
+)
+
+// defaultEventLogSize is the number of the recent partition events retained.
+const defaultEventLogSize = 256
+
+// PartitionEventType specifies what happened to a partition.
+type PartitionEventType string
+
+const (
+	// PartitionEventCreated means a new memory partition was created to accept writes.
+	PartitionEventCreated PartitionEventType = "created"
+	// PartitionEventFlushed means a memory partition was persisted and swapped for the disk partition.
+	PartitionEventFlushed PartitionEventType = "flushed"
+	// PartitionEventMerged means a memory partition with fewer data points than WithMinFlushPoints
+	// was merged into the next newer one.
+	PartitionEventMerged PartitionEventType = "merged"
+	// PartitionEventExpired means a partition was dropped because of the retention.
+	PartitionEventExpired PartitionEventType = "expired"
+	// PartitionEventSkipped means a disk partition failed to be opened and got excluded from reads.
+	PartitionEventSkipped PartitionEventType = "skipped"
+	// PartitionEventCorrupted means the scrubber found the data file of a disk partition not matching its checksum.
+	PartitionEventCorrupted PartitionEventType = "corrupted"
+	// PartitionEventDropped means the active memory partition was discarded by DropActivePartition.
+	PartitionEventDropped PartitionEventType = "dropped"
+	// PartitionEventRepaired means disk partitions overlapping each other were merged into one by WithReadRepair.
+	PartitionEventRepaired PartitionEventType = "repaired"
+)
+
+// PartitionEvent describes a transition in the lifecycle of a partition.
+type PartitionEvent struct {
+	Type PartitionEventType
+	// The wall-clock time when the event happened.
+	Time time.Time
+	// The partition the event happened to. Partitions are identified by MinTimestamp, or DirPath once persisted.
+	// For PartitionEventFlushed, it describes the persisted disk partition.
+	Partition PartitionInfo
+	// Err is the reason for PartitionEventSkipped and PartitionEventCorrupted.
+	Err error
+}
+
+// eventLog is a ring buffer holding the recent partition events.
+type eventLog struct {
+	mu     sync.Mutex
+	events []PartitionEvent
+	// index to put the next event at.
+	next int
+	// whether events has been filled.
+	full bool
+}
+
+func newEventLog(size int) *eventLog {
+	return &eventLog{events: make([]PartitionEvent, size)}
+}
+
+func (l *eventLog) add(e PartitionEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events[l.next] = e
+	l.next++
+	if l.next == len(l.events) {
+		l.next = 0
+		l.full = true
+	}
+}
+
+// recent gives back at most n recent events in order of oldest to newest.
+func (l *eventLog) recent(n int) []PartitionEvent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	size := l.next
+	if l.full {
+		size = len(l.events)
+	}
+	if n > size {
+		n = size
+	}
+	if n <= 0 {
+		return []PartitionEvent{}
+	}
+	events := make([]PartitionEvent, 0, n)
+	for i := l.next - n; i < l.next; i++ {
+		events = append(events, l.events[(i+len(l.events))%len(l.events)])
+	}
+	return events
+}
+
+// WithEventHook specifies a function invoked for each partition event, such as created, flushed and expired.
+// The recent events can be also seen through RecentEvents without the hook.
+//
+// The hook is called synchronously by whoever caused the event, including writers, so it should return quickly.
+// Defaults to nil.
+func WithEventHook(fn func(e PartitionEvent)) Option {
+	return func(s *storage) {
+		s.eventHook = fn
+	}
+}
+
+func (s *storage) RecentEvents(n int) []PartitionEvent {
+	if s.events == nil {
+		return []PartitionEvent{}
+	}
+	return s.events.recent(n)
+}
+
+// recordEvent records the event happened to the described partition, and then passes it to the event hook.
+func (s *storage) recordEvent(typ PartitionEventType, info PartitionInfo, err error) {
+	if s.events == nil && s.eventHook == nil {
+		return
+	}
+	e := PartitionEvent{
+		Type:      typ,
+		Time:      time.Now(),
+		Partition: info,
+		Err:       err,
+	}
+	if s.events != nil {
+		s.events.add(e)
+	}
+	if s.eventHook != nil {
+		s.eventHook(e)
+	}
+}
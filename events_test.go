@@ -0,0 +1,82 @@
+package tstorage
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_eventLog_recent(t *testing.T) {
+	tests := []struct {
+		name  string
+		added int
+		n     int
+		want  []int64
+	}{
+		{name: "empty", added: 0, n: 2, want: []int64{}},
+		{name: "fewer than n", added: 2, n: 3, want: []int64{0, 1}},
+		{name: "n within the buffer", added: 2, n: 1, want: []int64{1}},
+		{name: "wrapped around", added: 5, n: 3, want: []int64{2, 3, 4}},
+		{name: "wrapped around more than n", added: 5, n: 10, want: []int64{2, 3, 4}},
+		{name: "non-positive n", added: 2, n: 0, want: []int64{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newEventLog(3)
+			for i := 0; i < tt.added; i++ {
+				l.add(PartitionEvent{Partition: PartitionInfo{MinTimestamp: int64(i)}})
+			}
+			got := make([]int64, 0)
+			for _, e := range l.recent(tt.n) {
+				got = append(got, e.Partition.MinTimestamp)
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_storage_RecentEvents(t *testing.T) {
+	type event struct {
+		typ      PartitionEventType
+		min, max int64
+		dirPath  string
+	}
+	tmpDir := t.TempDir()
+	var hooked []PartitionEvent
+	s, err := NewStorage(
+		WithDataPath(tmpDir),
+		WithTimestampPrecision(Seconds),
+		WithRetention(time.Nanosecond),
+		WithEventHook(func(e PartitionEvent) {
+			hooked = append(hooked, e)
+		}),
+	)
+	require.NoError(t, err)
+	err = s.InsertRows([]Row{
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000000, Value: 0.1}},
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000001, Value: 0.1}},
+	})
+	require.NoError(t, err)
+	// Closing flushes the partition, and then removes it as it's already expired.
+	require.NoError(t, s.Close())
+
+	got := s.RecentEvents(10)
+	assert.Equal(t, hooked, got)
+	events := make([]event, 0, len(got))
+	for _, e := range got {
+		assert.False(t, e.Time.IsZero())
+		events = append(events, event{typ: e.Type, min: e.Partition.MinTimestamp, max: e.Partition.MaxTimestamp, dirPath: e.Partition.DirPath})
+	}
+	dir := filepath.Join(tmpDir, "p-1600000000-1600000001")
+	assert.Equal(t, []event{
+		{typ: PartitionEventCreated},
+		// Closing makes new partitions to let all the existing ones be flushed.
+		{typ: PartitionEventCreated},
+		{typ: PartitionEventCreated},
+		{typ: PartitionEventFlushed, min: 1600000000, max: 1600000001, dirPath: dir},
+		{typ: PartitionEventExpired, min: 1600000000, max: 1600000001, dirPath: dir},
+	}, events)
+}
@@ -7,9 +7,14 @@ type fakePartition struct {
 	IsActive  bool
 
 	err error
+	// insertPanic is given to panic on insertRows if not nil.
+	insertPanic interface{}
 }
 
 func (f *fakePartition) insertRows(_ []Row) ([]Row, error) {
+	if f.insertPanic != nil {
+		panic(f.insertPanic)
+	}
 	return nil, f.err
 }
 
@@ -17,6 +22,10 @@ func (f *fakePartition) selectDataPoints(_ string, _ []Label, _, _ int64) ([]*Da
 	return nil, f.err
 }
 
+func (f *fakePartition) countDataPoints(_ string, _ []Label, _, _ int64) (int, error) {
+	return 0, f.err
+}
+
 func (f *fakePartition) minTimestamp() int64 {
 	return f.minT
 }
@@ -0,0 +1,40 @@
+package tstorage
+
+type fakeWAL struct {
+	appendFunc func(op walOperation, rows []Row) error
+}
+
+func (f *fakeWAL) append(op walOperation, rows []Row) error {
+	if f.appendFunc == nil {
+		return nil
+	}
+	return f.appendFunc(op, rows)
+}
+
+func (f *fakeWAL) flush() error {
+	return nil
+}
+
+func (f *fakeWAL) sync() error {
+	return nil
+}
+
+func (f *fakeWAL) punctuate() error {
+	return nil
+}
+
+func (f *fakeWAL) removeOldest() error {
+	return nil
+}
+
+func (f *fakeWAL) removeAll() error {
+	return nil
+}
+
+func (f *fakeWAL) refresh() error {
+	return nil
+}
+
+func (f *fakeWAL) discardActive() error {
+	return nil
+}
@@ -0,0 +1,93 @@
+package tstorage
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// mkdirAll is like os.MkdirAll, but it makes sure the permission bits of the given
+// directory are perm regardless of the process's umask, as long as it's newly created.
+// The permissions of an already existing directory are left as is.
+func mkdirAll(fsys FileSystem, path string, perm fs.FileMode) error {
+	if info, err := fsys.Stat(path); err == nil && info.IsDir() {
+		return nil
+	}
+	if err := fsys.MkdirAll(path, perm); err != nil {
+		return err
+	}
+	return fsys.Chmod(path, perm)
+}
+
+// openFile is like os.OpenFile, but it makes sure the permission bits of the
+// opened file are perm regardless of the process's umask.
+func openFile(fsys FileSystem, name string, flag int, perm fs.FileMode) (File, error) {
+	f, err := fsys.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// writeFile is like os.WriteFile, but it makes sure the permission bits of the
+// written file are perm regardless of the process's umask.
+func writeFile(fsys FileSystem, name string, data []byte, perm fs.FileMode) error {
+	f, err := openFile(fsys, name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err1 := f.Close(); err1 != nil && err == nil {
+		err = err1
+	}
+	return err
+}
+
+// renamer is implemented by file systems able to rename files.
+type renamer interface {
+	rename(oldpath, newpath string) error
+}
+
+// writeFileAtomic is like writeFile, but it makes sure that the file is replaced entirely or not at all
+// even if crashed midway, by writing the data into a temporary file, syncing it and then renaming it
+// over the given one. File systems unable to rename get the file written in place instead.
+func writeFileAtomic(fsys FileSystem, name string, data []byte, perm fs.FileMode) error {
+	r, ok := fsys.(renamer)
+	if !ok {
+		return writeFile(fsys, name, data, perm)
+	}
+	tmp := name + ".tmp"
+	f, err := openFile(fsys, tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if syncer, ok := f.(interface{ Sync() error }); ok && err == nil {
+		err = syncer.Sync()
+	}
+	if err1 := f.Close(); err1 != nil && err == nil {
+		err = err1
+	}
+	if err == nil {
+		err = r.rename(tmp, name)
+	}
+	if err != nil {
+		fsys.RemoveAll(tmp)
+		return err
+	}
+	return syncDir(fsys, filepath.Dir(name))
+}
+
+// syncDir makes the entries created in or removed from the given directory durable,
+// as long as the file system supports it. Otherwise it does nothing.
+func syncDir(fsys FileSystem, dir string) error {
+	syncer, ok := fsys.(interface{ syncDir(name string) error })
+	if !ok {
+		return nil
+	}
+	return syncer.syncDir(dir)
+}
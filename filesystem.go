@@ -0,0 +1,98 @@
+package tstorage
+
+import (
+	"io"
+	"io/fs"
+	"os"
+)
+
+// FileSystem is the file system where a Storage persists partitions and the WAL. See WithFileSystem
+// Errors for missing files should wrap fs.ErrNotExist, as the os package does.
+type FileSystem interface {
+	// OpenFile is like os.OpenFile.
+	OpenFile(name string, flag int, perm fs.FileMode) (File, error)
+	// ReadDir is like os.ReadDir; it gives back the entries sorted by filename.
+	ReadDir(name string) ([]fs.DirEntry, error)
+	// Stat is like os.Stat.
+	Stat(name string) (fs.FileInfo, error)
+	// MkdirAll is like os.MkdirAll.
+	MkdirAll(path string, perm fs.FileMode) error
+	// Chmod is like os.Chmod.
+	Chmod(name string, mode fs.FileMode) error
+	// RemoveAll is like os.RemoveAll.
+	RemoveAll(path string) error
+}
+
+// File is a file opened by FileSystem.
+type File interface {
+	io.Reader
+	io.Writer
+	io.Closer
+	Stat() (fs.FileInfo, error)
+	Chmod(mode fs.FileMode) error
+}
+
+// osFileSystem is the FileSystem backed by the os package.
+type osFileSystem struct{}
+
+func (osFileSystem) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		// Not to give back a non-nil interface holding a nil pointer.
+		return nil, err
+	}
+	return f, nil
+}
+
+func (osFileSystem) ReadDir(name string) ([]fs.DirEntry, error) {
+	return os.ReadDir(name)
+}
+
+func (osFileSystem) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFileSystem) MkdirAll(path string, perm fs.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (osFileSystem) Chmod(name string, mode fs.FileMode) error {
+	return os.Chmod(name, mode)
+}
+
+func (osFileSystem) RemoveAll(path string) error {
+	return os.RemoveAll(path)
+}
+
+// rename renames the given file, replacing the existing one at newpath.
+func (osFileSystem) rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+// syncDir makes the entries in the given directory durable.
+func (osFileSystem) syncDir(name string) error {
+	d, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if err1 := d.Close(); err1 != nil && err == nil {
+		err = err1
+	}
+	return err
+}
+
+// defaultFileSystem is the file system of the operating system.
+var defaultFileSystem FileSystem = osFileSystem{}
+
+// WithFileSystem specifies the file system where partitions and the WAL are persisted under the data path.
+// It is useful to run a Storage on an in-memory file system in tests; see the testutil package.
+// Data files are memory-mapped only if the file system gives back *os.File.
+// Note that Merge, Migrate and DumpWAL always work on the file system of the operating system.
+//
+// Defaults to the file system of the operating system.
+func WithFileSystem(fsys FileSystem) Option {
+	return func(s *storage) {
+		s.fsys = fsys
+	}
+}
@@ -0,0 +1,83 @@
+package tstorage
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// FlushHandle reports the completion of a flush running in the background. See Storage.FlushAsync
+type FlushHandle struct {
+	done chan struct{}
+	err  error
+}
+
+// Done gives back a channel that is closed when the flush completes.
+func (h *FlushHandle) Done() <-chan struct{} {
+	return h.done
+}
+
+// Wait waits for the flush to complete, and then gives back the error it faced if any.
+func (h *FlushHandle) Wait() error {
+	<-h.done
+	return h.err
+}
+
+func (s *storage) FlushAsync() *FlushHandle {
+	h := &FlushHandle{done: make(chan struct{})}
+	s.flushWg.Add(1)
+	go func() {
+		defer s.flushWg.Done()
+		h.err = s.recovered(func() error { return s.flushPartitions(true) })
+		close(h.done)
+	}()
+	return h
+}
+
+// FlushedPartitionInfo describes a disk partition persisted by Storage.Flush.
+type FlushedPartitionInfo struct {
+	PartitionInfo
+	// ID is the one given by WithIDGenerator, which is empty if not given.
+	ID string
+}
+
+// newFlushedPartitionInfo describes the persisted partition, taking the ID from the directory name if hasID.
+func newFlushedPartitionInfo(info PartitionInfo, hasID bool) FlushedPartitionInfo {
+	flushed := FlushedPartitionInfo{PartitionInfo: info}
+	if hasID {
+		flushed.ID = partitionID(info.DirPath)
+	}
+	return flushed
+}
+
+// partitionID takes the ID given by WithIDGenerator from the name of the given partition directory.
+func partitionID(dirPath string) string {
+	if m := partitionIDRegex.FindStringSubmatch(filepath.Base(dirPath)); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+func (s *storage) Flush() (flushed []FlushedPartitionInfo, err error) {
+	s.flushWg.Add(1)
+	defer s.flushWg.Done()
+	defer s.recoverPanic(&err)
+	return s.flushPartitionsWithInfo(true)
+}
+
+// PartialFlushError is returned by flushes if some of the partitions fail to be persisted,
+// which stay in memory until the next flush. The others are persisted regardless.
+// It wraps the errors of all failed partitions, so that errors.Is and errors.As see each of them.
+type PartialFlushError struct {
+	// Flushed holds the disk partitions persisted, in order of newest to oldest.
+	Flushed []FlushedPartitionInfo
+	// Errs holds why each of the partitions failed to be persisted.
+	Errs []error
+}
+
+func (e *PartialFlushError) Error() string {
+	return fmt.Sprintf("failed to persist %d partitions while %d persisted: %v", len(e.Errs), len(e.Flushed), e.Errs[0])
+}
+
+func (e *PartialFlushError) Unwrap() []error {
+	return e.Errs
+}
@@ -0,0 +1,164 @@
+package tstorage
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_storage_FlushAsync(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tstorage-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	s, err := NewStorage(WithDataPath(tmpDir), WithTimestampPrecision(Seconds), WithPartitionDuration(time.Hour))
+	require.NoError(t, err)
+	defer s.Close()
+	// A partition takes rows until its range exceeds the duration, so that it makes four partitions.
+	timestamps := []int64{1, 5000, 10000, 15000, 20000, 25000, 30000}
+	for _, ts := range timestamps {
+		require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: ts}}}))
+	}
+
+	h := s.FlushAsync()
+	require.NoError(t, h.Wait())
+	select {
+	case <-h.Done():
+	default:
+		t.Fatal("done channel must be closed once the flush completes")
+	}
+
+	parts := s.ListPartitions()
+	require.Len(t, parts, 4)
+	for i, p := range parts {
+		assert.Equal(t, i >= writablePartitionsNum, p.DirPath != "", "partition %d", i)
+	}
+	got, err := s.Select("metric1", nil, 0, 30001)
+	require.NoError(t, err)
+	require.Len(t, got, len(timestamps))
+	for i, p := range got {
+		assert.Equal(t, timestamps[i], p.Timestamp)
+	}
+}
+
+func Test_storage_Flush(t *testing.T) {
+	var n int
+	s, err := NewStorage(WithDataPath(t.TempDir()), WithTimestampPrecision(Seconds), WithPartitionDuration(time.Hour),
+		WithIDGenerator(func() string {
+			n++
+			return fmt.Sprintf("id%d", n)
+		}))
+	require.NoError(t, err)
+	defer s.Close()
+	ss := s.(*storage)
+
+	// Nothing is flushable yet.
+	flushed, err := s.Flush()
+	require.NoError(t, err)
+	assert.Empty(t, flushed)
+
+	require.NoError(t, s.InsertRows([]Row{
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1}},
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 5000}},
+	}))
+	require.NoError(t, ss.newPartition(nil, true))
+	require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 10000}}}))
+	// Make the above ones no longer writable, without triggering a flush in the background.
+	for i := 0; i < writablePartitionsNum; i++ {
+		require.NoError(t, ss.newPartition(nil, true))
+	}
+
+	flushed, err = s.Flush()
+	require.NoError(t, err)
+	require.Len(t, flushed, 2)
+	assert.Equal(t, "id1", flushed[0].ID)
+	assert.Equal(t, filepath.Join(ss.dataPath, "p-10000-10000-id1"), flushed[0].DirPath)
+	assert.Equal(t, int64(10000), flushed[0].MinTimestamp)
+	assert.Equal(t, int64(10000), flushed[0].MaxTimestamp)
+	assert.Equal(t, 1, flushed[0].NumDataPoints)
+	assert.Equal(t, "id2", flushed[1].ID)
+	assert.Equal(t, filepath.Join(ss.dataPath, "p-1-5000-id2"), flushed[1].DirPath)
+	assert.Equal(t, int64(1), flushed[1].MinTimestamp)
+	assert.Equal(t, int64(5000), flushed[1].MaxTimestamp)
+	assert.Equal(t, 2, flushed[1].NumDataPoints)
+	assert.False(t, flushed[1].PersistedAt.IsZero())
+
+	// They are already persisted.
+	flushed, err = s.Flush()
+	require.NoError(t, err)
+	assert.Empty(t, flushed)
+}
+
+// partitionFailingFileSystem fails to create the data file of partitions whose directory name starts with prefix.
+type partitionFailingFileSystem struct {
+	FileSystem
+	prefix string
+}
+
+func (f *partitionFailingFileSystem) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	if filepath.Base(name) == dataFileName && flag&os.O_CREATE != 0 && f.prefix != "" &&
+		strings.HasPrefix(filepath.Base(filepath.Dir(name)), f.prefix) {
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EIO}
+	}
+	return f.FileSystem.OpenFile(name, flag, perm)
+}
+
+func Test_storage_Flush_partiallyFailed(t *testing.T) {
+	dataPath := t.TempDir()
+	fsys := &partitionFailingFileSystem{FileSystem: defaultFileSystem, prefix: "p-10000-"}
+	s, err := NewStorage(WithDataPath(dataPath), WithTimestampPrecision(Seconds), WithPartitionDuration(time.Hour),
+		WithWALBufferedSize(0), WithFileSystem(fsys))
+	require.NoError(t, err)
+	defer s.Close()
+	ss := s.(*storage)
+
+	// A partition along with a WAL segment for each, without triggering a flush in the background.
+	for i, ts := range []int64{1, 10000, 20000, 30000, 40000} {
+		if i > 0 {
+			require.NoError(t, ss.newPartition(nil, true))
+		}
+		require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: ts}}}))
+	}
+	segments, err := WALSegments(dataPath)
+	require.NoError(t, err)
+	require.Len(t, segments, 5)
+
+	flushed, err := s.Flush()
+	var flushErr *PartialFlushError
+	require.True(t, errors.As(err, &flushErr))
+	assert.ErrorIs(t, err, syscall.EIO)
+	assert.Len(t, flushErr.Errs, 1)
+	assert.Equal(t, flushed, flushErr.Flushed)
+	// The ones older and newer than the failed one are persisted.
+	require.Len(t, flushed, 2)
+	assert.Equal(t, filepath.Join(dataPath, "p-20000-20000"), flushed[0].DirPath)
+	assert.Equal(t, filepath.Join(dataPath, "p-1-1"), flushed[1].DirPath)
+	// Only the oldest segment can be removed, since the failed one precedes the others.
+	segments, err = WALSegments(dataPath)
+	require.NoError(t, err)
+	assert.Len(t, segments, 4)
+
+	// The failed one stays in memory.
+	points, err := s.Select("metric1", nil, 0, 40001)
+	require.NoError(t, err)
+	assert.Len(t, points, 5)
+
+	fsys.prefix = ""
+	flushed, err = s.Flush()
+	require.NoError(t, err)
+	require.Len(t, flushed, 1)
+	assert.Equal(t, filepath.Join(dataPath, "p-10000-10000"), flushed[0].DirPath)
+	// Along with its own segment, the one of the newer persisted partition is removed.
+	segments, err = WALSegments(dataPath)
+	require.NoError(t, err)
+	assert.Len(t, segments, 2)
+}
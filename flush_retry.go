@@ -0,0 +1,40 @@
+package tstorage
+
+import (
+	"errors"
+	"syscall"
+	"time"
+)
+
+// WithFlushRetry makes persisting a partition retried when it fails with a transient disk error,
+// such as EINTR, EAGAIN or ENOSPC which may go away once other files get removed.
+// It's tried up to the given number of attempts in total, waiting for backoff in between,
+// which gets doubled every retry. Other errors fail the flush at once.
+// A partition failed to be persisted stays in memory until the next flush anyway.
+//
+// Defaults to 0, which is regarded as 1 attempt and never retries.
+func WithFlushRetry(attempts int, backoff time.Duration) Option {
+	return func(s *storage) {
+		s.flushRetryAttempts = attempts
+		s.flushRetryBackoff = backoff
+	}
+}
+
+// isTransientDiskError reports whether the given error may not happen if retried.
+func isTransientDiskError(err error) bool {
+	return errors.Is(err, syscall.EINTR) || errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.ENOSPC)
+}
+
+// retryFlush calls fn until it succeeds, fails with a permanent error, or runs out of attempts.
+func (s *storage) retryFlush(fn func() error) error {
+	backoff := s.flushRetryBackoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= s.flushRetryAttempts || !isTransientDiskError(err) {
+			return err
+		}
+		s.logger.Printf("retrying flush in %v: %v\n", backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
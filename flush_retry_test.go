@@ -0,0 +1,153 @@
+package tstorage
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// flakyFileSystem fails to create data files of partitions with err as many times as failures.
+// If failWrite, it fails to write them partway through instead.
+type flakyFileSystem struct {
+	FileSystem
+	failures  int
+	err       error
+	failWrite bool
+	calls     int
+}
+
+func (f *flakyFileSystem) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	if filepath.Base(name) == dataFileName && flag&os.O_CREATE != 0 {
+		f.calls++
+		if f.calls <= f.failures {
+			if !f.failWrite {
+				return nil, &os.PathError{Op: "open", Path: name, Err: f.err}
+			}
+			file, err := f.FileSystem.OpenFile(name, flag, perm)
+			if err != nil {
+				return nil, err
+			}
+			return &flakyFile{File: file, err: f.err}, nil
+		}
+	}
+	return f.FileSystem.OpenFile(name, flag, perm)
+}
+
+// flakyFile fails only the second write with err, as if the disk got full for a moment.
+type flakyFile struct {
+	File
+	err    error
+	writes int
+}
+
+func (f *flakyFile) Write(p []byte) (int, error) {
+	f.writes++
+	if f.writes == 2 {
+		return 0, &os.PathError{Op: "write", Err: f.err}
+	}
+	return f.File.Write(p)
+}
+
+func Test_storage_withFlushRetry(t *testing.T) {
+	tests := []struct {
+		name      string
+		attempts  int
+		failures  int
+		err       error
+		failWrite bool
+		wantCalls int
+		wantErr   bool
+	}{
+		{
+			name:      "no retry by default",
+			failures:  1,
+			err:       syscall.ENOSPC,
+			wantCalls: 1,
+			wantErr:   true,
+		},
+		{
+			name:      "transient error recovered",
+			attempts:  3,
+			failures:  2,
+			err:       syscall.EINTR,
+			wantCalls: 3,
+		},
+		{
+			name:      "transient error lasting",
+			attempts:  3,
+			failures:  3,
+			err:       syscall.ENOSPC,
+			wantCalls: 3,
+			wantErr:   true,
+		},
+		{
+			name:      "transient error in the middle of the file recovered",
+			attempts:  3,
+			failures:  2,
+			err:       syscall.ENOSPC,
+			failWrite: true,
+			wantCalls: 3,
+		},
+		{
+			name:      "transient error in the middle of the file lasting",
+			attempts:  3,
+			failures:  3,
+			err:       syscall.ENOSPC,
+			failWrite: true,
+			wantCalls: 3,
+			wantErr:   true,
+		},
+		{
+			name:      "permanent error",
+			attempts:  3,
+			failures:  1,
+			err:       syscall.EACCES,
+			wantCalls: 1,
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dataPath := t.TempDir()
+			fsys := &flakyFileSystem{FileSystem: defaultFileSystem, failures: tt.failures, err: tt.err, failWrite: tt.failWrite}
+			// Flush in small writes to fail in the middle of the data file.
+			opts := []Option{WithDataPath(dataPath), WithFileSystem(fsys), WithFlushBufferSize(16)}
+			if tt.attempts > 0 {
+				opts = append(opts, WithFlushRetry(tt.attempts, time.Millisecond))
+			}
+			s, err := NewStorage(opts...)
+			require.NoError(t, err)
+			want := make([]*DataPoint, 0, 100)
+			for i := int64(1); i <= 100; i++ {
+				require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: i, Value: 0.1}}}))
+				want = append(want, &DataPoint{Timestamp: i, Value: 0.1})
+			}
+			err = s.Close()
+			if tt.wantErr {
+				assert.ErrorIs(t, err, tt.err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.wantCalls, fsys.calls)
+
+			// No data points are lost either way, since the WAL is kept unless persisted.
+			s, err = NewStorage(WithDataPath(dataPath))
+			require.NoError(t, err)
+			defer s.Close()
+			got, err := s.Select("metric1", nil, 0, 101)
+			require.NoError(t, err)
+			assert.Equal(t, want, got)
+		})
+	}
+}
+
+func Test_NewStorage_withInvalidFlushRetry(t *testing.T) {
+	_, err := NewStorage(WithFlushRetry(-1, time.Second))
+	assert.Error(t, err)
+}
@@ -0,0 +1,38 @@
+package tstorage
+
+import "fmt"
+
+// Gap is a range where data points are missing, such as missed scrapes. See Reader.SelectGaps
+type Gap struct {
+	// The timestamp of the data point right before the gap.
+	From int64
+	// The timestamp of the data point right after the gap.
+	To int64
+}
+
+func (s *storage) SelectGaps(metric string, labels []Label, start, end, expectedInterval int64) ([]Gap, error) {
+	if expectedInterval <= 0 {
+		return nil, fmt.Errorf("expected interval must be positive")
+	}
+	iterator, err := s.SelectIterator(metric, labels, start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer iterator.Close()
+
+	gaps := make([]Gap, 0)
+	var prev int64
+	first := true
+	for iterator.Next() {
+		ts := iterator.Value().Timestamp
+		// Compare the doubled ones, not to round 1.5 times the interval.
+		if !first && 2*(ts-prev) > 3*expectedInterval {
+			gaps = append(gaps, Gap{From: prev, To: ts})
+		}
+		prev, first = ts, false
+	}
+	if err := iterator.Err(); err != nil {
+		return nil, err
+	}
+	return gaps, nil
+}
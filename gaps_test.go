@@ -0,0 +1,74 @@
+package tstorage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_storage_SelectGaps(t *testing.T) {
+	s, err := NewStorage(WithTimestampPrecision(Seconds))
+	require.NoError(t, err)
+	defer s.Close()
+	// Scraped every 10 seconds, with missed scrapes between 30 and 60, and a late one at 96.
+	for _, ts := range []int64{10, 20, 30, 60, 70, 80, 96, 110} {
+		require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: ts}}}))
+	}
+
+	tests := []struct {
+		name             string
+		start            int64
+		end              int64
+		expectedInterval int64
+		want             []Gap
+		wantErr          bool
+	}{
+		{
+			name:             "gaps found",
+			start:            0,
+			end:              105,
+			expectedInterval: 10,
+			want:             []Gap{{From: 30, To: 60}, {From: 80, To: 96}},
+		},
+		{
+			name:             "tolerated up to 1.5 times the interval",
+			start:            0,
+			end:              105,
+			expectedInterval: 11,
+			want:             []Gap{{From: 30, To: 60}},
+		},
+		{
+			name:             "range after the gap",
+			start:            60,
+			end:              90,
+			expectedInterval: 10,
+			want:             []Gap{},
+		},
+		{
+			name:             "no data points",
+			start:            200,
+			end:              300,
+			expectedInterval: 10,
+			want:             []Gap{},
+		},
+		{
+			name:             "non-positive interval",
+			start:            0,
+			end:              105,
+			expectedInterval: 0,
+			wantErr:          true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := s.SelectGaps("metric1", nil, tt.start, tt.end, tt.expectedInterval)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
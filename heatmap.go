@@ -0,0 +1,65 @@
+package tstorage
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Heatmap is a two-dimensional grid counting data points by time and value. See Reader.Heatmap
+type Heatmap struct {
+	// Timestamps holds the inclusive start of each time bucket, in ascending order.
+	// A time bucket covers [Timestamps[i], Timestamps[i]+timeStep).
+	Timestamps []int64
+	// UpperBounds holds the inclusive upper bound of each value bucket, in ascending order.
+	// A value bucket covers (UpperBounds[j-1], UpperBounds[j]], where the first one has no lower bound.
+	UpperBounds []float64
+	// Counts holds the number of data points for each time bucket and value bucket, as Counts[i][j].
+	// Each row has one more element than UpperBounds for the overflow bucket,
+	// which counts data points greater than the last upper bound, as well as NaN.
+	Counts [][]int
+}
+
+func (s *storage) Heatmap(metric string, labels []Label, start, end, timeStep int64, valueBuckets []float64) (*Heatmap, error) {
+	if timeStep <= 0 {
+		return nil, fmt.Errorf("time step must be positive")
+	}
+	if len(valueBuckets) == 0 {
+		return nil, fmt.Errorf("value buckets must be given")
+	}
+	for i := 1; i < len(valueBuckets); i++ {
+		if valueBuckets[i-1] >= valueBuckets[i] {
+			return nil, fmt.Errorf("value buckets must be in strictly ascending order")
+		}
+	}
+	pointsList, _, err := s.selectPartitionPoints(metric, labels, start, end)
+	if err != nil && !errors.Is(err, ErrNoDataPoints) {
+		return nil, err
+	}
+
+	numTimeBuckets := (end - start + timeStep - 1) / timeStep
+	h := &Heatmap{
+		Timestamps:  make([]int64, numTimeBuckets),
+		UpperBounds: append([]float64(nil), valueBuckets...),
+		Counts:      make([][]int, numTimeBuckets),
+	}
+	for i := range h.Timestamps {
+		h.Timestamps[i] = start + int64(i)*timeStep
+		h.Counts[i] = make([]int, len(valueBuckets)+1)
+	}
+	for _, ps := range pointsList {
+		for _, p := range ps {
+			if p.Timestamp < start || p.Timestamp >= end {
+				continue
+			}
+			i := (p.Timestamp - start) / timeStep
+			// The first bucket whose upper bound is greater than or equal to the value.
+			// It gives back the overflow bucket for NaN since every comparison with it is false.
+			j := sort.Search(len(valueBuckets), func(j int) bool {
+				return p.Value <= valueBuckets[j]
+			})
+			h.Counts[i][j]++
+		}
+	}
+	return h, nil
+}
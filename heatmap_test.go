@@ -0,0 +1,91 @@
+package tstorage
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_storage_Heatmap(t *testing.T) {
+	s, err := NewStorage(WithTimestampPrecision(Seconds))
+	require.NoError(t, err)
+	defer s.Close()
+	err = s.InsertRows([]Row{
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1, Value: 0.5}},
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 2, Value: 1}},
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 3, Value: 1.5}},
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 6, Value: 3}},
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 7, Value: math.NaN()}},
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 10, Value: 0.1}},
+	})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name         string
+		metric       string
+		start        int64
+		end          int64
+		timeStep     int64
+		valueBuckets []float64
+		want         *Heatmap
+		wantErr      bool
+	}{
+		{
+			name:         "with overflow",
+			metric:       "metric1",
+			start:        0,
+			end:          10,
+			timeStep:     4,
+			valueBuckets: []float64{1, 2},
+			want: &Heatmap{
+				Timestamps:  []int64{0, 4, 8},
+				UpperBounds: []float64{1, 2},
+				Counts: [][]int{
+					{2, 1, 0},
+					{0, 0, 2},
+					{0, 0, 0},
+				},
+			},
+		},
+		{
+			name:         "no data points",
+			metric:       "unknown",
+			start:        0,
+			end:          4,
+			timeStep:     2,
+			valueBuckets: []float64{1},
+			want: &Heatmap{
+				Timestamps:  []int64{0, 2},
+				UpperBounds: []float64{1},
+				Counts:      [][]int{{0, 0}, {0, 0}},
+			},
+		},
+		{
+			name:         "non-positive time step",
+			metric:       "metric1",
+			start:        0,
+			end:          10,
+			timeStep:     0,
+			valueBuckets: []float64{1},
+			wantErr:      true,
+		},
+		{
+			name:         "unsorted value buckets",
+			metric:       "metric1",
+			start:        0,
+			end:          10,
+			timeStep:     1,
+			valueBuckets: []float64{2, 1},
+			wantErr:      true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := s.Heatmap(tt.metric, nil, tt.start, tt.end, tt.timeStep, tt.valueBuckets)
+			assert.Equal(t, tt.wantErr, err != nil)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package tstorage
+
+import (
+	"sort"
+	"sync"
+)
+
+// WithHotPartitions keeps the newest n partitions among flushed ones in memory in addition to the disk,
+// so that reads of recent data don't have to load their data files.
+// Reads prefer the memory copy of such a partition and skip its disk copy, thus data points are never given back twice.
+// The memory copies are released when the storage gets closed.
+//
+// Defaults to 0, which releases partitions from memory as soon as they get flushed.
+func WithHotPartitions(n int) Option {
+	return func(s *storage) {
+		s.hotPartitions.max = n
+	}
+}
+
+// hotPartitions holds the memory copies of partitions that have been flushed.
+type hotPartitions struct {
+	mu  sync.RWMutex
+	max int
+	// in order of the oldest to the newest by timestamp.
+	partitions []*memoryPartition
+}
+
+// add keeps the given flushed partition, and releases the oldest one if it holds more than max.
+// Partitions are flushed from the newest, so they are sorted instead of being just appended.
+func (h *hotPartitions) add(m *memoryPartition) {
+	if h.max <= 0 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.partitions = append(h.partitions, m)
+	sort.Slice(h.partitions, func(i, j int) bool {
+		return h.partitions[i].minTimestamp() < h.partitions[j].minTimestamp()
+	})
+	if len(h.partitions) > h.max {
+		// Zero out so that the released one can be garbage collected.
+		h.partitions[0] = nil
+		h.partitions = h.partitions[1:]
+	}
+}
+
+// lookup gives back the memory copy of the given disk partition if any.
+// They are matched by the range and the number of data points.
+func (h *hotPartitions) lookup(d *diskPartition) (*memoryPartition, bool) {
+	if h.max <= 0 {
+		return nil, false
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for _, m := range h.partitions {
+		if m.minTimestamp() == d.minTimestamp() && m.maxTimestamp() == d.maxTimestamp() && m.size() == d.size() {
+			return m, true
+		}
+	}
+	return nil, false
+}
+
+func (h *hotPartitions) reset() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.partitions = nil
+}
+
+// readablePartition gives back the memory copy in place of the given partition if it's a hot one.
+func (s *storage) readablePartition(part partition) partition {
+	if d, ok := part.(*diskPartition); ok {
+		if m, ok := s.hotPartitions.lookup(d); ok {
+			return m
+		}
+	}
+	return part
+}
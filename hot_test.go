@@ -0,0 +1,47 @@
+package tstorage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_storage_Select_withHotPartitions(t *testing.T) {
+	tmpDir := t.TempDir()
+	s, err := NewStorage(
+		WithDataPath(tmpDir),
+		WithTimestampPrecision(Seconds),
+		WithPartitionDuration(time.Hour),
+		WithHotPartitions(1),
+	)
+	require.NoError(t, err)
+	defer s.Close()
+	timestamps := []int64{1, 5000, 10000, 15000, 20000, 25000, 30000}
+	for _, ts := range timestamps {
+		require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: ts, Value: float64(ts)}}}))
+	}
+	require.NoError(t, s.FlushAsync().Wait())
+
+	var disk []PartitionInfo
+	for _, p := range s.ListPartitions() {
+		if p.DirPath != "" {
+			disk = append(disk, p)
+		}
+	}
+	require.Len(t, disk, 2)
+	// Only the newest flushed one is kept in memory.
+	require.Len(t, s.(*storage).hotPartitions.partitions, 1)
+	assert.Equal(t, disk[0].MinTimestamp, s.(*storage).hotPartitions.partitions[0].minTimestamp())
+
+	points, err := s.Select("metric1", nil, 1, 30001)
+	require.NoError(t, err)
+	got := make([]int64, 0, len(points))
+	for _, p := range points {
+		got = append(got, p.Timestamp)
+	}
+	assert.Equal(t, timestamps, got)
+	// The hot one is read from memory, whereas the other one has to be loaded.
+	assert.Equal(t, int64(1), s.Stats().PartitionCacheMisses)
+}
@@ -1,5 +1,15 @@
 package syscall
 
+import "errors"
+
+// ErrNotSupported is returned by Mmap on platforms where memory-mapping isn't available.
+var ErrNotSupported = errors.New("mmap is not supported on this platform")
+
 func Mmap(fd, length int) ([]byte, error) {
 	return mmap(fd, length)
 }
+
+// Munmap releases the memory mapped by Mmap.
+func Munmap(b []byte) error {
+	return munmap(b)
+}
@@ -0,0 +1,12 @@
+//go:build plan9
+// +build plan9
+
+package syscall
+
+func mmap(_, _ int) ([]byte, error) {
+	return nil, ErrNotSupported
+}
+
+func munmap(_ []byte) error {
+	return ErrNotSupported
+}
@@ -0,0 +1,131 @@
+package tstorage
+
+import (
+	"errors"
+	"fmt"
+)
+
+// PointIterator streams data points selected by SelectIterator in ascending order,
+// reading partitions one at a time. The basic usage is:
+//
+//	it, err := storage.SelectIterator("metric1", nil, start, end)
+//	if err != nil {
+//		return err
+//	}
+//	defer it.Close()
+//	for it.Next() {
+//		p := it.Value()
+//	}
+//	if err := it.Err(); err != nil {
+//		return err
+//	}
+//
+// Disk partitions yet to be read are pinned so that retention doesn't remove them under the iterator.
+// Close must be called to release them, even if the iteration is abandoned in the middle.
+// It isn't goroutine safe.
+type PointIterator struct {
+	metric string
+	labels []Label
+	start  int64
+	end    int64
+	// partitions yet to be read, in order of the oldest to the newest.
+	parts  []partition
+	points []*DataPoint
+	cur    *DataPoint
+	err    error
+	closed bool
+}
+
+func (s *storage) SelectIterator(metric string, labels []Label, start, end int64) (*PointIterator, error) {
+	metric = s.normalizeMetricName(metric)
+	if metric == "" {
+		return nil, fmt.Errorf("metric must be set")
+	}
+	if start >= end {
+		return nil, fmt.Errorf("the given start is greater than end")
+	}
+	overlapping, err := s.overlappingPartitions(start, end)
+	if err != nil {
+		return nil, err
+	}
+	parts := make([]partition, 0, len(overlapping))
+	// overlappingPartitions gives back from the newest one.
+	for i := len(overlapping) - 1; i >= 0; i-- {
+		if d, ok := overlapping[i].(*diskPartition); ok && !d.pin() {
+			// Already removed by retention.
+			continue
+		}
+		parts = append(parts, overlapping[i])
+	}
+	return &PointIterator{metric: metric, labels: labels, start: start, end: end, parts: parts}, nil
+}
+
+// Next advances the iterator to the next data point. It gives back false once all data points are read,
+// an error occurs, or the iterator gets closed.
+func (it *PointIterator) Next() bool {
+	for !it.closed && it.err == nil {
+		if len(it.points) > 0 {
+			it.cur, it.points = it.points[0], it.points[1:]
+			return true
+		}
+		if len(it.parts) == 0 {
+			return false
+		}
+		part := it.parts[0]
+		it.parts = it.parts[1:]
+		points, err := part.selectDataPoints(it.metric, it.labels, it.start, it.end)
+		// Nothing will be read from it anymore.
+		if unpinErr := unpinPartition(part); unpinErr != nil && err == nil {
+			err = unpinErr
+		}
+		if err != nil && !errors.Is(err, ErrNoDataPoints) {
+			it.err = fmt.Errorf("failed to select data points: %w", err)
+			return false
+		}
+		it.points = points
+	}
+	return false
+}
+
+// Value gives back the data point the iterator currently points to.
+func (it *PointIterator) Value() *DataPoint {
+	return it.cur
+}
+
+// Err gives back the error occurred while iterating, if any.
+func (it *PointIterator) Err() error {
+	return it.err
+}
+
+// Close releases the partitions yet to be read. It is safe to call it more than once.
+func (it *PointIterator) Close() error {
+	if it.closed {
+		return nil
+	}
+	it.closed = true
+	var err error
+	for _, part := range it.parts {
+		if e := unpinPartition(part); e != nil && err == nil {
+			err = e
+		}
+	}
+	it.parts, it.points, it.cur = nil, nil, nil
+	return err
+}
+
+// unpinPartition releases the given partition if it's a disk partition.
+// pinPartition keeps the given partition from being removed by retention until unpinPartition gets called.
+// It gives back false if it has been already removed.
+func pinPartition(part partition) bool {
+	if d, ok := part.(*diskPartition); ok {
+		return d.pin()
+	}
+	return true
+}
+
+func unpinPartition(part partition) error {
+	if d, ok := part.(*diskPartition); ok {
+		return d.unpin()
+	}
+	return nil
+}
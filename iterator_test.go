@@ -0,0 +1,78 @@
+package tstorage
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_storage_SelectIterator(t *testing.T) {
+	tmpDir := t.TempDir()
+	opts := []Option{WithDataPath(tmpDir), WithTimestampPrecision(Seconds), WithPartitionDuration(time.Hour)}
+	s, err := NewStorage(opts...)
+	require.NoError(t, err)
+	for _, ts := range []int64{1, 5000, 10000, 15000} {
+		require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: ts, Value: float64(ts)}}}))
+	}
+	require.NoError(t, s.Close())
+	s, err = NewStorage(opts...)
+	require.NoError(t, err)
+	defer s.Close()
+	require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 20000, Value: 20000}}}))
+
+	it, err := s.SelectIterator("metric1", nil, 1, 20001)
+	require.NoError(t, err)
+	var got []int64
+	for it.Next() {
+		got = append(got, it.Value().Timestamp)
+	}
+	require.NoError(t, it.Err())
+	require.NoError(t, it.Close())
+	assert.Equal(t, []int64{1, 5000, 10000, 15000, 20000}, got)
+}
+
+func TestPointIterator_Close(t *testing.T) {
+	tmpDir := t.TempDir()
+	opts := []Option{WithDataPath(tmpDir), WithTimestampPrecision(Seconds), WithPartitionDuration(time.Hour)}
+	s, err := NewStorage(opts...)
+	require.NoError(t, err)
+	for _, ts := range []int64{1, 5000, 10000, 15000} {
+		require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: ts, Value: float64(ts)}}}))
+	}
+	require.NoError(t, s.Close())
+	s, err = NewStorage(opts...)
+	require.NoError(t, err)
+	defer s.Close()
+
+	var parts []*diskPartition
+	iterator := s.(*storage).partitionList.newIterator()
+	for iterator.next() {
+		if d, ok := iterator.value().(*diskPartition); ok {
+			parts = append(parts, d)
+		}
+	}
+	require.Len(t, parts, 2)
+
+	it, err := s.SelectIterator("metric1", nil, 1, 20000)
+	require.NoError(t, err)
+	// Abandon it after reading the first data point.
+	require.True(t, it.Next())
+
+	// Retention takes place meanwhile, yet the partition yet to be read must stay.
+	// parts are in order of the newest to the oldest.
+	for _, p := range parts {
+		require.NoError(t, s.(*storage).partitionList.remove(p))
+	}
+	_, err = os.Stat(parts[1].dirPath)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	_, err = os.Stat(parts[0].dirPath)
+	assert.NoError(t, err)
+
+	require.NoError(t, it.Close())
+	assert.False(t, it.Next())
+	_, err = os.Stat(parts[0].dirPath)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
@@ -2,6 +2,7 @@ package tstorage
 
 import (
 	"sort"
+	"unsafe"
 
 	"github.com/nakabonne/tstorage/internal/encoding"
 )
@@ -30,37 +31,49 @@ func marshalMetricName(metric string, labels []Label) string {
 	if len(labels) == 0 {
 		return metric
 	}
+	return string(appendMetricName(nil, metric, labels))
+}
+
+// appendMetricName appends the name built by marshalMetricName to dst, which lets the caller reuse the buffer.
+// Labels are encoded in order by name, so that the same set of labels in any order gives the same name.
+// labels must not be empty, and are never modified.
+//
+// Labels sharing a name are left in the order sort.Slice puts them, which may depend on the given order.
+// It is kept as is on purpose, since names of series already persisted and SeriesHash must not change.
+func appendMetricName(dst []byte, metric string, labels []Label) []byte {
 	invalid := func(name, value string) bool {
 		return name == "" || value == ""
 	}
+	if !sortedByUniqueName(labels) {
+		// Sort a copy not to reorder the caller's labels.
+		labels = append(make([]Label, 0, len(labels)), labels...)
+		sort.Slice(labels, func(i, j int) bool {
+			return labels[i].Name < labels[j].Name
+		})
+	}
 
 	// Determine the bytes size in advance.
 	size := len(metric) + 2
-	sort.Slice(labels, func(i, j int) bool {
-		return labels[i].Name < labels[j].Name
-	})
 	for i := range labels {
-		label := &labels[i]
+		label := truncateLabel(labels[i])
 		if invalid(label.Name, label.Value) {
 			continue
 		}
-		if len(label.Name) > maxLabelNameLen {
-			label.Name = label.Name[:maxLabelNameLen]
-		}
-		if len(label.Value) > maxLabelValueLen {
-			label.Value = label.Value[:maxLabelValueLen]
-		}
 		size += len(label.Name)
 		size += len(label.Value)
 		size += 4
 	}
 
 	// Start building the bytes.
-	out := make([]byte, 0, size)
+	out := dst
+	if cap(out)-len(out) < size {
+		out = make([]byte, len(dst), len(dst)+size)
+		copy(out, dst)
+	}
 	out = encoding.MarshalUint16(out, uint16(len(metric)))
 	out = append(out, metric...)
 	for i := range labels {
-		label := &labels[i]
+		label := truncateLabel(labels[i])
 		if invalid(label.Name, label.Value) {
 			continue
 		}
@@ -69,5 +82,62 @@ func marshalMetricName(metric string, labels []Label) string {
 		out = encoding.MarshalUint16(out, uint16(len(label.Value)))
 		out = append(out, label.Value...)
 	}
-	return string(out)
+	return out
+}
+
+// sortedByUniqueName reports whether the given labels are sorted by name without any names shared,
+// in which case sorting them by name leaves them as they are.
+func sortedByUniqueName(labels []Label) bool {
+	for i := 1; i < len(labels); i++ {
+		if labels[i-1].Name >= labels[i].Name {
+			return false
+		}
+	}
+	return true
+}
+
+// truncateLabel gives back the label whose name and value are cut down to the maximum lengths.
+func truncateLabel(label Label) Label {
+	if len(label.Name) > maxLabelNameLen {
+		label.Name = label.Name[:maxLabelNameLen]
+	}
+	if len(label.Value) > maxLabelValueLen {
+		label.Value = label.Value[:maxLabelValueLen]
+	}
+	return label
+}
+
+// bytesToString converts b to a string without copying. b must not be modified while the string is in use.
+func bytesToString(b []byte) string {
+	return unsafe.String(unsafe.SliceData(b), len(b))
+}
+
+// unmarshalMetricName parses the name built by marshalMetricName.
+// ok is false if the name isn't encoded along with labels, where the name is the metric itself.
+func unmarshalMetricName(name string) (metric string, labels []Label, ok bool) {
+	src := name
+	next := func() (string, bool) {
+		if len(src) < 2 {
+			return "", false
+		}
+		n := int(encoding.UnmarshalUint16([]byte(src[:2])))
+		if len(src) < 2+n {
+			return "", false
+		}
+		s := src[2 : 2+n]
+		src = src[2+n:]
+		return s, true
+	}
+	if metric, ok = next(); !ok {
+		return name, nil, false
+	}
+	for len(src) > 0 {
+		labelName, ok1 := next()
+		labelValue, ok2 := next()
+		if !ok1 || !ok2 {
+			return name, nil, false
+		}
+		labels = append(labels, Label{Name: labelName, Value: labelValue})
+	}
+	return metric, labels, true
 }
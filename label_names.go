@@ -0,0 +1,29 @@
+package tstorage
+
+import "sort"
+
+func (s *storage) LabelNames() ([]string, error) {
+	seen := make(map[string]struct{})
+	iterator := s.partitionList.newIterator()
+	for iterator.next() {
+		names, err := seriesNames(iterator.value())
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			_, labels, ok := unmarshalMetricName(name)
+			if !ok {
+				continue
+			}
+			for _, l := range labels {
+				seen[l.Name] = struct{}{}
+			}
+		}
+	}
+	labelNames := make([]string, 0, len(seen))
+	for name := range seen {
+		labelNames = append(labelNames, name)
+	}
+	sort.Strings(labelNames)
+	return labelNames, nil
+}
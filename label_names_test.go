@@ -0,0 +1,45 @@
+package tstorage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_storage_LabelNames(t *testing.T) {
+	dataPath := t.TempDir()
+	s, err := NewStorage(WithDataPath(dataPath), WithPartitionDuration(time.Hour), WithTimestampPrecision(Seconds))
+	require.NoError(t, err)
+	require.NoError(t, s.InsertRows([]Row{
+		{Metric: "metric1", Labels: []Label{{Name: "host", Value: "a"}}, DataPoint: DataPoint{Timestamp: 1, Value: 0.1}},
+		{Metric: "metric2", Labels: []Label{{Name: "region", Value: "us"}, {Name: "host", Value: "b"}}, DataPoint: DataPoint{Timestamp: 2, Value: 0.2}},
+	}))
+	require.NoError(t, s.Close())
+
+	// Reopen to have the above ones in a disk partition.
+	s, err = NewStorage(WithDataPath(dataPath), WithPartitionDuration(time.Hour), WithTimestampPrecision(Seconds),
+		WithRetention(100*365*24*time.Hour))
+	require.NoError(t, err)
+	defer s.Close()
+	require.NoError(t, s.InsertRows([]Row{
+		{Metric: "metric1", Labels: []Label{{Name: "zone", Value: "x"}, {Name: "host", Value: "a"}}, DataPoint: DataPoint{Timestamp: 10000, Value: 0.3}},
+		{Metric: "metric3", DataPoint: DataPoint{Timestamp: 10000, Value: 0.4}},
+	}))
+
+	got, err := s.LabelNames()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"host", "region", "zone"}, got)
+}
+
+func Test_storage_LabelNames_empty(t *testing.T) {
+	s, err := NewStorage()
+	require.NoError(t, err)
+	defer s.Close()
+	require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1, Value: 0.1}}}))
+
+	got, err := s.LabelNames()
+	require.NoError(t, err)
+	assert.Empty(t, got)
+}
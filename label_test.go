@@ -52,3 +52,30 @@ func TestMarshalMetricName(t *testing.T) {
 		})
 	}
 }
+
+func TestMarshalMetricName_stable(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels [][]Label
+	}{
+		{
+			name: "different orders",
+			labels: [][]Label{
+				{{Name: "method", Value: "GET"}, {Name: "status", Value: "200"}, {Name: "host", Value: "a"}},
+				{{Name: "status", Value: "200"}, {Name: "host", Value: "a"}, {Name: "method", Value: "GET"}},
+				{{Name: "host", Value: "a"}, {Name: "method", Value: "GET"}, {Name: "status", Value: "200"}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := marshalMetricName("metric1", tt.labels[0])
+			for _, labels := range tt.labels {
+				given := append([]Label(nil), labels...)
+				assert.Equal(t, want, marshalMetricName("metric1", labels))
+				// Left in the given order.
+				assert.Equal(t, given, labels)
+			}
+		})
+	}
+}
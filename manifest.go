@@ -0,0 +1,91 @@
+package tstorage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// manifestFileName is the name of the file placed right under the data path,
+// which records the settings the data path was created with.
+const manifestFileName = "manifest.json"
+
+var (
+	// ErrPartitionDurationMismatch is returned by NewStorage if the data path was created with a partition duration
+	// other than the given one, since new partitions wouldn't align with existent ones.
+	ErrPartitionDurationMismatch = errors.New("partition duration mismatch")
+	// ErrTimestampPrecisionMismatch is returned by NewStorage if the data path was created with a timestamp precision
+	// other than the given one, since timestamps of existent data points would be misinterpreted.
+	ErrTimestampPrecisionMismatch = errors.New("timestamp precision mismatch")
+	// ErrUnsupportedFormatVersion is returned by NewStorage if the data path was written in a format version
+	// newer than CurrentFormatVersion.
+	ErrUnsupportedFormatVersion = errors.New("unsupported format version")
+)
+
+// Manifest is the store-level metadata placed at the data path, which records the settings
+// the data path was created with. It is validated every time the storage gets opened.
+//
+// Codecs aren't recorded, since the codec is recorded per block and can be changed freely.
+type Manifest struct {
+	// FormatVersion is the format version of partitions persisted under the data path.
+	FormatVersion      int                `json:"formatVersion"`
+	PartitionDuration  time.Duration      `json:"partitionDuration"`
+	TimestampPrecision TimestampPrecision `json:"timestampPrecision"`
+}
+
+// ReadManifest reads the manifest of the given data path, without opening any partitions.
+// It gives back an error wrapping os.ErrNotExist if the data path has no manifest.
+func ReadManifest(dataPath string) (*Manifest, error) {
+	return readManifest(defaultFileSystem, dataPath)
+}
+
+func readManifest(fsys FileSystem, dataPath string) (*Manifest, error) {
+	f, err := fsys.OpenFile(filepath.Join(dataPath, manifestFileName), os.O_RDONLY, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	defer f.Close()
+	m := &Manifest{}
+	if err := json.NewDecoder(f).Decode(m); err != nil {
+		return nil, fmt.Errorf("failed to decode manifest: %w", err)
+	}
+	return m, nil
+}
+
+// checkManifest makes sure the data path is consistent with the options, and then brings the manifest up to date.
+// The manifest gets written if the data path doesn't have one yet, including one created before the manifest
+// was introduced. Settings missing from the manifest are regarded as consistent.
+func (s *storage) checkManifest() error {
+	want := Manifest{
+		FormatVersion:      CurrentFormatVersion,
+		PartitionDuration:  s.partitionDuration,
+		TimestampPrecision: s.timestampPrecision,
+	}
+	m, err := readManifest(s.fsys, s.dataPath)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return err
+	case m.FormatVersion > CurrentFormatVersion:
+		return fmt.Errorf("%w: %s was written in %d, but the latest one is %d", ErrUnsupportedFormatVersion, s.dataPath, m.FormatVersion, CurrentFormatVersion)
+	case m.PartitionDuration != 0 && m.PartitionDuration != want.PartitionDuration:
+		return fmt.Errorf("%w: %s was created with %s, but %s given", ErrPartitionDurationMismatch, s.dataPath, m.PartitionDuration, want.PartitionDuration)
+	case m.TimestampPrecision != "" && m.TimestampPrecision != want.TimestampPrecision:
+		return fmt.Errorf("%w: %s was created with %q, but %q given", ErrTimestampPrecisionMismatch, s.dataPath, m.TimestampPrecision, want.TimestampPrecision)
+	case *m == want:
+		return nil
+	}
+
+	b, err := json.Marshal(&want)
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %w", err)
+	}
+	path := filepath.Join(s.dataPath, manifestFileName)
+	if err := writeFileAtomic(s.fsys, path, b, s.filePerm); err != nil {
+		return fmt.Errorf("failed to write manifest to %s: %w", path, err)
+	}
+	return nil
+}
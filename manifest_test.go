@@ -0,0 +1,128 @@
+package tstorage
+
+import (
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewStorage_manifest(t *testing.T) {
+	tests := []struct {
+		name      string
+		precision TimestampPrecision
+		duration  time.Duration
+		wantErr   error
+	}{
+		{
+			name:      "consistent",
+			precision: Seconds,
+			duration:  time.Hour,
+		},
+		{
+			name:      "different partition duration",
+			precision: Seconds,
+			duration:  2 * time.Hour,
+			wantErr:   ErrPartitionDurationMismatch,
+		},
+		{
+			name:      "different timestamp precision",
+			precision: Milliseconds,
+			duration:  time.Hour,
+			wantErr:   ErrTimestampPrecisionMismatch,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			s, err := NewStorage(WithDataPath(tmpDir), WithTimestampPrecision(Seconds), WithPartitionDuration(time.Hour))
+			require.NoError(t, err)
+			require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1, Value: 0.1}}}))
+			require.NoError(t, s.Close())
+
+			m, err := ReadManifest(tmpDir)
+			require.NoError(t, err)
+			assert.Equal(t, &Manifest{
+				FormatVersion:      CurrentFormatVersion,
+				PartitionDuration:  time.Hour,
+				TimestampPrecision: Seconds,
+			}, m)
+
+			s, err = NewStorage(WithDataPath(tmpDir), WithTimestampPrecision(tt.precision), WithPartitionDuration(tt.duration))
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			defer s.Close()
+			points, err := s.Select("metric1", nil, 1, 2)
+			require.NoError(t, err)
+			assert.Equal(t, []*DataPoint{{Timestamp: 1, Value: 0.1}}, points)
+		})
+	}
+}
+
+func TestNewStorage_unsupportedFormatVersion(t *testing.T) {
+	tmpDir := t.TempDir()
+	b, err := json.Marshal(&Manifest{FormatVersion: CurrentFormatVersion + 1})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(tmpDir, manifestFileName), b, defaultFilePerm))
+
+	_, err = NewStorage(WithDataPath(tmpDir))
+	assert.ErrorIs(t, err, ErrUnsupportedFormatVersion)
+}
+
+func TestNewStorage_withoutManifest(t *testing.T) {
+	// Data paths created before the manifest was introduced get one on open.
+	tmpDir := t.TempDir()
+	s, err := NewStorage(WithDataPath(tmpDir), WithPartitionDuration(time.Hour))
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+	require.NoError(t, os.Remove(filepath.Join(tmpDir, manifestFileName)))
+	_, err = ReadManifest(tmpDir)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	s, err = NewStorage(WithDataPath(tmpDir), WithPartitionDuration(2*time.Hour))
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+	_, err = NewStorage(WithDataPath(tmpDir), WithPartitionDuration(time.Hour))
+	assert.ErrorIs(t, err, ErrPartitionDurationMismatch)
+}
+
+// partialWriteFileSystem fails writes into the given file after writing a few bytes.
+type partialWriteFileSystem struct {
+	osFileSystem
+	name string
+}
+
+func (p partialWriteFileSystem) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	f, err := p.osFileSystem.OpenFile(name, flag, perm)
+	if err != nil || name != p.name {
+		return f, err
+	}
+	return &failingWriteFile{File: f, fails: true, partial: 4}, nil
+}
+
+func Test_writeFileAtomic(t *testing.T) {
+	path := filepath.Join(t.TempDir(), manifestFileName)
+	require.NoError(t, writeFileAtomic(defaultFileSystem, path, []byte(`{"formatVersion":1}`), defaultFilePerm))
+
+	// The manifest written before remains as is if writing fails midway.
+	fsys := partialWriteFileSystem{name: path + ".tmp"}
+	assert.Error(t, writeFileAtomic(fsys, path, []byte(`{"formatVersion":2}`), defaultFilePerm))
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, `{"formatVersion":1}`, string(b))
+	_, err = os.Stat(path + ".tmp")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	require.NoError(t, writeFileAtomic(defaultFileSystem, path, []byte(`{"formatVersion":2}`), defaultFilePerm))
+	b, err = os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, `{"formatVersion":2}`, string(b))
+}
@@ -0,0 +1,172 @@
+package tstorage
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// AggFunc specifies how to aggregate data points falling into the same time bucket.
+type AggFunc string
+
+const (
+	// AggAvg gives back the arithmetic mean of the values.
+	AggAvg AggFunc = "avg"
+	// AggSum gives back the sum of the values.
+	AggSum AggFunc = "sum"
+	// AggMin gives back the minimum value.
+	AggMin AggFunc = "min"
+	// AggMax gives back the maximum value.
+	AggMax AggFunc = "max"
+	// AggCount gives back the number of data points.
+	AggCount AggFunc = "count"
+	// AggLast gives back the value of the latest data point.
+	AggLast AggFunc = "last"
+)
+
+func (f AggFunc) valid() bool {
+	switch f {
+	case AggAvg, AggSum, AggMin, AggMax, AggCount, AggLast:
+		return true
+	}
+	return false
+}
+
+func (s *storage) SelectMatrix(metrics []string, labels []Label, start, end, step int64, fn AggFunc) ([]int64, map[string][]float64, error) {
+	if step <= 0 {
+		return nil, nil, fmt.Errorf("time step must be positive")
+	}
+	if start >= end {
+		return nil, nil, fmt.Errorf("start must be less than end")
+	}
+	if !fn.valid() {
+		return nil, nil, fmt.Errorf("unknown aggregate function %q", fn)
+	}
+
+	numBuckets := (end - start + step - 1) / step
+	timestamps := make([]int64, numBuckets)
+	for i := range timestamps {
+		timestamps[i] = start + int64(i)*step
+	}
+	rows := make(map[string][]float64, len(metrics))
+	for _, metric := range metrics {
+		pointsList, _, err := s.selectPartitionPoints(metric, labels, start, end)
+		if err != nil && !errors.Is(err, ErrNoDataPoints) {
+			return nil, nil, fmt.Errorf("failed to select data points of %q: %w", metric, err)
+		}
+		rows[metric] = downsample(pointsList, start, end, step, fn)
+	}
+	return timestamps, rows, nil
+}
+
+// downsample aggregates the given data points into time buckets of step starting from start.
+// pointsList is expected to be in order of the oldest to the newest partition, as selectPartitionPoints gives back.
+// The bucket without any data points is NaN.
+func downsample(pointsList [][]*DataPoint, start, end, step int64, fn AggFunc) []float64 {
+	numBuckets := (end - start + step - 1) / step
+	values := make([]float64, numBuckets)
+	counts := make([]int, numBuckets)
+	lastTimestamps := make([]int64, numBuckets)
+	for _, ps := range pointsList {
+		for _, p := range ps {
+			if p.Timestamp < start || p.Timestamp >= end {
+				continue
+			}
+			i := (p.Timestamp - start) / step
+			counts[i]++
+			if counts[i] == 1 {
+				values[i] = p.Value
+				lastTimestamps[i] = p.Timestamp
+				continue
+			}
+			switch fn {
+			case AggAvg, AggSum:
+				values[i] += p.Value
+			case AggMin:
+				values[i] = math.Min(values[i], p.Value)
+			case AggMax:
+				values[i] = math.Max(values[i], p.Value)
+			case AggLast:
+				// Partitions may overlap, so that the latest data point may not be the last one given.
+				if p.Timestamp >= lastTimestamps[i] {
+					values[i] = p.Value
+					lastTimestamps[i] = p.Timestamp
+				}
+			}
+		}
+	}
+	for i := range values {
+		switch {
+		case counts[i] == 0:
+			values[i] = math.NaN()
+		case fn == AggAvg:
+			values[i] /= float64(counts[i])
+		case fn == AggCount:
+			values[i] = float64(counts[i])
+		}
+	}
+	return values
+}
+
+func (s *storage) SelectAligned(metric string, labels []Label, start, end, step int64, fn AggFunc) ([]*DataPoint, error) {
+	if step <= 0 {
+		return nil, fmt.Errorf("time step must be positive")
+	}
+	if start >= end {
+		return nil, fmt.Errorf("start must be less than end")
+	}
+	if !fn.valid() {
+		return nil, fmt.Errorf("unknown aggregate function %q", fn)
+	}
+
+	pointsList, _, err := s.selectPartitionPoints(metric, labels, start, end)
+	if err != nil {
+		return nil, err
+	}
+	// Round down toward negative infinity, so that negative timestamps are aligned as well.
+	alignedStart := start - start%step
+	if start%step < 0 {
+		alignedStart -= step
+	}
+	values := downsample(pointsList, alignedStart, end, step, fn)
+	points := make([]*DataPoint, 0, len(values))
+	for i, v := range values {
+		if math.IsNaN(v) {
+			continue
+		}
+		points = append(points, &DataPoint{Timestamp: alignedStart + int64(i)*step, Value: v})
+	}
+	if len(points) == 0 {
+		return nil, ErrNoDataPoints
+	}
+	return points, nil
+}
+
+func (s *storage) SelectBuckets(metric string, labels []Label, start, end, bucketSize int64, fn AggFunc) (map[int64]float64, error) {
+	if bucketSize <= 0 {
+		return nil, fmt.Errorf("bucket size must be positive")
+	}
+	if start >= end {
+		return nil, fmt.Errorf("start must be less than end")
+	}
+	if !fn.valid() {
+		return nil, fmt.Errorf("unknown aggregate function %q", fn)
+	}
+
+	pointsList, _, err := s.selectPartitionPoints(metric, labels, start, end)
+	if err != nil {
+		return nil, err
+	}
+	values := downsample(pointsList, start, end, bucketSize, fn)
+	buckets := make(map[int64]float64)
+	for i, v := range values {
+		if math.IsNaN(v) {
+			continue
+		}
+		buckets[start+int64(i)*bucketSize] = v
+	}
+	if len(buckets) == 0 {
+		return nil, ErrNoDataPoints
+	}
+	return buckets, nil
+}
@@ -0,0 +1,252 @@
+package tstorage
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_storage_SelectMatrix(t *testing.T) {
+	s, err := NewStorage(WithTimestampPrecision(Seconds))
+	require.NoError(t, err)
+	defer s.Close()
+	// metric1 is sampled every second, whereas metric2 is every three seconds with a gap.
+	for ts := int64(1); ts < 10; ts++ {
+		rows := []Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: ts, Value: float64(ts)}}}
+		if ts == 1 || ts == 4 {
+			rows = append(rows, Row{Metric: "metric2", DataPoint: DataPoint{Timestamp: ts, Value: float64(ts * 10)}})
+		}
+		require.NoError(t, s.InsertRows(rows))
+	}
+
+	nan := math.NaN()
+	tests := []struct {
+		name           string
+		step           int64
+		fn             AggFunc
+		wantTimestamps []int64
+		wantRows       map[string][]float64
+		wantErr        bool
+	}{
+		{
+			name:           "avg",
+			step:           3,
+			fn:             AggAvg,
+			wantTimestamps: []int64{1, 4, 7},
+			wantRows: map[string][]float64{
+				"metric1": {2, 5, 8},
+				"metric2": {10, 40, nan},
+				"unknown": {nan, nan, nan},
+			},
+		},
+		{
+			name:           "last with the partial bucket",
+			step:           4,
+			fn:             AggLast,
+			wantTimestamps: []int64{1, 5, 9},
+			wantRows: map[string][]float64{
+				"metric1": {4, 8, 9},
+				"metric2": {40, nan, nan},
+				"unknown": {nan, nan, nan},
+			},
+		},
+		{
+			name:           "count",
+			step:           5,
+			fn:             AggCount,
+			wantTimestamps: []int64{1, 6},
+			wantRows: map[string][]float64{
+				"metric1": {5, 4},
+				"metric2": {2, nan},
+				"unknown": {nan, nan},
+			},
+		},
+		{
+			name:    "unknown aggregate function",
+			step:    3,
+			fn:      "unknown",
+			wantErr: true,
+		},
+		{
+			name:    "non-positive step",
+			step:    0,
+			fn:      AggAvg,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			timestamps, rows, err := s.SelectMatrix([]string{"metric1", "metric2", "unknown"}, nil, 1, 10, tt.step, tt.fn)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantTimestamps, timestamps)
+			require.Len(t, rows, len(tt.wantRows))
+			for metric, want := range tt.wantRows {
+				require.Len(t, rows[metric], len(want), metric)
+				for i := range want {
+					if math.IsNaN(want[i]) {
+						assert.True(t, math.IsNaN(rows[metric][i]), "%s[%d]", metric, i)
+					} else {
+						assert.Equal(t, want[i], rows[metric][i], "%s[%d]", metric, i)
+					}
+				}
+			}
+		})
+	}
+}
+
+func Test_storage_SelectAligned(t *testing.T) {
+	s, err := NewStorage(WithTimestampPrecision(Seconds))
+	require.NoError(t, err)
+	defer s.Close()
+	// A gap between 5 and 9.
+	for _, ts := range []int64{2, 3, 4, 5, 9, 10, 11} {
+		require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: ts, Value: float64(ts)}}}))
+	}
+
+	tests := []struct {
+		name    string
+		start   int64
+		end     int64
+		step    int64
+		fn      AggFunc
+		want    []*DataPoint
+		wantErr error
+	}{
+		{
+			name:  "aligned to multiples of step",
+			start: 3,
+			end:   12,
+			step:  3,
+			fn:    AggSum,
+			want: []*DataPoint{
+				{Timestamp: 3, Value: 12},
+				{Timestamp: 9, Value: 30},
+			},
+		},
+		{
+			name:  "start in the middle of a bucket",
+			start: 5,
+			end:   11,
+			step:  4,
+			fn:    AggMax,
+			want: []*DataPoint{
+				{Timestamp: 4, Value: 5},
+				{Timestamp: 8, Value: 10},
+			},
+		},
+		{
+			name:    "no data points",
+			start:   100,
+			end:     200,
+			step:    10,
+			fn:      AggAvg,
+			wantErr: ErrNoDataPoints,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := s.SelectAligned("metric1", nil, tt.start, tt.end, tt.step, tt.fn)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_storage_SelectBuckets(t *testing.T) {
+	s, err := NewStorage(WithTimestampPrecision(Seconds))
+	require.NoError(t, err)
+	defer s.Close()
+	// A gap between 5 and 9.
+	for _, ts := range []int64{2, 3, 4, 5, 9, 10, 11} {
+		require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: ts, Value: float64(ts)}}}))
+	}
+
+	tests := []struct {
+		name    string
+		start   int64
+		end     int64
+		size    int64
+		fn      AggFunc
+		want    map[int64]float64
+		wantErr error
+	}{
+		{
+			name:  "avg",
+			start: 2,
+			end:   12,
+			size:  4,
+			fn:    AggAvg,
+			// The bucket from 6 holds nothing but 9.
+			want: map[int64]float64{2: 3.5, 6: 9, 10: 10.5},
+		},
+		{
+			name:  "sum with an empty bucket omitted",
+			start: 3,
+			end:   12,
+			size:  2,
+			fn:    AggSum,
+			want:  map[int64]float64{3: 7, 5: 5, 9: 19, 11: 11},
+		},
+		{
+			name:  "min",
+			start: 1,
+			end:   12,
+			size:  5,
+			fn:    AggMin,
+			want:  map[int64]float64{1: 2, 6: 9, 11: 11},
+		},
+		{
+			name:  "max",
+			start: 1,
+			end:   12,
+			size:  5,
+			fn:    AggMax,
+			want:  map[int64]float64{1: 5, 6: 10, 11: 11},
+		},
+		{
+			name:  "count",
+			start: 1,
+			end:   12,
+			size:  5,
+			fn:    AggCount,
+			want:  map[int64]float64{1: 4, 6: 2, 11: 1},
+		},
+		{
+			name:  "last with the end cutting off the last bucket",
+			start: 1,
+			end:   11,
+			size:  5,
+			fn:    AggLast,
+			want:  map[int64]float64{1: 5, 6: 10},
+		},
+		{
+			name:    "no data points",
+			start:   100,
+			end:     200,
+			size:    10,
+			fn:      AggAvg,
+			wantErr: ErrNoDataPoints,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := s.SelectBuckets("metric1", nil, tt.start, tt.end, tt.size, tt.fn)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package tstorage
+
+import (
+	"sync/atomic"
+	"unsafe"
+)
+
+// Estimated sizes of what memory partitions hold, which MemoryUsage is computed from.
+const (
+	// A data point and the pointer to it held by a series.
+	pointMemorySize = int64(unsafe.Sizeof(DataPoint{}) + unsafe.Sizeof(uintptr(0)))
+	// A series excluding its name, the entry of the map holding it, and the initial capacity of its points.
+	metricMemorySize = int64(unsafe.Sizeof(memoryMetric{})) + 64 + initialPointsCap*int64(unsafe.Sizeof(uintptr(0)))
+)
+
+// WithMemoryBudget specifies the number of bytes memory partitions may hold, as estimated by MemoryUsage.
+// The head partition is regarded as ready to be persisted once it takes its share of the budget,
+// which is a third since up to two writable partitions and one being persisted stay in memory.
+// It works in addition to the partition duration, like WithFlushTrigger.
+//
+// Defaults to 0, which means no budget.
+func WithMemoryBudget(bytes int64) Option {
+	return func(s *storage) {
+		s.memoryBudget = bytes
+	}
+}
+
+// withMemoryBudget makes the partition inactive once it estimates to hold the given bytes or more.
+func withMemoryBudget(bytes int64) memoryPartitionOption {
+	return func(m *memoryPartition) {
+		m.memoryBudget = bytes
+	}
+}
+
+func (s *storage) MemoryUsage() int64 {
+	var usage int64
+	iterator := s.partitionList.newIterator()
+	for iterator.next() {
+		if m, ok := iterator.value().(*memoryPartition); ok {
+			usage += m.memoryUsage()
+		}
+	}
+	s.hotPartitions.mu.RLock()
+	defer s.hotPartitions.mu.RUnlock()
+	for _, m := range s.hotPartitions.partitions {
+		usage += m.memoryUsage()
+	}
+	return usage
+}
+
+// memoryUsage gives back the estimated number of bytes the partition holds, computed from the number of
+// series and data points. It leaves out the slack capacity of slices, whose growth is amortized.
+func (m *memoryPartition) memoryUsage() int64 {
+	return atomic.LoadInt64(&m.numPoints)*pointMemorySize +
+		atomic.LoadInt64(&m.numMetrics)*metricMemorySize +
+		atomic.LoadInt64(&m.metricNameBytes)
+}
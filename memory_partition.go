@@ -13,12 +13,15 @@ import (
 type memoryPartition struct {
 	// The number of data points
 	numPoints int64
-	// minT is immutable.
+	// minT is immutable, except when an older partition gets merged into it.
 	minT int64
 	maxT int64
 
 	// A hash map from metric name to memoryMetric.
 	metrics sync.Map
+	// The number of metrics and the total length of their names, which estimate the memory usage.
+	numMetrics      int64
+	metricNameBytes int64
 
 	// Write ahead log.
 	wal wal
@@ -26,30 +29,87 @@ type memoryPartition struct {
 	partitionDuration  int64
 	timestampPrecision TimestampPrecision
 	once               sync.Once
+
+	// The wall-clock time when the partition was created. It is immutable.
+	createdAt time.Time
+	// The wall-clock time in Unix nanoseconds when rows were most recently written.
+	lastWriteAt int64
+
+	outOfOrderPolicy OutOfOrderPolicy
+	// The length of the dedupe window in the timestamp precision. 0 means disabled.
+	dedupeWindow int64
+	dedupePolicy DedupePolicy
+	flushTrigger func(info PartitionInfo) bool
+	// stats is shared among all partitions within the same storage.
+	stats *storageStats
+	// zeroCopy makes data points reference the given rows instead of copies of them. See WithZeroCopyStrings
+	zeroCopy bool
+	// The estimated bytes after which it gets inactive. 0 means no limit.
+	memoryBudget int64
+	// The number of older partitions merged into it, whose WAL segments remain until it gets persisted.
+	// It is accessed only while flushing partitions.
+	mergedPartitions int
 }
 
-func newMemoryPartition(wal wal, partitionDuration time.Duration, precision TimestampPrecision) partition {
+// The capacity of data points allocated for a new metric up front.
+const initialPointsCap = 1000
+
+// memoryPartitionOption is an optional setting for newMemoryPartition.
+type memoryPartitionOption func(*memoryPartition)
+
+// withOutOfOrderPolicy specifies how to handle out-of-order data points.
+func withOutOfOrderPolicy(policy OutOfOrderPolicy) memoryPartitionOption {
+	return func(m *memoryPartition) {
+		m.outOfOrderPolicy = policy
+	}
+}
+
+// withDedupeWindow specifies the window in which data points of the same metric are regarded as duplicates.
+func withDedupeWindow(window time.Duration, policy DedupePolicy) memoryPartitionOption {
+	return func(m *memoryPartition) {
+		m.dedupeWindow = toDuration(window, m.timestampPrecision)
+		m.dedupePolicy = policy
+	}
+}
+
+// withFlushTrigger specifies a function that decides whether the partition is ready to be persisted,
+// in addition to the partition duration.
+func withFlushTrigger(trigger func(info PartitionInfo) bool) memoryPartitionOption {
+	return func(m *memoryPartition) {
+		m.flushTrigger = trigger
+	}
+}
+
+// withZeroCopy makes the partition reference the given rows instead of copying them.
+func withZeroCopy(enabled bool) memoryPartitionOption {
+	return func(m *memoryPartition) {
+		m.zeroCopy = enabled
+	}
+}
+
+// withStats specifies the counters to be updated by the partition.
+func withStats(stats *storageStats) memoryPartitionOption {
+	return func(m *memoryPartition) {
+		m.stats = stats
+	}
+}
+
+func newMemoryPartition(wal wal, partitionDuration time.Duration, precision TimestampPrecision, opts ...memoryPartitionOption) partition {
 	if wal == nil {
 		wal = &nopWAL{}
 	}
-	var d int64
-	switch precision {
-	case Nanoseconds:
-		d = partitionDuration.Nanoseconds()
-	case Microseconds:
-		d = partitionDuration.Microseconds()
-	case Milliseconds:
-		d = partitionDuration.Milliseconds()
-	case Seconds:
-		d = int64(partitionDuration.Seconds())
-	default:
-		d = partitionDuration.Nanoseconds()
-	}
-	return &memoryPartition{
-		partitionDuration:  d,
+	m := &memoryPartition{
+		partitionDuration:  toDuration(partitionDuration, precision),
 		wal:                wal,
 		timestampPrecision: precision,
+		createdAt:          time.Now(),
+		outOfOrderPolicy:   OutOfOrderAccept,
+		stats:              &storageStats{},
+	}
+	for _, opt := range opts {
+		opt(m)
 	}
+	return m
 }
 
 // insertRows inserts the given rows to partition.
@@ -57,6 +117,16 @@ func (m *memoryPartition) insertRows(rows []Row) ([]Row, error) {
 	if len(rows) == 0 {
 		return nil, fmt.Errorf("no rows given")
 	}
+	if m.outOfOrderPolicy == OutOfOrderReject || m.outOfOrderPolicy == OutOfOrderDrop {
+		var err error
+		rows, err = m.filterOutOfOrderRows(rows)
+		if err != nil {
+			return nil, err
+		}
+		if len(rows) == 0 {
+			return []Row{}, nil
+		}
+	}
 	// FIXME: Just emitting log is enough
 	err := m.wal.append(operationInsert, rows)
 	if err != nil {
@@ -73,15 +143,25 @@ func (m *memoryPartition) insertRows(rows []Row) ([]Row, error) {
 			}
 		}
 		atomic.StoreInt64(&m.minT, min)
+		// Start max timestamp from there rather than zero, which negative timestamps never exceed.
+		atomic.StoreInt64(&m.maxT, min)
 	})
 
 	outdatedRows := make([]Row, 0)
 	maxTimestamp := rows[0].Timestamp
 	var rowsNum int64
+	// buf is reused to build the names of series under zeroCopy.
+	var buf []byte
 	for i := range rows {
-		row := rows[i]
+		var row *Row
+		if m.zeroCopy {
+			row = &rows[i]
+		} else {
+			r := rows[i]
+			row = &r
+		}
 		if row.Timestamp < m.minTimestamp() {
-			outdatedRows = append(outdatedRows, row)
+			outdatedRows = append(outdatedRows, *row)
 			continue
 		}
 		if row.Timestamp == 0 {
@@ -90,12 +170,31 @@ func (m *memoryPartition) insertRows(rows []Row) ([]Row, error) {
 		if row.Timestamp > maxTimestamp {
 			maxTimestamp = row.Timestamp
 		}
-		name := marshalMetricName(row.Metric, row.Labels)
-		mt := m.getMetric(name)
-		mt.insertPoint(&row.DataPoint)
+		var mt *memoryMetric
+		if m.zeroCopy && len(row.Labels) > 0 {
+			buf = appendMetricName(buf[:0], row.Metric, row.Labels)
+			mt = m.lookupMetric(buf)
+		} else {
+			mt = m.getMetric(marshalMetricName(row.Metric, row.Labels))
+		}
+		if m.dedupeWindow > 0 && mt.dedupePoint(&row.DataPoint, m.dedupeWindow, m.dedupePolicy == DedupeKeepLast) {
+			atomic.AddInt64(&m.stats.pointsDeduplicated, 1)
+			continue
+		}
+		inserted, outOfOrder := mt.insertPoint(&row.DataPoint, m.outOfOrderPolicy == OutOfOrderAccept)
+		if !inserted {
+			// It can happen only when the other goroutine inserts newer points
+			// between filterOutOfOrderRows and here.
+			atomic.AddInt64(&m.stats.outOfOrderDropped, 1)
+			continue
+		}
+		if outOfOrder {
+			atomic.AddInt64(&m.stats.outOfOrderAccepted, 1)
+		}
 		rowsNum++
 	}
 	atomic.AddInt64(&m.numPoints, rowsNum)
+	atomic.StoreInt64(&m.lastWriteAt, time.Now().UnixNano())
 
 	// Make max timestamp up-to-date.
 	if atomic.LoadInt64(&m.maxT) < maxTimestamp {
@@ -105,6 +204,49 @@ func (m *memoryPartition) insertRows(rows []Row) ([]Row, error) {
 	return outdatedRows, nil
 }
 
+// filterOutOfOrderRows gives back rows excluding out-of-order ones, which are older than or equal
+// to the latest data point of the same metric. Rows older than the partition itself are left as is
+// because they are supposed to be inserted into the older partition.
+// It gives back ErrOutOfOrder without any rows if the policy is OutOfOrderReject and out-of-order ones found.
+func (m *memoryPartition) filterOutOfOrderRows(rows []Row) ([]Row, error) {
+	minT := m.minTimestamp()
+	latest := make(map[string]int64)
+	filtered := make([]Row, 0, len(rows))
+	var numOutOfOrder int64
+	for i := range rows {
+		row := rows[i]
+		if row.Timestamp == 0 || (minT != 0 && row.Timestamp < minT) {
+			filtered = append(filtered, row)
+			continue
+		}
+		name := marshalMetricName(row.Metric, row.Labels)
+		last, ok := latest[name]
+		if !ok {
+			if value, found := m.metrics.Load(name); found {
+				mt := value.(*memoryMetric)
+				if atomic.LoadInt64(&mt.size) > 0 {
+					last, ok = atomic.LoadInt64(&mt.maxTimestamp), true
+				}
+			}
+		}
+		if ok && row.Timestamp <= last {
+			numOutOfOrder++
+			continue
+		}
+		latest[name] = row.Timestamp
+		filtered = append(filtered, row)
+	}
+	if numOutOfOrder == 0 {
+		return rows, nil
+	}
+	if m.outOfOrderPolicy == OutOfOrderReject {
+		atomic.AddInt64(&m.stats.outOfOrderRejected, numOutOfOrder)
+		return nil, fmt.Errorf("%d data points are older than the latest ones: %w", numOutOfOrder, ErrOutOfOrder)
+	}
+	atomic.AddInt64(&m.stats.outOfOrderDropped, numOutOfOrder)
+	return filtered, nil
+}
+
 func toUnix(t time.Time, precision TimestampPrecision) int64 {
 	switch precision {
 	case Nanoseconds:
@@ -120,27 +262,120 @@ func toUnix(t time.Time, precision TimestampPrecision) int64 {
 	}
 }
 
+// fromUnix converts the given timestamp in the given precision into time.Time.
+func fromUnix(ts int64, precision TimestampPrecision) time.Time {
+	switch precision {
+	case Microseconds:
+		return time.UnixMicro(ts)
+	case Milliseconds:
+		return time.UnixMilli(ts)
+	case Seconds:
+		return time.Unix(ts, 0)
+	default:
+		return time.Unix(0, ts)
+	}
+}
+
+// toDuration converts the given duration into the length in the given precision.
+func toDuration(d time.Duration, precision TimestampPrecision) int64 {
+	switch precision {
+	case Nanoseconds:
+		return d.Nanoseconds()
+	case Microseconds:
+		return d.Microseconds()
+	case Milliseconds:
+		return d.Milliseconds()
+	case Seconds:
+		return int64(d.Seconds())
+	default:
+		return d.Nanoseconds()
+	}
+}
+
 func (m *memoryPartition) selectDataPoints(metric string, labels []Label, start, end int64) ([]*DataPoint, error) {
 	name := marshalMetricName(metric, labels)
 	mt := m.getMetric(name)
 	return mt.selectPoints(start, end), nil
 }
 
+func (m *memoryPartition) countDataPoints(metric string, labels []Label, start, end int64) (int, error) {
+	value, ok := m.metrics.Load(marshalMetricName(metric, labels))
+	if !ok {
+		return 0, ErrNoDataPoints
+	}
+	return len(value.(*memoryMetric).selectPoints(start, end)), nil
+}
+
 // getMetric gives back the reference to the metrics list whose name is the given one.
 // If none, it creates a new one.
 func (m *memoryPartition) getMetric(name string) *memoryMetric {
 	value, ok := m.metrics.Load(name)
 	if !ok {
-		value = &memoryMetric{
+		var loaded bool
+		value, loaded = m.metrics.LoadOrStore(name, &memoryMetric{
 			name:             name,
-			points:           make([]*DataPoint, 0, 1000),
+			points:           make([]*DataPoint, 0, initialPointsCap),
 			outOfOrderPoints: make([]*DataPoint, 0),
+		})
+		if !loaded {
+			atomic.AddInt64(&m.numMetrics, 1)
+			atomic.AddInt64(&m.metricNameBytes, int64(len(name)))
 		}
-		m.metrics.Store(name, value)
 	}
 	return value.(*memoryMetric)
 }
 
+// lookupMetric is like getMetric, but takes the name in bytes, which gets copied only if the metric is new.
+func (m *memoryPartition) lookupMetric(name []byte) *memoryMetric {
+	if value, ok := m.metrics.Load(bytesToString(name)); ok {
+		return value.(*memoryMetric)
+	}
+	return m.getMetric(string(name))
+}
+
+// mergeInto merges all data points into dst, which must be newer than m,
+// so that m can be dropped without being persisted.
+func (m *memoryPartition) mergeInto(dst *memoryPartition) {
+	m.metrics.Range(func(key, value interface{}) bool {
+		src := value.(*memoryMetric)
+		// Size it up front, not to copy data points over and over while collecting them.
+		points := &pointsCollector{points: make([]*DataPoint, 0, atomic.LoadInt64(&src.size)+int64(len(src.outOfOrderPoints)))}
+		// Never fails because pointsCollector never fails.
+		_ = src.encodeAllPoints(points)
+		dst.getMetric(src.name).mergePoints(points.points)
+		return true
+	})
+	atomic.AddInt64(&dst.numPoints, int64(m.size()))
+	// Make inserts into dst keep the merged min timestamp even if dst is still empty.
+	dst.once.Do(func() {
+		atomic.StoreInt64(&dst.minT, m.minTimestamp())
+		atomic.StoreInt64(&dst.maxT, m.maxTimestamp())
+	})
+	for {
+		minT := dst.minTimestamp()
+		if m.minTimestamp() >= minT || atomic.CompareAndSwapInt64(&dst.minT, minT, m.minTimestamp()) {
+			break
+		}
+	}
+	for {
+		maxT := dst.maxTimestamp()
+		if m.maxTimestamp() <= maxT || atomic.CompareAndSwapInt64(&dst.maxT, maxT, m.maxTimestamp()) {
+			break
+		}
+	}
+	dst.mergedPartitions += 1 + m.mergedPartitions
+}
+
+// lastWriteTime gives back the wall-clock time when rows were most recently written.
+// Zero if nothing has been written yet.
+func (m *memoryPartition) lastWriteTime() time.Time {
+	t := atomic.LoadInt64(&m.lastWriteAt)
+	if t == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, t)
+}
+
 func (m *memoryPartition) minTimestamp() int64 {
 	return atomic.LoadInt64(&m.minT)
 }
@@ -154,7 +389,17 @@ func (m *memoryPartition) size() int {
 }
 
 func (m *memoryPartition) active() bool {
-	return m.maxTimestamp()-m.minTimestamp()+1 < m.partitionDuration
+	if m.maxTimestamp()-m.minTimestamp()+1 >= m.partitionDuration {
+		return false
+	}
+	if m.memoryBudget > 0 && m.memoryUsage() >= m.memoryBudget {
+		return false
+	}
+	// An empty partition is never ready, otherwise new partitions would keep being created.
+	if m.flushTrigger != nil && m.size() > 0 && m.flushTrigger(newPartitionInfo(m)) {
+		return false
+	}
+	return true
 }
 
 func (m *memoryPartition) clean() error {
@@ -179,8 +424,9 @@ type memoryMetric struct {
 	mu               sync.RWMutex
 }
 
-func (m *memoryMetric) insertPoint(point *DataPoint) {
-	size := atomic.LoadInt64(&m.size)
+// insertPoint inserts the given point in order. An out-of-order point is buffered separately
+// only if allowOutOfOrder is true; otherwise it is discarded and inserted is false.
+func (m *memoryMetric) insertPoint(point *DataPoint, allowOutOfOrder bool) (inserted, outOfOrder bool) {
 	// TODO: Consider to stop using mutex every time.
 	//   Instead, fix the capacity of points slice, kind of like:
 	/*
@@ -191,6 +437,7 @@ func (m *memoryMetric) insertPoint(point *DataPoint) {
 	*/
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	size := atomic.LoadInt64(&m.size)
 
 	// First insertion
 	if size == 0 {
@@ -198,21 +445,91 @@ func (m *memoryMetric) insertPoint(point *DataPoint) {
 		atomic.StoreInt64(&m.minTimestamp, point.Timestamp)
 		atomic.StoreInt64(&m.maxTimestamp, point.Timestamp)
 		atomic.AddInt64(&m.size, 1)
-		return
+		return true, false
 	}
 	// Insert point in order
 	if m.points[size-1].Timestamp < point.Timestamp {
 		m.points = append(m.points, point)
 		atomic.StoreInt64(&m.maxTimestamp, point.Timestamp)
 		atomic.AddInt64(&m.size, 1)
-		return
+		return true, false
 	}
 
+	if !allowOutOfOrder {
+		return false, true
+	}
 	m.outOfOrderPoints = append(m.outOfOrderPoints, point)
+	return true, true
+}
+
+// mergePoints merges the given data points in order by timestamp into the metric.
+func (m *memoryMetric) mergePoints(points []*DataPoint) {
+	if len(points) == 0 {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	merged := make([]*DataPoint, 0, len(points)+len(m.points))
+	var i, j int
+	for i < len(points) && j < len(m.points) {
+		if points[i].Timestamp <= m.points[j].Timestamp {
+			merged = append(merged, points[i])
+			i++
+		} else {
+			merged = append(merged, m.points[j])
+			j++
+		}
+	}
+	merged = append(merged, points[i:]...)
+	merged = append(merged, m.points[j:]...)
+	m.points = merged
+	atomic.StoreInt64(&m.minTimestamp, merged[0].Timestamp)
+	atomic.StoreInt64(&m.maxTimestamp, merged[len(merged)-1].Timestamp)
+	atomic.StoreInt64(&m.size, int64(len(merged)))
+}
+
+// pointsCollector is a seriesEncoder that just collects the given data points.
+type pointsCollector struct {
+	points []*DataPoint
+}
+
+func (c *pointsCollector) encodePoint(point *DataPoint) error {
+	c.points = append(c.points, point)
+	return nil
+}
+
+func (c *pointsCollector) flush() error {
+	return nil
+}
+
+// dedupePoint reports whether the given point is within the window after the latest point.
+// If so, the given point is dropped, or replaces the latest point if keepLast is true.
+func (m *memoryMetric) dedupePoint(point *DataPoint, window int64, keepLast bool) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	size := atomic.LoadInt64(&m.size)
+	if size == 0 {
+		return false
+	}
+	last := m.points[size-1]
+	if diff := point.Timestamp - last.Timestamp; diff < 0 || diff >= window {
+		return false
+	}
+	if keepLast {
+		m.points[size-1] = point
+		atomic.StoreInt64(&m.maxTimestamp, point.Timestamp)
+		if size == 1 {
+			atomic.StoreInt64(&m.minTimestamp, point.Timestamp)
+		}
+	}
+	return true
 }
 
 // selectPoints returns a new slice by re-slicing with [startIdx:endIdx].
 func (m *memoryMetric) selectPoints(start, end int64) []*DataPoint {
+	// Lock first, since mergePoints replaces points entirely.
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 	size := atomic.LoadInt64(&m.size)
 	minTimestamp := atomic.LoadInt64(&m.minTimestamp)
 	maxTimestamp := atomic.LoadInt64(&m.maxTimestamp)
@@ -221,9 +538,6 @@ func (m *memoryMetric) selectPoints(start, end int64) []*DataPoint {
 	if end <= minTimestamp {
 		return []*DataPoint{}
 	}
-
-	m.mu.RLock()
-	defer m.mu.RUnlock()
 	if start <= minTimestamp {
 		startIdx = 0
 	} else {
@@ -247,36 +561,93 @@ func (m *memoryMetric) selectPoints(start, end int64) []*DataPoint {
 // encodeAllPoints uses the given seriesEncoder to encode all metric data points in order by timestamp,
 // including outOfOrderPoints.
 func (m *memoryMetric) encodeAllPoints(encoder seriesEncoder) error {
+	iterator := m.allPointsIterator()
+	for iterator.next() {
+		if err := encoder.encodePoint(iterator.value()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// allPointsIterator gives back an iterator walking all data points in order by timestamp,
+// which merges outOfOrderPoints on the fly instead of collecting them up front.
+func (m *memoryMetric) allPointsIterator() *memoryPointsIterator {
 	sort.Slice(m.outOfOrderPoints, func(i, j int) bool {
 		return m.outOfOrderPoints[i].Timestamp < m.outOfOrderPoints[j].Timestamp
 	})
+	return &memoryPointsIterator{points: m.points, outOfOrderPoints: m.outOfOrderPoints}
+}
 
-	var oi, pi int
-	for oi < len(m.outOfOrderPoints) && pi < len(m.points) {
-		if m.outOfOrderPoints[oi].Timestamp < m.points[pi].Timestamp {
-			if err := encoder.encodePoint(m.outOfOrderPoints[oi]); err != nil {
-				return err
-			}
-			oi++
-		} else {
-			if err := encoder.encodePoint(m.points[pi]); err != nil {
-				return err
-			}
-			pi++
-		}
+// memoryPointsIterator walks the in-order data points and the sorted out-of-order ones of a series
+// as a single sequence in order by timestamp.
+type memoryPointsIterator struct {
+	points           []*DataPoint
+	outOfOrderPoints []*DataPoint
+	pi, oi           int
+	current          *DataPoint
+}
+
+func (i *memoryPointsIterator) next() bool {
+	switch {
+	case i.oi < len(i.outOfOrderPoints) && (i.pi >= len(i.points) || i.outOfOrderPoints[i.oi].Timestamp < i.points[i.pi].Timestamp):
+		i.current = i.outOfOrderPoints[i.oi]
+		i.oi++
+	case i.pi < len(i.points):
+		i.current = i.points[i.pi]
+		i.pi++
+	default:
+		return false
 	}
-	for oi < len(m.outOfOrderPoints) {
-		if err := encoder.encodePoint(m.outOfOrderPoints[oi]); err != nil {
-			return err
+	return true
+}
+
+func (i *memoryPointsIterator) value() *DataPoint {
+	return i.current
+}
+
+// memoryPartitionIterator walks all data points of a memory partition series by series, in order by
+// the series name and then by timestamp, without collecting them up front.
+type memoryPartitionIterator struct {
+	metrics []*memoryMetric
+	// The index of the next series.
+	mi     int
+	points *memoryPointsIterator
+}
+
+// selectAllIterator gives back an iterator walking all data points in the partition, which lets callers
+// such as flushes consume a large partition without materializing all of its data points.
+// Series having no data points are skipped.
+func (m *memoryPartition) selectAllIterator() *memoryPartitionIterator {
+	metrics := make([]*memoryMetric, 0)
+	m.metrics.Range(func(_, value interface{}) bool {
+		metrics = append(metrics, value.(*memoryMetric))
+		return true
+	})
+	sort.Slice(metrics, func(i, j int) bool {
+		return metrics[i].name < metrics[j].name
+	})
+	return &memoryPartitionIterator{metrics: metrics}
+}
+
+func (i *memoryPartitionIterator) next() bool {
+	for {
+		if i.points != nil && i.points.next() {
+			return true
 		}
-		oi++
-	}
-	for pi < len(m.points) {
-		if err := encoder.encodePoint(m.points[pi]); err != nil {
-			return err
+		if i.mi >= len(i.metrics) {
+			return false
 		}
-		pi++
+		i.points = i.metrics[i.mi].allPointsIterator()
+		i.mi++
 	}
+}
 
-	return nil
+// metric gives back the series the current data point belongs to.
+func (i *memoryPartitionIterator) metric() *memoryMetric {
+	return i.metrics[i.mi-1]
+}
+
+func (i *memoryPartitionIterator) value() *DataPoint {
+	return i.points.value()
 }
@@ -65,6 +65,22 @@ func Test_memoryPartition_InsertRows(t *testing.T) {
 	}
 }
 
+func Test_memoryPartition_InsertRows_negativeTimestamps(t *testing.T) {
+	m := newMemoryPartition(nil, time.Hour, Seconds).(*memoryPartition)
+	_, err := m.insertRows([]Row{
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: -3, Value: 0.1}},
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: -2, Value: 0.1}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int64(-3), m.minTimestamp())
+	assert.Equal(t, int64(-2), m.maxTimestamp())
+	assert.True(t, m.active())
+
+	got, err := m.selectDataPoints("metric1", nil, -3, 0)
+	require.NoError(t, err)
+	assert.Equal(t, []*DataPoint{{Timestamp: -3, Value: 0.1}, {Timestamp: -2, Value: 0.1}}, got)
+}
+
 func Test_memoryPartition_SelectDataPoints(t *testing.T) {
 	tests := []struct {
 		name            string
@@ -193,6 +209,43 @@ func Test_memoryMetric_EncodeAllPoints_error(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func Test_memoryPartition_selectAllIterator(t *testing.T) {
+	m := newMemoryPartition(nil, 0, "").(*memoryPartition)
+	_, err := m.insertRows([]Row{
+		{Metric: "metric2", DataPoint: DataPoint{Timestamp: 2, Value: 0.2}},
+		{Metric: "metric1", Labels: []Label{{Name: "host", Value: "a"}}, DataPoint: DataPoint{Timestamp: 3, Value: 0.3}},
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 4, Value: 0.4}},
+		{Metric: "metric2", DataPoint: DataPoint{Timestamp: 5, Value: 0.5}},
+		// Out-of-order ones.
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 3, Value: 0.3}},
+		{Metric: "metric2", DataPoint: DataPoint{Timestamp: 4, Value: 0.4}},
+		{Metric: "metric2", DataPoint: DataPoint{Timestamp: 3, Value: 0.3}},
+	})
+	require.NoError(t, err)
+
+	type entry struct {
+		name      string
+		timestamp int64
+	}
+	var got []entry
+	iterator := m.selectAllIterator()
+	for iterator.next() {
+		got = append(got, entry{name: iterator.metric().name, timestamp: iterator.value().Timestamp})
+	}
+	// Series are in order by name, where labeled ones come first since their names start with the length of the metric.
+	assert.Equal(t, []entry{
+		{name: marshalMetricName("metric1", []Label{{Name: "host", Value: "a"}}), timestamp: 3},
+		{name: "metric1", timestamp: 3},
+		{name: "metric1", timestamp: 4},
+		{name: "metric2", timestamp: 2},
+		{name: "metric2", timestamp: 3},
+		{name: "metric2", timestamp: 4},
+		{name: "metric2", timestamp: 5},
+	}, got)
+
+	assert.False(t, newMemoryPartition(nil, 0, "").(*memoryPartition).selectAllIterator().next())
+}
+
 func Test_toUnix(t *testing.T) {
 	tests := []struct {
 		name      string
@@ -0,0 +1,53 @@
+package tstorage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_storage_MemoryUsage(t *testing.T) {
+	tmpDir := t.TempDir()
+	s, err := NewStorage(WithDataPath(tmpDir), WithTimestampPrecision(Seconds), WithPartitionDuration(time.Hour))
+	require.NoError(t, err)
+	defer s.Close()
+	assert.Equal(t, int64(0), s.MemoryUsage())
+
+	require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1, Value: 1}}}))
+	usage := s.MemoryUsage()
+	assert.Equal(t, metricMemorySize+int64(len("metric1"))+pointMemorySize, usage)
+
+	// It grows in proportion to the number of data points.
+	for ts := int64(2); ts <= 1001; ts++ {
+		require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: ts, Value: 1}}}))
+	}
+	assert.Equal(t, usage+1000*pointMemorySize, s.MemoryUsage())
+	assert.Equal(t, s.MemoryUsage(), s.Stats().MemoryUsage)
+
+	// It drops once the partition gets flushed. Make it flushable without starting a background flush,
+	// which would otherwise race the measurement.
+	ss := s.(*storage)
+	for i := 0; i < writablePartitionsNum; i++ {
+		require.NoError(t, ss.newPartition(nil, true))
+	}
+	before := s.MemoryUsage()
+	require.NoError(t, s.FlushAsync().Wait())
+	assert.Less(t, s.MemoryUsage(), before)
+}
+
+func Test_storage_InsertRows_withMemoryBudget(t *testing.T) {
+	tmpDir := t.TempDir()
+	budget := 3 * (metricMemorySize + 100*pointMemorySize)
+	s, err := NewStorage(WithDataPath(tmpDir), WithTimestampPrecision(Seconds), WithMemoryBudget(budget))
+	require.NoError(t, err)
+	defer s.Close()
+	// All of them lie within the partition duration.
+	for ts := int64(1); ts <= 1000; ts++ {
+		require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: ts, Value: 1}}}))
+	}
+	require.NoError(t, s.FlushAsync().Wait())
+	assert.Greater(t, s.Stats().PartitionsFlushed, int64(0))
+	assert.LessOrEqual(t, s.MemoryUsage(), budget)
+}
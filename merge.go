@@ -0,0 +1,413 @@
+package tstorage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// DuplicatePolicy specifies which data point to keep when two data directories being merged
+// both have a data point of the same metric at the same timestamp.
+type DuplicatePolicy string
+
+const (
+	// DuplicateKeepDst keeps the data point in the destination directory.
+	DuplicateKeepDst DuplicatePolicy = "keep-dst"
+	// DuplicateKeepSrc overwrites the data point in the destination directory with the source one.
+	DuplicateKeepSrc DuplicatePolicy = "keep-src"
+)
+
+// MergeResult reports what Merge has done.
+type MergeResult struct {
+	// The number of source partitions copied as is because they overlap no destination partition.
+	PartitionsCopied int
+	// The number of partitions written by merging overlapping source and destination partitions.
+	PartitionsMerged int
+	// The number of data points from the source written into the destination.
+	PointsMerged int64
+	// The number of data points with the same metric and timestamp resolved by the DuplicatePolicy.
+	ConflictsResolved int64
+}
+
+// Merge merges the disk partitions under srcDataPath into dstDataPath.
+// It is an offline operation; neither directory may be opened by a Storage while merging.
+//
+// Source partitions overlapping no destination partition get copied as is.
+// Otherwise, all partitions whose time ranges overlap each other are merged into a single partition,
+// so that dstDataPath remains a set of non-overlapping partitions that NewStorage can open.
+// srcDataPath is left untouched.
+//
+// If it crashes, the next Merge or NewStorage on dstDataPath finishes or rolls back the interrupted merge of partitions.
+//
+// Only persisted partitions are merged; rows remaining in the WAL of srcDataPath are ignored.
+// Open and close it with NewStorage beforehand to persist them.
+func Merge(srcDataPath, dstDataPath string, policy DuplicatePolicy) (MergeResult, error) {
+	var result MergeResult
+	if policy != DuplicateKeepDst && policy != DuplicateKeepSrc {
+		return result, fmt.Errorf("unknown duplicate policy %q", policy)
+	}
+	if err := recoverMerge(defaultFileSystem, dstDataPath); err != nil {
+		return result, err
+	}
+	srcParts, err := openMergeablePartitions(srcDataPath, true)
+	if err != nil {
+		return result, err
+	}
+	dstParts, err := openMergeablePartitions(dstDataPath, false)
+	if err != nil {
+		return result, err
+	}
+
+	// Group partitions whose time ranges overlap each other, transitively.
+	all := append(srcParts, dstParts...)
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].minTimestamp() < all[j].minTimestamp()
+	})
+	var groups [][]*mergeablePartition
+	var groupMax int64
+	for _, p := range all {
+		if len(groups) > 0 && p.minTimestamp() <= groupMax {
+			groups[len(groups)-1] = append(groups[len(groups)-1], p)
+		} else {
+			groups = append(groups, []*mergeablePartition{p})
+		}
+		if len(groups[len(groups)-1]) == 1 || p.maxTimestamp() > groupMax {
+			groupMax = p.maxTimestamp()
+		}
+	}
+
+	for _, group := range groups {
+		var numSrc int
+		for _, p := range group {
+			if p.src {
+				numSrc++
+			}
+		}
+		switch {
+		case numSrc == 0:
+			// Nothing to be merged into the destination partition.
+			continue
+		case len(group) == 1:
+			p := group[0]
+			if err := copyPartition(p.dirPath, dstDataPath, p.minTimestamp(), p.maxTimestamp()); err != nil {
+				return result, err
+			}
+			result.PartitionsCopied++
+			result.PointsMerged += int64(p.size())
+		default:
+			pointsMerged, conflicts, err := mergePartitions(group, dstDataPath, policy)
+			if err != nil {
+				return result, err
+			}
+			result.PartitionsMerged++
+			result.PointsMerged += pointsMerged
+			result.ConflictsResolved += conflicts
+		}
+	}
+	return result, nil
+}
+
+// mergeablePartition is a disk partition to be merged, along with where it comes from.
+type mergeablePartition struct {
+	*diskPartition
+	src bool
+}
+
+func openMergeablePartitions(dataPath string, src bool) ([]*mergeablePartition, error) {
+	dirs, err := listPartitionDirs(defaultFileSystem, dataPath)
+	if err != nil {
+		return nil, err
+	}
+	parts := make([]*mergeablePartition, 0, len(dirs))
+	for _, dir := range dirs {
+		path := filepath.Join(dataPath, dir)
+		// Expired partitions are still merged; the Storage opening the destination takes care of them.
+		part, err := openDiskPartition(defaultFileSystem, path, math.MaxInt64, true, defaultAllocator)
+		if errors.Is(err, ErrNoDataPoints) || errors.Is(err, errInvalidPartition) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to open disk partition for %s: %w", path, err)
+		}
+		parts = append(parts, &mergeablePartition{
+			diskPartition: part.(*diskPartition),
+			src:           src,
+		})
+	}
+	return parts, nil
+}
+
+// mergePartitions writes a single partition holding all data points of the given partitions into dstDataPath,
+// and then removes the destination partitions among them.
+// It gives back the number of data points taken from the source partitions, and the number of conflicts resolved.
+func mergePartitions(parts []*mergeablePartition, dstDataPath string, policy DuplicatePolicy) (pointsMerged, conflicts int64, err error) {
+	srcPoints := make(map[string][]*DataPoint)
+	dstPoints := make(map[string][]*DataPoint)
+	// The partitions are in order by timestamp, so are the points of each side.
+	for _, p := range parts {
+		points := dstPoints
+		if p.src {
+			points = srcPoints
+		}
+		for name := range p.meta.Metrics {
+			ps, err := p.selectDataPointsByName(name, math.MinInt64, math.MaxInt64)
+			if err != nil {
+				return 0, 0, fmt.Errorf("failed to select data points of %q from %s: %w", name, p.dirPath, err)
+			}
+			points[name] = append(points[name], ps...)
+		}
+	}
+
+	merged := make(map[string][]*DataPoint, len(srcPoints)+len(dstPoints))
+	for name, src := range srcPoints {
+		points, fromSrc, c := mergePoints(dstPoints[name], src, policy)
+		merged[name] = points
+		pointsMerged += fromSrc
+		conflicts += c
+	}
+	for name, dst := range dstPoints {
+		if _, ok := srcPoints[name]; !ok {
+			merged[name] = dst
+		}
+	}
+	m := newMergedMemoryPartition(merged)
+
+	// Write to a directory that isn't regarded as a partition first, not to leave a broken one.
+	tmpDir := filepath.Join(dstDataPath, fmt.Sprintf("%s%d-%d", mergingDirPrefix, m.minT, m.maxT))
+	s := &storage{
+		dirPerm:         defaultDirPerm,
+		filePerm:        defaultFilePerm,
+		pointsPerBlock:  defaultPointsPerBlock,
+		allocator:       defaultAllocator,
+		flushBufferSize: defaultFlushBufferSize,
+		fsys:            defaultFileSystem,
+		logger:          &nopLogger{},
+	}
+	if err := s.flush(tmpDir, m); err != nil {
+		os.RemoveAll(tmpDir)
+		return 0, 0, fmt.Errorf("failed to write merged partition: %w", err)
+	}
+	dir, err := newPartitionDirPath(defaultFileSystem, dstDataPath, m.minT, m.maxT)
+	if err != nil {
+		return 0, 0, err
+	}
+	// The destination partitions get removed only after the merged one takes place, and
+	// the marker lets the next open finish removing them if it crashes in the meantime.
+	marker := mergeMarker{Merged: filepath.Base(dir)}
+	for _, p := range parts {
+		if p.src {
+			continue
+		}
+		rel, err := filepath.Rel(dstDataPath, p.dirPath)
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to make path of %s relative: %w", p.dirPath, err)
+		}
+		marker.Replaced = append(marker.Replaced, rel)
+	}
+	b, err := json.Marshal(marker)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to encode merge marker: %w", err)
+	}
+	if err := writeFile(defaultFileSystem, filepath.Join(dstDataPath, mergeMarkerFileName), b, defaultFilePerm); err != nil {
+		os.RemoveAll(tmpDir)
+		return 0, 0, fmt.Errorf("failed to write merge marker: %w", err)
+	}
+	if err := os.Rename(tmpDir, dir); err != nil {
+		return 0, 0, fmt.Errorf("failed to rename %s to %s: %w", tmpDir, dir, err)
+	}
+	if err := finishMerge(defaultFileSystem, dstDataPath, &marker); err != nil {
+		return 0, 0, err
+	}
+	return pointsMerged, conflicts, nil
+}
+
+// mergingDirPrefix is the prefix of the directories partitions get written to before being renamed.
+const mergingDirPrefix = "merging-"
+
+// mergeMarkerFileName is the name of the file put under the data path while a merged partition replaces others.
+const mergeMarkerFileName = "merging.json"
+
+// mergeMarker records what a merged partition replaces.
+type mergeMarker struct {
+	// Merged is the directory the merged partition gets renamed to, relative to the data path.
+	Merged string `json:"merged"`
+	// Replaced are the directories of the partitions merged into it, relative to the data path.
+	Replaced []string `json:"replaced"`
+}
+
+// finishMerge removes the partitions replaced by the merged one, and then the marker.
+func finishMerge(fsys FileSystem, dataPath string, marker *mergeMarker) error {
+	for _, dir := range marker.Replaced {
+		if err := fsys.RemoveAll(filepath.Join(dataPath, dir)); err != nil {
+			return fmt.Errorf("failed to remove merged partition: %w", err)
+		}
+	}
+	if err := fsys.RemoveAll(filepath.Join(dataPath, mergeMarkerFileName)); err != nil {
+		return fmt.Errorf("failed to remove merge marker: %w", err)
+	}
+	return nil
+}
+
+// recoverMerge cleans up after a merge interrupted by a crash. It finishes the merge if the merged partition
+// has taken place, and otherwise leaves the partitions as they were. Either way, half-written partitions get removed.
+func recoverMerge(fsys FileSystem, dataPath string) error {
+	f, err := fsys.OpenFile(filepath.Join(dataPath, mergeMarkerFileName), os.O_RDONLY, 0)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return fmt.Errorf("failed to read merge marker: %w", err)
+	default:
+		marker := &mergeMarker{}
+		err := json.NewDecoder(f).Decode(marker)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("failed to decode merge marker: %w", err)
+		}
+		_, err = fsys.Stat(filepath.Join(dataPath, marker.Merged))
+		switch {
+		case err == nil:
+			if err := finishMerge(fsys, dataPath, marker); err != nil {
+				return err
+			}
+		case errors.Is(err, os.ErrNotExist):
+			// Crashed before renamed.
+			if err := fsys.RemoveAll(filepath.Join(dataPath, mergeMarkerFileName)); err != nil {
+				return fmt.Errorf("failed to remove merge marker: %w", err)
+			}
+		default:
+			return fmt.Errorf("failed to stat merged partition: %w", err)
+		}
+	}
+
+	entries, err := fsys.ReadDir(dataPath)
+	if err != nil {
+		return fmt.Errorf("failed to open data directory: %w", err)
+	}
+	for _, e := range entries {
+		if e.IsDir() && strings.HasPrefix(e.Name(), mergingDirPrefix) {
+			if err := fsys.RemoveAll(filepath.Join(dataPath, e.Name())); err != nil {
+				return fmt.Errorf("failed to remove half-written partition: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// newMergedMemoryPartition gives back a memory partition holding the given data points of each metric name,
+// which must be sorted by timestamp.
+func newMergedMemoryPartition(points map[string][]*DataPoint) *memoryPartition {
+	m := newMemoryPartition(nil, 0, "").(*memoryPartition)
+	m.minT, m.maxT = math.MaxInt64, math.MinInt64
+	for name, ps := range points {
+		if len(ps) == 0 {
+			continue
+		}
+		mt := m.getMetric(name)
+		for _, p := range ps {
+			mt.insertPoint(p, true)
+		}
+		m.numPoints += int64(len(ps))
+		if ps[0].Timestamp < m.minT {
+			m.minT = ps[0].Timestamp
+		}
+		if ps[len(ps)-1].Timestamp > m.maxT {
+			m.maxT = ps[len(ps)-1].Timestamp
+		}
+	}
+	return m
+}
+
+// mergePoints merges two slices of data points in order by timestamp.
+// It gives back the merged data points, the number of those taken from src, and the number of conflicts resolved.
+func mergePoints(dst, src []*DataPoint, policy DuplicatePolicy) (points []*DataPoint, fromSrc, conflicts int64) {
+	points = make([]*DataPoint, 0, len(dst)+len(src))
+	var di, si int
+	for di < len(dst) && si < len(src) {
+		switch {
+		case dst[di].Timestamp < src[si].Timestamp:
+			points = append(points, dst[di])
+			di++
+		case src[si].Timestamp < dst[di].Timestamp:
+			points = append(points, src[si])
+			fromSrc++
+			si++
+		default:
+			conflicts++
+			if policy == DuplicateKeepSrc {
+				points = append(points, src[si])
+				fromSrc++
+			} else {
+				points = append(points, dst[di])
+			}
+			di++
+			si++
+		}
+	}
+	points = append(points, dst[di:]...)
+	points = append(points, src[si:]...)
+	fromSrc += int64(len(src) - si)
+	return points, fromSrc, conflicts
+}
+
+// copyPartition copies the partition placed at srcDir into dstDataPath.
+func copyPartition(srcDir, dstDataPath string, minTimestamp, maxTimestamp int64) error {
+	tmpDir := filepath.Join(dstDataPath, fmt.Sprintf("%s%d-%d", mergingDirPrefix, minTimestamp, maxTimestamp))
+	if err := mkdirAll(defaultFileSystem, tmpDir, defaultDirPerm); err != nil {
+		return fmt.Errorf("failed to make directory %q: %w", tmpDir, err)
+	}
+	// The meta file is copied at last like flush does.
+	for _, name := range []string{dataFileName, metaFileName} {
+		if err := copyFile(filepath.Join(srcDir, name), filepath.Join(tmpDir, name)); err != nil {
+			os.RemoveAll(tmpDir)
+			return err
+		}
+	}
+	dir, err := newPartitionDirPath(defaultFileSystem, dstDataPath, minTimestamp, maxTimestamp)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmpDir, dir); err != nil {
+		return fmt.Errorf("failed to rename %s to %s: %w", tmpDir, dir, err)
+	}
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", src, err)
+	}
+	defer in.Close()
+	out, err := openFile(defaultFileSystem, dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, defaultFilePerm)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", dst, err)
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return fmt.Errorf("failed to copy %s to %s: %w", src, dst, err)
+	}
+	return out.Close()
+}
+
+// newPartitionDirPath gives back the path to a new partition directory under dataPath,
+// with a suffix if the directory for the same time range already exists.
+func newPartitionDirPath(fsys FileSystem, dataPath string, minTimestamp, maxTimestamp int64) (string, error) {
+	base := filepath.Join(dataPath, fmt.Sprintf("p-%d-%d", minTimestamp, maxTimestamp))
+	dir := base
+	for i := 1; ; i++ {
+		_, err := fsys.Stat(dir)
+		if errors.Is(err, os.ErrNotExist) {
+			return dir, nil
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to stat %s: %w", dir, err)
+		}
+		dir = fmt.Sprintf("%s-%d", base, i)
+	}
+}
@@ -0,0 +1,174 @@
+package tstorage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writePartition persists the given rows as a single disk partition.
+func writePartition(t *testing.T, dataPath string, rows []Row) {
+	m := newMemoryPartition(nil, 0, Seconds).(*memoryPartition)
+	_, err := m.insertRows(rows)
+	require.NoError(t, err)
+	dir, err := newPartitionDirPath(defaultFileSystem, dataPath, m.minTimestamp(), m.maxTimestamp())
+	require.NoError(t, err)
+	s := &storage{dirPerm: defaultDirPerm, filePerm: defaultFilePerm, allocator: defaultAllocator, flushBufferSize: defaultFlushBufferSize, fsys: defaultFileSystem, logger: &nopLogger{}}
+	require.NoError(t, s.flush(dir, m))
+}
+
+func TestMerge(t *testing.T) {
+	tests := []struct {
+		name        string
+		policy      DuplicatePolicy
+		want        MergeResult
+		wantMetric1 []*DataPoint
+	}{
+		{
+			name:   "keep dst",
+			policy: DuplicateKeepDst,
+			want: MergeResult{
+				PartitionsCopied:  1,
+				PartitionsMerged:  1,
+				PointsMerged:      4,
+				ConflictsResolved: 1,
+			},
+			wantMetric1: []*DataPoint{
+				{Timestamp: 100, Value: 1},
+				{Timestamp: 105, Value: 2},
+				{Timestamp: 110, Value: 3},
+				{Timestamp: 115, Value: 12},
+				{Timestamp: 120, Value: 13},
+			},
+		},
+		{
+			name:   "keep src",
+			policy: DuplicateKeepSrc,
+			want: MergeResult{
+				PartitionsCopied:  1,
+				PartitionsMerged:  1,
+				PointsMerged:      5,
+				ConflictsResolved: 1,
+			},
+			wantMetric1: []*DataPoint{
+				{Timestamp: 100, Value: 1},
+				{Timestamp: 105, Value: 11},
+				{Timestamp: 110, Value: 3},
+				{Timestamp: 115, Value: 12},
+				{Timestamp: 120, Value: 13},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srcDir, err := os.MkdirTemp("", "tstorage-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(srcDir)
+			dstDir, err := os.MkdirTemp("", "tstorage-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dstDir)
+
+			writePartition(t, dstDir, []Row{
+				{Metric: "metric1", DataPoint: DataPoint{Timestamp: 100, Value: 1}},
+				{Metric: "metric1", DataPoint: DataPoint{Timestamp: 105, Value: 2}},
+				{Metric: "metric1", DataPoint: DataPoint{Timestamp: 110, Value: 3}},
+			})
+			writePartition(t, dstDir, []Row{
+				{Metric: "metric1", DataPoint: DataPoint{Timestamp: 200, Value: 4}},
+			})
+			// Overlaps with the first destination partition.
+			writePartition(t, srcDir, []Row{
+				{Metric: "metric1", DataPoint: DataPoint{Timestamp: 105, Value: 11}},
+				{Metric: "metric1", DataPoint: DataPoint{Timestamp: 115, Value: 12}},
+				{Metric: "metric1", DataPoint: DataPoint{Timestamp: 120, Value: 13}},
+				{Metric: "metric2", DataPoint: DataPoint{Timestamp: 110, Value: 14}},
+			})
+			// Disjoint with any destination partition.
+			writePartition(t, srcDir, []Row{
+				{Metric: "metric1", DataPoint: DataPoint{Timestamp: 300, Value: 15}},
+			})
+
+			got, err := Merge(srcDir, dstDir, tt.policy)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+
+			dirs, err := filepath.Glob(filepath.Join(dstDir, "*"))
+			require.NoError(t, err)
+			assert.Equal(t, []string{
+				filepath.Join(dstDir, "p-100-120"),
+				filepath.Join(dstDir, "p-200-200"),
+				filepath.Join(dstDir, "p-300-300"),
+			}, dirs)
+
+			s, err := NewStorage(WithDataPath(dstDir), WithTimestampPrecision(Seconds))
+			require.NoError(t, err)
+			defer s.Close()
+			points, err := s.Select("metric1", nil, 100, 121)
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantMetric1, points)
+			points, err = s.Select("metric2", nil, 100, 121)
+			require.NoError(t, err)
+			assert.Equal(t, []*DataPoint{{Timestamp: 110, Value: 14}}, points)
+			points, err = s.Select("metric1", nil, 200, 301)
+			require.NoError(t, err)
+			assert.Equal(t, []*DataPoint{{Timestamp: 200, Value: 4}, {Timestamp: 300, Value: 15}}, points)
+		})
+	}
+}
+
+func Test_recoverMerge(t *testing.T) {
+	tests := []struct {
+		name     string
+		renamed  bool
+		wantDirs []string
+	}{
+		{
+			name:     "crashed after renamed",
+			renamed:  true,
+			wantDirs: []string{"p-100-110-1"},
+		},
+		{
+			name:     "crashed before renamed",
+			renamed:  false,
+			wantDirs: []string{"p-100-110"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dataPath := t.TempDir()
+			rows := []Row{
+				{Metric: "metric1", DataPoint: DataPoint{Timestamp: 100, Value: 1}},
+				{Metric: "metric1", DataPoint: DataPoint{Timestamp: 110, Value: 2}},
+			}
+			writePartition(t, dataPath, rows)
+			// Leave the merged partition, holding the same data points, as a crash would.
+			if tt.renamed {
+				require.NoError(t, copyPartition(filepath.Join(dataPath, "p-100-110"), dataPath, 100, 110))
+			} else {
+				require.NoError(t, os.Mkdir(filepath.Join(dataPath, "merging-100-110"), defaultDirPerm))
+			}
+			require.NoError(t, os.WriteFile(filepath.Join(dataPath, mergeMarkerFileName),
+				[]byte(`{"merged":"p-100-110-1","replaced":["p-100-110"]}`), defaultFilePerm))
+
+			// Opening the data path recovers it.
+			s, err := NewStorage(WithDataPath(dataPath), WithTimestampPrecision(Seconds), WithRetention(100*365*24*time.Hour))
+			require.NoError(t, err)
+			got, err := s.Select("metric1", nil, 100, 111)
+			require.NoError(t, err)
+			assert.Equal(t, []*DataPoint{&rows[0].DataPoint, &rows[1].DataPoint}, got)
+			require.NoError(t, s.Close())
+
+			dirs, err := listPartitionDirs(defaultFileSystem, dataPath)
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantDirs, dirs)
+			_, err = os.Stat(filepath.Join(dataPath, mergeMarkerFileName))
+			assert.ErrorIs(t, err, os.ErrNotExist)
+			_, err = os.Stat(filepath.Join(dataPath, "merging-100-110"))
+			assert.ErrorIs(t, err, os.ErrNotExist)
+		})
+	}
+}
@@ -0,0 +1,210 @@
+package tstorage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// formatVersionLegacy is the format of partitions persisted before blocks were introduced,
+	// where data points of each metric are encoded into a single block.
+	formatVersionLegacy = 1
+	// CurrentFormatVersion is the format version of partitions persisted by this package.
+	// Data points of each metric are divided into blocks, each of which records its codec.
+	CurrentFormatVersion = 2
+)
+
+const (
+	// Prefix of the directory a partition is rewritten into while migrating.
+	migratingDirPrefix = "migrating-"
+	// Prefix of the directory the original partition is moved to until the rewritten one takes its place.
+	migratedDirPrefix = "migrated-"
+)
+
+// Migrate rewrites the disk partitions under dataPath into the given format version.
+// It is an offline operation; the directory may not be opened by a Storage while migrating.
+//
+// Each partition is rewritten into a separate directory first, and then takes the place of the original one,
+// so that any partition is never left broken. If interrupted, just call it again to resume;
+// partitions already in the target version are left untouched.
+// Only upgrading is supported.
+//
+// progress, if not nil, is called each time a partition is done with the number of partitions done so far
+// and the total number of partitions.
+func Migrate(dataPath string, targetVersion int, progress func(done, total int)) error {
+	if targetVersion < formatVersionLegacy || targetVersion > CurrentFormatVersion {
+		return fmt.Errorf("unknown format version %d", targetVersion)
+	}
+	// Partitions may be placed in the subdirectories made by WithPartitionSharding.
+	parents := []string{dataPath}
+	entries, err := os.ReadDir(dataPath)
+	if err != nil {
+		return fmt.Errorf("failed to open data directory: %w", err)
+	}
+	for _, e := range entries {
+		if e.IsDir() && strings.HasPrefix(e.Name(), shardDirPrefix) {
+			parents = append(parents, filepath.Join(dataPath, e.Name()))
+		}
+	}
+	for _, parent := range parents {
+		if err := recoverMigration(parent); err != nil {
+			return err
+		}
+	}
+
+	names, err := listPartitionDirs(defaultFileSystem, dataPath)
+	if err != nil {
+		return err
+	}
+	for i, name := range names {
+		if err := migratePartition(filepath.Join(dataPath, filepath.Dir(name)), filepath.Base(name), targetVersion); err != nil {
+			return err
+		}
+		if progress != nil {
+			progress(i+1, len(names))
+		}
+	}
+	return nil
+}
+
+// migratePartition rewrites the partition placed at the given directory into targetVersion.
+func migratePartition(dataPath, name string, targetVersion int) error {
+	dirPath := filepath.Join(dataPath, name)
+	p, err := openDiskPartition(defaultFileSystem, dirPath, math.MaxInt64, true, defaultAllocator)
+	if errors.Is(err, ErrNoDataPoints) || errors.Is(err, errInvalidPartition) {
+		// Nothing to be migrated.
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open disk partition for %s: %w", dirPath, err)
+	}
+	part := p.(*diskPartition)
+	defer part.close()
+	switch v := part.meta.version(); {
+	case v == targetVersion:
+		return nil
+	case v > targetVersion:
+		return fmt.Errorf("failed to migrate %s: downgrading from version %d to %d is not supported", dirPath, v, targetVersion)
+	}
+
+	m := newMemoryPartition(nil, 0, "").(*memoryPartition)
+	m.minT, m.maxT = part.minTimestamp(), part.maxTimestamp()
+	m.createdAt = part.meta.PartitionCreatedAt
+	if !part.meta.LastWriteAt.IsZero() {
+		m.lastWriteAt = part.meta.LastWriteAt.UnixNano()
+	}
+	for name := range part.meta.Metrics {
+		points, err := part.selectDataPointsByName(name, math.MinInt64, math.MaxInt64)
+		if err != nil {
+			return fmt.Errorf("failed to select data points of %q from %s: %w", name, dirPath, err)
+		}
+		mt := m.getMetric(name)
+		for _, p := range points {
+			mt.insertPoint(p, true)
+		}
+		m.numPoints += int64(len(points))
+	}
+
+	// Write to a directory that isn't regarded as a partition first, not to leave a broken one.
+	tmpDir := filepath.Join(dataPath, migratingDirPrefix+name)
+	s := &storage{
+		dirPerm:         defaultDirPerm,
+		filePerm:        defaultFilePerm,
+		pointsPerBlock:  defaultPointsPerBlock,
+		allocator:       defaultAllocator,
+		flushBufferSize: defaultFlushBufferSize,
+		fsys:            defaultFileSystem,
+		logger:          &nopLogger{},
+	}
+	if err := s.flush(tmpDir, m); err != nil {
+		os.RemoveAll(tmpDir)
+		return fmt.Errorf("failed to rewrite %s: %w", dirPath, err)
+	}
+	// Retention is based on when the partition was persisted originally.
+	if err := updateMeta(tmpDir, func(mt *meta) {
+		mt.CreatedAt = part.meta.CreatedAt
+	}); err != nil {
+		os.RemoveAll(tmpDir)
+		return err
+	}
+
+	// Swap them. recoverMigration completes it if interrupted in between.
+	backupDir := filepath.Join(dataPath, migratedDirPrefix+name)
+	if err := os.Rename(dirPath, backupDir); err != nil {
+		return fmt.Errorf("failed to rename %s to %s: %w", dirPath, backupDir, err)
+	}
+	if err := os.Rename(tmpDir, dirPath); err != nil {
+		return fmt.Errorf("failed to rename %s to %s: %w", tmpDir, dirPath, err)
+	}
+	if err := os.RemoveAll(backupDir); err != nil {
+		return fmt.Errorf("failed to remove %s: %w", backupDir, err)
+	}
+	return nil
+}
+
+// recoverMigration cleans up what the interrupted migration has left under dataPath.
+func recoverMigration(dataPath string) error {
+	dirs, err := os.ReadDir(dataPath)
+	if err != nil {
+		return fmt.Errorf("failed to open data directory: %w", err)
+	}
+	// Complete swaps first, because the rewritten partition is complete once the original one has been moved.
+	for _, e := range dirs {
+		if !e.IsDir() || !strings.HasPrefix(e.Name(), migratedDirPrefix) {
+			continue
+		}
+		name := strings.TrimPrefix(e.Name(), migratedDirPrefix)
+		backupDir := filepath.Join(dataPath, e.Name())
+		dirPath := filepath.Join(dataPath, name)
+		tmpDir := filepath.Join(dataPath, migratingDirPrefix+name)
+		if _, err := os.Stat(dirPath); errors.Is(err, os.ErrNotExist) {
+			src := backupDir
+			if _, err := os.Stat(tmpDir); err == nil {
+				src = tmpDir
+			}
+			if err := os.Rename(src, dirPath); err != nil {
+				return fmt.Errorf("failed to rename %s to %s: %w", src, dirPath, err)
+			}
+		}
+		if err := os.RemoveAll(backupDir); err != nil {
+			return fmt.Errorf("failed to remove %s: %w", backupDir, err)
+		}
+	}
+	// Partitions being rewritten may be broken.
+	for _, e := range dirs {
+		if !e.IsDir() || !strings.HasPrefix(e.Name(), migratingDirPrefix) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(dataPath, e.Name())); err != nil {
+			return fmt.Errorf("failed to remove %s: %w", e.Name(), err)
+		}
+	}
+	return nil
+}
+
+// updateMeta rewrites the meta file of the partition placed at dirPath.
+func updateMeta(dirPath string, update func(m *meta)) error {
+	metaPath := filepath.Join(dirPath, metaFileName)
+	b, err := os.ReadFile(metaPath)
+	if err != nil {
+		return fmt.Errorf("failed to read metadata: %w", err)
+	}
+	m := meta{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return fmt.Errorf("failed to decode metadata: %w", err)
+	}
+	update(&m)
+	b, err = json.Marshal(&m)
+	if err != nil {
+		return fmt.Errorf("failed to encode metadata: %w", err)
+	}
+	if err := writeFile(defaultFileSystem, metaPath, b, defaultFilePerm); err != nil {
+		return fmt.Errorf("failed to write metadata to %s: %w", metaPath, err)
+	}
+	return nil
+}
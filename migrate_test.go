@@ -0,0 +1,136 @@
+package tstorage
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrate(t *testing.T) {
+	createdAt := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	// writeLegacyPartition persists the given rows as a single disk partition without the block index.
+	writeLegacyPartition := func(t *testing.T, dataPath string, rows []Row) string {
+		m := newMemoryPartition(nil, 0, Seconds).(*memoryPartition)
+		_, err := m.insertRows(rows)
+		require.NoError(t, err)
+		dir, err := newPartitionDirPath(defaultFileSystem, dataPath, m.minTimestamp(), m.maxTimestamp())
+		require.NoError(t, err)
+		s := &storage{dirPerm: defaultDirPerm, filePerm: defaultFilePerm, allocator: defaultAllocator, flushBufferSize: defaultFlushBufferSize, fsys: defaultFileSystem, logger: &nopLogger{}}
+		require.NoError(t, s.flush(dir, m))
+		require.NoError(t, updateMeta(dir, func(m *meta) {
+			m.Version = 0
+			m.CreatedAt = createdAt
+			for name, mt := range m.Metrics {
+				mt.Blocks = nil
+				m.Metrics[name] = mt
+			}
+		}))
+		return dir
+	}
+	readMeta := func(t *testing.T, dir string) meta {
+		b, err := os.ReadFile(filepath.Join(dir, metaFileName))
+		require.NoError(t, err)
+		m := meta{}
+		require.NoError(t, json.Unmarshal(b, &m))
+		return m
+	}
+
+	tests := []struct {
+		name string
+		// interrupt leaves the given partition as if the migration got interrupted.
+		interrupt func(t *testing.T, dataPath, dir string)
+	}{
+		{
+			name:      "from scratch",
+			interrupt: func(t *testing.T, dataPath, dir string) {},
+		},
+		{
+			name: "interrupted while rewriting",
+			interrupt: func(t *testing.T, dataPath, dir string) {
+				tmpDir := filepath.Join(dataPath, migratingDirPrefix+filepath.Base(dir))
+				require.NoError(t, os.Mkdir(tmpDir, defaultDirPerm))
+				require.NoError(t, writeFile(defaultFileSystem, filepath.Join(tmpDir, dataFileName), []byte("broken"), defaultFilePerm))
+			},
+		},
+		{
+			name: "interrupted while swapping",
+			interrupt: func(t *testing.T, dataPath, dir string) {
+				require.NoError(t, migratePartition(dataPath, filepath.Base(dir), CurrentFormatVersion))
+				// Put back the original partition as the backup, before the rewritten one takes its place.
+				tmpDir := filepath.Join(dataPath, migratingDirPrefix+filepath.Base(dir))
+				require.NoError(t, os.Rename(dir, tmpDir))
+				writeLegacyPartition(t, dataPath, []Row{
+					{Metric: "metric1", DataPoint: DataPoint{Timestamp: 200, Value: 4}},
+				})
+				require.NoError(t, os.Rename(dir, filepath.Join(dataPath, migratedDirPrefix+filepath.Base(dir))))
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dataPath := t.TempDir()
+			writeLegacyPartition(t, dataPath, []Row{
+				{Metric: "metric1", DataPoint: DataPoint{Timestamp: 100, Value: 1}},
+				{Metric: "metric1", DataPoint: DataPoint{Timestamp: 105, Value: 2}},
+				{Metric: "metric2", DataPoint: DataPoint{Timestamp: 110, Value: 3}},
+			})
+			dir := writeLegacyPartition(t, dataPath, []Row{
+				{Metric: "metric1", DataPoint: DataPoint{Timestamp: 200, Value: 4}},
+			})
+			tt.interrupt(t, dataPath, dir)
+
+			var progress [][2]int
+			err := Migrate(dataPath, CurrentFormatVersion, func(done, total int) {
+				progress = append(progress, [2]int{done, total})
+			})
+			require.NoError(t, err)
+			assert.Equal(t, [][2]int{{1, 2}, {2, 2}}, progress)
+
+			dirs, err := filepath.Glob(filepath.Join(dataPath, "*"))
+			require.NoError(t, err)
+			assert.Equal(t, []string{
+				filepath.Join(dataPath, "p-100-110"),
+				filepath.Join(dataPath, "p-200-200"),
+			}, dirs)
+			for _, dir := range dirs {
+				m := readMeta(t, dir)
+				assert.Equal(t, CurrentFormatVersion, m.Version)
+				assert.True(t, createdAt.Equal(m.CreatedAt))
+				for _, mt := range m.Metrics {
+					assert.Len(t, mt.Blocks, 1)
+				}
+			}
+
+			s, err := NewStorage(WithDataPath(dataPath), WithTimestampPrecision(Seconds), WithRetention(100*365*24*time.Hour))
+			require.NoError(t, err)
+			defer s.Close()
+			points, err := s.Select("metric1", nil, 100, 201)
+			require.NoError(t, err)
+			assert.Equal(t, []*DataPoint{
+				{Timestamp: 100, Value: 1},
+				{Timestamp: 105, Value: 2},
+				{Timestamp: 200, Value: 4},
+			}, points)
+			points, err = s.Select("metric2", nil, 100, 201)
+			require.NoError(t, err)
+			assert.Equal(t, []*DataPoint{{Timestamp: 110, Value: 3}}, points)
+		})
+	}
+}
+
+func TestMigrate_downgrade(t *testing.T) {
+	dataPath := t.TempDir()
+	m := newMemoryPartition(nil, 0, Seconds).(*memoryPartition)
+	_, err := m.insertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 100, Value: 1}}})
+	require.NoError(t, err)
+	s := &storage{dirPerm: defaultDirPerm, filePerm: defaultFilePerm, allocator: defaultAllocator, flushBufferSize: defaultFlushBufferSize, fsys: defaultFileSystem, logger: &nopLogger{}}
+	require.NoError(t, s.flush(filepath.Join(dataPath, "p-100-100"), m))
+
+	assert.Error(t, Migrate(dataPath, formatVersionLegacy, nil))
+	assert.Error(t, Migrate(dataPath, CurrentFormatVersion+1, nil))
+}
@@ -0,0 +1,80 @@
+package tstorage
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// lastTimestamps tracks the latest timestamp of each series, to enforce monotonic timestamps.
+type lastTimestamps struct {
+	mu sync.Mutex
+	m  map[string]int64
+}
+
+func newLastTimestamps() *lastTimestamps {
+	return &lastTimestamps{m: make(map[string]int64)}
+}
+
+// enforceMonotonicTimestamps gives back the rows newer than the latest ones of the same series,
+// with an error wrapping ErrOutOfOrder if some rows are rejected. It is a no-op unless enabled.
+// The latest timestamps are advanced only by the rows given to commit, which must be called once
+// with the rows accepted eventually; the rows failed to be inserted don't make later ones rejected.
+// Inserts are serialized until commit gets called, not to let concurrent ones accept the same timestamp.
+func (s *storage) enforceMonotonicTimestamps(rows []Row) (filtered []Row, commit func(accepted []Row), err error) {
+	if !s.enforceMonotonic {
+		return rows, func([]Row) {}, nil
+	}
+	l := s.lastTimestamps
+	l.mu.Lock()
+	commit = func(accepted []Row) {
+		defer l.mu.Unlock()
+		for i := range accepted {
+			if accepted[i].Timestamp == 0 {
+				continue
+			}
+			name := marshalMetricName(accepted[i].Metric, accepted[i].Labels)
+			if last, ok := l.m[name]; !ok || accepted[i].Timestamp > last {
+				l.m[name] = accepted[i].Timestamp
+			}
+		}
+	}
+
+	// Rows in the given ones have to be newer than the preceding ones of the same series as well.
+	var latest map[string]int64
+	for i := range rows {
+		row := rows[i]
+		// Rows without timestamp get the current time later, so that they are regarded as the latest.
+		if row.Timestamp == 0 {
+			if filtered != nil {
+				filtered = append(filtered, row)
+			}
+			continue
+		}
+		name := marshalMetricName(row.Metric, row.Labels)
+		last, ok := latest[name]
+		if !ok {
+			last, ok = l.m[name]
+		}
+		if ok && row.Timestamp <= last {
+			if filtered == nil {
+				// Copy not to modify the given rows.
+				filtered = append(make([]Row, 0, len(rows)), rows[:i]...)
+			}
+			continue
+		}
+		if latest == nil {
+			latest = make(map[string]int64)
+		}
+		latest[name] = row.Timestamp
+		if filtered != nil {
+			filtered = append(filtered, row)
+		}
+	}
+	if filtered == nil {
+		return rows, commit, nil
+	}
+	n := len(rows) - len(filtered)
+	atomic.AddInt64(&s.stats.monotonicityViolations, int64(n))
+	return filtered, commit, fmt.Errorf("%d data points are not newer than the latest ones of the same series: %w", n, ErrOutOfOrder)
+}
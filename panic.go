@@ -0,0 +1,49 @@
+package tstorage
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sync/atomic"
+)
+
+// WithPanicRecovery specifies whether to recover from panics while inserting rows and flushing with Flush,
+// which are returned as errors wrapping ErrPanicked instead of crashing the caller.
+// Panics in background tasks such as flushing partitions and removing expired ones are recovered regardless,
+// and logged with the Logger, since nothing could catch them otherwise.
+// The number of panics recovered can be seen through Stats.
+//
+// Defaults to false.
+func WithPanicRecovery(enabled bool) Option {
+	return func(s *storage) {
+		s.panicRecovery = enabled
+	}
+}
+
+// recoverPanic converts the panic into an error wrapping ErrPanicked, and assigns it to err, under WithPanicRecovery.
+// It must be deferred directly, since recover works only if called by a deferred function.
+func (s *storage) recoverPanic(err *error) {
+	if !s.panicRecovery {
+		return
+	}
+	s.panicked(recover(), err)
+}
+
+// recoverBackgroundPanic is like recoverPanic, but always recovers since it's for background tasks.
+func (s *storage) recoverBackgroundPanic(err *error) {
+	s.panicked(recover(), err)
+}
+
+// panicked converts the given value recovered into an error wrapping ErrPanicked, and assigns it to err.
+func (s *storage) panicked(r interface{}, err *error) {
+	if r == nil {
+		return
+	}
+	atomic.AddInt64(&s.stats.panicsRecovered, 1)
+	*err = fmt.Errorf("%w: %v\n%s", ErrPanicked, r, debug.Stack())
+}
+
+// recovered calls fn in a background task, and gives back the error it returns, or the panic converted into an error.
+func (s *storage) recovered(fn func() error) (err error) {
+	defer s.recoverBackgroundPanic(&err)
+	return fn()
+}
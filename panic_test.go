@@ -0,0 +1,56 @@
+package tstorage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_storage_InsertRows_withPanicRecovery(t *testing.T) {
+	rows := []Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1, Value: 0.1}}}
+
+	t.Run("recovered", func(t *testing.T) {
+		s, err := NewStorage(WithPanicRecovery(true))
+		require.NoError(t, err)
+		defer s.Close()
+		st := s.(*storage)
+		st.partitionList.insert(&fakePartition{IsActive: true, insertPanic: "injected"})
+
+		// More than the worker slots, which must be released even after panics.
+		for i := 0; i <= defaultWorkersLimit; i++ {
+			err := s.InsertRows(rows)
+			assert.ErrorIs(t, err, ErrPanicked)
+			assert.Contains(t, err.Error(), "injected")
+		}
+		assert.Equal(t, int64(defaultWorkersLimit+1), s.Stats().PanicsRecovered)
+	})
+
+	t.Run("disabled by default", func(t *testing.T) {
+		s, err := NewStorage()
+		require.NoError(t, err)
+		defer s.Close()
+		st := s.(*storage)
+		st.partitionList.insert(&fakePartition{IsActive: true, insertPanic: "injected"})
+
+		assert.PanicsWithValue(t, "injected", func() {
+			_ = s.InsertRows(rows)
+		})
+		assert.Equal(t, int64(0), s.Stats().PanicsRecovered)
+	})
+}
+
+func Test_storage_recovered(t *testing.T) {
+	// Background tasks are recovered even if WithPanicRecovery isn't given.
+	s := &storage{stats: &storageStats{}, partitionList: newPartitionList()}
+	err := s.recovered(func() error {
+		var m map[string]int
+		m["nil map"] = 1
+		return nil
+	})
+	assert.ErrorIs(t, err, ErrPanicked)
+	assert.Equal(t, int64(1), s.Stats().PanicsRecovered)
+
+	assert.NoError(t, s.recovered(func() error { return nil }))
+	assert.Equal(t, int64(1), s.Stats().PanicsRecovered)
+}
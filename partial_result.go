@@ -0,0 +1,63 @@
+package tstorage
+
+import (
+	"fmt"
+	"math"
+	"path/filepath"
+)
+
+// SkippedPartition describes a partition whose data points are unavailable.
+type SkippedPartition struct {
+	PartitionInfo
+	// Err is the reason why the partition is unavailable.
+	Err error
+}
+
+// PartialResultError is returned by SelectStrict if some of the partitions overlapping the range are unavailable.
+type PartialResultError struct {
+	// Points holds the data points selected from the available partitions, in ascending order.
+	Points []*DataPoint
+	// Skipped holds the unavailable partitions overlapping the range.
+	Skipped []SkippedPartition
+}
+
+func (e *PartialResultError) Error() string {
+	return fmt.Sprintf("%v: %d partitions unavailable", ErrPartialResult, len(e.Skipped))
+}
+
+func (e *PartialResultError) Unwrap() error {
+	return ErrPartialResult
+}
+
+// newSkippedPartition describes the partition at dirPath failed to be opened.
+// The time range is taken from the directory name, or regarded as unbounded if it can't be parsed.
+func newSkippedPartition(dirPath string, err error) SkippedPartition {
+	info := PartitionInfo{DirPath: dirPath}
+	if _, scanErr := fmt.Sscanf(filepath.Base(dirPath), "p-%d-%d", &info.MinTimestamp, &info.MaxTimestamp); scanErr != nil {
+		info.MinTimestamp, info.MaxTimestamp = math.MinInt64, math.MaxInt64
+	}
+	return SkippedPartition{PartitionInfo: info, Err: err}
+}
+
+func (s *storage) SelectStrict(metric string, labels []Label, start, end int64) ([]*DataPoint, error) {
+	pointsList, n, skipped, err := s.selectAvailablePartitionPoints(metric, labels, start, end, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range s.skippedPartitions {
+		if p.MaxTimestamp >= start && p.MinTimestamp < end {
+			skipped = append(skipped, p)
+		}
+	}
+	points := make([]*DataPoint, 0, n)
+	for _, ps := range pointsList {
+		points = append(points, ps...)
+	}
+	if len(skipped) > 0 {
+		return nil, &PartialResultError{Points: points, Skipped: skipped}
+	}
+	if n == 0 {
+		return nil, ErrNoDataPoints
+	}
+	return points, nil
+}
@@ -1,5 +1,7 @@
 package tstorage
 
+import "time"
+
 // partition is a chunk of time-series data with the timestamp range.
 // A partition acts as a fully independent database containing all data
 // points for its time range.
@@ -23,6 +25,8 @@ type partition interface {
 	//
 	// selectDataPoints gives back certain metric's data points within the given range.
 	selectDataPoints(metric string, labels []Label, start, end int64) ([]*DataPoint, error)
+	// countDataPoints gives back the number of certain metric's data points within the given range.
+	countDataPoints(metric string, labels []Label, start, end int64) (int, error)
 	// minTimestamp returns the minimum Unix timestamp in milliseconds.
 	minTimestamp() int64
 	// maxTimestamp returns the maximum Unix timestamp in milliseconds.
@@ -34,3 +38,44 @@ type partition interface {
 	// expired means it should get removed.
 	expired() bool
 }
+
+// PartitionInfo describes a partition.
+type PartitionInfo struct {
+	// The minimum timestamp of data points the partition holds.
+	MinTimestamp int64
+	// The maximum timestamp of data points the partition holds.
+	MaxTimestamp int64
+	// The number of data points the partition holds.
+	NumDataPoints int
+	// The path to the directory the partition is persisted to.
+	// Empty if the partition is still in memory.
+	DirPath string
+	// The wall-clock time when the partition was created in memory.
+	CreatedAt time.Time
+	// The wall-clock time when rows were most recently written into the partition.
+	// Comparing it with timestamps of data points reveals ingestion lag.
+	LastWriteAt time.Time
+	// The wall-clock time when the partition was persisted to the disk.
+	// Zero if the partition is still in memory.
+	PersistedAt time.Time
+}
+
+// newPartitionInfo gives back the description of the given partition.
+func newPartitionInfo(p partition) PartitionInfo {
+	info := PartitionInfo{
+		MinTimestamp:  p.minTimestamp(),
+		MaxTimestamp:  p.maxTimestamp(),
+		NumDataPoints: p.size(),
+	}
+	switch p := p.(type) {
+	case *memoryPartition:
+		info.CreatedAt = p.createdAt
+		info.LastWriteAt = p.lastWriteTime()
+	case *diskPartition:
+		info.DirPath = p.dirPath
+		info.CreatedAt = p.meta.PartitionCreatedAt
+		info.LastWriteAt = p.meta.LastWriteAt
+		info.PersistedAt = p.meta.CreatedAt
+	}
+	return info
+}
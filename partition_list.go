@@ -20,6 +20,12 @@ type partitionList interface {
 	remove(partition partition) error
 	// swap replaces the old partition with the new one.
 	swap(old, new partition) error
+	// insertAfter puts the new partition right after the given one, which is identified by itself.
+	insertAfter(prev, partition partition) error
+	// replace substitutes the new partition for all of the old ones at once.
+	replace(olds []partition, new partition) error
+	// mergeInto merges src into the newer dst with the given function, and then unlinks src.
+	mergeInto(src, dst partition, merge func()) error
 	// getHead gives back the head node which is the newest one.
 	getHead() partition
 	// size returns the number of partitions of itself.
@@ -55,6 +61,9 @@ type partitionListImpl struct {
 	head          *partitionNode
 	tail          *partitionNode
 	mu            sync.RWMutex
+	// writeMu serializes insert, remove and swap, since each of them reads and updates
+	// multiple nodes. Iterators don't need it because every single update is atomic.
+	writeMu sync.Mutex
 }
 
 func newPartitionList() partitionList {
@@ -71,6 +80,8 @@ func (p *partitionListImpl) getHead() partition {
 }
 
 func (p *partitionListImpl) insert(partition partition) {
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
 	node := &partitionNode{
 		val: partition,
 	}
@@ -85,9 +96,47 @@ func (p *partitionListImpl) insert(partition partition) {
 	atomic.AddInt64(&p.numPartitions, 1)
 }
 
+func (p *partitionListImpl) insertAfter(prev, partition partition) error {
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+	iterator := p.newIterator()
+	for iterator.next() {
+		current := iterator.currentNode()
+		if current.value() != prev {
+			continue
+		}
+		node := &partitionNode{
+			val:  partition,
+			next: current.getNext(),
+		}
+		current.setNext(node)
+		if node.next == nil {
+			p.setTail(node)
+		}
+		atomic.AddInt64(&p.numPartitions, 1)
+		return nil
+	}
+	return fmt.Errorf("the given partition was not found")
+}
+
 func (p *partitionListImpl) remove(target partition) error {
+	removed, err := p.unlink(target)
+	if err != nil {
+		return err
+	}
+	// Clean it outside of the lock because it may take a while.
+	if err := removed.clean(); err != nil {
+		return fmt.Errorf("failed to clean resources managed by partition to be removed: %w", err)
+	}
+	return nil
+}
+
+// unlink eliminates the given partition from the list, and gives back the removed one.
+func (p *partitionListImpl) unlink(target partition) (partition, error) {
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
 	if p.size() <= 0 {
-		return fmt.Errorf("empty partition")
+		return nil, fmt.Errorf("empty partition")
 	}
 
 	// Iterate over itself from the head.
@@ -117,17 +166,15 @@ func (p *partitionListImpl) remove(target partition) error {
 			prev.setNext(next)
 		}
 		atomic.AddInt64(&p.numPartitions, -1)
-
-		if err := current.value().clean(); err != nil {
-			return fmt.Errorf("failed to clean resources managed by partition to be removed: %w", err)
-		}
-		return nil
+		return current.value(), nil
 	}
 
-	return fmt.Errorf("the given partition was not found")
+	return nil, fmt.Errorf("the given partition was not found")
 }
 
 func (p *partitionListImpl) swap(old, new partition) error {
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
 	if p.size() <= 0 {
 		return fmt.Errorf("empty partition")
 	}
@@ -168,6 +215,103 @@ func (p *partitionListImpl) swap(old, new partition) error {
 	return fmt.Errorf("the given partition was not found")
 }
 
+// replace puts the new partition where the oldest of olds is, and unlinks the rest of them.
+// Unlike remove and swap, it identifies partitions by themselves rather than by the min timestamp,
+// since overlapping ones to be replaced may share it.
+func (p *partitionListImpl) replace(olds []partition, new partition) error {
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+	targets := make(map[partition]struct{}, len(olds))
+	for _, old := range olds {
+		targets[old] = struct{}{}
+	}
+	// Make sure all of them exist not to leave the list half updated.
+	found := 0
+	iterator := p.newIterator()
+	for iterator.next() {
+		if _, ok := targets[iterator.value()]; ok {
+			found++
+		}
+	}
+	if found == 0 || found != len(targets) {
+		return fmt.Errorf("the given partitions were not found")
+	}
+
+	var prev *partitionNode
+	iterator = p.newIterator()
+	for iterator.next() {
+		current := iterator.currentNode()
+		if _, ok := targets[current.value()]; !ok {
+			prev = current
+			continue
+		}
+		found--
+		next := current.getNext()
+		if found > 0 {
+			// Unlink it. The oldest one comes later, so it's never the tail.
+			if prev == nil {
+				p.setHead(next)
+			} else {
+				prev.setNext(next)
+			}
+			atomic.AddInt64(&p.numPartitions, -1)
+			continue
+		}
+		newNode := &partitionNode{
+			val:  new,
+			next: next,
+		}
+		if prev == nil {
+			p.setHead(newNode)
+		} else {
+			prev.setNext(newNode)
+		}
+		if next == nil {
+			p.setTail(newNode)
+		}
+		return nil
+	}
+	return nil
+}
+
+// mergeInto identifies partitions by themselves like replace, since dst takes over the min timestamp of src.
+// The other updates wait for it, so that they never see dst half merged. Selects meanwhile may see
+// the merged data points in both, but never in neither.
+func (p *partitionListImpl) mergeInto(src, dst partition, merge func()) error {
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+	var prev, srcNode *partitionNode
+	foundDst := false
+	iterator := p.newIterator()
+	for iterator.next() {
+		current := iterator.currentNode()
+		if current.value() == src {
+			srcNode = current
+			break
+		}
+		if current.value() == dst {
+			foundDst = true
+		}
+		prev = current
+	}
+	if srcNode == nil || !foundDst {
+		return fmt.Errorf("the given partitions were not found")
+	}
+	merge()
+
+	next := srcNode.getNext()
+	if prev == nil {
+		p.setHead(next)
+	} else {
+		prev.setNext(next)
+	}
+	if next == nil {
+		p.setTail(prev)
+	}
+	atomic.AddInt64(&p.numPartitions, -1)
+	return nil
+}
+
 func samePartitions(x, y partition) bool {
 	return x.minTimestamp() == y.minTimestamp()
 }
@@ -1,9 +1,12 @@
 package tstorage
 
 import (
+	"fmt"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func Test_partitionList_Remove(t *testing.T) {
@@ -414,3 +417,143 @@ func Test_partitionList_Swap(t *testing.T) {
 		})
 	}
 }
+
+func Test_partitionList_concurrent(t *testing.T) {
+	const numPartitions = 200
+	list := newPartitionList()
+
+	var wg sync.WaitGroup
+	doneCh := make(chan struct{})
+	// Keep iterating while modifying, to check the list is always consistent.
+	iterErrCh := make(chan error, 1)
+	go func() {
+		defer close(iterErrCh)
+		for {
+			select {
+			case <-doneCh:
+				return
+			default:
+			}
+			seen := make(map[int64]bool)
+			iterator := list.newIterator()
+			for iterator.next() {
+				minT := iterator.value().minTimestamp()
+				if seen[minT] {
+					iterErrCh <- fmt.Errorf("partition %d found twice", minT)
+					return
+				}
+				seen[minT] = true
+			}
+		}
+	}()
+
+	for i := int64(1); i <= numPartitions; i++ {
+		wg.Add(1)
+		go func(minT int64) {
+			defer wg.Done()
+			list.insert(&fakePartition{minT: minT})
+			// Mark it swapped with maxT.
+			assert.NoError(t, list.swap(&fakePartition{minT: minT}, &fakePartition{minT: minT, maxT: minT}))
+			if minT%2 == 0 {
+				assert.NoError(t, list.remove(&fakePartition{minT: minT}))
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(doneCh)
+	require.NoError(t, <-iterErrCh)
+
+	got := make(map[int64]bool)
+	iterator := list.newIterator()
+	for iterator.next() {
+		p := iterator.value()
+		assert.False(t, got[p.minTimestamp()], "partition %d found twice", p.minTimestamp())
+		assert.Equal(t, p.minTimestamp(), p.maxTimestamp(), "partition %d isn't swapped", p.minTimestamp())
+		got[p.minTimestamp()] = true
+	}
+	assert.Equal(t, numPartitions/2, list.size())
+	assert.Len(t, got, numPartitions/2)
+	for i := int64(1); i <= numPartitions; i += 2 {
+		assert.True(t, got[i], "partition %d is lost", i)
+	}
+}
+
+func Test_partitionList_replace(t *testing.T) {
+	list := newPartitionList()
+	p1 := &fakePartition{minT: 1}
+	p2 := &fakePartition{minT: 1}
+	p3 := &fakePartition{minT: 3}
+	list.insert(p1)
+	list.insert(p2)
+	list.insert(p3)
+
+	merged := &fakePartition{minT: 1, maxT: 2}
+	require.NoError(t, list.replace([]partition{p1, p2}, merged))
+	assert.Equal(t, 2, list.size())
+	iterator := list.newIterator()
+	var got []partition
+	for iterator.next() {
+		got = append(got, iterator.value())
+	}
+	assert.Equal(t, []partition{p3, merged}, got)
+
+	assert.Error(t, list.replace([]partition{p1}, merged))
+}
+
+func Test_partitionList_insertAfter(t *testing.T) {
+	list := newPartitionList()
+	p1 := &fakePartition{minT: 1}
+	p3 := &fakePartition{minT: 3}
+	list.insert(p1)
+	list.insert(p3)
+
+	p2 := &fakePartition{minT: 2}
+	require.NoError(t, list.insertAfter(p3, p2))
+	p0 := &fakePartition{minT: 0}
+	require.NoError(t, list.insertAfter(p1, p0))
+	assert.Equal(t, 4, list.size())
+	iterator := list.newIterator()
+	var got []partition
+	for iterator.next() {
+		got = append(got, iterator.value())
+	}
+	assert.Equal(t, []partition{p3, p2, p1, p0}, got)
+
+	assert.Error(t, list.insertAfter(&fakePartition{minT: 5}, p2))
+}
+
+func Test_partitionList_mergeInto(t *testing.T) {
+	list := newPartitionList()
+	p1 := &fakePartition{minT: 1}
+	p2 := &fakePartition{minT: 2}
+	p3 := &fakePartition{minT: 3}
+	list.insert(p1)
+	list.insert(p2)
+	list.insert(p3)
+
+	values := func() []partition {
+		var got []partition
+		iterator := list.newIterator()
+		for iterator.next() {
+			got = append(got, iterator.value())
+		}
+		return got
+	}
+	// The tail gets merged while it's still in the list, and the other one having taken over its min timestamp is kept.
+	require.NoError(t, list.mergeInto(p1, p2, func() {
+		assert.Equal(t, []partition{p3, p2, p1}, values())
+		p2.minT = 1
+	}))
+	assert.Equal(t, []partition{p3, p2}, values())
+	assert.Equal(t, 2, list.size())
+	assert.Equal(t, p2, list.(*partitionListImpl).tail.value())
+
+	require.NoError(t, list.mergeInto(p2, p3, func() {}))
+	assert.Equal(t, []partition{p3}, values())
+
+	called := false
+	assert.Error(t, list.mergeInto(p1, p3, func() { called = true }))
+	// The destination must be newer.
+	assert.Error(t, list.mergeInto(p3, &fakePartition{minT: 4}, func() { called = true }))
+	assert.False(t, called)
+}
@@ -0,0 +1,42 @@
+package tstorage
+
+import (
+	"errors"
+	"fmt"
+)
+
+// PartitionResult is the contribution of a partition to the result of a query. See Reader.SelectByPartition
+type PartitionResult struct {
+	PartitionInfo
+	// Points holds the data points selected from the partition, in ascending order.
+	// It is empty if the partition overlaps the range but has no data points of the metric.
+	Points []*DataPoint
+}
+
+func (s *storage) SelectByPartition(metric string, labels []Label, start, end int64) ([]PartitionResult, error) {
+	metric = s.normalizeMetricName(metric)
+	if metric == "" {
+		return nil, fmt.Errorf("metric must be set")
+	}
+	if start >= end {
+		return nil, fmt.Errorf("the given start is greater than end")
+	}
+	parts, release, err := s.pinnedPartitions(start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	results := make([]PartitionResult, 0, len(parts))
+	// Iterate from the oldest one, to keep the order in ascending.
+	for i := len(parts) - 1; i >= 0; i-- {
+		points, err := parts[i].selectDataPoints(metric, labels, start, end)
+		if err != nil && !errors.Is(err, ErrNoDataPoints) {
+			return nil, fmt.Errorf("failed to select data points: %w", err)
+		}
+		results = append(results, PartitionResult{
+			PartitionInfo: newPartitionInfo(parts[i]),
+			Points:        points,
+		})
+	}
+	return results, nil
+}
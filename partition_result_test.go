@@ -0,0 +1,88 @@
+package tstorage
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_storage_SelectByPartition(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tstorage-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	s, err := NewStorage(WithDataPath(tmpDir), WithTimestampPrecision(Seconds), WithPartitionDuration(time.Hour))
+	require.NoError(t, err)
+	defer s.Close()
+	// Makes three partitions: {1, 5000}, {10000, 15000} and {20000}, where metric2 is only in the first one.
+	for _, ts := range []int64{1, 5000, 10000, 15000, 20000} {
+		rows := []Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: ts}}}
+		if ts < 10000 {
+			rows = append(rows, Row{Metric: "metric2", DataPoint: DataPoint{Timestamp: ts}})
+		}
+		require.NoError(t, s.InsertRows(rows))
+	}
+	require.NoError(t, s.FlushAsync().Wait())
+
+	tests := []struct {
+		name       string
+		metric     string
+		start      int64
+		end        int64
+		wantRanges [][2]int64
+		wantPoints [][]*DataPoint
+	}{
+		{
+			name:       "spanning all partitions",
+			metric:     "metric1",
+			start:      0,
+			end:        20001,
+			wantRanges: [][2]int64{{1, 5000}, {10000, 15000}, {20000, 20000}},
+			wantPoints: [][]*DataPoint{
+				{{Timestamp: 1}, {Timestamp: 5000}},
+				{{Timestamp: 10000}, {Timestamp: 15000}},
+				{{Timestamp: 20000}},
+			},
+		},
+		{
+			name:       "partially overlapping",
+			metric:     "metric1",
+			start:      5000,
+			end:        12000,
+			wantRanges: [][2]int64{{1, 5000}, {10000, 15000}},
+			wantPoints: [][]*DataPoint{
+				{{Timestamp: 5000}},
+				{{Timestamp: 10000}},
+			},
+		},
+		{
+			name:       "metric in a part of partitions",
+			metric:     "metric2",
+			start:      0,
+			end:        20001,
+			wantRanges: [][2]int64{{1, 5000}, {10000, 15000}, {20000, 20000}},
+			wantPoints: [][]*DataPoint{
+				{{Timestamp: 1}, {Timestamp: 5000}},
+				{},
+				{},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results, err := s.SelectByPartition(tt.metric, nil, tt.start, tt.end)
+			require.NoError(t, err)
+			gotRanges := make([][2]int64, 0, len(results))
+			gotPoints := make([][]*DataPoint, 0, len(results))
+			for _, r := range results {
+				gotRanges = append(gotRanges, [2]int64{r.MinTimestamp, r.MaxTimestamp})
+				gotPoints = append(gotPoints, append([]*DataPoint{}, r.Points...))
+			}
+			assert.Equal(t, tt.wantRanges, gotRanges)
+			assert.Equal(t, tt.wantPoints, gotPoints)
+		})
+	}
+}
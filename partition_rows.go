@@ -0,0 +1,87 @@
+package tstorage
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+func (s *storage) ForEachPartitionInRange(start, end int64, fn func(info PartitionInfo, rows []Row) error) error {
+	if fn == nil {
+		return fmt.Errorf("callback must be set")
+	}
+	if start >= end {
+		return fmt.Errorf("the given start is greater than end")
+	}
+	parts, err := s.overlappingPartitions(start, end)
+	if err != nil {
+		return err
+	}
+	// Iterate from the oldest one, to keep the order in ascending.
+	for i := len(parts) - 1; i >= 0; i-- {
+		part := parts[i]
+		if d, ok := part.(*diskPartition); ok && !d.pin() {
+			// Already removed by retention.
+			continue
+		}
+		rows, err := partitionRows(part, start, end)
+		if unpinErr := unpinPartition(part); unpinErr != nil && err == nil {
+			err = unpinErr
+		}
+		if err != nil {
+			return err
+		}
+		if len(rows) == 0 {
+			continue
+		}
+		if err := fn(newPartitionInfo(part), rows); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// partitionRows gives back all rows within the given range in the given partition,
+// in order by series and then by timestamp.
+func partitionRows(part partition, start, end int64) ([]Row, error) {
+	names, err := seriesNames(part)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+
+	var rows []Row
+	for _, name := range names {
+		metric, labels, _ := unmarshalMetricName(name)
+		points, err := part.selectDataPoints(metric, labels, start, end)
+		if errors.Is(err, ErrNoDataPoints) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to select data points of %q: %w", metric, err)
+		}
+		for _, p := range points {
+			rows = append(rows, Row{Metric: metric, Labels: labels, DataPoint: *p})
+		}
+	}
+	return rows, nil
+}
+
+// seriesNames gives back the names of all series in the given partition, built by marshalMetricName.
+func seriesNames(part partition) ([]string, error) {
+	var names []string
+	switch p := part.(type) {
+	case *memoryPartition:
+		p.metrics.Range(func(key, _ interface{}) bool {
+			names = append(names, key.(string))
+			return true
+		})
+	case *diskPartition:
+		for name := range p.meta.Metrics {
+			names = append(names, name)
+		}
+	default:
+		return nil, fmt.Errorf("unknown partition type %T", part)
+	}
+	return names, nil
+}
@@ -0,0 +1,61 @@
+package tstorage
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_storage_ForEachPartitionInRange(t *testing.T) {
+	tmpDir := t.TempDir()
+	opts := []Option{WithDataPath(tmpDir), WithTimestampPrecision(Seconds), WithPartitionDuration(time.Hour)}
+	s, err := NewStorage(opts...)
+	require.NoError(t, err)
+	require.NoError(t, s.InsertRows([]Row{
+		{Metric: "metric1", Labels: []Label{{Name: "host", Value: "a"}}, DataPoint: DataPoint{Timestamp: 1, Value: 0.1}},
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 2, Value: 0.2}},
+		{Metric: "metric2", DataPoint: DataPoint{Timestamp: 3, Value: 0.3}},
+	}))
+	require.NoError(t, s.Close())
+	s, err = NewStorage(opts...)
+	require.NoError(t, err)
+	defer s.Close()
+	require.NoError(t, s.InsertRows([]Row{
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 10000, Value: 1}},
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 10002, Value: 1.2}},
+	}))
+
+	var infos []PartitionInfo
+	var got [][]Row
+	err = s.ForEachPartitionInRange(2, 10001, func(info PartitionInfo, rows []Row) error {
+		infos = append(infos, info)
+		got = append(got, rows)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Len(t, infos, 2)
+	assert.NotEmpty(t, infos[0].DirPath)
+	assert.Empty(t, infos[1].DirPath)
+	assert.Equal(t, [][]Row{
+		{
+			{Metric: "metric1", DataPoint: DataPoint{Timestamp: 2, Value: 0.2}},
+			{Metric: "metric2", DataPoint: DataPoint{Timestamp: 3, Value: 0.3}},
+		},
+		{
+			{Metric: "metric1", DataPoint: DataPoint{Timestamp: 10000, Value: 1}},
+		},
+	}, got)
+
+	// Stops at the first error.
+	wantErr := errors.New("stop")
+	calls := 0
+	err = s.ForEachPartitionInRange(1, 10003, func(info PartitionInfo, rows []Row) error {
+		calls++
+		return wantErr
+	})
+	assert.ErrorIs(t, err, wantErr)
+	assert.Equal(t, 1, calls)
+}
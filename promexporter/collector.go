@@ -0,0 +1,125 @@
+// Package promexporter exposes the internal statistics of a tstorage.Storage as Prometheus metrics.
+// It lives in a separate module so that the core package doesn't depend on the Prometheus client.
+package promexporter
+
+import (
+	"github.com/nakabonne/tstorage"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "tstorage"
+
+var (
+	rowsInsertedDesc = prometheus.NewDesc(namespace+"_rows_inserted_total",
+		"The number of rows inserted into partitions.", nil, nil)
+	partitionsFlushedDesc = prometheus.NewDesc(namespace+"_partitions_flushed_total",
+		"The number of partitions persisted to the disk.", nil, nil)
+	selectsDesc = prometheus.NewDesc(namespace+"_selects_total",
+		"The number of selects walking partitions.", nil, nil)
+	outOfOrderPointsDesc = prometheus.NewDesc(namespace+"_out_of_order_points_total",
+		"The number of out-of-order data points by how they were handled.", []string{"action"}, nil)
+	pointsDeduplicatedDesc = prometheus.NewDesc(namespace+"_points_deduplicated_total",
+		"The number of data points deduplicated within the dedupe window.", nil, nil)
+	monotonicityViolationsDesc = prometheus.NewDesc(namespace+"_monotonicity_violations_total",
+		"The number of data points rejected for non-monotonic timestamps.", nil, nil)
+	walDiskFullDesc = prometheus.NewDesc(namespace+"_wal_disk_full",
+		"Whether the last append to the WAL failed because the disk is full.", nil, nil)
+	walRowsDroppedDesc = prometheus.NewDesc(namespace+"_wal_rows_dropped_total",
+		"The number of rows ingested without being written to the WAL.", nil, nil)
+	panicsRecoveredDesc = prometheus.NewDesc(namespace+"_panics_recovered_total",
+		"The number of panics recovered.", nil, nil)
+	partitionCacheHitsDesc = prometheus.NewDesc(namespace+"_partition_cache_hits_total",
+		"The number of reads of disk partitions whose data file had been loaded.", nil, nil)
+	partitionCacheMissesDesc = prometheus.NewDesc(namespace+"_partition_cache_misses_total",
+		"The number of reads of disk partitions that had to load the data file.", nil, nil)
+	corruptPartitionsDesc = prometheus.NewDesc(namespace+"_corrupt_partitions_total",
+		"The number of disk partitions the scrubber found corrupt.", nil, nil)
+	lastScrubDesc = prometheus.NewDesc(namespace+"_last_scrub_timestamp_seconds",
+		"The unix time when the scrubber finished the last pass.", nil, nil)
+	memoryUsageDesc = prometheus.NewDesc(namespace+"_memory_usage_bytes",
+		"The estimated number of bytes held by memory partitions.", nil, nil)
+	partitionsDesc = prometheus.NewDesc(namespace+"_partitions",
+		"The number of partitions by where they reside.", []string{"location"}, nil)
+	dataPointsDesc = prometheus.NewDesc(namespace+"_data_points",
+		"The number of data points by where they reside.", []string{"location"}, nil)
+)
+
+// Collector gives back a prometheus.Collector exposing the internal statistics of the given storage.
+// The statistics are read every time it gets scraped.
+//
+//	prometheus.MustRegister(promexporter.Collector(storage))
+func Collector(s tstorage.Storage) prometheus.Collector {
+	return &collector{storage: s}
+}
+
+type collector struct {
+	storage tstorage.Storage
+}
+
+func (c *collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- rowsInsertedDesc
+	ch <- partitionsFlushedDesc
+	ch <- selectsDesc
+	ch <- outOfOrderPointsDesc
+	ch <- pointsDeduplicatedDesc
+	ch <- monotonicityViolationsDesc
+	ch <- walDiskFullDesc
+	ch <- walRowsDroppedDesc
+	ch <- panicsRecoveredDesc
+	ch <- partitionCacheHitsDesc
+	ch <- partitionCacheMissesDesc
+	ch <- corruptPartitionsDesc
+	ch <- lastScrubDesc
+	ch <- memoryUsageDesc
+	ch <- partitionsDesc
+	ch <- dataPointsDesc
+}
+
+func (c *collector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.storage.Stats()
+	counter := func(desc *prometheus.Desc, v int64, labelValues ...string) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, float64(v), labelValues...)
+	}
+	counter(rowsInsertedDesc, stats.RowsInserted)
+	counter(partitionsFlushedDesc, stats.PartitionsFlushed)
+	counter(selectsDesc, stats.Selects)
+	counter(outOfOrderPointsDesc, stats.OutOfOrderAccepted, "accepted")
+	counter(outOfOrderPointsDesc, stats.OutOfOrderRejected, "rejected")
+	counter(outOfOrderPointsDesc, stats.OutOfOrderDropped, "dropped")
+	counter(pointsDeduplicatedDesc, stats.PointsDeduplicated)
+	counter(monotonicityViolationsDesc, stats.MonotonicityViolations)
+	counter(walRowsDroppedDesc, stats.WALRowsDropped)
+	counter(panicsRecoveredDesc, stats.PanicsRecovered)
+	counter(partitionCacheHitsDesc, stats.PartitionCacheHits)
+	counter(partitionCacheMissesDesc, stats.PartitionCacheMisses)
+	counter(corruptPartitionsDesc, stats.CorruptPartitions)
+
+	var lastScrub float64
+	if !stats.LastScrubAt.IsZero() {
+		lastScrub = float64(stats.LastScrubAt.UnixNano()) / 1e9
+	}
+	ch <- prometheus.MustNewConstMetric(lastScrubDesc, prometheus.GaugeValue, lastScrub)
+	ch <- prometheus.MustNewConstMetric(memoryUsageDesc, prometheus.GaugeValue, float64(stats.MemoryUsage))
+
+	var walDiskFull float64
+	if stats.WALDiskFull {
+		walDiskFull = 1
+	}
+	ch <- prometheus.MustNewConstMetric(walDiskFullDesc, prometheus.GaugeValue, walDiskFull)
+
+	var memoryPartitions, diskPartitions, memoryPoints, diskPoints int
+	for _, p := range c.storage.ListPartitions() {
+		// Partitions still in memory have no directory.
+		if p.DirPath == "" {
+			memoryPartitions++
+			memoryPoints += p.NumDataPoints
+			continue
+		}
+		diskPartitions++
+		diskPoints += p.NumDataPoints
+	}
+	ch <- prometheus.MustNewConstMetric(partitionsDesc, prometheus.GaugeValue, float64(memoryPartitions), "memory")
+	ch <- prometheus.MustNewConstMetric(partitionsDesc, prometheus.GaugeValue, float64(diskPartitions), "disk")
+	ch <- prometheus.MustNewConstMetric(dataPointsDesc, prometheus.GaugeValue, float64(memoryPoints), "memory")
+	ch <- prometheus.MustNewConstMetric(dataPointsDesc, prometheus.GaugeValue, float64(diskPoints), "disk")
+}
@@ -0,0 +1,38 @@
+package promexporter
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/nakabonne/tstorage"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCollector(t *testing.T) {
+	s, err := tstorage.NewStorage(tstorage.WithTimestampPrecision(tstorage.Seconds))
+	require.NoError(t, err)
+	defer s.Close()
+	require.NoError(t, s.InsertRows([]tstorage.Row{
+		{Metric: "metric1", DataPoint: tstorage.DataPoint{Timestamp: 1, Value: 0.1}},
+		{Metric: "metric1", DataPoint: tstorage.DataPoint{Timestamp: 2, Value: 0.2}},
+	}))
+	_, err = s.Select("metric1", nil, 1, 3)
+	require.NoError(t, err)
+
+	c := Collector(s)
+	assert.NoError(t, testutil.CollectAndCompare(c, strings.NewReader(`
+# HELP tstorage_rows_inserted_total The number of rows inserted into partitions.
+# TYPE tstorage_rows_inserted_total counter
+tstorage_rows_inserted_total 2
+# HELP tstorage_selects_total The number of selects walking partitions.
+# TYPE tstorage_selects_total counter
+tstorage_selects_total 1
+# HELP tstorage_data_points The number of data points by where they reside.
+# TYPE tstorage_data_points gauge
+tstorage_data_points{location="disk"} 0
+tstorage_data_points{location="memory"} 2
+`), "tstorage_rows_inserted_total", "tstorage_selects_total", "tstorage_data_points"))
+	assert.Equal(t, 20, testutil.CollectAndCount(c))
+}
@@ -0,0 +1,170 @@
+package tstorage
+
+import (
+	"fmt"
+	"math"
+	"sync/atomic"
+)
+
+// WithReadRepair lets selects fix the inconsistencies they come across, namely disk partitions overlapping
+// each other, which can be left by a restore or by Merge for instance. Once a select finds such partitions,
+// all overlapping ones get merged into a single partition in the background, where the data point
+// from the partition opened later wins if two of them have the same timestamp.
+// The select itself never waits for it, and sees the layout as it was.
+//
+// Defaults to false.
+func WithReadRepair(enabled bool) Option {
+	return func(s *storage) {
+		s.readRepair = enabled
+	}
+}
+
+// hasOverlappingDiskPartitions reports whether any of the given disk partitions overlap each other.
+// parts must be in order of the newest to the oldest, as overlappingPartitions gives back.
+func hasOverlappingDiskPartitions(parts []partition) bool {
+	var newer partition
+	for _, p := range parts {
+		if _, ok := p.(*diskPartition); !ok {
+			continue
+		}
+		if newer != nil && newer.minTimestamp() <= p.maxTimestamp() {
+			return true
+		}
+		newer = p
+	}
+	return false
+}
+
+// scheduleReadRepair starts repairing overlapping disk partitions in the background unless it's already running.
+func (s *storage) scheduleReadRepair() {
+	if !atomic.CompareAndSwapInt32(&s.repairing, 0, 1) {
+		return
+	}
+	doneCh := s.doneCh
+	s.flushWg.Add(1)
+	go func() {
+		defer s.flushWg.Done()
+		defer atomic.StoreInt32(&s.repairing, 0)
+		select {
+		case <-doneCh:
+			// Closed in the meantime.
+			return
+		default:
+		}
+		if err := s.recovered(s.repairOverlappingPartitions); err != nil {
+			s.logger.Printf("failed to repair overlapping partitions: %v\n", err)
+		}
+	}()
+}
+
+// repairOverlappingPartitions merges each set of disk partitions overlapping each other, transitively.
+func (s *storage) repairOverlappingPartitions() error {
+	// Keep flushes from swapping partitions in the middle.
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+
+	var parts []*diskPartition
+	iterator := s.partitionList.newIterator()
+	for iterator.next() {
+		if d, ok := iterator.value().(*diskPartition); ok {
+			parts = append(parts, d)
+		}
+	}
+	// In order of the oldest to the newest, so that later ones win.
+	for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+		parts[i], parts[j] = parts[j], parts[i]
+	}
+
+	var group []*diskPartition
+	var groupMax int64
+	for _, p := range parts {
+		if len(group) > 0 && p.minTimestamp() <= groupMax {
+			group = append(group, p)
+			if p.maxTimestamp() > groupMax {
+				groupMax = p.maxTimestamp()
+			}
+			continue
+		}
+		if err := s.repairPartitions(group); err != nil {
+			return err
+		}
+		group = []*diskPartition{p}
+		groupMax = p.maxTimestamp()
+	}
+	return s.repairPartitions(group)
+}
+
+// repairPartitions swaps the given overlapping partitions for a single one holding all of their data points.
+// Nothing happens unless more than one are given.
+func (s *storage) repairPartitions(group []*diskPartition) error {
+	if len(group) < 2 {
+		return nil
+	}
+	// Keep retention from removing the files while reading them.
+	for i, p := range group {
+		if !p.pin() {
+			for _, pinned := range group[:i] {
+				pinned.unpin()
+			}
+			return nil
+		}
+	}
+	defer func() {
+		for _, p := range group {
+			if err := p.unpin(); err != nil {
+				s.logger.Printf("failed to release partition %s: %v\n", p.dirPath, err)
+			}
+		}
+	}()
+
+	points := make(map[string][]*DataPoint)
+	for _, p := range group {
+		for name := range p.meta.Metrics {
+			ps, err := p.selectDataPointsByName(name, math.MinInt64, math.MaxInt64)
+			if err != nil {
+				return fmt.Errorf("failed to select data points of %q from %s: %w", name, p.dirPath, err)
+			}
+			points[name], _, _ = mergePoints(points[name], ps, DuplicateKeepSrc)
+		}
+	}
+	m := newMergedMemoryPartition(points)
+	var dir string
+	var err error
+	if s.idGenerator != nil {
+		dir, err = s.partitionDirPath(m.minTimestamp(), m.maxTimestamp())
+	} else {
+		// The directory for the range may be taken by one of the overlapping partitions.
+		name := fmt.Sprintf("p-%d-%d", m.minTimestamp(), m.maxTimestamp())
+		dir, err = newPartitionDirPath(s.fsys, s.shardPath(name, m.minTimestamp()), m.minTimestamp(), m.maxTimestamp())
+	}
+	if err != nil {
+		return err
+	}
+	if err := s.flush(dir, m); err != nil {
+		return fmt.Errorf("failed to compact overlapping partitions into %s: %w", dir, err)
+	}
+	newPart, err := s.openDiskPartition(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open repaired partition %s: %w", dir, err)
+	}
+
+	olds := make([]partition, len(group))
+	for i, p := range group {
+		olds[i] = p
+	}
+	if err := s.partitionList.replace(olds, newPart); err != nil {
+		// Some of them have been removed by retention meanwhile.
+		if err := newPart.clean(); err != nil {
+			s.logger.Printf("failed to remove partition %s: %v\n", dir, err)
+		}
+		return fmt.Errorf("failed to replace overlapping partitions: %w", err)
+	}
+	for _, p := range group {
+		// Readers still holding it keep the files until they're done.
+		if err := p.clean(); err != nil {
+			return fmt.Errorf("failed to remove repaired partition %s: %w", p.dirPath, err)
+		}
+	}
+	s.recordEvent(PartitionEventRepaired, newPartitionInfo(newPart), nil)
+	return nil
+}
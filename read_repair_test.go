@@ -0,0 +1,75 @@
+package tstorage
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_storage_readRepair(t *testing.T) {
+	dataPath := t.TempDir()
+	writePartition := func(name string, rows []Row) {
+		m := newMemoryPartition(nil, 0, Seconds).(*memoryPartition)
+		_, err := m.insertRows(rows)
+		require.NoError(t, err)
+		s := &storage{dirPerm: defaultDirPerm, filePerm: defaultFilePerm, allocator: defaultAllocator, flushBufferSize: defaultFlushBufferSize, fsys: defaultFileSystem, logger: &nopLogger{}}
+		require.NoError(t, s.flush(filepath.Join(dataPath, name), m))
+	}
+	writePartition("p-1-2", []Row{
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1, Value: 0.1}},
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 2, Value: 0.2}},
+	})
+	// Overlapping the above one with a conflicting data point, as if restored on top of it.
+	writePartition("p-2-3", []Row{
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 2, Value: 0.3}},
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 3, Value: 0.4}},
+	})
+	writePartition("p-10-11", []Row{
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 10, Value: 1}},
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 11, Value: 1.1}},
+	})
+
+	s, err := NewStorage(WithDataPath(dataPath), WithTimestampPrecision(Seconds), WithRetention(100*365*24*time.Hour), WithReadRepair(true))
+	require.NoError(t, err)
+	defer s.Close()
+
+	// The select finding them sees the layout as it is.
+	points, err := s.Select("metric1", nil, 1, 12)
+	require.NoError(t, err)
+	assert.Len(t, points, 6)
+
+	diskPartitions := func() []PartitionInfo {
+		var infos []PartitionInfo
+		for _, p := range s.ListPartitions() {
+			if p.DirPath != "" {
+				infos = append(infos, p)
+			}
+		}
+		return infos
+	}
+	require.Eventually(t, func() bool {
+		return len(diskPartitions()) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	infos := diskPartitions()
+	assert.Equal(t, int64(10), infos[0].MinTimestamp)
+	assert.Equal(t, int64(1), infos[1].MinTimestamp)
+	assert.Equal(t, int64(3), infos[1].MaxTimestamp)
+	assert.Equal(t, 3, infos[1].NumDataPoints)
+
+	points, err = s.Select("metric1", nil, 1, 12)
+	require.NoError(t, err)
+	assert.Equal(t, []*DataPoint{
+		{Timestamp: 1, Value: 0.1},
+		{Timestamp: 2, Value: 0.3},
+		{Timestamp: 3, Value: 0.4},
+		{Timestamp: 10, Value: 1},
+		{Timestamp: 11, Value: 1.1},
+	}, points)
+	assert.NoDirExists(t, filepath.Join(dataPath, "p-1-2"))
+	assert.NoDirExists(t, filepath.Join(dataPath, "p-2-3"))
+	assert.DirExists(t, filepath.Join(dataPath, "p-1-3"))
+}
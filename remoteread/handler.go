@@ -0,0 +1,391 @@
+// Package remoteread serves data points in a tstorage.Storage to Prometheus through the remote read API.
+// It lives in a separate module so that the core package doesn't depend on Prometheus.
+package remoteread
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+
+	"github.com/golang/snappy"
+	"github.com/nakabonne/tstorage"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+)
+
+// Label name Prometheus gives the metric name.
+const metricNameLabel = "__name__"
+
+// The maximum number of samples in a chunk, which is the same as Prometheus cuts chunks at.
+const maxSamplesPerChunk = 120
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// RemoteReadHandler gives back an http.Handler serving the Prometheus remote read API from the given storage.
+// Each query must have an equality matcher on the metric name, with which series are looked up by
+// tstorage.Reader.SelectSeriesBlocks, and then the other matchers filter them by their labels.
+// Timestamps are converted between milliseconds and the precision of the storage.
+//
+// If the client accepts STREAMED_XOR_CHUNKS, as Prometheus does by default, series are streamed one by one,
+// and each block is transcoded into Prometheus XOR chunks on its own, so that no more than a block
+// gets decoded at a time. Otherwise, all data points are given back as samples at once.
+//
+//	http.Handle("/api/v1/read", remoteread.RemoteReadHandler(storage))
+func RemoteReadHandler(s tstorage.Storage) http.Handler {
+	return &handler{storage: s}
+}
+
+type handler struct {
+	storage tstorage.Storage
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	req, err := decodeReadRequest(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, t := range req.AcceptedResponseTypes {
+		if t == prompb.ReadRequest_STREAMED_XOR_CHUNKS {
+			h.serveChunks(w, req.Queries)
+			return
+		}
+	}
+	h.serveSamples(w, req.Queries)
+}
+
+func decodeReadRequest(r io.Reader) (*prompb.ReadRequest, error) {
+	compressed, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read request: %w", err)
+	}
+	b, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress request: %w", err)
+	}
+	req := &prompb.ReadRequest{}
+	if err := req.Unmarshal(b); err != nil {
+		return nil, fmt.Errorf("failed to decode request: %w", err)
+	}
+	return req, nil
+}
+
+func (h *handler) serveSamples(w http.ResponseWriter, queries []*prompb.Query) {
+	resp := &prompb.ReadResponse{Results: make([]*prompb.QueryResult, 0, len(queries))}
+	for _, q := range queries {
+		result := &prompb.QueryResult{}
+		err := h.selectSeries(q, func(labels []prompb.Label, points []*tstorage.DataPoint) error {
+			ts := &prompb.TimeSeries{Labels: labels, Samples: make([]prompb.Sample, 0, len(points))}
+			for _, p := range points {
+				ts.Samples = append(ts.Samples, prompb.Sample{Timestamp: h.toMillis(p.Timestamp), Value: p.Value})
+			}
+			result.Timeseries = append(result.Timeseries, ts)
+			return nil
+		})
+		if err != nil {
+			http.Error(w, err.Error(), statusOf(err))
+			return
+		}
+		resp.Results = append(resp.Results, result)
+	}
+	b, err := resp.Marshal()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Header().Set("Content-Encoding", "snappy")
+	w.Write(snappy.Encode(nil, b))
+}
+
+func (h *handler) serveChunks(w http.ResponseWriter, queries []*prompb.Query) {
+	w.Header().Set("Content-Type", "application/x-streamed-protobuf; proto=prometheus.ChunkedReadResponse")
+	flusher, _ := w.(http.Flusher)
+	written := false
+	for i, q := range queries {
+		err := h.selectSeries(q, func(labels []prompb.Label, points []*tstorage.DataPoint) error {
+			chunks, err := h.encodeChunks(points)
+			if err != nil {
+				return err
+			}
+			if len(chunks) == 0 {
+				return nil
+			}
+			written = true
+			return writeFrame(w, flusher, &prompb.ChunkedReadResponse{
+				ChunkedSeries: []*prompb.ChunkedSeries{{Labels: labels, Chunks: chunks}},
+				QueryIndex:    int64(i),
+			})
+		})
+		if err != nil {
+			if !written {
+				// The status can't be changed once the response has begun.
+				http.Error(w, err.Error(), statusOf(err))
+			}
+			return
+		}
+	}
+}
+
+// writeFrame writes the given message as a frame of the stream, which is prefixed by its size in uvarint
+// and its CRC32 checksum with the Castagnoli polynomial.
+func writeFrame(w io.Writer, flusher http.Flusher, resp *prompb.ChunkedReadResponse) error {
+	b, err := resp.Marshal()
+	if err != nil {
+		return fmt.Errorf("failed to encode response: %w", err)
+	}
+	header := make([]byte, binary.MaxVarintLen64+4)
+	n := binary.PutUvarint(header, uint64(len(b)))
+	binary.BigEndian.PutUint32(header[n:], crc32.Checksum(b, castagnoliTable))
+	if _, err := w.Write(header[:n+4]); err != nil {
+		return err
+	}
+	if _, err := w.Write(b); err != nil {
+		return err
+	}
+	if flusher != nil {
+		flusher.Flush()
+	}
+	return nil
+}
+
+// encodeChunks encodes the given data points of a block into XOR chunks.
+func (h *handler) encodeChunks(points []*tstorage.DataPoint) ([]prompb.Chunk, error) {
+	var (
+		chunks []prompb.Chunk
+		c      *chunkenc.XORChunk
+		app    chunkenc.Appender
+		cur    prompb.Chunk
+	)
+	for _, p := range points {
+		if c == nil || c.NumSamples() >= maxSamplesPerChunk {
+			if c != nil {
+				cur.Data = c.Bytes()
+				chunks = append(chunks, cur)
+			}
+			c = chunkenc.NewXORChunk()
+			var err error
+			if app, err = c.Appender(); err != nil {
+				return nil, fmt.Errorf("failed to make chunk appender: %w", err)
+			}
+			cur = prompb.Chunk{MinTimeMs: h.toMillis(p.Timestamp), Type: prompb.Chunk_XOR}
+		}
+		t := h.toMillis(p.Timestamp)
+		app.Append(t, p.Value)
+		cur.MaxTimeMs = t
+	}
+	if c != nil {
+		cur.Data = c.Bytes()
+		chunks = append(chunks, cur)
+	}
+	return chunks, nil
+}
+
+// selectSeries calls fn with the labels and the data points within the range of each series matching the query,
+// block by block in ascending order.
+func (h *handler) selectSeries(q *prompb.Query, fn func(labels []prompb.Label, points []*tstorage.DataPoint) error) error {
+	metric, labels, filters, err := parseMatchers(q.Matchers)
+	if err != nil {
+		return err
+	}
+	start, end := h.toRange(q.StartTimestampMs, q.EndTimestampMs)
+	if start >= end {
+		return nil
+	}
+	series, err := h.storage.SelectSeriesBlocks(metric, labels, start, end)
+	if errors.Is(err, tstorage.ErrNoDataPoints) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to select blocks: %w", err)
+	}
+	for _, s := range series {
+		promLabels := toPromLabels(metric, s.Labels)
+		if !matchesAll(promLabels, filters) {
+			continue
+		}
+		for _, b := range s.Blocks {
+			points, err := b.DataPoints()
+			if err != nil {
+				return fmt.Errorf("failed to decode block: %w", err)
+			}
+			// Blocks may hold data points outside the range.
+			points = pointsWithin(points, start, end)
+			if len(points) == 0 {
+				continue
+			}
+			if err := fn(promLabels, points); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func pointsWithin(points []*tstorage.DataPoint, start, end int64) []*tstorage.DataPoint {
+	from := sort.Search(len(points), func(i int) bool { return points[i].Timestamp >= start })
+	to := sort.Search(len(points), func(i int) bool { return points[i].Timestamp >= end })
+	return points[from:to]
+}
+
+// matcherError is an error caused by the request.
+type matcherError struct {
+	msg string
+}
+
+func (e *matcherError) Error() string { return e.msg }
+
+func statusOf(err error) int {
+	var me *matcherError
+	if errors.As(err, &me) {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// labelFilter reports whether the value of a label satisfies a matcher, where a missing label has the empty value.
+type labelFilter struct {
+	name  string
+	match func(value string) bool
+}
+
+// parseMatchers gives back the metric name, the labels to look up series with, and the filters for the rest
+// of the given matchers.
+func parseMatchers(matchers []*prompb.LabelMatcher) (metric string, labels []tstorage.Label, filters []labelFilter, err error) {
+	for _, m := range matchers {
+		if m.Name == metricNameLabel && m.Type == prompb.LabelMatcher_EQ {
+			if metric != "" && metric != m.Value {
+				return "", nil, nil, &matcherError{msg: "conflicting metric names given"}
+			}
+			metric = m.Value
+			continue
+		}
+		if m.Type == prompb.LabelMatcher_EQ && m.Value != "" {
+			labels = append(labels, tstorage.Label{Name: m.Name, Value: m.Value})
+			continue
+		}
+		f, err := newLabelFilter(m)
+		if err != nil {
+			return "", nil, nil, err
+		}
+		filters = append(filters, f)
+	}
+	if metric == "" {
+		return "", nil, nil, &matcherError{msg: fmt.Sprintf("an equality matcher on %s must be given", metricNameLabel)}
+	}
+	return metric, labels, filters, nil
+}
+
+func newLabelFilter(m *prompb.LabelMatcher) (labelFilter, error) {
+	f := labelFilter{name: m.Name}
+	switch m.Type {
+	case prompb.LabelMatcher_EQ:
+		f.match = func(v string) bool { return v == m.Value }
+	case prompb.LabelMatcher_NEQ:
+		f.match = func(v string) bool { return v != m.Value }
+	case prompb.LabelMatcher_RE, prompb.LabelMatcher_NRE:
+		// Anchored as Prometheus does.
+		re, err := regexp.Compile("^(?:" + m.Value + ")$")
+		if err != nil {
+			return labelFilter{}, &matcherError{msg: fmt.Sprintf("invalid regular expression %q: %v", m.Value, err)}
+		}
+		want := m.Type == prompb.LabelMatcher_RE
+		f.match = func(v string) bool { return re.MatchString(v) == want }
+	default:
+		return labelFilter{}, &matcherError{msg: fmt.Sprintf("unknown matcher type %v", m.Type)}
+	}
+	return f, nil
+}
+
+func matchesAll(labels []prompb.Label, filters []labelFilter) bool {
+	for _, f := range filters {
+		var value string
+		for _, l := range labels {
+			if l.Name == f.name {
+				value = l.Value
+				break
+			}
+		}
+		if !f.match(value) {
+			return false
+		}
+	}
+	return true
+}
+
+// toPromLabels gives back the labels of a series sorted by name, including the metric name, as Prometheus expects.
+func toPromLabels(metric string, labels []tstorage.Label) []prompb.Label {
+	res := make([]prompb.Label, 0, len(labels)+1)
+	res = append(res, prompb.Label{Name: metricNameLabel, Value: metric})
+	for _, l := range labels {
+		res = append(res, prompb.Label{Name: l.Name, Value: l.Value})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res
+}
+
+// unitsPerMilli gives back how many units of the storage's precision a millisecond is, or -1000 for seconds.
+func (h *handler) unitsPerMilli() int64 {
+	switch h.storage.Config().TimestampPrecision {
+	case tstorage.Nanoseconds:
+		return 1e6
+	case tstorage.Microseconds:
+		return 1e3
+	case tstorage.Seconds:
+		return -1000
+	default:
+		return 1
+	}
+}
+
+// toRange converts the given inclusive range in milliseconds into the half-open range in the storage's precision.
+func (h *handler) toRange(startMs, endMs int64) (start, end int64) {
+	u := h.unitsPerMilli()
+	if u < 0 {
+		// Round the start up, and the end down, to select seconds within the range.
+		return ceilDiv(startMs, -u), floorDiv(endMs, -u) + 1
+	}
+	return mulClamped(startMs, u), mulClamped(endMs, u) + u
+}
+
+// toMillis converts the given timestamp in the storage's precision into milliseconds, rounding down.
+func (h *handler) toMillis(ts int64) int64 {
+	u := h.unitsPerMilli()
+	if u < 0 {
+		return mulClamped(ts, -u)
+	}
+	return floorDiv(ts, u)
+}
+
+func floorDiv(a, b int64) int64 {
+	q := a / b
+	if a%b != 0 && a < 0 {
+		q--
+	}
+	return q
+}
+
+func ceilDiv(a, b int64) int64 {
+	q := a / b
+	if a%b != 0 && a > 0 {
+		q++
+	}
+	return q
+}
+
+// mulClamped multiplies a by the positive b, clamping the result not to overflow.
+func mulClamped(a, b int64) int64 {
+	switch {
+	case a > (math.MaxInt64-b)/b:
+		return math.MaxInt64 - b
+	case a < math.MinInt64/b:
+		return math.MinInt64
+	}
+	return a * b
+}
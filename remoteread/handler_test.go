@@ -0,0 +1,261 @@
+package remoteread
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/nakabonne/tstorage"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/storage/remote"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type sample struct {
+	t int64
+	v float64
+}
+
+// newTestStorage gives back a storage in nanoseconds holding 300 points of each series on disk,
+// and 10 more in memory, at every millisecond from 1000.
+func newTestStorage(t *testing.T) tstorage.Storage {
+	dir := t.TempDir()
+	rows := func(from, to int) []tstorage.Row {
+		var rows []tstorage.Row
+		for i := from; i < to; i++ {
+			ts := int64(1000+i) * int64(time.Millisecond)
+			rows = append(rows,
+				tstorage.Row{Metric: "cpu", Labels: []tstorage.Label{{Name: "host", Value: "a"}}, DataPoint: tstorage.DataPoint{Timestamp: ts, Value: float64(i)}},
+				tstorage.Row{Metric: "cpu", Labels: []tstorage.Label{{Name: "host", Value: "b"}}, DataPoint: tstorage.DataPoint{Timestamp: ts, Value: float64(-i)}},
+			)
+		}
+		return rows
+	}
+	s, err := tstorage.NewStorage(tstorage.WithDataPath(dir))
+	require.NoError(t, err)
+	require.NoError(t, s.InsertRows(rows(0, 300)))
+	require.NoError(t, s.Close())
+
+	s, err = tstorage.NewStorage(tstorage.WithDataPath(dir))
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	require.NoError(t, s.InsertRows(rows(300, 310)))
+	return s
+}
+
+func post(t *testing.T, url string, req *prompb.ReadRequest) *http.Response {
+	b, err := req.Marshal()
+	require.NoError(t, err)
+	resp, err := http.Post(url, "application/x-protobuf", bytes.NewReader(snappy.Encode(nil, b)))
+	require.NoError(t, err)
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func wantSamples(from, to int, sign float64) []sample {
+	var samples []sample
+	for i := from; i <= to; i++ {
+		samples = append(samples, sample{t: int64(1000 + i), v: sign * float64(i)})
+	}
+	return samples
+}
+
+func TestRemoteReadHandler(t *testing.T) {
+	server := httptest.NewServer(RemoteReadHandler(newTestStorage(t)))
+	defer server.Close()
+
+	name := &prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "cpu"}
+	hostA := []prompb.Label{{Name: "__name__", Value: "cpu"}, {Name: "host", Value: "a"}}
+	hostB := []prompb.Label{{Name: "__name__", Value: "cpu"}, {Name: "host", Value: "b"}}
+	tests := []struct {
+		name     string
+		matchers []*prompb.LabelMatcher
+		startMs  int64
+		endMs    int64
+		want     map[string][]sample
+	}{
+		{
+			name:     "all series across disk and memory",
+			matchers: []*prompb.LabelMatcher{name},
+			startMs:  1000,
+			endMs:    1309,
+			want: map[string][]sample{
+				hostA[1].Value: wantSamples(0, 309, 1),
+				hostB[1].Value: wantSamples(0, 309, -1),
+			},
+		},
+		{
+			name:     "range within blocks with its end included",
+			matchers: []*prompb.LabelMatcher{name, {Type: prompb.LabelMatcher_EQ, Name: "host", Value: "a"}},
+			startMs:  1100,
+			endMs:    1305,
+			want:     map[string][]sample{hostA[1].Value: wantSamples(100, 305, 1)},
+		},
+		{
+			name:     "not equal",
+			matchers: []*prompb.LabelMatcher{name, {Type: prompb.LabelMatcher_NEQ, Name: "host", Value: "a"}},
+			startMs:  1000,
+			endMs:    1001,
+			want:     map[string][]sample{hostB[1].Value: wantSamples(0, 1, -1)},
+		},
+		{
+			name:     "regular expression anchored",
+			matchers: []*prompb.LabelMatcher{name, {Type: prompb.LabelMatcher_RE, Name: "host", Value: "b|c"}},
+			startMs:  1000,
+			endMs:    1001,
+			want:     map[string][]sample{hostB[1].Value: wantSamples(0, 1, -1)},
+		},
+		{
+			name:     "no matching series",
+			matchers: []*prompb.LabelMatcher{name, {Type: prompb.LabelMatcher_RE, Name: "host", Value: "a.+"}},
+			startMs:  1000,
+			endMs:    1309,
+			want:     map[string][]sample{},
+		},
+		{
+			name:     "unknown metric",
+			matchers: []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "mem"}},
+			startMs:  1000,
+			endMs:    1309,
+			want:     map[string][]sample{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+" in samples", func(t *testing.T) {
+			resp := post(t, server.URL, &prompb.ReadRequest{
+				Queries: []*prompb.Query{{StartTimestampMs: tt.startMs, EndTimestampMs: tt.endMs, Matchers: tt.matchers}},
+			})
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, "snappy", resp.Header.Get("Content-Encoding"))
+			compressed, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			b, err := snappy.Decode(nil, compressed)
+			require.NoError(t, err)
+			var res prompb.ReadResponse
+			require.NoError(t, res.Unmarshal(b))
+			require.Len(t, res.Results, 1)
+
+			got := map[string][]sample{}
+			for _, ts := range res.Results[0].Timeseries {
+				require.Len(t, ts.Labels, 2)
+				assert.Equal(t, "__name__", ts.Labels[0].Name)
+				for _, s := range ts.Samples {
+					got[ts.Labels[1].Value] = append(got[ts.Labels[1].Value], sample{t: s.Timestamp, v: s.Value})
+				}
+			}
+			assert.Equal(t, tt.want, got)
+		})
+		t.Run(tt.name+" in streamed chunks", func(t *testing.T) {
+			resp := post(t, server.URL, &prompb.ReadRequest{
+				Queries:               []*prompb.Query{{StartTimestampMs: tt.startMs, EndTimestampMs: tt.endMs, Matchers: tt.matchers}},
+				AcceptedResponseTypes: []prompb.ReadRequest_ResponseType{prompb.ReadRequest_STREAMED_XOR_CHUNKS},
+			})
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, "application/x-streamed-protobuf; proto=prometheus.ChunkedReadResponse", resp.Header.Get("Content-Type"))
+
+			got := map[string][]sample{}
+			reader := remote.NewChunkedReader(resp.Body, remote.DefaultChunkedReadLimit, nil)
+			for {
+				var res prompb.ChunkedReadResponse
+				err := reader.NextProto(&res)
+				if err == io.EOF {
+					break
+				}
+				require.NoError(t, err)
+				assert.Equal(t, int64(0), res.QueryIndex)
+				for _, cs := range res.ChunkedSeries {
+					require.Len(t, cs.Labels, 2)
+					assert.Equal(t, "__name__", cs.Labels[0].Name)
+					for _, c := range cs.Chunks {
+						assert.LessOrEqual(t, c.MinTimeMs, c.MaxTimeMs)
+						chunk, err := chunkenc.FromData(chunkenc.EncXOR, c.Data)
+						require.NoError(t, err)
+						assert.LessOrEqual(t, chunk.NumSamples(), maxSamplesPerChunk)
+						it := chunk.Iterator(nil)
+						for it.Next() == chunkenc.ValFloat {
+							ts, v := it.At()
+							assert.True(t, c.MinTimeMs <= ts && ts <= c.MaxTimeMs)
+							got[cs.Labels[1].Value] = append(got[cs.Labels[1].Value], sample{t: ts, v: v})
+						}
+						require.NoError(t, it.Err())
+					}
+				}
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestRemoteReadHandler_badRequest(t *testing.T) {
+	server := httptest.NewServer(RemoteReadHandler(newTestStorage(t)))
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		matchers []*prompb.LabelMatcher
+	}{
+		{
+			name:     "no metric name",
+			matchers: []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "host", Value: "a"}},
+		},
+		{
+			name:     "metric name by regular expression",
+			matchers: []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_RE, Name: "__name__", Value: "cpu"}},
+		},
+		{
+			name: "invalid regular expression",
+			matchers: []*prompb.LabelMatcher{
+				{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "cpu"},
+				{Type: prompb.LabelMatcher_RE, Name: "host", Value: "("},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := post(t, server.URL, &prompb.ReadRequest{
+				Queries: []*prompb.Query{{StartTimestampMs: 1000, EndTimestampMs: 1309, Matchers: tt.matchers}},
+			})
+			assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		})
+	}
+
+	resp, err := http.Post(server.URL, "application/x-protobuf", bytes.NewReader([]byte("not snappy")))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func Test_handler_toRange(t *testing.T) {
+	tests := []struct {
+		name      string
+		precision tstorage.TimestampPrecision
+		startMs   int64
+		endMs     int64
+		wantStart int64
+		wantEnd   int64
+	}{
+		{name: "nanoseconds", precision: tstorage.Nanoseconds, startMs: 1, endMs: 2, wantStart: 1e6, wantEnd: 3e6},
+		{name: "microseconds", precision: tstorage.Microseconds, startMs: 1, endMs: 2, wantStart: 1e3, wantEnd: 3e3},
+		{name: "milliseconds", precision: tstorage.Milliseconds, startMs: 1, endMs: 2, wantStart: 1, wantEnd: 3},
+		{name: "seconds rounded inwards", precision: tstorage.Seconds, startMs: 1001, endMs: 2999, wantStart: 2, wantEnd: 3},
+		{name: "seconds on the boundaries", precision: tstorage.Seconds, startMs: 1000, endMs: 3000, wantStart: 1, wantEnd: 4},
+		{name: "negative seconds", precision: tstorage.Seconds, startMs: -1999, endMs: -1, wantStart: -1, wantEnd: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := tstorage.NewStorage(tstorage.WithTimestampPrecision(tt.precision))
+			require.NoError(t, err)
+			defer s.Close()
+			h := &handler{storage: s}
+			start, end := h.toRange(tt.startMs, tt.endMs)
+			assert.Equal(t, tt.wantStart, start)
+			assert.Equal(t, tt.wantEnd, end)
+		})
+	}
+}
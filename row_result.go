@@ -0,0 +1,115 @@
+package tstorage
+
+import (
+	"errors"
+	"fmt"
+)
+
+// RowResult reports whether a row given to InsertRowsDetailed is accepted.
+type RowResult struct {
+	// Accepted is true if the row is inserted.
+	Accepted bool
+	// Err tells why the row is rejected. It wraps ErrOutOfOrder if the row is rejected under OutOfOrderReject
+	// or WithEnforceMonotonicTimestamps, and ErrTooOld if the row is older than all writable partitions.
+	// Rows silently dropped under OutOfOrderDrop or by WithDedupeWindow are reported as accepted,
+	// in the same way as InsertRows returns no error for them.
+	Err error
+}
+
+// PartialInsertError is returned by InsertRows under WithPartialInsert if some of the rows are rejected.
+// It wraps the errors of all rejected rows, so that errors.Is and errors.As see each of them.
+type PartialInsertError struct {
+	// Accepted is the number of rows inserted.
+	Accepted int
+	// Errs holds why each rejected row is rejected, in the order the rows are given.
+	Errs []error
+}
+
+func (e *PartialInsertError) Error() string {
+	return fmt.Sprintf("%d of %d rows rejected: %v", len(e.Errs), e.Accepted+len(e.Errs), e.Errs[0])
+}
+
+func (e *PartialInsertError) Unwrap() []error {
+	return e.Errs
+}
+
+// WithPartialInsert makes InsertRows attempt every row even if some of them are rejected,
+// instead of failing the whole batch. The rejected rows are reported with *PartialInsertError.
+// Rows are inserted one by one in the same way as InsertRowsDetailed, which is slower than inserting at once;
+// in particular WithWriteBuffer doesn't take effect.
+//
+// Defaults to false.
+func WithPartialInsert(enabled bool) Option {
+	return func(s *storage) {
+		s.partialInsert = enabled
+	}
+}
+
+// insertRowsPartially inserts the given rows one by one under WithPartialInsert.
+func (s *storage) insertRowsPartially(rows []Row) error {
+	var errs []error
+	for i := range rows {
+		if err := s.insertRowDetailed(rows[i]); err != nil {
+			errs = append(errs, fmt.Errorf("row %d: %w", i, err))
+		}
+	}
+	if len(errs) > 0 {
+		return &PartialInsertError{Accepted: len(rows) - len(errs), Errs: errs}
+	}
+	return nil
+}
+
+func (s *storage) InsertRowsDetailed(rows []Row) ([]RowResult, error) {
+	done, err := s.beginInsert()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	results := make([]RowResult, len(rows))
+	var numRejected int
+	for i := range rows {
+		if err := s.insertRowDetailed(rows[i]); err != nil {
+			results[i].Err = err
+			numRejected++
+			continue
+		}
+		results[i].Accepted = true
+	}
+	if numRejected > 0 {
+		return results, fmt.Errorf("%d of %d rows rejected", numRejected, len(rows))
+	}
+	return results, nil
+}
+
+func (s *storage) insertRowDetailed(row Row) error {
+	if row.Metric == "" {
+		return fmt.Errorf("metric must be set")
+	}
+	rows, err := s.prepareRows([]Row{row})
+	if err != nil {
+		return fmt.Errorf("rejected by the insert hook: %w", err)
+	}
+	if len(rows) == 0 {
+		return errors.New("dropped by the insert hook")
+	}
+	if err := s.checkStateValues(rows); err != nil {
+		return err
+	}
+	rows, commit, monotonicErr := s.enforceMonotonicTimestamps(rows)
+	if len(rows) == 0 {
+		commit(nil)
+		return monotonicErr
+	}
+	dropped, err := s.insertPartitionRows(rows)
+	if err != nil {
+		commit(nil)
+		return err
+	}
+	accepted := acceptedRows(rows, dropped)
+	commit(accepted)
+	s.ingest.record(accepted, s.now)
+	if len(dropped) > 0 {
+		return fmt.Errorf("timestamp %d is older than all writable partitions: %w", dropped[0].Timestamp, ErrTooOld)
+	}
+	return monotonicErr
+}
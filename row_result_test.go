@@ -0,0 +1,81 @@
+package tstorage
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_storage_InsertRowsDetailed(t *testing.T) {
+	s, err := NewStorage(
+		WithOutOfOrderPolicy(OutOfOrderReject),
+		WithInsertHook(func(rows []Row) ([]Row, error) {
+			if rows[0].Metric == "forbidden" {
+				return nil, errors.New("forbidden metric")
+			}
+			return rows, nil
+		}),
+	)
+	require.NoError(t, err)
+	defer s.Close()
+
+	rows := []Row{
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 10}},
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 20}},
+		// Out-of-order within the head partition.
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 15}},
+		// Older than the head partition, which is the only one.
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 5}},
+		{Metric: "", DataPoint: DataPoint{Timestamp: 30}},
+		{Metric: "forbidden", DataPoint: DataPoint{Timestamp: 30}},
+		{Metric: "metric2", DataPoint: DataPoint{Timestamp: 15}},
+	}
+	results, err := s.InsertRowsDetailed(rows)
+	assert.EqualError(t, err, "4 of 7 rows rejected")
+	require.Len(t, results, len(rows))
+
+	accepted := make([]bool, 0, len(results))
+	for _, r := range results {
+		accepted = append(accepted, r.Accepted)
+	}
+	assert.Equal(t, []bool{true, true, false, false, false, false, true}, accepted)
+	assert.ErrorIs(t, results[2].Err, ErrOutOfOrder)
+	assert.ErrorIs(t, results[3].Err, ErrTooOld)
+	assert.EqualError(t, results[4].Err, "metric must be set")
+	assert.EqualError(t, results[5].Err, "rejected by the insert hook: forbidden metric")
+
+	got, err := s.Select("metric1", nil, 0, 100)
+	require.NoError(t, err)
+	assert.Equal(t, []*DataPoint{{Timestamp: 10}, {Timestamp: 20}}, got)
+
+	results, err = s.InsertRowsDetailed([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 21}}})
+	assert.NoError(t, err)
+	assert.Equal(t, []RowResult{{Accepted: true}}, results)
+}
+
+func Test_storage_InsertRows_withPartialInsert(t *testing.T) {
+	s, err := NewStorage(WithPartialInsert(true))
+	require.NoError(t, err)
+	defer s.Close()
+	require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 10}}}))
+
+	err = s.InsertRows([]Row{
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 20}},
+		// Older than the head partition, which is the only one.
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 5}},
+		{Metric: "", DataPoint: DataPoint{Timestamp: 30}},
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 30}},
+	})
+	var partialErr *PartialInsertError
+	require.ErrorAs(t, err, &partialErr)
+	assert.Equal(t, 2, partialErr.Accepted)
+	require.Len(t, partialErr.Errs, 2)
+	assert.ErrorIs(t, err, ErrTooOld)
+	assert.EqualError(t, partialErr.Errs[1], "row 2: metric must be set")
+
+	got, err := s.Select("metric1", nil, 0, 100)
+	require.NoError(t, err)
+	assert.Equal(t, []*DataPoint{{Timestamp: 10}, {Timestamp: 20}, {Timestamp: 30}}, got)
+}
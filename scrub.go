@@ -0,0 +1,115 @@
+package tstorage
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// scrubChunkSize is the size of a read done by the scrubber at once.
+	scrubChunkSize = 1 << 20
+	// scrubBytesPerSecond caps the read throughput of the scrubber.
+	scrubBytesPerSecond = 32 << 20
+)
+
+// checksumTable is used to compute the checksums of data files.
+var checksumTable = crc32.MakeTable(crc32.Castagnoli)
+
+// errScrubStopped is returned when the storage gets closed in the middle of a pass.
+var errScrubStopped = errors.New("scrub stopped")
+
+// startScrubber periodically verifies disk partitions until doneCh gets closed.
+func (s *storage) startScrubber(doneCh chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(s.scrubInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-doneCh:
+				return
+			case <-ticker.C:
+				err := s.recovered(func() error { return s.scrubPartitions(doneCh) })
+				if err != nil && !errors.Is(err, errScrubStopped) {
+					s.logger.Printf("%v\n", err)
+				}
+			}
+		}
+	}()
+}
+
+// scrubPartitions verifies the checksums of all disk partitions, and marks ones not matching as corrupt.
+func (s *storage) scrubPartitions(doneCh <-chan struct{}) error {
+	iterator := s.partitionList.newIterator()
+	for iterator.next() {
+		d, ok := iterator.value().(*diskPartition)
+		if !ok || d.meta.Checksum == 0 || d.corruption() != nil || d.expired() {
+			continue
+		}
+		// Keep retention from removing the files while reading them.
+		if !d.pin() {
+			continue
+		}
+		err := d.verifyChecksum(doneCh)
+		if unpinErr := d.unpin(); unpinErr != nil && err == nil {
+			err = unpinErr
+		}
+		switch {
+		case errors.Is(err, ErrCorruptPartition):
+			d.corruptErr.Store(err)
+			atomic.AddInt64(&s.stats.corruptPartitions, 1)
+			s.recordEvent(PartitionEventCorrupted, newPartitionInfo(d), err)
+			s.logger.Printf("%v\n", err)
+		case err != nil:
+			return fmt.Errorf("failed to scrub partition %q: %w", d.dirPath, err)
+		}
+	}
+	atomic.StoreInt64(&s.stats.lastScrubAt, time.Now().UnixNano())
+	return nil
+}
+
+// verifyChecksum reads the data file through and compares its checksum with the one in the meta file.
+// It reads at most scrubBytesPerSecond, so it may take long for large partitions.
+func (d *diskPartition) verifyChecksum(doneCh <-chan struct{}) error {
+	path := filepath.Join(d.dirPath, dataFileName)
+	f, err := d.fsys.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open data file: %w", err)
+	}
+	defer f.Close()
+
+	hash := crc32.New(checksumTable)
+	buf := make([]byte, scrubChunkSize)
+	for {
+		n, err := io.ReadFull(f, buf)
+		hash.Write(buf[:n])
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read data file: %w", err)
+		}
+		timer := time.NewTimer(time.Duration(n) * time.Second / scrubBytesPerSecond)
+		select {
+		case <-doneCh:
+			timer.Stop()
+			return errScrubStopped
+		case <-timer.C:
+		}
+	}
+	if sum := hash.Sum32(); sum != d.meta.Checksum {
+		return fmt.Errorf("checksum of %q is %08x, expected %08x: %w", path, sum, d.meta.Checksum, ErrCorruptPartition)
+	}
+	return nil
+}
+
+// corruption gives back the error found by the scrubber, or nil if the partition isn't known to be corrupt.
+func (d *diskPartition) corruption() error {
+	err, _ := d.corruptErr.Load().(error)
+	return err
+}
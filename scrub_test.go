@@ -0,0 +1,64 @@
+package tstorage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_storage_scrubPartitions(t *testing.T) {
+	tmpDir := t.TempDir()
+	opts := []Option{WithDataPath(tmpDir), WithTimestampPrecision(Seconds), WithPartitionDuration(time.Hour)}
+	s, err := NewStorage(opts...)
+	require.NoError(t, err)
+	// Give each data point its own partition.
+	for _, ts := range []int64{1, 10000} {
+		require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: ts, Value: float64(ts)}}}))
+		require.NoError(t, s.Close())
+		s, err = NewStorage(opts...)
+		require.NoError(t, err)
+	}
+	require.NoError(t, s.Close())
+
+	// Flip a byte of the older partition.
+	dataPath := filepath.Join(tmpDir, "p-1-1", dataFileName)
+	b, err := os.ReadFile(dataPath)
+	require.NoError(t, err)
+	b[0] ^= 0xff
+	require.NoError(t, os.WriteFile(dataPath, b, 0644))
+
+	s, err = NewStorage(append(opts, WithScrubInterval(10*time.Millisecond))...)
+	require.NoError(t, err)
+	defer s.Close()
+	require.Eventually(t, func() bool {
+		return !s.Stats().LastScrubAt.IsZero()
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, int64(1), s.Stats().CorruptPartitions)
+
+	var corrupted []PartitionEvent
+	for _, e := range s.RecentEvents(10) {
+		if e.Type == PartitionEventCorrupted {
+			corrupted = append(corrupted, e)
+		}
+	}
+	require.Len(t, corrupted, 1)
+	assert.Equal(t, filepath.Join(tmpDir, "p-1-1"), corrupted[0].Partition.DirPath)
+	assert.ErrorIs(t, corrupted[0].Err, ErrCorruptPartition)
+
+	_, err = s.Select("metric1", nil, 1, 2)
+	assert.ErrorIs(t, err, ErrCorruptPartition)
+	points, err := s.Select("metric1", nil, 10000, 10001)
+	require.NoError(t, err)
+	assert.Equal(t, []*DataPoint{{Timestamp: 10000, Value: 10000}}, points)
+
+	// A corrupt partition isn't counted again on the next passes.
+	lastScrubAt := s.Stats().LastScrubAt
+	require.Eventually(t, func() bool {
+		return s.Stats().LastScrubAt.After(lastScrubAt)
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, int64(1), s.Stats().CorruptPartitions)
+}
@@ -0,0 +1,104 @@
+package tstorage
+
+import (
+	"math"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// FuzzSelect inserts data points decoded from the input, including out-of-order and duplicated ones
+// across partition boundaries, and checks if Select agrees with a reference holding all accepted data points.
+func FuzzSelect(f *testing.F) {
+	f.Add([]byte{0, 10, 1, 1, 10, 2, 0, 0, 3})
+	// Out-of-order and duplicated.
+	f.Add([]byte{0, 100, 1, 0, 156, 2, 0, 0, 3, 1, 20, 4, 0, 0, 5})
+	// Across partitions.
+	f.Add([]byte{0, 127, 1, 0, 127, 2, 0, 127, 3, 0, 200, 4, 1, 127, 5, 1, 129, 6, 0, 127, 7, 0, 1, 8})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		metrics := []string{"metric1", "metric2"}
+		dataPath := t.TempDir()
+		open := func() Storage {
+			s, err := NewStorage(WithDataPath(dataPath), WithTimestampPrecision(Seconds), WithPartitionDuration(time.Hour),
+				WithRetention(100*365*24*time.Hour))
+			require.NoError(t, err)
+			return s
+		}
+		s := open()
+
+		// Each of 3 bytes is decoded into a data point of a metric at a timestamp moved from the latest one.
+		want := make(map[string][]*DataPoint, len(metrics))
+		var latest int64 = 100000
+		for i := 0; i+2 < len(data); i += 3 {
+			metric := metrics[int(data[i])%len(metrics)]
+			ts := latest + int64(int8(data[i+1]))*60
+			if ts > latest {
+				latest = ts
+			}
+			row := Row{Metric: metric, DataPoint: DataPoint{Timestamp: ts, Value: float64(data[i+2])}}
+			// Rejected rows are reported with an error as well.
+			results, _ := s.InsertRowsDetailed([]Row{row})
+			require.Len(t, results, 1)
+			if results[0].Accepted {
+				want[metric] = append(want[metric], &row.DataPoint)
+			}
+		}
+		for _, points := range want {
+			sortPoints(points)
+		}
+
+		ranges := [][2]int64{{math.MinInt64, math.MaxInt64}}
+		for i := len(data) % 3; i+1 < len(data); i += 6 {
+			start := 100000 + int64(int8(data[i]))*60*int64(len(data)/3)/4
+			end := start + int64(data[i+1])*60 + 1
+			ranges = append(ranges, [2]int64{start, end})
+		}
+		check := func(exact bool) {
+			for _, metric := range metrics {
+				for _, r := range ranges {
+					got, err := s.Select(metric, nil, r[0], r[1])
+					if err != nil {
+						require.ErrorIs(t, err, ErrNoDataPoints)
+					}
+					var expected []*DataPoint
+					for _, p := range want[metric] {
+						if p.Timestamp >= r[0] && p.Timestamp < r[1] {
+							expected = append(expected, p)
+						}
+					}
+					require.True(t, sort.SliceIsSorted(got, func(i, j int) bool {
+						return got[i].Timestamp < got[j].Timestamp
+					}), "%s in [%d, %d) isn't sorted: %v", metric, r[0], r[1], got)
+					sortPoints(got)
+					if exact {
+						assert.Equal(t, expected, got, "%s in [%d, %d)", metric, r[0], r[1])
+						continue
+					}
+					// Out-of-order data points may not be visible until flushed.
+					assert.Subset(t, expected, got, "%s in [%d, %d)", metric, r[0], r[1])
+				}
+			}
+		}
+		check(false)
+
+		// All accepted data points must be there once persisted.
+		require.NoError(t, s.Close())
+		s = open()
+		defer s.Close()
+		check(true)
+	})
+}
+
+// sortPoints sorts the given data points by timestamp and then by value, to compare them regardless of
+// the order of ones with the same timestamp.
+func sortPoints(points []*DataPoint) {
+	sort.SliceStable(points, func(i, j int) bool {
+		if points[i].Timestamp != points[j].Timestamp {
+			return points[i].Timestamp < points[j].Timestamp
+		}
+		return points[i].Value < points[j].Value
+	})
+}
@@ -0,0 +1,63 @@
+package tstorage
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/nakabonne/tstorage/internal/timerpool"
+)
+
+// WithMaxConcurrentSelects limits the number of selects walking partitions at the same time to n,
+// in order to protect ingestion and the process itself from storms of expensive queries.
+// A select beyond the limit waits for up to timeout for another one to finish, and then fails with
+// ErrQueryOverloaded. Giving 0 or less for timeout fails it immediately.
+// SelectIterator isn't limited since the iterator lives as long as the caller wants.
+// The number of selects currently running can be seen through Stats.
+//
+// Defaults to 0, which doesn't limit them.
+func WithMaxConcurrentSelects(n int, timeout time.Duration) Option {
+	return func(s *storage) {
+		if n <= 0 {
+			s.selectsLimitCh = nil
+			return
+		}
+		s.selectsLimitCh = make(chan struct{}, n)
+		s.selectTimeout = timeout
+	}
+}
+
+// acquireSelect takes a slot for a select, and gives back the function to release it.
+func (s *storage) acquireSelect() (func(), error) {
+	release := func() {
+		atomic.AddInt64(&s.stats.concurrentSelects, -1)
+		if s.selectsLimitCh != nil {
+			<-s.selectsLimitCh
+		}
+	}
+	if s.selectsLimitCh == nil {
+		atomic.AddInt64(&s.stats.concurrentSelects, 1)
+		return release, nil
+	}
+
+	select {
+	case s.selectsLimitCh <- struct{}{}:
+		atomic.AddInt64(&s.stats.concurrentSelects, 1)
+		return release, nil
+	default:
+	}
+	if s.selectTimeout <= 0 {
+		return nil, fmt.Errorf("%w: %d selects running", ErrQueryOverloaded, cap(s.selectsLimitCh))
+	}
+
+	// Seems like all slots are taken; wait for up to selectTimeout
+	t := timerpool.Get(s.selectTimeout)
+	defer timerpool.Put(t)
+	select {
+	case s.selectsLimitCh <- struct{}{}:
+		atomic.AddInt64(&s.stats.concurrentSelects, 1)
+		return release, nil
+	case <-t.C:
+		return nil, fmt.Errorf("%w: %d selects running for %s", ErrQueryOverloaded, cap(s.selectsLimitCh), s.selectTimeout)
+	}
+}
@@ -0,0 +1,79 @@
+package tstorage
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_storage_withMaxConcurrentSelects(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		// Whether a slot gets free while the select beyond the limit waits.
+		release bool
+		wantErr bool
+	}{
+		{
+			name:    "overloaded without timeout",
+			wantErr: true,
+		},
+		{
+			name:    "overloaded after timeout",
+			timeout: 10 * time.Millisecond,
+			wantErr: true,
+		},
+		{
+			name:    "admitted within timeout",
+			timeout: 5 * time.Second,
+			release: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewStorage(WithMaxConcurrentSelects(2, tt.timeout))
+			require.NoError(t, err)
+			defer s.Close()
+			require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1, Value: 0.1}}}))
+
+			// Hold both slots by blocking in the predicate.
+			unblock := make(chan struct{})
+			var once sync.Once
+			release := func() { once.Do(func() { close(unblock) }) }
+			defer release()
+			var wg sync.WaitGroup
+			for i := 0; i < 2; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					s.SelectWhere("metric1", nil, 0, 10, func(float64) bool {
+						<-unblock
+						return true
+					})
+				}()
+			}
+			require.Eventually(t, func() bool {
+				return s.Stats().ConcurrentSelects == 2
+			}, 5*time.Second, time.Millisecond)
+
+			if tt.release {
+				time.AfterFunc(10*time.Millisecond, release)
+			}
+			_, err = s.Select("metric1", nil, 0, 10)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrQueryOverloaded)
+			} else {
+				assert.NoError(t, err)
+			}
+
+			release()
+			wg.Wait()
+			assert.Equal(t, int64(0), s.Stats().ConcurrentSelects)
+			_, err = s.Select("metric1", nil, 0, 10)
+			assert.NoError(t, err)
+		})
+	}
+}
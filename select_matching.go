@@ -0,0 +1,93 @@
+package tstorage
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+func (s *storage) SelectMatching(metric string, labels []Label, start, end int64) ([]Row, error) {
+	metric = s.normalizeMetricName(metric)
+	if metric == "" {
+		return nil, fmt.Errorf("metric must be set")
+	}
+	if start >= end {
+		return nil, fmt.Errorf("the given start is greater than end")
+	}
+	// Find out the series first, and then select each of them across partitions.
+	names, err := s.matchingSeries(metric, labels, start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	rows := make([]Row, 0)
+	for _, name := range names {
+		_, seriesLabels, _ := unmarshalMetricName(name)
+		points, err := s.Select(metric, seriesLabels, start, end)
+		if errors.Is(err, ErrNoDataPoints) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range points {
+			rows = append(rows, Row{Metric: metric, Labels: seriesLabels, DataPoint: *p})
+		}
+	}
+	if len(rows) == 0 {
+		return nil, ErrNoDataPoints
+	}
+	return rows, nil
+}
+
+// matchingSeries gives back the names of the series of the given metric having all of the given labels
+// in partitions overlapping the given range, in sorted order.
+func (s *storage) matchingSeries(metric string, labels []Label, start, end int64) ([]string, error) {
+	parts, err := s.overlappingPartitions(start, end)
+	if err != nil {
+		return nil, err
+	}
+	matched := make(map[string]struct{})
+	for _, part := range parts {
+		names, err := seriesNames(part)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			if seriesMatches(name, metric, labels) {
+				matched[name] = struct{}{}
+			}
+		}
+	}
+	names := make([]string, 0, len(matched))
+	for name := range matched {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// seriesMatches reports whether the series with the given name built by marshalMetricName is of the given metric,
+// and has all of the given labels. Invalid labels are ignored as marshalMetricName does.
+func seriesMatches(name, metric string, labels []Label) bool {
+	m, seriesLabels, _ := unmarshalMetricName(name)
+	if m != metric {
+		return false
+	}
+	for _, l := range labels {
+		if l.Name == "" || l.Value == "" {
+			continue
+		}
+		found := false
+		for _, sl := range seriesLabels {
+			if sl == l {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
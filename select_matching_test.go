@@ -0,0 +1,86 @@
+package tstorage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_storage_SelectMatching(t *testing.T) {
+	s, err := NewStorage(WithDataPath(t.TempDir()), WithTimestampPrecision(Seconds), WithPartitionDuration(time.Hour),
+		WithRetention(100*365*24*time.Hour))
+	require.NoError(t, err)
+	defer s.Close()
+
+	get := []Label{{Name: "method", Value: "GET"}, {Name: "status", Value: "200"}}
+	post := []Label{{Name: "method", Value: "POST"}, {Name: "status", Value: "200"}}
+	notFound := []Label{{Name: "status", Value: "404"}, {Name: "method", Value: "GET"}}
+	for _, ts := range []int64{1, 10000} {
+		require.NoError(t, s.InsertRows([]Row{
+			{Metric: "http_requests", Labels: get, DataPoint: DataPoint{Timestamp: ts, Value: 1}},
+			{Metric: "http_requests", Labels: post, DataPoint: DataPoint{Timestamp: ts, Value: 2}},
+			{Metric: "http_requests", Labels: notFound, DataPoint: DataPoint{Timestamp: ts, Value: 3}},
+			{Metric: "http_requests", DataPoint: DataPoint{Timestamp: ts, Value: 4}},
+			{Metric: "other", Labels: get, DataPoint: DataPoint{Timestamp: ts, Value: 5}},
+		}))
+	}
+	// Persist the older ones.
+	_, err = s.Flush()
+	require.NoError(t, err)
+
+	rowsOf := func(labels []Label, value float64) []Row {
+		return []Row{
+			{Metric: "http_requests", Labels: labels, DataPoint: DataPoint{Timestamp: 1, Value: value}},
+			{Metric: "http_requests", Labels: labels, DataPoint: DataPoint{Timestamp: 10000, Value: value}},
+		}
+	}
+	concat := func(rows ...[]Row) []Row {
+		var all []Row
+		for _, r := range rows {
+			all = append(all, r...)
+		}
+		return all
+	}
+	getSorted := []Label{{Name: "method", Value: "GET"}, {Name: "status", Value: "404"}}
+
+	tests := []struct {
+		name    string
+		labels  []Label
+		want    []Row
+		wantErr error
+	}{
+		{
+			name:   "superset of a label",
+			labels: []Label{{Name: "method", Value: "GET"}},
+			want:   concat(rowsOf(get, 1), rowsOf(getSorted, 3)),
+		},
+		{
+			name:   "exact labels",
+			labels: []Label{{Name: "status", Value: "200"}, {Name: "method", Value: "POST"}},
+			want:   rowsOf(post, 2),
+		},
+		{
+			name:   "no labels",
+			labels: nil,
+			want:   concat(rowsOf(get, 1), rowsOf(getSorted, 3), rowsOf(post, 2), rowsOf(nil, 4)),
+		},
+		{
+			name:    "no series",
+			labels:  []Label{{Name: "method", Value: "PUT"}},
+			wantErr: ErrNoDataPoints,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := s.SelectMatching("http_requests", tt.labels, 0, 10001)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
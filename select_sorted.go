@@ -0,0 +1,64 @@
+package tstorage
+
+import (
+	"container/heap"
+	"fmt"
+	"sort"
+)
+
+func (s *storage) SelectSorted(metric string, labels []Label, start, end int64, less func(a, b *DataPoint) bool, limit int) ([]*DataPoint, error) {
+	if less == nil {
+		return nil, fmt.Errorf("comparator must be set")
+	}
+	if limit <= 0 {
+		return nil, fmt.Errorf("limit must be positive")
+	}
+	iterator, err := s.SelectIterator(metric, labels, start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer iterator.Close()
+
+	h := &boundedPointHeap{less: less}
+	for iterator.Next() {
+		p := iterator.Value()
+		if len(h.points) < limit {
+			heap.Push(h, p)
+			continue
+		}
+		// Swap the last one among the kept points for it.
+		if less(p, h.points[0]) {
+			h.points[0] = p
+			heap.Fix(h, 0)
+		}
+	}
+	if err := iterator.Err(); err != nil {
+		return nil, err
+	}
+	if len(h.points) == 0 {
+		return nil, ErrNoDataPoints
+	}
+	// Sort only the kept ones.
+	sort.Slice(h.points, func(i, j int) bool {
+		return less(h.points[i], h.points[j])
+	})
+	return h.points, nil
+}
+
+// boundedPointHeap is a heap whose root is the last data point in order of less, so that it can be dropped first.
+type boundedPointHeap struct {
+	points []*DataPoint
+	less   func(a, b *DataPoint) bool
+}
+
+func (h *boundedPointHeap) Len() int           { return len(h.points) }
+func (h *boundedPointHeap) Less(i, j int) bool { return h.less(h.points[j], h.points[i]) }
+func (h *boundedPointHeap) Swap(i, j int)      { h.points[i], h.points[j] = h.points[j], h.points[i] }
+func (h *boundedPointHeap) Push(x interface{}) { h.points = append(h.points, x.(*DataPoint)) }
+
+func (h *boundedPointHeap) Pop() interface{} {
+	n := len(h.points)
+	p := h.points[n-1]
+	h.points = h.points[:n-1]
+	return p
+}
@@ -0,0 +1,78 @@
+package tstorage
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_storage_SelectSorted(t *testing.T) {
+	// Backed by disk so that partitions flushed in the background keep their points.
+	s, err := NewStorage(WithTimestampPrecision(Seconds), WithPartitionDuration(time.Hour), WithDataPath(t.TempDir()))
+	require.NoError(t, err)
+	defer s.Close()
+
+	r := rand.New(rand.NewSource(1))
+	all := make([]*DataPoint, 0, 1000)
+	// Spread over several partitions.
+	for i := 0; i < 1000; i++ {
+		p := DataPoint{Timestamp: int64(1 + i*10), Value: r.Float64()}
+		all = append(all, &p)
+		require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: p}}))
+	}
+	highest := func(a, b *DataPoint) bool { return a.Value > b.Value }
+	lowest := func(a, b *DataPoint) bool { return a.Value < b.Value }
+	latest := func(a, b *DataPoint) bool { return a.Timestamp > b.Timestamp }
+
+	tests := []struct {
+		name  string
+		start int64
+		end   int64
+		less  func(a, b *DataPoint) bool
+		limit int
+	}{
+		{name: "highest values", start: 0, end: 10001, less: highest, limit: 10},
+		{name: "lowest values", start: 0, end: 10001, less: lowest, limit: 10},
+		{name: "latest", start: 0, end: 10001, less: latest, limit: 3},
+		{name: "within range", start: 3000, end: 6000, less: highest, limit: 5},
+		{name: "limit beyond the number of points", start: 0, end: 100, less: highest, limit: 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Sort all in the range by brute force.
+			var want []*DataPoint
+			for _, p := range all {
+				if p.Timestamp >= tt.start && p.Timestamp < tt.end {
+					want = append(want, p)
+				}
+			}
+			sort.Slice(want, func(i, j int) bool { return tt.less(want[i], want[j]) })
+			if len(want) > tt.limit {
+				want = want[:tt.limit]
+			}
+
+			got, err := s.SelectSorted("metric1", nil, tt.start, tt.end, tt.less, tt.limit)
+			require.NoError(t, err)
+			assert.Equal(t, want, got)
+		})
+	}
+}
+
+func Test_storage_SelectSorted_invalid(t *testing.T) {
+	s, err := NewStorage(WithTimestampPrecision(Seconds))
+	require.NoError(t, err)
+	defer s.Close()
+	require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1}}}))
+	highest := func(a, b *DataPoint) bool { return a.Value > b.Value }
+
+	_, err = s.SelectSorted("metric1", nil, 0, 2, nil, 10)
+	assert.Error(t, err)
+	_, err = s.SelectSorted("metric1", nil, 0, 2, highest, 0)
+	assert.Error(t, err)
+	_, err = s.SelectSorted("metric2", nil, 0, 2, highest, 10)
+	assert.ErrorIs(t, err, ErrNoDataPoints)
+}
@@ -0,0 +1,19 @@
+package tstorage
+
+import "hash/fnv"
+
+// SeriesHash gives back the hash of the series identified by the given metric name and labels,
+// which lets clients shard series consistently, such as for federation.
+//
+// It is the 64-bit FNV-1a hash of the key the storage identifies series with internally,
+// thus labels are sorted by name and ones with empty name or value are ignored, as the storage does.
+// Labels sharing a name aren't sorted by value, so that the same ones in another order may give another value.
+// The metric name is hashed as is, that is, WithMetricNameNormalizer isn't applied.
+// The algorithm is frozen; it gives back the same value for the same series across versions.
+func SeriesHash(metric string, labels []Label) uint64 {
+	// Don't sort the caller's labels in place.
+	labels = append([]Label(nil), labels...)
+	h := fnv.New64a()
+	h.Write([]byte(marshalMetricName(metric, labels)))
+	return h.Sum64()
+}
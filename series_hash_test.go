@@ -0,0 +1,67 @@
+package tstorage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSeriesHash(t *testing.T) {
+	tests := []struct {
+		name   string
+		metric string
+		labels []Label
+		want   uint64
+	}{
+		{
+			name:   "no labels",
+			metric: "metric1",
+			want:   0x164c71a4b54e00b0,
+		},
+		{
+			name:   "labels",
+			metric: "metric1",
+			labels: []Label{{Name: "host", Value: "host-1"}, {Name: "region", Value: "region-1"}},
+			want:   0xeb815f455088b9a3,
+		},
+		{
+			name:   "labels in another order",
+			metric: "metric1",
+			labels: []Label{{Name: "region", Value: "region-1"}, {Name: "host", Value: "host-1"}},
+			want:   0xeb815f455088b9a3,
+		},
+		{
+			name:   "invalid label ignored",
+			metric: "metric1",
+			labels: []Label{{Name: "region", Value: "region-1"}, {Name: "host", Value: "host-1"}, {Name: "empty"}},
+			want:   0xeb815f455088b9a3,
+		},
+		{
+			// Labels sharing a name are left in the given order, as they have always been.
+			name:   "labels sharing a name",
+			metric: "metric1",
+			labels: []Label{{Name: "tag", Value: "b"}, {Name: "tag", Value: "a"}},
+			want:   0xfa0f4b2a5ebd6a02,
+		},
+		{
+			name:   "labels sharing a name in another order",
+			metric: "metric1",
+			labels: []Label{{Name: "tag", Value: "a"}, {Name: "tag", Value: "b"}},
+			want:   0xce9529b867bfc826,
+		},
+		{
+			name:   "labels sharing a name among others",
+			metric: "metric1",
+			labels: []Label{{Name: "z", Value: "1"}, {Name: "tag", Value: "b"}, {Name: "a", Value: "x"}, {Name: "tag", Value: "a"}},
+			want:   0x949cd35950d0a32e,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			labels := append([]Label(nil), tt.labels...)
+			// The values are frozen across versions.
+			assert.Equal(t, tt.want, SeriesHash(tt.metric, tt.labels))
+			assert.Equal(t, labels, tt.labels)
+		})
+	}
+}
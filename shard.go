@@ -0,0 +1,95 @@
+package tstorage
+
+import (
+	"fmt"
+	"hash/fnv"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// PartitionSharding represents how to spread partition directories over subdirectories of the data path.
+// See WithPartitionSharding
+type PartitionSharding string
+
+const (
+	// ShardingNone places all partition directories right under the data path.
+	ShardingNone PartitionSharding = "none"
+	// ShardingByDay groups partition directories by the UTC day of their minimum timestamp, like "s-20060102".
+	ShardingByDay PartitionSharding = "day"
+	// ShardingByHash spreads partition directories over 256 subdirectories by the hash of their names, like "s-3f".
+	ShardingByHash PartitionSharding = "hash"
+)
+
+// Prefix of the subdirectories holding partition directories.
+const shardDirPrefix = "s-"
+
+// WithPartitionSharding specifies how to spread partition directories persisted from now on over subdirectories
+// of the data path, so that no single directory holds too many entries, which stresses some file systems
+// under long retention with short partitions.
+// Partition directories are found wherever they are when opening the storage, so that it can be changed
+// at any time; existing ones stay where they are.
+//
+// Defaults to ShardingNone.
+func WithPartitionSharding(sharding PartitionSharding) Option {
+	return func(s *storage) {
+		s.partitionSharding = sharding
+	}
+}
+
+func (p PartitionSharding) valid() bool {
+	switch p {
+	case ShardingNone, ShardingByDay, ShardingByHash:
+		return true
+	default:
+		return false
+	}
+}
+
+// shardPath gives back the directory to place the partition directory with the given name and minimum timestamp.
+func (s *storage) shardPath(name string, minTimestamp int64) string {
+	switch s.partitionSharding {
+	case ShardingByDay:
+		day := fromUnix(minTimestamp, s.timestampPrecision).UTC().Format("20060102")
+		return filepath.Join(s.dataPath, shardDirPrefix+day)
+	case ShardingByHash:
+		h := fnv.New32a()
+		h.Write([]byte(name))
+		return filepath.Join(s.dataPath, fmt.Sprintf("%s%02x", shardDirPrefix, h.Sum32()&0xff))
+	default:
+		return s.dataPath
+	}
+}
+
+// listPartitionDirs gives back the paths relative to dataPath of all partition directories,
+// including ones in the subdirectories made by WithPartitionSharding, in order by the path.
+func listPartitionDirs(fsys FileSystem, dataPath string) ([]string, error) {
+	entries, err := fsys.ReadDir(dataPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open data directory: %w", err)
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		if partitionDirRegex.MatchString(e.Name()) {
+			names = append(names, e.Name())
+			continue
+		}
+		if !strings.HasPrefix(e.Name(), shardDirPrefix) {
+			continue
+		}
+		shardEntries, err := fsys.ReadDir(filepath.Join(dataPath, e.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to open shard directory: %w", err)
+		}
+		for _, se := range shardEntries {
+			if se.IsDir() && partitionDirRegex.MatchString(se.Name()) {
+				names = append(names, filepath.Join(e.Name(), se.Name()))
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
@@ -0,0 +1,70 @@
+package tstorage
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_storage_withPartitionSharding(t *testing.T) {
+	tests := []struct {
+		name     string
+		sharding PartitionSharding
+		// The pattern of where the partition directories are placed.
+		wantDirs []string
+	}{
+		{
+			name:     "none",
+			sharding: ShardingNone,
+			wantDirs: []string{"p-1-5000", "p-100000-100000"},
+		},
+		{
+			name:     "by day",
+			sharding: ShardingByDay,
+			wantDirs: []string{"s-19700101/p-1-5000", "s-19700102/p-100000-100000"},
+		},
+		{
+			name:     "by hash",
+			sharding: ShardingByHash,
+			wantDirs: []string{"s-[0-9a-f][0-9a-f]/p-1-5000", "s-[0-9a-f][0-9a-f]/p-100000-100000"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dataPath := t.TempDir()
+			s, err := NewStorage(WithDataPath(dataPath), WithTimestampPrecision(Seconds), WithPartitionDuration(time.Hour),
+				WithRetention(100*365*24*time.Hour), WithPartitionSharding(tt.sharding))
+			require.NoError(t, err)
+			for _, ts := range []int64{1, 5000, 100000} {
+				require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: ts}}}))
+			}
+			require.NoError(t, s.Close())
+
+			dirs, err := listPartitionDirs(defaultFileSystem, dataPath)
+			require.NoError(t, err)
+			require.Len(t, dirs, len(tt.wantDirs))
+			for i := range dirs {
+				matched, err := filepath.Match(filepath.FromSlash(tt.wantDirs[i]), dirs[i])
+				require.NoError(t, err)
+				assert.True(t, matched, "%s must match %s", dirs[i], tt.wantDirs[i])
+			}
+
+			// Found regardless of the sharding in effect.
+			s, err = NewStorage(WithDataPath(dataPath), WithTimestampPrecision(Seconds), WithRetention(100*365*24*time.Hour))
+			require.NoError(t, err)
+			defer s.Close()
+			points, err := s.Select("metric1", nil, 0, 100000)
+			require.NoError(t, err)
+			assert.Equal(t, []*DataPoint{{Timestamp: 1}, {Timestamp: 5000}}, points)
+			assert.Len(t, s.ListPartitions(), 3)
+		})
+	}
+}
+
+func Test_storage_withPartitionSharding_unknown(t *testing.T) {
+	_, err := NewStorage(WithDataPath(t.TempDir()), WithPartitionSharding("month"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,71 @@
+package tstorage
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+// PartitionRef identifies the partition a data point came from.
+type PartitionRef struct {
+	// The minimum timestamp of the partition, which identifies partitions still in memory.
+	MinTimestamp int64
+	// The directory of the partition, which is empty if it's still in memory.
+	DirPath string
+	// ID is the one given by WithIDGenerator, which is empty if not given or if the partition is still in memory.
+	ID string
+}
+
+// SourcedDataPoint is a data point annotated with the partition it came from. See SelectWithSource.
+type SourcedDataPoint struct {
+	DataPoint
+	Source PartitionRef
+}
+
+func (s *storage) SelectWithSource(metric string, labels []Label, start, end int64) ([]SourcedDataPoint, error) {
+	metric = s.normalizeMetricName(metric)
+	if metric == "" {
+		return nil, fmt.Errorf("metric must be set")
+	}
+	if start >= end {
+		return nil, fmt.Errorf("the given start is greater than end")
+	}
+
+	release, err := s.acquireSelect()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	atomic.AddInt64(&s.stats.selects, 1)
+	parts, release, err := s.pinnedPartitions(start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	points := make([]SourcedDataPoint, 0)
+	// overlappingPartitions gives back from the newest one.
+	for i := len(parts) - 1; i >= 0; i-- {
+		ps, err := s.readablePartition(parts[i]).selectDataPoints(metric, labels, start, end)
+		if errors.Is(err, ErrNoDataPoints) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to select data points: %w", err)
+		}
+		// Hot partitions are read from memory, but still reported as the persisted ones.
+		ref := PartitionRef{MinTimestamp: parts[i].minTimestamp()}
+		if d, ok := parts[i].(*diskPartition); ok {
+			ref.DirPath = d.dirPath
+			if s.idGenerator != nil {
+				ref.ID = partitionID(d.dirPath)
+			}
+		}
+		for _, p := range ps {
+			points = append(points, SourcedDataPoint{DataPoint: *p, Source: ref})
+		}
+	}
+	if len(points) == 0 {
+		return nil, ErrNoDataPoints
+	}
+	return points, nil
+}
@@ -0,0 +1,68 @@
+package tstorage
+
+import (
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_storage_SelectWithSource(t *testing.T) {
+	tmpDir := t.TempDir()
+	opts := []Option{WithDataPath(tmpDir), WithTimestampPrecision(Seconds), WithPartitionDuration(time.Hour)}
+	s, err := NewStorage(opts...)
+	require.NoError(t, err)
+	require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1, Value: 1}}}))
+	require.NoError(t, s.Close())
+	s, err = NewStorage(opts...)
+	require.NoError(t, err)
+	defer s.Close()
+	require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 10000, Value: 2}}}))
+
+	got, err := s.SelectWithSource("metric1", nil, 1, 10001)
+	require.NoError(t, err)
+	assert.Equal(t, []SourcedDataPoint{
+		{DataPoint: DataPoint{Timestamp: 1, Value: 1}, Source: PartitionRef{MinTimestamp: 1, DirPath: filepath.Join(tmpDir, "p-1-1")}},
+		{DataPoint: DataPoint{Timestamp: 10000, Value: 2}, Source: PartitionRef{MinTimestamp: 10000}},
+	}, got)
+
+	_, err = s.SelectWithSource("metric2", nil, 1, 10001)
+	assert.ErrorIs(t, err, ErrNoDataPoints)
+}
+
+func Test_storage_SelectWithSource_withIDGenerator(t *testing.T) {
+	tmpDir := t.TempDir()
+	var n int
+	opts := []Option{
+		WithDataPath(tmpDir),
+		WithTimestampPrecision(Seconds),
+		WithPartitionDuration(time.Hour),
+		WithRetention(100 * 365 * 24 * time.Hour),
+		WithIDGenerator(func() string {
+			n++
+			return strconv.Itoa(n)
+		}),
+	}
+	// Persist a partition on each close.
+	for i := int64(0); i < 2; i++ {
+		s, err := NewStorage(opts...)
+		require.NoError(t, err)
+		require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1 + i*10000, Value: float64(i)}}}))
+		require.NoError(t, s.Close())
+	}
+	s, err := NewStorage(opts...)
+	require.NoError(t, err)
+	defer s.Close()
+	require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 20000, Value: 2}}}))
+
+	got, err := s.SelectWithSource("metric1", nil, 1, 20001)
+	require.NoError(t, err)
+	assert.Equal(t, []SourcedDataPoint{
+		{DataPoint: DataPoint{Timestamp: 1, Value: 0}, Source: PartitionRef{MinTimestamp: 1, DirPath: filepath.Join(tmpDir, "p-1-1-1"), ID: "1"}},
+		{DataPoint: DataPoint{Timestamp: 10001, Value: 1}, Source: PartitionRef{MinTimestamp: 10001, DirPath: filepath.Join(tmpDir, "p-10001-10001-2"), ID: "2"}},
+		{DataPoint: DataPoint{Timestamp: 20000, Value: 2}, Source: PartitionRef{MinTimestamp: 20000}},
+	}, got)
+}
@@ -0,0 +1,42 @@
+package tstorage
+
+import "fmt"
+
+// WithStartupFlush makes NewStorage persist the data points recovered from WAL right away,
+// rather than keeping them in memory until the partitions get inactive.
+// WAL gets emptied on recovery, so without it, the recovered data points would be lost again
+// if the process crashed before the next flush.
+// It takes longer to start up as much as it takes to flush them.
+//
+// Defaults to false.
+func WithStartupFlush(enabled bool) Option {
+	return func(s *storage) {
+		s.startupFlush = enabled
+	}
+}
+
+// flushRecovered persists all memory partitions, which hold only data points recovered from WAL at this point.
+func (s *storage) flushRecovered() error {
+	recovered := false
+	iterator := s.partitionList.newIterator()
+	for iterator.next() {
+		if m, ok := iterator.value().(*memoryPartition); ok && m.size() > 0 {
+			// Their WAL segments have already been removed on recovery.
+			m.mergedPartitions = -1
+			recovered = true
+		}
+	}
+	if !recovered {
+		return nil
+	}
+	// Make them read-only as Close does.
+	for i := 0; i < writablePartitionsNum; i++ {
+		if err := s.newPartition(nil, false); err != nil {
+			return err
+		}
+	}
+	if err := s.flushPartitions(true); err != nil {
+		return fmt.Errorf("failed to flush recovered partitions: %w", err)
+	}
+	return nil
+}
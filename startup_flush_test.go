@@ -0,0 +1,72 @@
+package tstorage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_storage_withStartupFlush(t *testing.T) {
+	tests := []struct {
+		name          string
+		startupFlush  bool
+		wantPersisted int
+	}{
+		{
+			name:          "disabled",
+			startupFlush:  false,
+			wantPersisted: 0,
+		},
+		{
+			name:          "enabled",
+			startupFlush:  true,
+			wantPersisted: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dataPath := t.TempDir()
+			// Leave WAL as if the process had crashed.
+			wal, err := newDiskWAL(defaultFileSystem, WALDir(dataPath), 0, defaultDirPerm, defaultFilePerm, WALCompressionNone)
+			require.NoError(t, err)
+			require.NoError(t, wal.append(operationInsert, []Row{
+				{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1, Value: 0.1}},
+				{Metric: "metric1", DataPoint: DataPoint{Timestamp: 5000, Value: 0.2}},
+				{Metric: "metric1", DataPoint: DataPoint{Timestamp: 10000, Value: 0.3}},
+			}))
+			require.NoError(t, wal.flush())
+
+			s, err := NewStorage(WithDataPath(dataPath), WithTimestampPrecision(Seconds), WithPartitionDuration(time.Hour),
+				WithRetention(100*365*24*time.Hour), WithStartupFlush(tt.startupFlush))
+			require.NoError(t, err)
+			defer s.Close()
+
+			var persisted int
+			for _, p := range s.ListPartitions() {
+				if p.DirPath != "" {
+					persisted++
+				}
+			}
+			assert.Equal(t, tt.wantPersisted, persisted)
+			dirs, err := listPartitionDirs(defaultFileSystem, dataPath)
+			require.NoError(t, err)
+			assert.Len(t, dirs, tt.wantPersisted)
+
+			// Nothing is left to be replayed.
+			wal2, err := newDiskWALReader(defaultFileSystem, WALDir(dataPath))
+			require.NoError(t, err)
+			require.NoError(t, wal2.readAll())
+			assert.Empty(t, wal2.rowsToInsert)
+
+			points, err := s.Select("metric1", nil, 0, 10001)
+			require.NoError(t, err)
+			assert.Equal(t, []*DataPoint{
+				{Timestamp: 1, Value: 0.1},
+				{Timestamp: 5000, Value: 0.2},
+				{Timestamp: 10000, Value: 0.3},
+			}, points)
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package tstorage
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// checkStateValues makes sure the rows of metrics using CodecState hold boolean values.
+func (s *storage) checkStateValues(rows []Row) error {
+	if len(s.metricCodecs) == 0 {
+		return nil
+	}
+	for i := range rows {
+		v := rows[i].Value
+		if v != 0 && v != 1 && s.codecFor(rows[i].Metric) == CodecState {
+			return fmt.Errorf("%w: %q has %v", ErrNotBoolean, rows[i].Metric, v)
+		}
+	}
+	return nil
+}
+
+func (s *storage) SelectStateChanges(metric string, labels []Label, start, end int64) ([]*DataPoint, error) {
+	return s.SelectChanges(metric, labels, start, end)
+}
+
+func (s *storage) StateAt(metric string, labels []Label, timestamp int64) (bool, error) {
+	metric = s.normalizeMetricName(metric)
+	if metric == "" {
+		return false, fmt.Errorf("metric must be set")
+	}
+	end := timestamp + 1
+	if timestamp == math.MaxInt64 {
+		end = math.MaxInt64
+	}
+	// Iterate over partitions from the newest one until the one holding the latest data point at the timestamp.
+	iterator := s.partitionList.newIterator()
+	for iterator.next() {
+		part := iterator.value()
+		if part == nil {
+			return false, fmt.Errorf("unexpected empty partition found")
+		}
+		if part.size() == 0 || part.minTimestamp() > timestamp {
+			continue
+		}
+		if !pinPartition(part) {
+			// Already removed by retention.
+			continue
+		}
+		ps, err := part.selectDataPoints(metric, labels, math.MinInt64, end)
+		s.releasePartition(part)
+		if errors.Is(err, ErrNoDataPoints) {
+			continue
+		}
+		if err != nil {
+			return false, fmt.Errorf("failed to select data points: %w", err)
+		}
+		if len(ps) == 0 {
+			continue
+		}
+		return ps[len(ps)-1].Value != 0, nil
+	}
+	return false, ErrNoDataPoints
+}
@@ -0,0 +1,88 @@
+package tstorage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_storage_states(t *testing.T) {
+	dataPath := t.TempDir()
+	opts := []Option{
+		WithDataPath(dataPath),
+		WithTimestampPrecision(Seconds),
+		WithPartitionDuration(time.Hour),
+		WithRetention(100 * 365 * 24 * time.Hour),
+		WithPointsPerBlock(3),
+		WithMetricCodec("up", CodecState),
+	}
+	s, err := NewStorage(opts...)
+	require.NoError(t, err)
+	labels := []Label{{Name: "host", Value: "a"}}
+	values := []float64{1, 1, 1, 0, 0, 1, 1, 1, 1, 0}
+	for i, v := range values {
+		require.NoError(t, s.InsertRows([]Row{{Metric: "up", Labels: labels, DataPoint: DataPoint{Timestamp: int64(1000 + i*1000), Value: v}}}))
+	}
+	err = s.InsertRows([]Row{{Metric: "up", Labels: labels, DataPoint: DataPoint{Timestamp: 20000, Value: 0.5}}})
+	assert.ErrorIs(t, err, ErrNotBoolean)
+	// Other metrics accept any value.
+	require.NoError(t, s.InsertRows([]Row{{Metric: "temperature", DataPoint: DataPoint{Timestamp: 20000, Value: 0.5}}}))
+	require.NoError(t, s.Close())
+
+	s, err = NewStorage(opts...)
+	require.NoError(t, err)
+	defer s.Close()
+	// Some of them are in memory again.
+	require.NoError(t, s.InsertRows([]Row{{Metric: "up", Labels: labels, DataPoint: DataPoint{Timestamp: 30000, Value: 1}}}))
+
+	blocks, err := s.SelectBlocks("up", labels, 0, 11000)
+	require.NoError(t, err)
+	for _, b := range blocks {
+		assert.Equal(t, CodecState, b.Codec)
+	}
+	points, err := s.Select("up", labels, 0, 11000)
+	require.NoError(t, err)
+	require.Len(t, points, len(values))
+	for i, p := range points {
+		assert.Equal(t, values[i], p.Value)
+	}
+
+	changes, err := s.SelectStateChanges("up", labels, 0, 31000)
+	require.NoError(t, err)
+	assert.Equal(t, []*DataPoint{
+		{Timestamp: 1000, Value: 1},
+		{Timestamp: 4000, Value: 0},
+		{Timestamp: 6000, Value: 1},
+		{Timestamp: 10000, Value: 0},
+		{Timestamp: 30000, Value: 1},
+	}, changes)
+	changes, err = s.SelectStateChanges("up", labels, 5000, 9000)
+	require.NoError(t, err)
+	assert.Equal(t, []*DataPoint{{Timestamp: 5000, Value: 0}, {Timestamp: 6000, Value: 1}}, changes)
+
+	tests := []struct {
+		timestamp int64
+		want      bool
+		wantErr   error
+	}{
+		{timestamp: 999, wantErr: ErrNoDataPoints},
+		{timestamp: 1000, want: true},
+		{timestamp: 4500, want: false},
+		{timestamp: 6000, want: true},
+		{timestamp: 25000, want: false},
+		{timestamp: 30000, want: true},
+	}
+	for _, tt := range tests {
+		got, err := s.StateAt("up", labels, tt.timestamp)
+		if tt.wantErr != nil {
+			assert.ErrorIs(t, err, tt.wantErr, tt.timestamp)
+			continue
+		}
+		require.NoError(t, err)
+		assert.Equal(t, tt.want, got, tt.timestamp)
+	}
+	_, err = s.StateAt("up", nil, 30000)
+	assert.ErrorIs(t, err, ErrNoDataPoints)
+}
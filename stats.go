@@ -0,0 +1,103 @@
+package tstorage
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stats represents a snapshot of the storage's internal statistics. See Storage.Stats
+type Stats struct {
+	// The number of out-of-order data points accepted and buffered so far.
+	OutOfOrderAccepted int64
+	// The number of out-of-order data points rejected with ErrOutOfOrder so far.
+	OutOfOrderRejected int64
+	// The number of out-of-order data points silently dropped so far.
+	OutOfOrderDropped int64
+	// Whether the last append to the WAL failed because the disk is full.
+	WALDiskFull bool
+	// The number of rows ingested without being written to the WAL under WALFullDropAndContinue.
+	WALRowsDropped int64
+	// The number of data points deduplicated within the dedupe window so far.
+	PointsDeduplicated int64
+	// The number of data points rejected under WithEnforceMonotonicTimestamps so far.
+	MonotonicityViolations int64
+	// The number of panics recovered under WithPanicRecovery so far.
+	PanicsRecovered int64
+	// The number of reads of disk partitions whose data file had been loaded, such as by Warm, so far.
+	PartitionCacheHits int64
+	// The number of reads of disk partitions that had to load the data file so far.
+	PartitionCacheMisses int64
+	// The number of rows inserted into partitions so far, including ones dropped by the out-of-order
+	// or dedupe policies afterwards.
+	RowsInserted int64
+	// The number of partitions persisted to the disk so far.
+	PartitionsFlushed int64
+	// The number of partitions removed because of the retention so far.
+	PartitionsExpired int64
+	// The number of selects walking partitions so far.
+	Selects int64
+	// The number of selects walking partitions right now. See WithMaxConcurrentSelects
+	ConcurrentSelects int64
+	// The number of disk partitions the scrubber found corrupt so far.
+	CorruptPartitions int64
+	// When the scrubber finished the last pass. It is zero if it has never finished.
+	LastScrubAt time.Time
+	// The estimated number of bytes held by memory partitions. See Storage.MemoryUsage
+	MemoryUsage int64
+	// The metrics inserted into the most frequently, in descending order of the rate, estimated by sampling rows.
+	// Metrics inserted into rarely may not show up at all.
+	TopMetricsByIngest []MetricIngestRate
+}
+
+// storageStats holds the counters behind Stats. All fields must be accessed atomically.
+type storageStats struct {
+	outOfOrderAccepted int64
+	outOfOrderRejected int64
+	outOfOrderDropped  int64
+	walDiskFull        int32
+	walRowsDropped     int64
+	pointsDeduplicated int64
+	// monotonicityViolations is the number of data points rejected for non-monotonic timestamps.
+	monotonicityViolations int64
+	panicsRecovered        int64
+	partitionCacheHits     int64
+	partitionCacheMisses   int64
+	// pagesWarmed is the number of pages of data files read in advance by Warm.
+	pagesWarmed       int64
+	rowsInserted      int64
+	partitionsFlushed int64
+	partitionsExpired int64
+	selects           int64
+	concurrentSelects int64
+	corruptPartitions int64
+	// lastScrubAt is in unix nanoseconds.
+	lastScrubAt int64
+}
+
+func (s *storage) Stats() Stats {
+	var lastScrubAt time.Time
+	if ns := atomic.LoadInt64(&s.stats.lastScrubAt); ns != 0 {
+		lastScrubAt = time.Unix(0, ns)
+	}
+	return Stats{
+		OutOfOrderAccepted:     atomic.LoadInt64(&s.stats.outOfOrderAccepted),
+		OutOfOrderRejected:     atomic.LoadInt64(&s.stats.outOfOrderRejected),
+		OutOfOrderDropped:      atomic.LoadInt64(&s.stats.outOfOrderDropped),
+		WALDiskFull:            atomic.LoadInt32(&s.stats.walDiskFull) == 1,
+		WALRowsDropped:         atomic.LoadInt64(&s.stats.walRowsDropped),
+		PointsDeduplicated:     atomic.LoadInt64(&s.stats.pointsDeduplicated),
+		MonotonicityViolations: atomic.LoadInt64(&s.stats.monotonicityViolations),
+		PanicsRecovered:        atomic.LoadInt64(&s.stats.panicsRecovered),
+		PartitionCacheHits:     atomic.LoadInt64(&s.stats.partitionCacheHits),
+		PartitionCacheMisses:   atomic.LoadInt64(&s.stats.partitionCacheMisses),
+		RowsInserted:           atomic.LoadInt64(&s.stats.rowsInserted),
+		PartitionsFlushed:      atomic.LoadInt64(&s.stats.partitionsFlushed),
+		PartitionsExpired:      atomic.LoadInt64(&s.stats.partitionsExpired),
+		Selects:                atomic.LoadInt64(&s.stats.selects),
+		ConcurrentSelects:      atomic.LoadInt64(&s.stats.concurrentSelects),
+		CorruptPartitions:      atomic.LoadInt64(&s.stats.corruptPartitions),
+		LastScrubAt:            lastScrubAt,
+		MemoryUsage:            s.MemoryUsage(),
+		TopMetricsByIngest:     s.ingest.top(topMetricsNum, s.now),
+	}
+}
@@ -4,13 +4,18 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"io/fs"
+	"math"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
 	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/nakabonne/tstorage/internal/cgroup"
@@ -19,6 +24,29 @@ import (
 
 var (
 	ErrNoDataPoints = errors.New("no data points found")
+	// ErrOutOfOrder is returned if out-of-order data points are given under OutOfOrderReject.
+	ErrOutOfOrder = errors.New("out-of-order data points given")
+	// ErrWALFull is returned if the WAL can't be written because the disk is full under WALFullRejectWrites.
+	ErrWALFull = errors.New("no space left for WAL")
+	// ErrPartialResult is returned by SelectStrict if some of the partitions overlapping the range are unavailable.
+	ErrPartialResult = errors.New("partial result")
+	// ErrTooOld is reported by InsertRowsDetailed for rows older than all writable partitions.
+	ErrTooOld = errors.New("data points too old to be inserted")
+	// ErrPanicked is returned if a panic is recovered under WithPanicRecovery.
+	ErrPanicked = errors.New("recovered from panic")
+	// ErrCorruptPartition is returned by reads of a disk partition the scrubber found corrupt.
+	ErrCorruptPartition = errors.New("corrupt partition")
+	// ErrWALDisabled is returned by InsertRowsSync if there is no WAL to make rows durable.
+	ErrWALDisabled = errors.New("WAL is disabled")
+	// ErrDuplicatePartitionID is returned by NewStorage if partition directories sharing an ID are found
+	// under DuplicateIDReject.
+	ErrDuplicatePartitionID = errors.New("duplicate partition ID")
+	// ErrQueryOverloaded is returned by selects beyond the limit given by WithMaxConcurrentSelects.
+	ErrQueryOverloaded = errors.New("too many concurrent selects")
+	// ErrNotBoolean is returned on insert if a metric using CodecState is given a value other than 0 or 1.
+	ErrNotBoolean = errors.New("not a boolean value")
+	// ErrStorageClosed is returned by inserts after Close gets called.
+	ErrStorageClosed = errors.New("storage closed")
 
 	// Limit the concurrency for data ingestion to GOMAXPROCS, since this operation
 	// is CPU bound, so there is no sense in running more than GOMAXPROCS concurrent
@@ -28,6 +56,64 @@ var (
 	partitionDirRegex = regexp.MustCompile(`^p-.+`)
 )
 
+// OutOfOrderPolicy represents how to handle out-of-order data points, which are older than or equal to
+// the latest data point of the same metric within a partition. See WithOutOfOrderPolicy
+type OutOfOrderPolicy string
+
+const (
+	// OutOfOrderAccept buffers out-of-order data points and merges them at flush time.
+	OutOfOrderAccept OutOfOrderPolicy = "accept"
+	// OutOfOrderReject rejects the whole rows with ErrOutOfOrder if any out-of-order data points are given.
+	OutOfOrderReject OutOfOrderPolicy = "reject"
+	// OutOfOrderDrop silently drops out-of-order data points while inserting the others.
+	OutOfOrderDrop OutOfOrderPolicy = "drop"
+)
+
+// WALFullPolicy represents how to behave when appending to the WAL fails because the disk is full.
+// See WithWALFullPolicy
+type WALFullPolicy string
+
+const (
+	// WALFullRejectWrites rejects the rows with ErrWALFull.
+	WALFullRejectWrites WALFullPolicy = "reject"
+	// WALFullDropAndContinue keeps ingesting the rows without writing them to the WAL, at the expense of durability.
+	WALFullDropAndContinue WALFullPolicy = "drop"
+	// WALFullForceFlush flushes all flushable partitions to free the WAL segments, and then retries once.
+	// The rows get rejected with ErrWALFull if it still fails.
+	WALFullForceFlush WALFullPolicy = "flush"
+)
+
+// DedupePolicy represents which data point to keep among ones within the dedupe window. See WithDedupePolicy
+type DedupePolicy string
+
+const (
+	// DedupeKeepFirst keeps the earliest data point, and drops the later ones.
+	DedupeKeepFirst DedupePolicy = "keep-first"
+	// DedupeKeepLast keeps the latest data point, by replacing the earlier one with it.
+	DedupeKeepLast DedupePolicy = "keep-last"
+)
+
+// DuplicateIDPolicy represents how to handle partition directories sharing an ID on startup. See WithDuplicateIDPolicy
+type DuplicateIDPolicy string
+
+const (
+	// DuplicateIDReject makes NewStorage fail with ErrDuplicatePartitionID.
+	DuplicateIDReject DuplicateIDPolicy = "reject"
+	// DuplicateIDQuarantine opens the first directory in name order, and excludes the others from reads,
+	// leaving them on the disk. They are reported by SelectStrict as unavailable.
+	DuplicateIDQuarantine DuplicateIDPolicy = "quarantine"
+)
+
+// WALCompression represents how to compress records written to the WAL. See WithWALCompression
+type WALCompression string
+
+const (
+	// WALCompressionNone writes records as they are.
+	WALCompressionNone WALCompression = "none"
+	// WALCompressionFlate compresses the records of each insertion together with DEFLATE.
+	WALCompressionFlate WALCompression = "flate"
+)
+
 // TimestampPrecision represents precision of timestamps. See WithTimestampPrecision
 type TimestampPrecision string
 
@@ -42,6 +128,12 @@ const (
 	defaultTimestampPrecision = Nanoseconds
 	defaultWriteTimeout       = 30 * time.Second
 	defaultWALBufferedSize    = 4096
+	defaultDirPerm            = fs.FileMode(0755)
+	defaultFilePerm           = fs.FileMode(0644)
+	// The number of partitions a query must touch to select from them in parallel.
+	defaultSelectParallelismThreshold = 8
+	// The number of data points encoded into a block of a disk partition.
+	defaultPointsPerBlock = 1024
 
 	writablePartitionsNum = 2
 	checkExpiredInterval  = time.Hour
@@ -55,9 +147,96 @@ type Storage interface {
 	// InsertRows ingests the given rows to the time-series storage.
 	// If the timestamp is empty, it uses the machine's local timestamp in UTC.
 	// The precision of timestamps is nanoseconds by default. It can be changed using WithTimestampPrecision.
+	// Under WithPartialInsert, it inserts all acceptable rows even if some of them are rejected.
 	InsertRows(rows []Row) error
+	// InsertRowsDetailed ingests the given rows like InsertRows, and gives back the result for each row
+	// in the same order, so that only the rejected rows can be retried or logged.
+	// The returned error is nil if all rows are accepted.
+	// Rows are inserted one by one right away, even if WithWriteBuffer is given.
+	InsertRowsDetailed(rows []Row) ([]RowResult, error)
+	// InsertRowsSync ingests the given rows like InsertRows, and returns only after they are fsynced to the WAL,
+	// so that callers can confirm they survive a crash before acknowledging them upstream.
+	// Rows are inserted right away, even if WithWriteBuffer is given.
+	// It gives back ErrWALDisabled in the in-memory mode or if the WAL is disabled with WithWALBufferedSize.
+	//
+	// Note that it's far slower than InsertRows, since every call waits for the disk to commit the WAL,
+	// which typically takes from hundreds of microseconds to several milliseconds. Batch rows as much as possible.
+	InsertRowsSync(rows []Row) error
+	// InsertNow ingests a data point of the given metric and labels stamped with the current time
+	// in the precision given by WithTimestampPrecision. It goes through the same path as InsertRows,
+	// so that the insert hook and the other options for inserting apply.
+	InsertNow(metric string, labels []Label, value float64) error
+	// InsertFrom decodes rows from the given stream using the given codec, and ingests them in batches.
+	// BinaryWireCodec is used if codec is nil. It gives back the number of rows inserted.
+	// If the stream is broken in the middle, rows decoded before that get inserted, and then an error is returned.
+	InsertFrom(r io.Reader, codec WireCodec) (int, error)
+	// ListPartitions gives back the descriptions of all partitions, in order of newest to oldest.
+	ListPartitions() []PartitionInfo
+	// FlushAsync persists the memory partitions that are no longer writable in a background goroutine,
+	// and gives back immediately. Reads keep being served from each memory partition until it gets
+	// swapped for the persisted disk partition. The result is delivered to the returned handle.
+	FlushAsync() *FlushHandle
+	// Flush persists the memory partitions that are no longer writable like FlushAsync, but waits for it,
+	// and gives back the disk partitions persisted in order of newest to oldest, so that callers such as
+	// replication can tell exactly what was persisted. A partition failed to be persisted doesn't keep
+	// the others from being persisted; the failures are reported with *PartialFlushError, and the persisted
+	// ones are given back along with it.
+	Flush() ([]FlushedPartitionInfo, error)
+	// OldestTimestamp gives back the minimum timestamp across the current partitions.
+	// It gives back false if the storage has no data points.
+	OldestTimestamp() (int64, bool)
+	// LatestTimestamp gives back the maximum timestamp across the current partitions, that is, the data horizon.
+	// It gives back false if the storage has no data points.
+	LatestTimestamp() (int64, bool)
+	// RecentEvents gives back the n most recent partition events in order of oldest to newest.
+	// Only a bounded number of events are retained; see WithEventHook to observe all of them.
+	RecentEvents(n int) []PartitionEvent
+	// RetentionHorizon gives back the timestamp of the current time minus the retention,
+	// in the precision given by WithTimestampPrecision. Data points older than it are subject to removal.
+	// Along with OldestTimestamp, it helps to bound the time range to query.
+	// Note that retention itself is measured by when partitions were persisted, not by the timestamps of
+	// data points, so that data points with relative or pre-epoch timestamps aren't removed right away,
+	// unless WithRetentionByTimestamp is given.
+	RetentionHorizon() int64
+	// Warm loads the data of disk partitions holding the given metrics within the given range in advance,
+	// so that the subsequent queries don't have to read the disk. It is useful right after the startup,
+	// or before a known spike of queries. Whether queries find the data loaded can be seen through Stats.
+	// Loaded data are kept until the storage gets closed, since nothing is evicted.
+	Warm(metrics []string, start, end int64) error
+	// DuplicatePartitions gives back the disk partitions found to hold exactly the same data points as another one
+	// when opening the storage. They are excluded from queries so that data points aren't given back twice,
+	// but left on the disk until DeduplicatePartitions gets called.
+	DuplicatePartitions() []DuplicatePartition
+	// DeduplicatePartitions permanently removes the partitions DuplicatePartitions gives back,
+	// and gives back the number of partitions removed.
+	DeduplicatePartitions() (int, error)
+	// DropActivePartition discards the active memory partition, that is the head, along with its WAL records
+	// without flushing, and starts a fresh one in place of it. It is meant to reset state in tests, or to recover
+	// from a partition poisoned with bad data points.
+	//
+	// IT LOSES ALL DATA POINTS IN THE ACTIVE PARTITION, which can never be recovered. Out-of-order data points
+	// inserted into the older writable partition since the active one was created lose their WAL records as well,
+	// thus they will be lost if the process crashes before they get flushed.
+	// It fails unless enabled with WithDropActivePartition, and must not be called concurrently with writes.
+	DropActivePartition() error
+	// MemoryUsage gives back the estimated number of bytes held by memory partitions, including data points,
+	// series and their names. It is computed from the numbers of them rather than the runtime heap statistics,
+	// so that it reflects only the footprint of the storage. Persisted partitions aren't taken into account,
+	// except for ones kept in memory by WithHotPartitions.
+	MemoryUsage() int64
+	// Stats gives back a snapshot of the storage's internal statistics.
+	Stats() Stats
+	// Config gives back a snapshot of the configuration in effect, which is useful to confirm
+	// what settings are actually applied. Modifying it has no effect on the storage.
+	Config() StorageConfig
 	// Close gracefully shutdowns by flushing any unwritten data to the underlying disk partition.
+	// It rejects new inserts with ErrStorageClosed, and waits for in-flight ones to finish before flushing.
 	Close() error
+	// Reopen makes the closed storage available again with the same options, as NewStorage does;
+	// it reads partitions from the data directory again, and resumes accepting writes.
+	// Data points in the in-memory mode don't survive Close, thus it starts empty.
+	// It must not be called concurrently with any other operations.
+	Reopen() error
 }
 
 // Reader provides reading access to time series data.
@@ -66,6 +245,121 @@ type Reader interface {
 	// labels within the given start-end range. Keep in mind that start is inclusive, end is exclusive,
 	// and both must be Unix timestamp. ErrNoDataPoints will be returned if no data points found.
 	Select(metric string, labels []Label, start, end int64) (points []*DataPoint, err error)
+	// SelectColumns is like Select, but gives back the timestamps and values as parallel slices
+	// instead of a slice of data points. It is more memory-efficient, and directly consumable by
+	// numerical libraries.
+	SelectColumns(metric string, labels []Label, start, end int64) (timestamps []int64, values []float64, err error)
+	// SelectIterator is like Select, but gives back an iterator that reads partitions one at a time
+	// instead of collecting all data points up front. The iterator must be closed.
+	SelectIterator(metric string, labels []Label, start, end int64) (*PointIterator, error)
+	// SelectWhere is like Select, but gives back only data points whose value satisfies pred,
+	// such as ones above a threshold. pred is applied while scanning partitions, so that data points
+	// not satisfying it are never decoded into the result. ErrNoDataPoints will be returned if none satisfies it.
+	// pred may be called concurrently.
+	SelectWhere(metric string, labels []Label, start, end int64, pred func(value float64) bool) (points []*DataPoint, err error)
+	// SelectDigest gives back a hash of the data points Select would give back, without giving back them.
+	// It depends only on the timestamps and values, regardless of how they are split into partitions,
+	// so that it can be used to tell if the result has changed, such as for an ETag.
+	// ErrNoDataPoints will be returned if no data points found.
+	SelectDigest(metric string, labels []Label, start, end int64) (digest uint64, err error)
+	// SelectClamped is like Select, but caps end to right after the latest data point across all metrics,
+	// and gives back true as clamped if it did so. If start is beyond the latest data point,
+	// it gives back ErrNoDataPoints immediately without walking partitions.
+	// It helps to tell clients that they queried past the data horizon; see also LatestTimestamp.
+	SelectClamped(metric string, labels []Label, start, end int64) (points []*DataPoint, clamped bool, err error)
+	// SelectWithSource is like Select, but annotates each data point with the partition it came from.
+	// It is meant for debugging where data points are placed, such as misrouted out-of-order ones,
+	// or ones moved by flushes and merges. Select should be used otherwise since it's cheaper.
+	SelectWithSource(metric string, labels []Label, start, end int64) (points []SourcedDataPoint, err error)
+	// SelectChanges is like Select, but gives back only data points whose value differs from
+	// the previous one, which suppresses runs of identical values. The first data point is always included.
+	SelectChanges(metric string, labels []Label, start, end int64) (points []*DataPoint, err error)
+	// SelectMatching is like Select, but gives back data points of all series of the given metric having all of
+	// the given labels, rather than the series with exactly the given labels. Series may have other labels as well,
+	// and all series of the metric match if labels is empty.
+	// Rows are in order by series and then by timestamp, where each row holds the labels of its series.
+	// ErrNoDataPoints will be returned if no data points found.
+	SelectMatching(metric string, labels []Label, start, end int64) (rows []Row, err error)
+	// SelectGaps gives back the ranges within the given range where consecutive data points of the given metric
+	// and labels are more than 1.5 times expectedInterval apart, such as missed scrapes, in ascending order.
+	// Ranges before the first data point and after the last one aren't regarded as gaps.
+	// It streams data points like SelectIterator, without collecting them up front.
+	// Unlike Select, it gives back no gaps with no error if no data points found.
+	SelectGaps(metric string, labels []Label, start, end, expectedInterval int64) (gaps []Gap, err error)
+	// SelectStateChanges gives back the data points of the given boolean series within the given range
+	// where its state changes, like SelectChanges. The first data point is always included as the initial state.
+	// It suits metrics using CodecState, whose data points are persisted as runs of the same state.
+	// ErrNoDataPoints will be returned if no data points found.
+	SelectStateChanges(metric string, labels []Label, start, end int64) (points []*DataPoint, err error)
+	// StateAt gives back the state of the given boolean series at the given timestamp, which is the value of
+	// the latest data point at or before it; any value other than 0 is regarded as true.
+	// It walks partitions from the newest one and stops at the first one holding such a data point.
+	// ErrNoDataPoints will be returned if there is no data point at or before the timestamp.
+	StateAt(metric string, labels []Label, timestamp int64) (state bool, err error)
+	// SelectSorted gives back at most limit data points of the given metric and labels within the given range
+	// that come first in order of less, sorted by less, such as the highest values in the range.
+	// Only limit data points are kept while streaming data points like SelectIterator, rather than sorting all of them.
+	// Data points equal to each other in order of less come in no particular order.
+	// ErrNoDataPoints will be returned if no data points found.
+	SelectSorted(metric string, labels []Label, start, end int64, less func(a, b *DataPoint) bool, limit int) (points []*DataPoint, err error)
+	// SelectLastN gives back the latest n data points of the given metric and labels regardless of the time range,
+	// in ascending order. ErrNoDataPoints will be returned if no data points found.
+	// It walks partitions from the newest one and stops once n data points are collected, so that older partitions
+	// are never read. Within a disk partition, only the blocks holding the latest data points are decoded.
+	SelectLastN(metric string, labels []Label, n int) (points []*DataPoint, err error)
+	// SelectStrict is like Select, but tells whether the result is complete.
+	// If some of the partitions overlapping the range are unavailable, such as ones failed to be read
+	// or skipped when opening the storage, it gives back a *PartialResultError, which wraps ErrPartialResult
+	// and holds the data points selected from the others along with the unavailable partitions.
+	SelectStrict(metric string, labels []Label, start, end int64) (points []*DataPoint, err error)
+	// CountPoints gives back the number of data points that Select would give back, without decoding
+	// them where possible. Unlike Select, it gives back 0 with no error if no data points found.
+	CountPoints(metric string, labels []Label, start, end int64) (int, error)
+	// Heatmap gives back the number of data points within the given range, bucketed by time with timeStep
+	// and by value with valueBuckets, which are upper bounds in ascending order.
+	// Values greater than the last upper bound fall into the overflow bucket.
+	// It gives back a heatmap filled with zeros if no data points found.
+	Heatmap(metric string, labels []Label, start, end, timeStep int64, valueBuckets []float64) (*Heatmap, error)
+	// SelectMatrix gives back data points of the given metrics sharing the given labels within the given range,
+	// aggregated with fn into time buckets of step, so that all series are aligned on a common time axis.
+	// timestamps holds the inclusive start of each bucket, and rows holds the aggregated value of each bucket
+	// for each metric, where NaN means no data points in the bucket.
+	SelectMatrix(metrics []string, labels []Label, start, end, step int64, fn AggFunc) (timestamps []int64, rows map[string][]float64, err error)
+	// SelectAligned gives back data points of the given metric and labels within the given range,
+	// aggregated with fn into time buckets of step, which are aligned to multiples of step.
+	// Each data point given back has the inclusive start of the bucket as its timestamp; empty buckets are omitted.
+	// ErrNoDataPoints will be returned if no data points found.
+	SelectAligned(metric string, labels []Label, start, end, step int64, fn AggFunc) (points []*DataPoint, err error)
+	// SelectBuckets aggregates data points of the given metric and labels within the given range with fn into
+	// time buckets of bucketSize, which are laid out from start regardless of the data points, unlike SelectAligned.
+	// It gives back the aggregated values keyed by the inclusive start of each bucket; empty buckets are omitted.
+	// ErrNoDataPoints will be returned if no data points found.
+	SelectBuckets(metric string, labels []Label, start, end, bucketSize int64, fn AggFunc) (buckets map[int64]float64, err error)
+	// SelectBlocks gives back the compressed blocks holding data points of the given metric and labels
+	// overlapping the given range, in ascending order. Blocks in disk partitions are given back as they are,
+	// without being decoded, hence they may contain data points outside the range.
+	// Data points in memory partitions are encoded into blocks on the fly.
+	// It is useful to serve data to remote readers, which decode blocks by themselves.
+	SelectBlocks(metric string, labels []Label, start, end int64) ([]*Block, error)
+	// SelectSeriesBlocks is like SelectBlocks, but gives back the blocks of all series of the given metric having
+	// all of the given labels like SelectMatching, in order by series. Each holds the labels of its series.
+	// ErrNoDataPoints will be returned if no data points found.
+	SelectSeriesBlocks(metric string, labels []Label, start, end int64) ([]SeriesBlocks, error)
+	// SelectByPartition gives back the data points within the given range like Select, but grouped by
+	// the partitions overlapping the range, in order of oldest to newest. It is a diagnostic tool
+	// to reveal how data points are placed, such as duplicates across partitions.
+	SelectByPartition(metric string, labels []Label, start, end int64) ([]PartitionResult, error)
+	// ForEachPartitionInRange calls fn with the rows of all series within the given range for each partition
+	// overlapping the range, in order of oldest to newest, and stops at the first error fn gives back.
+	// Rows are in order by series and then by timestamp. It suits processing a partition at a time,
+	// such as computing per-partition aggregates, without assembling the whole result.
+	// Note that all rows of a partition within the range are held in memory at once, thus narrow the range
+	// or use SelectIterator per series for large partitions.
+	ForEachPartitionInRange(start, end int64, fn func(info PartitionInfo, rows []Row) error) error
+	// LabelNames gives back all distinct label names across all partitions in ascending order,
+	// like the label names endpoint of Prometheus. It reads only the series names kept in memory
+	// and in the metadata of disk partitions, never data points.
+	LabelNames() ([]string, error)
 }
 
 // Row includes a data point along with properties to identify a kind of metrics.
@@ -83,7 +377,8 @@ type Row struct {
 type DataPoint struct {
 	// The actual value. This field must be set.
 	Value float64
-	// Unix timestamp.
+	// Unix timestamp. Negative ones, such as before the epoch or relative to an arbitrary origin, are allowed too.
+	// Zero is regarded as unset, and replaced with the current time on insertion. See WithTimestampAutofill
 	Timestamp int64
 }
 
@@ -107,6 +402,9 @@ func WithDataPath(dataPath string) Option {
 // It acts as a fully independent database containing all data
 // points for its time range.
 //
+// The data path remembers the partition duration it was created with,
+// and NewStorage fails with ErrPartitionDurationMismatch if another one is given.
+//
 // Defaults to 1h
 func WithPartitionDuration(duration time.Duration) Option {
 	return func(s *storage) {
@@ -124,7 +422,32 @@ func WithRetention(retention time.Duration) Option {
 	}
 }
 
+// WithRetentionByTimestamp makes the retention measured by the timestamps of data points as well as by when
+// disk partitions were persisted: a disk partition whose max timestamp is older than RetentionHorizon
+// gets removed too, which bounds the disk usage even if old data points are backfilled.
+// Partitions being read are removed once the reads are done.
+//
+// Defaults to false.
+func WithRetentionByTimestamp(enabled bool) Option {
+	return func(s *storage) {
+		s.retentionByTimestamp = enabled
+	}
+}
+
+// WithScrubInterval enables the background scrubber, which verifies the checksums of the data files
+// of disk partitions at the given interval. The reads are rate-limited so as not to starve other I/O.
+// A partition found corrupt gets reported with PartitionEventCorrupted and all reads of it fail
+// with ErrCorruptPartition. Partitions flushed by older versions have no checksum and are skipped.
+// Defaults to 0, which disables the scrubber.
+func WithScrubInterval(interval time.Duration) Option {
+	return func(s *storage) {
+		s.scrubInterval = interval
+	}
+}
+
 // WithTimestampPrecision specifies the precision of timestamps to be used by all operations.
+// Like WithPartitionDuration, the data path remembers it, and NewStorage fails with
+// ErrTimestampPrecisionMismatch if another one is given.
 //
 // Defaults to Nanoseconds
 func WithTimestampPrecision(precision TimestampPrecision) Option {
@@ -145,6 +468,29 @@ func WithWriteTimeout(timeout time.Duration) Option {
 	}
 }
 
+// WithIDGenerator specifies the function generating an ID for each partition getting persisted,
+// which is appended to the name of its directory like "p-1600000000-1600003600-<id>".
+// It lets tests name directories deterministically, and keeps partitions with the same time range apart.
+// An ID must not be empty nor contain path separators.
+//
+// Defaults to nil, which names directories only by the time range.
+func WithIDGenerator(fn func() string) Option {
+	return func(s *storage) {
+		s.idGenerator = fn
+	}
+}
+
+// WithDuplicateIDPolicy specifies how to handle partition directories sharing an ID given by WithIDGenerator,
+// which can be left by a botched copy or merge, when opening the storage.
+// IDs are checked only if WithIDGenerator is given, since directories are named only by the time range otherwise.
+//
+// Defaults to DuplicateIDReject.
+func WithDuplicateIDPolicy(policy DuplicateIDPolicy) Option {
+	return func(s *storage) {
+		s.duplicateIDPolicy = policy
+	}
+}
+
 // WithLogger specifies the logger to emit verbose output.
 //
 // Defaults to a logger implementation that does nothing.
@@ -166,138 +512,727 @@ func WithWALBufferedSize(size int) Option {
 	}
 }
 
+// WithWriteBuffer makes InsertRows buffer rows instead of inserting them right away,
+// in order to reduce the per-call overhead of lots of small inserts.
+// Buffered rows get inserted at once when the buffer holds maxRows rows or more,
+// when maxDelay elapses, or when the storage gets closed.
+// Giving 0 or less for maxDelay flushes it only based on the number of rows.
+//
+// Note that buffered rows are neither selectable nor written to WAL until they get flushed,
+// that is, they will be lost if the process crashes, and errors caused by inserting them get
+// returned to the caller filling up the buffer or emitted to the logger.
+//
+// Defaults to no buffering.
+func WithWriteBuffer(maxRows int, maxDelay time.Duration) Option {
+	return func(s *storage) {
+		if maxRows <= 1 {
+			s.writeBuffer = nil
+			return
+		}
+		s.writeBuffer = newWriteBuffer(maxRows, maxDelay)
+	}
+}
+
+// WithDirPerm specifies the permission bits of directories created by the storage,
+// such as the data directory, partition directories and the WAL directory.
+// They are applied as is, regardless of the process's umask.
+//
+// Defaults to 0755.
+func WithDirPerm(perm fs.FileMode) Option {
+	return func(s *storage) {
+		s.dirPerm = perm
+	}
+}
+
+// WithFilePerm specifies the permission bits of files created by the storage,
+// such as partition data files, meta files and WAL segment files.
+// They are applied as is, regardless of the process's umask.
+//
+// Defaults to 0644.
+func WithFilePerm(perm fs.FileMode) Option {
+	return func(s *storage) {
+		s.filePerm = perm
+	}
+}
+
+// WithMmap specifies whether to memory-map the data files of disk partitions.
+// With mmap, only the pages touched by a query get read from the disk, which keeps
+// the memory footprint small even for large historical queries.
+// Giving false forces reading the whole data file into the heap when opening a partition.
+// It automatically falls back to reading into the heap on platforms where mmap isn't available.
+// The buffers to read into are given by the allocator specified with WithAllocator.
+//
+// Defaults to true.
+func WithMmap(enabled bool) Option {
+	return func(s *storage) {
+		s.useMmap = enabled
+	}
+}
+
+// WithInsertHook specifies a function invoked with the given rows every time InsertRows gets called,
+// before they are written to the WAL and partitions.
+// The rows it gives back are inserted instead of the given ones, which allows to drop, enrich or relabel rows.
+// Returning an error rejects the whole rows, and then InsertRows returns it as is.
+//
+// Note that the hook isn't invoked for rows recovered from WAL since they have already been through it.
+func WithInsertHook(hook func(rows []Row) ([]Row, error)) Option {
+	return func(s *storage) {
+		s.insertHook = hook
+	}
+}
+
+// WithTimestampFunc specifies a function that derives the timestamp of each row given to InsertRows.
+// The derived timestamp replaces the row's own one before the insert hook gets invoked,
+// and is used to route the row to a partition and stored as is,
+// which allows to choose between event time and processing time, for instance.
+//
+// Defaults to using the timestamp of the row as is.
+func WithTimestampFunc(fn func(row Row) int64) Option {
+	return func(s *storage) {
+		s.timestampFunc = fn
+	}
+}
+
+// WithTimestampAutofill makes InsertRows give rows with a zero timestamp the current time in the timestamp precision
+// on arrival, after WithTimestampFunc is applied. All of such rows in a call get the same time.
+// Otherwise they get the time when inserted into a partition, which is after being written to the WAL,
+// hence they get the time of recovery if recovered from the WAL; the insert hook sees zero timestamps as well.
+// Rows with explicit timestamps are left untouched either way.
+//
+// Defaults to false.
+func WithTimestampAutofill(enabled bool) Option {
+	return func(s *storage) {
+		s.timestampAutofill = enabled
+	}
+}
+
+// WithMetricNameNormalizer specifies a function that converts metric names into their canonical form,
+// such as "http.requests" into "http_requests", to prevent a series from being split by naming inconsistencies.
+// It is applied to both rows given to InsertRows, before the insert hook, and metric names given to
+// read operations, so that metrics are always stored and queried under their canonical form.
+//
+// Defaults to nil, which means metric names are used as is.
+func WithMetricNameNormalizer(normalizer func(metric string) string) Option {
+	return func(s *storage) {
+		s.metricNameNormalizer = normalizer
+	}
+}
+
+// WithRetentionCallback specifies a function invoked for each partition dropped because of
+// the retention, right before its directory gets deleted.
+// It is useful to log or archive what the retention deleted.
+//
+// The callback is called synchronously by the retention sweeper, so it should return quickly.
+func WithRetentionCallback(fn func(info PartitionInfo)) Option {
+	return func(s *storage) {
+		s.retentionCallback = fn
+	}
+}
+
+// WithOutOfOrderPolicy specifies how to handle out-of-order data points.
+// The number of out-of-order data points accepted, rejected and dropped can be seen through Stats.
+//
+// Defaults to OutOfOrderAccept.
+func WithOutOfOrderPolicy(policy OutOfOrderPolicy) Option {
+	return func(s *storage) {
+		s.outOfOrderPolicy = policy
+	}
+}
+
+// WithEnforceMonotonicTimestamps makes the storage reject data points whose timestamps are older than or
+// equal to the latest ones of the same series, for sources that guarantee monotonic timestamps per series.
+// It catches bugs of such sources, and keeps insertion on the fast path of appending to the end of series.
+// Unlike OutOfOrderReject, it works across partitions, and rejects only the violating data points
+// while inserting the others; then InsertRows returns an error wrapping ErrOutOfOrder.
+// The number of rejected data points can be seen through Stats.
+//
+// The latest timestamps are tracked in memory, since the storage was opened.
+// Defaults to false.
+func WithEnforceMonotonicTimestamps(enabled bool) Option {
+	return func(s *storage) {
+		s.enforceMonotonic = enabled
+	}
+}
+
+// WithWALFullPolicy specifies how to behave when appending to the WAL fails because the disk is full.
+// Whether the disk is currently full can be seen through Stats.
+//
+// Defaults to WALFullRejectWrites.
+func WithWALFullPolicy(policy WALFullPolicy) Option {
+	return func(s *storage) {
+		s.walFullPolicy = policy
+	}
+}
+
+// WithDedupeWindow specifies the window in which data points of the same metric are regarded as duplicates.
+// A data point whose timestamp is within d after the latest data point of the same metric gets deduplicated
+// according to the DedupePolicy, which is useful for jittery sources emitting the same sample repeatedly.
+// Data points are compared with ones within the same partition only.
+// The number of deduplicated data points can be seen through Stats.
+//
+// Defaults to 0, which disables deduplication.
+func WithDedupeWindow(d time.Duration) Option {
+	return func(s *storage) {
+		s.dedupeWindow = d
+	}
+}
+
+// WithDedupePolicy specifies which data point to keep among ones within the dedupe window.
+//
+// Defaults to DedupeKeepFirst.
+func WithDedupePolicy(policy DedupePolicy) Option {
+	return func(s *storage) {
+		s.dedupePolicy = policy
+	}
+}
+
+// WithFlushTrigger specifies a function that decides whether the head partition is ready to be persisted,
+// based on its description such as the number of data points or the age.
+// It is consulted in addition to the partition duration; a partition is regarded as ready once either
+// its time range exceeds the partition duration, or the trigger gives back true.
+// Then a new partition gets created and the old one gets persisted at some point.
+// It is never invoked for an empty partition.
+//
+// Defaults to nil, which means only the partition duration is taken into account.
+func WithFlushTrigger(trigger func(info PartitionInfo) bool) Option {
+	return func(s *storage) {
+		s.flushTrigger = trigger
+	}
+}
+
+// WithSelectParallelismThreshold specifies the number of partitions a query must touch
+// to select data points from them in parallel. Queries touching fewer partitions run serially,
+// which avoids the goroutine overhead for small queries.
+// Giving 0 or less disables the parallel selection.
+//
+// Defaults to 8.
+func WithSelectParallelismThreshold(n int) Option {
+	return func(s *storage) {
+		s.selectParallelismThreshold = n
+	}
+}
+
+// WithRelativeTimestamps makes partitions persisted from now on encode timestamps as offsets from
+// the min timestamp of the partition, rather than as absolute ones. It shrinks the leading timestamp of each block,
+// which matters for partitions with short durations and a lot of blocks, especially in nanosecond precision.
+// The base is recorded in the meta file, so partitions can be read regardless of this option,
+// but not by versions of this package older than it.
+//
+// Defaults to false.
+func WithRelativeTimestamps(enabled bool) Option {
+	return func(s *storage) {
+		s.relativeTimestamps = enabled
+	}
+}
+
+// WithPointsPerBlock specifies the number of data points of each metric encoded into a block
+// when persisting a partition. Each block is indexed in the meta file, so that a query decodes
+// only the blocks overlapping its time range.
+// Giving 0 or less encodes all data points of a metric into a single block.
+//
+// Defaults to 1024.
+func WithPointsPerBlock(n int) Option {
+	return func(s *storage) {
+		s.pointsPerBlock = n
+	}
+}
+
+// WithWALCompression specifies how to compress records written to the WAL, which trades CPU time
+// on the write path for less disk I/O and smaller WAL segments.
+// The compression pays off when rows are inserted in batches, since the rows given at once get compressed together.
+// Compressed records are decompressed transparently on recovery, regardless of this option.
+//
+// Defaults to WALCompressionNone.
+func WithWALCompression(compression WALCompression) Option {
+	return func(s *storage) {
+		s.walCompression = compression
+	}
+}
+
+// WithAllocator specifies the allocator of large byte buffers, which are ones used to write data files
+// when flushing partitions and to read data files when memory-mapping isn't used.
+// It enables arena-style reuse of buffers for predictable memory usage.
+//
+// Defaults to the allocator that allocates on the Go heap.
+func WithAllocator(allocator Allocator) Option {
+	return func(s *storage) {
+		s.allocator = allocator
+	}
+}
+
+// WithZeroCopyStrings reduces allocations on the insert path for high-throughput ingestion.
+// Data points reference the given rows as they are instead of copies of them, and the name of each series
+// is built in a reused buffer, which gets copied only when the series is new to the partition.
+//
+// In return, the caller must not modify or reuse the rows, including the strings and labels in them,
+// once they are given to InsertRows. Note that rows without timestamps get the current time set in place.
+//
+// Defaults to false.
+func WithZeroCopyStrings(enabled bool) Option {
+	return func(s *storage) {
+		s.zeroCopyStrings = enabled
+	}
+}
+
+// WithFlushBufferSize specifies the byte size of the buffer to write a data file through when flushing a partition.
+// Data points are encoded into it series by series, and it gets written to the disk every time it fills up,
+// so that the memory a flush takes is bounded by it rather than the size of the partition.
+// The larger the size, the fewer writes at the expense of memory. The buffer is given by the allocator
+// specified with WithAllocator.
+//
+// Defaults to 1MiB.
+func WithFlushBufferSize(size int) Option {
+	return func(s *storage) {
+		s.flushBufferSize = size
+	}
+}
+
+// WithMinFlushPoints specifies the minimum number of data points for a memory partition to be persisted.
+// A partition ready to be persisted with fewer data points gets merged into the next newer memory partition
+// instead, so that the disk isn't churned by tiny partitions under low ingestion.
+// Close and FlushAsync persist partitions regardless of it.
+//
+// Defaults to 0, which means partitions always get persisted.
+func WithMinFlushPoints(n int) Option {
+	return func(s *storage) {
+		s.minFlushPoints = n
+	}
+}
+
+// WithMetricCodec specifies the codec used to encode data points of metrics whose names match the given pattern
+// when persisting a partition. The pattern follows the syntax of path.Match.
+// It can be given multiple times, and then the first pattern matching a metric name is used.
+// The codec is recorded per block, so that reads decode each block transparently.
+//
+// Defaults to CodecGorilla for all metrics.
+func WithMetricCodec(pattern string, codec Codec) Option {
+	return func(s *storage) {
+		s.metricCodecs = append(s.metricCodecs, metricCodec{pattern: pattern, codec: codec})
+	}
+}
+
 // NewStorage gives back a new storage, which stores time-series data in the process memory by default.
 //
 // Give the WithDataPath option for running as a on-disk storage. Specify a directory with data already exists,
 // then it will be read as the initial data.
 func NewStorage(opts ...Option) (Storage, error) {
 	s := &storage{
-		partitionList:      newPartitionList(),
-		workersLimitCh:     make(chan struct{}, defaultWorkersLimit),
-		partitionDuration:  defaultPartitionDuration,
-		retention:          defaultRetention,
-		timestampPrecision: defaultTimestampPrecision,
-		writeTimeout:       defaultWriteTimeout,
-		walBufferedSize:    defaultWALBufferedSize,
-		wal:                &nopWAL{},
-		logger:             &nopLogger{},
-		doneCh:             make(chan struct{}, 0),
+		partitionList:              newPartitionList(),
+		workersLimitCh:             make(chan struct{}, defaultWorkersLimit),
+		partitionDuration:          defaultPartitionDuration,
+		retention:                  defaultRetention,
+		timestampPrecision:         defaultTimestampPrecision,
+		writeTimeout:               defaultWriteTimeout,
+		walBufferedSize:            defaultWALBufferedSize,
+		walCompression:             WALCompressionNone,
+		lastTimestamps:             newLastTimestamps(),
+		dirPerm:                    defaultDirPerm,
+		filePerm:                   defaultFilePerm,
+		useMmap:                    true,
+		outOfOrderPolicy:           OutOfOrderAccept,
+		walFullPolicy:              WALFullRejectWrites,
+		dedupePolicy:               DedupeKeepFirst,
+		duplicateIDPolicy:          DuplicateIDReject,
+		windowGapPolicy:            WindowGapExtendOlder,
+		partitionSharding:          ShardingNone,
+		selectParallelismThreshold: defaultSelectParallelismThreshold,
+		pointsPerBlock:             defaultPointsPerBlock,
+		allocator:                  defaultAllocator,
+		flushBufferSize:            defaultFlushBufferSize,
+		fsys:                       defaultFileSystem,
+		now:                        time.Now,
+		stats:                      &storageStats{},
+		events:                     newEventLog(defaultEventLogSize),
+		ingest:                     newIngestTracker(),
+		wal:                        &nopWAL{},
+		logger:                     &nopLogger{},
+		doneCh:                     make(chan struct{}, 0),
 	}
 	for _, opt := range opts {
 		opt(s)
 	}
+	if s.flushBufferSize <= 0 {
+		return nil, fmt.Errorf("flush buffer size must be positive")
+	}
+	if s.coldCache != nil && (s.coldCache.dir == "" || s.coldCache.maxBytes <= 0) {
+		return nil, fmt.Errorf("cold cache directory must be set and its size must be positive")
+	}
+	if s.flushRetryAttempts < 0 || s.flushRetryBackoff < 0 {
+		return nil, fmt.Errorf("flush retry attempts and backoff must not be negative")
+	}
+	if !s.partitionSharding.valid() {
+		return nil, fmt.Errorf("unknown partition sharding %q", s.partitionSharding)
+	}
+	for _, mc := range s.metricCodecs {
+		if _, err := path.Match(mc.pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid metric name pattern %q: %w", mc.pattern, err)
+		}
+		if !mc.codec.valid() {
+			return nil, fmt.Errorf("unknown codec %q", mc.codec)
+		}
+	}
+
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
 
+// open prepares partitions, WAL and background goroutines, on the basis of the options.
+func (s *storage) open() error {
 	if s.inMemoryMode() {
 		s.newPartition(nil, false)
-		return s, nil
+		s.startWriteBuffer()
+		return nil
 	}
 
-	if err := os.MkdirAll(s.dataPath, fs.ModePerm); err != nil {
-		return nil, fmt.Errorf("failed to make data directory %s: %w", s.dataPath, err)
+	if err := mkdirAll(s.fsys, s.dataPath, s.dirPerm); err != nil {
+		return fmt.Errorf("failed to make data directory %s: %w", s.dataPath, err)
+	}
+	if err := s.checkManifest(); err != nil {
+		return err
+	}
+	if err := recoverMerge(s.fsys, s.dataPath); err != nil {
+		return err
+	}
+	if s.coldCache != nil {
+		if err := s.coldCache.open(s.dirPerm); err != nil {
+			return err
+		}
 	}
 
-	walDir := filepath.Join(s.dataPath, walDirName)
+	walDir := WALDir(s.dataPath)
 	if s.walBufferedSize >= 0 {
-		wal, err := newDiskWAL(walDir, s.walBufferedSize)
+		wal, err := newDiskWAL(s.fsys, walDir, s.walBufferedSize, s.dirPerm, s.filePerm, s.walCompression)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		s.wal = wal
+		s.wal = s.newDiskFullWAL(wal)
 	}
 
 	// Read existent partitions from the disk.
-	dirs, err := os.ReadDir(s.dataPath)
+	dirs, err := listPartitionDirs(s.fsys, s.dataPath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open data directory: %w", err)
-	}
-	if len(dirs) == 0 {
-		s.newPartition(nil, false)
-		return s, nil
+		return err
 	}
-	isPartitionDir := func(f fs.DirEntry) bool {
-		return f.IsDir() && partitionDirRegex.MatchString(f.Name())
+	quarantined, err := s.checkPartitionIDs(dirs)
+	if err != nil {
+		return err
 	}
 	partitions := make([]partition, 0, len(dirs))
-	for _, e := range dirs {
-		if !isPartitionDir(e) {
+	for _, dir := range dirs {
+		path := filepath.Join(s.dataPath, dir)
+		if _, ok := quarantined[dir]; ok {
+			skipped := newSkippedPartition(path, ErrDuplicatePartitionID)
+			s.skippedPartitions = append(s.skippedPartitions, skipped)
+			s.recordEvent(PartitionEventSkipped, skipped.PartitionInfo, ErrDuplicatePartitionID)
 			continue
 		}
-		path := filepath.Join(s.dataPath, e.Name())
-		part, err := openDiskPartition(path, s.retention)
+		part, err := s.openDiskPartition(path)
 		if errors.Is(err, ErrNoDataPoints) {
 			continue
 		}
 		if errors.Is(err, errInvalidPartition) {
 			// It should be recovered by WAL
+			skipped := newSkippedPartition(path, err)
+			s.skippedPartitions = append(s.skippedPartitions, skipped)
+			s.recordEvent(PartitionEventSkipped, skipped.PartitionInfo, err)
 			continue
 		}
 		if err != nil {
-			return nil, fmt.Errorf("failed to open disk partition for %s: %w", path, err)
+			return fmt.Errorf("failed to open disk partition for %s: %w", path, err)
 		}
 		partitions = append(partitions, part)
 	}
-	sort.Slice(partitions, func(i, j int) bool {
+	sort.SliceStable(partitions, func(i, j int) bool {
 		return partitions[i].minTimestamp() < partitions[j].minTimestamp()
 	})
+	partitions = s.excludeDuplicatePartitions(partitions)
 	for _, p := range partitions {
 		s.newPartition(p, false)
 	}
 	// Start WAL recovery if there is.
 	if err := s.recoverWAL(walDir); err != nil {
-		return nil, fmt.Errorf("failed to recover WAL: %w", err)
+		return fmt.Errorf("failed to recover WAL: %w", err)
+	}
+	if s.startupFlush {
+		if err := s.flushRecovered(); err != nil {
+			return err
+		}
 	}
 	s.newPartition(nil, false)
 
 	// periodically check and permanently remove expired partitions.
+	// Hold doneCh of this lifecycle since Reopen replaces it.
+	doneCh := s.doneCh
 	go func() {
 		ticker := time.NewTicker(checkExpiredInterval)
 		defer ticker.Stop()
 		for {
 			select {
-			case <-s.doneCh:
+			case <-doneCh:
 				return
 			case <-ticker.C:
-				err := s.removeExpiredPartitions()
+				err := s.recovered(s.removeExpiredPartitions)
 				if err != nil {
 					s.logger.Printf("%v\n", err)
 				}
 			}
 		}
 	}()
-	return s, nil
+	if s.scrubInterval > 0 {
+		s.startScrubber(doneCh)
+	}
+	s.startWriteBuffer()
+	return nil
 }
 
 type storage struct {
 	partitionList partitionList
 
 	walBufferedSize    int
+	walCompression     WALCompression
 	wal                wal
 	partitionDuration  time.Duration
 	retention          time.Duration
+	scrubInterval      time.Duration
+	startupFlush       bool
 	timestampPrecision TimestampPrecision
 	dataPath           string
 	writeTimeout       time.Duration
+	dirPerm            fs.FileMode
+	filePerm           fs.FileMode
+	useMmap            bool
+	outOfOrderPolicy   OutOfOrderPolicy
+	enforceMonotonic   bool
+	lastTimestamps     *lastTimestamps
+	walFullPolicy      WALFullPolicy
+	dedupeWindow       time.Duration
+	dedupePolicy       DedupePolicy
+	flushTrigger       func(info PartitionInfo) bool
+	stats              *storageStats
+	ingest             *ingestTracker
+
+	selectParallelismThreshold int
+	pointsPerBlock             int
+	relativeTimestamps         bool
+	minFlushPoints             int
+	panicRecovery              bool
+	metricCodecs               []metricCodec
+	allocator                  Allocator
+	flushBufferSize            int
+	flushRetryAttempts         int
+	flushRetryBackoff          time.Duration
+	fsys                       FileSystem
+
+	timestampFunc        func(row Row) int64
+	timestampAutofill    bool
+	idGenerator          func() string
+	duplicateIDPolicy    DuplicateIDPolicy
+	windowGapPolicy      WindowGapPolicy
+	partitionSharding    PartitionSharding
+	metricNameNormalizer func(metric string) string
+	insertHook           func(rows []Row) ([]Row, error)
+	zeroCopyStrings      bool
+	dropActivePartition  bool
+	readRepair           bool
+	partialInsert        bool
+	memoryBudget         int64
+	hotPartitions        hotPartitions
+	coldCache            *coldCache
+	retentionCallback    func(info PartitionInfo)
+	retentionByTimestamp bool
+	eventHook            func(e PartitionEvent)
+	writeBuffer          *writeBuffer
+	// now gives back the current time to fill timestamps with. Tests replace it.
+	now func() time.Time
+
+	// Partitions failed to be opened when opening the storage. It is immutable.
+	skippedPartitions []SkippedPartition
+	// Partitions excluded when opening the storage for being duplicates, until removed by DeduplicatePartitions.
+	duplicatePartitions   []DuplicatePartition
+	duplicatePartitionsMu sync.Mutex
+	// Recent partition events, which survive Reopen.
+	events *eventLog
 
 	logger         Logger
 	workersLimitCh chan struct{}
+	// selectsLimitCh limits concurrent selects under WithMaxConcurrentSelects; nil if unlimited.
+	selectsLimitCh chan struct{}
+	selectTimeout  time.Duration
 	// wg must be incremented to guarantee all writes are done gracefully.
 	wg sync.WaitGroup
+	// flushMu serializes flushPartitions.
+	flushMu sync.Mutex
+	// flushWg waits for flushes running in the background.
+	flushWg sync.WaitGroup
+	// gapMu serializes creating partitions for rows falling in gaps between write windows.
+	gapMu sync.Mutex
+	// repairing is 1 while overlapping partitions are being repaired in the background.
+	repairing int32
+	// closed is true once Close succeeds, until Reopen succeeds.
+	closed bool
+	// closeMu is held for reading by inserts, so that Close can wait for them to finish.
+	closeMu sync.RWMutex
+	// closing is true once Close gets called, until Reopen succeeds.
+	closing bool
+	// closeRunMu serializes Close, which may be retried after failing.
+	closeRunMu sync.Mutex
+	// stopped is true once Close stops the background goroutines, and sealed is true once Close
+	// makes the writable partitions read-only, so that a retried Close doesn't do them twice.
+	stopped bool
+	sealed  bool
 
 	doneCh chan struct{}
 }
 
 func (s *storage) InsertRows(rows []Row) error {
+	return s.insert(rows, false)
+}
+
+func (s *storage) InsertRowsSync(rows []Row) error {
+	if s.inMemoryMode() || s.walBufferedSize < 0 {
+		return ErrWALDisabled
+	}
+	return s.insert(rows, true)
+}
+
+// insert inserts the given rows, and then waits until they get fsynced into the WAL if sync is true.
+// Rows inserted synchronously bypass the write buffer.
+func (s *storage) insert(rows []Row, sync bool) error {
+	done, err := s.beginInsert()
+	if err != nil {
+		return err
+	}
+	defer done()
+	var insertErr error
+	if s.partialInsert {
+		insertErr = s.insertRowsPartially(rows)
+		var partialErr *PartialInsertError
+		if insertErr != nil && (!errors.As(insertErr, &partialErr) || partialErr.Accepted == 0) {
+			return insertErr
+		}
+	} else {
+		rows, err = s.prepareRows(rows)
+		if err != nil {
+			return err
+		}
+		if err := s.checkStateValues(rows); err != nil {
+			return err
+		}
+		var (
+			commit       func(accepted []Row)
+			monotonicErr error
+		)
+		rows, commit, monotonicErr = s.enforceMonotonicTimestamps(rows)
+		if len(rows) == 0 {
+			commit(nil)
+			return monotonicErr
+		}
+		// Buffered rows are regarded as accepted, since they get inserted in order later.
+		accepted := rows
+		if s.writeBuffer != nil && !sync {
+			err = s.bufferRows(rows)
+		} else {
+			var dropped []Row
+			dropped, err = s.insertPartitionRows(rows)
+			if err == nil {
+				accepted = acceptedRows(rows, dropped)
+				s.ingest.record(accepted, s.now)
+			}
+		}
+		if err != nil {
+			commit(nil)
+			return err
+		}
+		commit(accepted)
+		insertErr = monotonicErr
+	}
+	if sync {
+		if err := s.wal.sync(); err != nil {
+			return fmt.Errorf("failed to sync WAL: %w", err)
+		}
+	}
+	return insertErr
+}
+
+// beginInsert gives back a function to be called once the insert finishes, or ErrStorageClosed if Close
+// has been called.
+func (s *storage) beginInsert() (done func(), err error) {
+	s.closeMu.RLock()
+	if s.closing {
+		s.closeMu.RUnlock()
+		return nil, ErrStorageClosed
+	}
+	return s.closeMu.RUnlock, nil
+}
+
+func (s *storage) InsertNow(metric string, labels []Label, value float64) error {
+	return s.InsertRows([]Row{{
+		Metric:    metric,
+		Labels:    labels,
+		DataPoint: DataPoint{Timestamp: toUnix(s.now(), s.timestampPrecision), Value: value},
+	}})
+}
+
+// prepareRows derives timestamps and metric names of the given rows, and then applies the insert hook.
+func (s *storage) prepareRows(rows []Row) ([]Row, error) {
+	if s.timestampFunc != nil || s.metricNameNormalizer != nil || s.timestampAutofill {
+		var now int64
+		if s.timestampAutofill {
+			now = toUnix(s.now(), s.timestampPrecision)
+		}
+		// Copy not to modify the given rows.
+		derived := make([]Row, len(rows))
+		for i := range rows {
+			derived[i] = rows[i]
+			if s.timestampFunc != nil {
+				derived[i].Timestamp = s.timestampFunc(rows[i])
+			}
+			if derived[i].Timestamp == 0 {
+				derived[i].Timestamp = now
+			}
+			derived[i].Metric = s.normalizeMetricName(rows[i].Metric)
+		}
+		rows = derived
+	}
+	if s.insertHook != nil {
+		var err error
+		rows, err = s.insertHook(rows)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return rows, nil
+}
+
+// insertRows inserts the given rows into the partitions, without invoking the insert hook.
+func (s *storage) insertRows(rows []Row) error {
+	dropped, err := s.insertPartitionRows(rows)
+	if err != nil {
+		return err
+	}
+	s.ingest.record(acceptedRows(rows, dropped), s.now)
+	return nil
+}
+
+// insertPartitionRows inserts the given rows into the partitions, and gives back the rows dropped
+// because they are older than all writable partitions.
+func (s *storage) insertPartitionRows(rows []Row) ([]Row, error) {
 	s.wg.Add(1)
 	defer s.wg.Done()
 
-	insert := func() error {
+	insert := func() (_ []Row, err error) {
+		// Release the worker slot even if it panics.
 		defer func() { <-s.workersLimitCh }()
+		defer s.recoverPanic(&err)
 		if err := s.ensureActiveHead(); err != nil {
-			return err
+			return nil, err
 		}
 		iterator := s.partitionList.newIterator()
 		n := s.partitionList.size()
 		rowsToInsert := rows
+		var newer partition
 		// Starting at the head partition, try to insert rows, and loop to insert outdated rows
 		// into older partitions. Any rows more than `writablePartitionsNum` partitions out
 		// of date are dropped.
@@ -308,13 +1243,37 @@ func (s *storage) InsertRows(rows []Row) error {
 			if !iterator.next() {
 				break
 			}
-			outdatedRows, err := iterator.value().insertRows(rowsToInsert)
-			if err != nil {
-				return fmt.Errorf("failed to insert rows: %w", err)
+			part := iterator.value()
+			if newer != nil && s.windowGapPolicy == WindowGapNewPartition {
+				var err error
+				if rowsToInsert, err = s.insertGapRows(newer, part, rowsToInsert); err != nil {
+					return nil, err
+				}
+				if len(rowsToInsert) == 0 {
+					break
+				}
+			}
+			var olderRows []Row
+			if i == 0 && part.size() == 0 {
+				// An empty head takes the min timestamp from the rows it gets first, which must not go back beyond
+				// the next partition; otherwise they would overlap each other and selects would give back
+				// data points out of order.
+				if next := s.secondPartition(); next != nil && next.size() > 0 {
+					rowsToInsert, olderRows = splitOlderRows(rowsToInsert, next.maxTimestamp())
+				}
+			}
+			if len(rowsToInsert) > 0 {
+				outdatedRows, err := part.insertRows(rowsToInsert)
+				if err != nil {
+					return nil, fmt.Errorf("failed to insert rows: %w", err)
+				}
+				olderRows = append(olderRows, outdatedRows...)
 			}
-			rowsToInsert = outdatedRows
+			rowsToInsert = olderRows
+			newer = part
 		}
-		return nil
+		atomic.AddInt64(&s.stats.rowsInserted, int64(len(rows)-len(rowsToInsert)))
+		return rowsToInsert, nil
 	}
 
 	// Limit the number of concurrent goroutines to prevent from out of memory
@@ -334,11 +1293,19 @@ func (s *storage) InsertRows(rows []Row) error {
 		return insert()
 	case <-t.C:
 		timerpool.Put(t)
-		return fmt.Errorf("failed to write a data point in %s, since it is overloaded with %d concurrent writers",
+		return nil, fmt.Errorf("failed to write a data point in %s, since it is overloaded with %d concurrent writers",
 			s.writeTimeout, defaultWorkersLimit)
 	}
 }
 
+// normalizeMetricName gives back the canonical form of the given metric name.
+func (s *storage) normalizeMetricName(metric string) string {
+	if s.metricNameNormalizer == nil {
+		return metric
+	}
+	return s.metricNameNormalizer(metric)
+}
+
 // ensureActiveHead ensures the head of partitionList is an active partition.
 // If none, it creates a new one.
 func (s *storage) ensureActiveHead() error {
@@ -347,12 +1314,14 @@ func (s *storage) ensureActiveHead() error {
 		return nil
 	}
 
-	// All partitions seems to be inactive so add a new partition to the list.
+	// All partitions seems to be inactive, or the list is even empty, so add a new partition to the list.
 	if err := s.newPartition(nil, true); err != nil {
 		return err
 	}
+	s.flushWg.Add(1)
 	go func() {
-		if err := s.flushPartitions(); err != nil {
+		defer s.flushWg.Done()
+		if err := s.recovered(func() error { return s.flushPartitions(false) }); err != nil {
 			s.logger.Printf("failed to flush in-memory partitions: %v", err)
 		}
 	}()
@@ -360,22 +1329,312 @@ func (s *storage) ensureActiveHead() error {
 }
 
 func (s *storage) Select(metric string, labels []Label, start, end int64) ([]*DataPoint, error) {
+	pointsList, n, err := s.selectPartitionPoints(metric, labels, start, end)
+	if err != nil {
+		return nil, err
+	}
+	points := make([]*DataPoint, 0, n)
+	for _, ps := range pointsList {
+		points = append(points, ps...)
+	}
+	return points, nil
+}
+
+func (s *storage) SelectClamped(metric string, labels []Label, start, end int64) ([]*DataPoint, bool, error) {
+	if start >= end {
+		return nil, false, fmt.Errorf("the given start is greater than end")
+	}
+	latest, ok := s.LatestTimestamp()
+	if !ok {
+		return nil, false, ErrNoDataPoints
+	}
+	if start > latest {
+		// Nothing can be found beyond the horizon.
+		return nil, true, ErrNoDataPoints
+	}
+	clamped := false
+	if end > latest+1 {
+		end = latest + 1
+		clamped = true
+	}
+	points, err := s.Select(metric, labels, start, end)
+	return points, clamped, err
+}
+
+func (s *storage) SelectWhere(metric string, labels []Label, start, end int64, pred func(value float64) bool) ([]*DataPoint, error) {
+	if pred == nil {
+		return nil, fmt.Errorf("predicate must be set")
+	}
+	pointsList, n, err := s.selectPartitionPointsWhere(metric, labels, start, end, pred)
+	if err != nil {
+		return nil, err
+	}
+	points := make([]*DataPoint, 0, n)
+	for _, ps := range pointsList {
+		points = append(points, ps...)
+	}
+	return points, nil
+}
+
+// filterPoints gives back the data points whose value satisfies pred, without modifying the given slice.
+func filterPoints(points []*DataPoint, pred func(value float64) bool) []*DataPoint {
+	filtered := make([]*DataPoint, 0)
+	for _, p := range points {
+		if pred(p.Value) {
+			filtered = append(filtered, p)
+		}
+	}
+	return filtered
+}
+
+func (s *storage) SelectColumns(metric string, labels []Label, start, end int64) ([]int64, []float64, error) {
+	pointsList, n, err := s.selectPartitionPoints(metric, labels, start, end)
+	if err != nil {
+		return nil, nil, err
+	}
+	timestamps := make([]int64, 0, n)
+	values := make([]float64, 0, n)
+	for _, ps := range pointsList {
+		for _, p := range ps {
+			timestamps = append(timestamps, p.Timestamp)
+			values = append(values, p.Value)
+		}
+	}
+	return timestamps, values, nil
+}
+
+func (s *storage) SelectChanges(metric string, labels []Label, start, end int64) ([]*DataPoint, error) {
+	pointsList, _, err := s.selectPartitionPoints(metric, labels, start, end)
+	if err != nil {
+		return nil, err
+	}
+	points := make([]*DataPoint, 0)
+	var prev *DataPoint
+	for _, ps := range pointsList {
+		for _, p := range ps {
+			if prev != nil && p.Value == prev.Value {
+				continue
+			}
+			points = append(points, p)
+			prev = p
+		}
+	}
+	return points, nil
+}
+
+func (s *storage) SelectLastN(metric string, labels []Label, n int) ([]*DataPoint, error) {
+	metric = s.normalizeMetricName(metric)
 	if metric == "" {
 		return nil, fmt.Errorf("metric must be set")
 	}
+	if n <= 0 {
+		return nil, fmt.Errorf("n must be positive")
+	}
+	pointsList := make([][]*DataPoint, 0)
+	var collected int
+
+	// Iterate over partitions from the newest one until n data points are collected.
+	iterator := s.partitionList.newIterator()
+	for collected < n && iterator.next() {
+		part := iterator.value()
+		if part == nil {
+			return nil, fmt.Errorf("unexpected empty partition found")
+		}
+		if part.size() == 0 {
+			// Skip the partition that has no points.
+			continue
+		}
+		if !pinPartition(part) {
+			// Already removed by retention.
+			continue
+		}
+		start := int64(math.MinInt64)
+		if d, ok := part.(*diskPartition); ok {
+			// Decode only the blocks holding the latest data points.
+			start = d.tailStart(marshalMetricName(metric, labels), n-collected)
+		}
+		ps, err := part.selectDataPoints(metric, labels, start, math.MaxInt64)
+		s.releasePartition(part)
+		if errors.Is(err, ErrNoDataPoints) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to select data points: %w", err)
+		}
+		if len(ps) > n-collected {
+			ps = ps[len(ps)-(n-collected):]
+		}
+		pointsList = append(pointsList, ps)
+		collected += len(ps)
+	}
+	if collected == 0 {
+		return nil, ErrNoDataPoints
+	}
+	points := make([]*DataPoint, 0, collected)
+	for i := len(pointsList) - 1; i >= 0; i-- {
+		points = append(points, pointsList[i]...)
+	}
+	return points, nil
+}
+
+// selectPartitionPoints gives back the data points within the given range for each partition,
+// in order of the oldest to the newest partition, along with the total number of them.
+// ErrNoDataPoints will be returned if no data points found.
+func (s *storage) selectPartitionPoints(metric string, labels []Label, start, end int64) ([][]*DataPoint, int, error) {
+	return s.selectPartitionPointsWhere(metric, labels, start, end, nil)
+}
+
+// selectPartitionPointsWhere is like selectPartitionPoints, but gives back only data points whose value satisfies pred.
+// All data points are given back if pred is nil.
+func (s *storage) selectPartitionPointsWhere(metric string, labels []Label, start, end int64, pred func(value float64) bool) ([][]*DataPoint, int, error) {
+	pointsList, n, skipped, err := s.selectAvailablePartitionPoints(metric, labels, start, end, pred)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(skipped) > 0 {
+		return nil, 0, skipped[0].Err
+	}
+	if n == 0 {
+		return nil, 0, ErrNoDataPoints
+	}
+	return pointsList, n, nil
+}
+
+// selectAvailablePartitionPoints is like selectPartitionPoints, but gives back partitions failed to be read
+// instead of an error. It never returns ErrNoDataPoints.
+func (s *storage) selectAvailablePartitionPoints(metric string, labels []Label, start, end int64, pred func(value float64) bool) ([][]*DataPoint, int, []SkippedPartition, error) {
+	metric = s.normalizeMetricName(metric)
+	if metric == "" {
+		return nil, 0, nil, fmt.Errorf("metric must be set")
+	}
 	if start >= end {
-		return nil, fmt.Errorf("the given start is greater than end")
+		return nil, 0, nil, fmt.Errorf("the given start is greater than end")
 	}
-	points := make([]*DataPoint, 0)
 
-	// Iterate over all partitions from the newest one.
+	release, err := s.acquireSelect()
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	defer release()
+	atomic.AddInt64(&s.stats.selects, 1)
+	parts, release, err := s.pinnedPartitions(start, end)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	defer release()
+	if s.readRepair && hasOverlappingDiskPartitions(parts) {
+		s.scheduleReadRepair()
+	}
+
+	// Populated in order of the oldest to the newest, in order to keep the order in ascending.
+	pointsList := make([][]*DataPoint, len(parts))
+	errs := make([]error, len(parts))
+	selectFrom := func(i int) {
+		var (
+			ps  []*DataPoint
+			err error
+		)
+		part := s.readablePartition(parts[i])
+		if d, ok := part.(*diskPartition); ok && pred != nil {
+			// Filter while decoding so that data points not satisfying it are never allocated.
+			ps, err = d.selectDataPointsWhere(metric, labels, start, end, pred)
+		} else {
+			ps, err = part.selectDataPoints(metric, labels, start, end)
+			if pred != nil {
+				ps = filterPoints(ps, pred)
+			}
+		}
+		if errors.Is(err, ErrNoDataPoints) {
+			return
+		}
+		if err != nil {
+			errs[i] = fmt.Errorf("failed to select data points: %w", err)
+			return
+		}
+		pointsList[len(parts)-1-i] = ps
+	}
+	if s.selectParallelismThreshold > 0 && len(parts) >= s.selectParallelismThreshold {
+		var wg sync.WaitGroup
+		limitCh := make(chan struct{}, defaultWorkersLimit)
+		for i := range parts {
+			wg.Add(1)
+			limitCh <- struct{}{}
+			go func(i int) {
+				defer func() {
+					<-limitCh
+					wg.Done()
+				}()
+				if err := s.recovered(func() error {
+					selectFrom(i)
+					return nil
+				}); err != nil {
+					errs[i] = err
+				}
+			}(i)
+		}
+		wg.Wait()
+	} else {
+		for i := range parts {
+			selectFrom(i)
+		}
+	}
+	var skipped []SkippedPartition
+	for i, err := range errs {
+		if err != nil {
+			skipped = append(skipped, SkippedPartition{PartitionInfo: newPartitionInfo(parts[i]), Err: err})
+		}
+	}
+
+	var n int
+	nonEmpty := pointsList[:0]
+	for _, ps := range pointsList {
+		if len(ps) == 0 {
+			continue
+		}
+		nonEmpty = append(nonEmpty, ps)
+		n += len(ps)
+	}
+	return nonEmpty, n, skipped, nil
+}
+
+func (s *storage) CountPoints(metric string, labels []Label, start, end int64) (int, error) {
+	metric = s.normalizeMetricName(metric)
+	if metric == "" {
+		return 0, fmt.Errorf("metric must be set")
+	}
+	if start >= end {
+		return 0, fmt.Errorf("the given start is greater than end")
+	}
+	parts, release, err := s.pinnedPartitions(start, end)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	var n int
+	for _, part := range parts {
+		c, err := part.countDataPoints(metric, labels, start, end)
+		if errors.Is(err, ErrNoDataPoints) {
+			continue
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to count data points: %w", err)
+		}
+		n += c
+	}
+	return n, nil
+}
+
+// overlappingPartitions gives back partitions overlapping the given range, in order of newest to oldest.
+func (s *storage) overlappingPartitions(start, end int64) ([]partition, error) {
+	// Iterate over all partitions from the newest one, to find ones overlapping the range.
+	parts := make([]partition, 0)
 	iterator := s.partitionList.newIterator()
 	for iterator.next() {
 		part := iterator.value()
 		if part == nil {
 			return nil, fmt.Errorf("unexpected empty partition found")
 		}
-		if part.minTimestamp() == 0 {
+		if part.size() == 0 {
 			// Skip the partition that has no points.
 			continue
 		}
@@ -386,38 +1645,138 @@ func (s *storage) Select(metric string, labels []Label, start, end int64) ([]*Da
 		if part.minTimestamp() > end {
 			continue
 		}
-		ps, err := part.selectDataPoints(metric, labels, start, end)
-		if errors.Is(err, ErrNoDataPoints) {
+		parts = append(parts, part)
+	}
+	return parts, nil
+}
+
+// pinnedPartitions is like overlappingPartitions, but pins the partitions so that retention doesn't remove
+// their files while being read. Partitions already removed are left out. release must be called once read.
+func (s *storage) pinnedPartitions(start, end int64) (parts []partition, release func(), err error) {
+	overlapping, err := s.overlappingPartitions(start, end)
+	if err != nil {
+		return nil, nil, err
+	}
+	parts = overlapping[:0]
+	for _, part := range overlapping {
+		if pinPartition(part) {
+			parts = append(parts, part)
+		}
+	}
+	release = func() {
+		for _, part := range parts {
+			s.releasePartition(part)
+		}
+	}
+	return parts, release, nil
+}
+
+// releasePartition unpins the given partition, and logs the error that occurs if it removes files,
+// which shouldn't fail the read.
+func (s *storage) releasePartition(part partition) {
+	if err := unpinPartition(part); err != nil {
+		s.logger.Printf("%v\n", err)
+	}
+}
+
+func (s *storage) ListPartitions() []PartitionInfo {
+	infos := make([]PartitionInfo, 0, s.partitionList.size())
+	iterator := s.partitionList.newIterator()
+	for iterator.next() {
+		part := iterator.value()
+		if part == nil {
 			continue
 		}
-		if err != nil {
-			return nil, fmt.Errorf("failed to select data points: %w", err)
+		infos = append(infos, newPartitionInfo(part))
+	}
+	return infos
+}
+
+func (s *storage) OldestTimestamp() (int64, bool) {
+	var (
+		oldest int64
+		found  bool
+	)
+	iterator := s.partitionList.newIterator()
+	for iterator.next() {
+		part := iterator.value()
+		if part == nil || part.size() == 0 {
+			continue
+		}
+		if d, ok := part.(*diskPartition); ok && d.expired() {
+			continue
+		}
+		if !found || part.minTimestamp() < oldest {
+			oldest = part.minTimestamp()
+			found = true
 		}
-		// in order to keep the order in ascending.
-		points = append(ps, points...)
 	}
-	if len(points) == 0 {
-		return nil, ErrNoDataPoints
+	return oldest, found
+}
+
+func (s *storage) LatestTimestamp() (int64, bool) {
+	var (
+		latest int64
+		found  bool
+	)
+	iterator := s.partitionList.newIterator()
+	for iterator.next() {
+		part := iterator.value()
+		if part == nil || part.size() == 0 {
+			continue
+		}
+		if d, ok := part.(*diskPartition); ok && d.expired() {
+			continue
+		}
+		if !found || part.maxTimestamp() > latest {
+			latest = part.maxTimestamp()
+			found = true
+		}
 	}
-	return points, nil
+	return latest, found
+}
+
+func (s *storage) RetentionHorizon() int64 {
+	return toUnix(s.now().Add(-s.retention), s.timestampPrecision)
 }
 
 func (s *storage) Close() error {
-	s.wg.Wait()
-	close(s.doneCh)
-	if err := s.wal.flush(); err != nil {
-		return fmt.Errorf("failed to flush buffered WAL: %w", err)
+	s.closeRunMu.Lock()
+	defer s.closeRunMu.Unlock()
+	// Taking the lock waits for in-flight inserts to finish, and no inserts begin after that.
+	s.closeMu.Lock()
+	if s.closed {
+		s.closeMu.Unlock()
+		return ErrStorageClosed
 	}
+	s.closing = true
+	s.closeMu.Unlock()
 
-	// TODO: Prevent from new goroutines calling InsertRows(), for graceful shutdown.
+	// The storage stays closing if any of the following steps fails; calling Close again resumes them.
+	if err := s.stopWriteBuffer(); err != nil {
+		return err
+	}
+	s.wg.Wait()
+	s.flushWg.Wait()
+	if !s.stopped {
+		close(s.doneCh)
+		s.stopped = true
+	}
+	// Sync so that no rows are lost even if the following flush fails.
+	if err := s.wal.sync(); err != nil {
+		return fmt.Errorf("failed to sync WAL: %w", err)
+	}
 
 	// Make all writable partitions read-only by inserting as same number of those.
-	for i := 0; i < writablePartitionsNum; i++ {
-		if err := s.newPartition(nil, true); err != nil {
-			return err
+	if !s.sealed {
+		for i := 0; i < writablePartitionsNum; i++ {
+			if err := s.newPartition(nil, true); err != nil {
+				return err
+			}
 		}
+		s.sealed = true
 	}
-	if err := s.flushPartitions(); err != nil {
+	if err := s.flushPartitions(true); err != nil {
 		return fmt.Errorf("failed to close storage: %w", err)
 	}
 	if err := s.removeExpiredPartitions(); err != nil {
@@ -427,14 +1786,55 @@ func (s *storage) Close() error {
 	if err := s.wal.removeAll(); err != nil {
 		return fmt.Errorf("failed to remove WAL: %w", err)
 	}
+	s.hotPartitions.reset()
+	s.closeMu.Lock()
+	s.closed = true
+	s.closeMu.Unlock()
+	return nil
+}
+
+func (s *storage) Reopen() error {
+	if !s.closed {
+		return fmt.Errorf("storage has not been closed")
+	}
+	// Release what the previous lifecycle holds. Goroutines have already stopped by Close.
+	iterator := s.partitionList.newIterator()
+	for iterator.next() {
+		if p, ok := iterator.value().(*diskPartition); ok {
+			if err := p.close(); err != nil {
+				return err
+			}
+		}
+	}
+	s.partitionList = newPartitionList()
+	s.wal = &nopWAL{}
+	s.skippedPartitions = nil
+	s.duplicatePartitions = nil
+	s.doneCh = make(chan struct{})
+	if s.writeBuffer != nil {
+		s.writeBuffer = newWriteBuffer(s.writeBuffer.maxRows, s.writeBuffer.maxDelay)
+	}
+	if err := s.open(); err != nil {
+		return fmt.Errorf("failed to reopen storage: %w", err)
+	}
+	s.stopped = false
+	s.sealed = false
+	s.closeMu.Lock()
+	s.closed = false
+	s.closing = false
+	s.closeMu.Unlock()
 	return nil
 }
 
 func (s *storage) newPartition(p partition, punctuateWal bool) error {
-	if p == nil {
-		p = newMemoryPartition(s.wal, s.partitionDuration, s.timestampPrecision)
+	created := p == nil
+	if created {
+		p = s.newMemoryPartition()
 	}
 	s.partitionList.insert(p)
+	if created {
+		s.recordEvent(PartitionEventCreated, newPartitionInfo(p), nil)
+	}
 	if punctuateWal {
 		return s.wal.punctuate()
 	}
@@ -443,117 +1843,297 @@ func (s *storage) newPartition(p partition, punctuateWal bool) error {
 
 // flushPartitions persists all in-memory partitions ready to persisted.
 // For the in-memory mode, just removes it from the partition list.
-func (s *storage) flushPartitions() error {
+// Unless force is true, partitions with fewer data points than minFlushPoints get merged into
+// the next newer memory partition instead.
+// Selects never wait for it; they iterate over the partition list without locking it as a whole,
+// and read each memory partition until it gets swapped for the disk partition.
+func (s *storage) flushPartitions(force bool) error {
+	_, err := s.flushPartitionsWithInfo(force)
+	return err
+}
+
+// flushPartitionsWithInfo is like flushPartitions, but gives back the disk partitions persisted.
+// A partition failed to be persisted stays in memory, and the others are persisted anyway;
+// the failures are reported with *PartialFlushError along with the persisted ones.
+func (s *storage) flushPartitionsWithInfo(force bool) (flushed []FlushedPartitionInfo, err error) {
+	// Flushes can be triggered concurrently by ensureActiveHead and Close,
+	// which otherwise persist the same partition and remove WAL segments twice.
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+
+	var errs []error
+	// WAL segments are removed from the oldest, so ones of persisted partitions newer than a failed partition
+	// have to remain until the failed one gets persisted. It counts the segments yet to be removed.
+	var walSegments int
 	// Keep the first two partitions as is even if they are inactive,
 	// to accept out-of-order data points.
 	i := 0
+	// The newest partition that isn't merged into another, to merge small partitions into.
+	var newer partition
 	iterator := s.partitionList.newIterator()
 	for iterator.next() {
 		if i < writablePartitionsNum {
 			i++
+			newer = iterator.value()
 			continue
 		}
 		part := iterator.value()
 		if part == nil {
-			return fmt.Errorf("unexpected empty partition found")
+			errs = append(errs, fmt.Errorf("unexpected empty partition found"))
+			continue
 		}
 		memPart, ok := part.(*memoryPartition)
 		if !ok {
+			newer = part
+			continue
+		}
+		if dst, ok := newer.(*memoryPartition); ok && !force && !s.inMemoryMode() && memPart.size() < s.minFlushPoints {
+			// Merge it before unlinking it, so that selects meanwhile never miss its data points.
+			if err := s.partitionList.mergeInto(part, dst, func() { memPart.mergeInto(dst) }); err != nil {
+				errs = append(errs, fmt.Errorf("failed to merge partition: %w", err))
+				continue
+			}
+			s.recordEvent(PartitionEventMerged, newPartitionInfo(memPart), nil)
 			continue
 		}
+		newer = part
 
-		if s.inMemoryMode() {
+		if s.inMemoryMode() || memPart.size() == 0 {
+			// Nothing to be persisted.
 			if err := s.partitionList.remove(part); err != nil {
-				return fmt.Errorf("failed to remove partition: %w", err)
+				errs = append(errs, fmt.Errorf("failed to remove partition: %w", err))
 			}
 			continue
 		}
 
-		// Start swapping in-memory partition for disk one.
-		// The disk partition will place at where in-memory one existed.
-
-		dir := filepath.Join(s.dataPath, fmt.Sprintf("p-%d-%d", memPart.minTimestamp(), memPart.maxTimestamp()))
-		if err := s.flush(dir, memPart); err != nil {
-			return fmt.Errorf("failed to compact memory partition into %s: %w", dir, err)
-		}
-		newPart, err := openDiskPartition(dir, s.retention)
+		info, err := s.flushMemoryPartition(memPart)
 		if errors.Is(err, ErrNoDataPoints) {
 			if err := s.partitionList.remove(part); err != nil {
-				return fmt.Errorf("failed to remove partition: %w", err)
+				errs = append(errs, fmt.Errorf("failed to remove partition: %w", err))
 			}
 			continue
 		}
 		if err != nil {
+			errs = append(errs, err)
+			// Its segment precedes theirs, so they get removed along with its own.
+			memPart.mergedPartitions += walSegments
+			walSegments = 0
+			continue
+		}
+		flushed = append(flushed, info)
+		// Remove WAL segments of the partitions merged into it as well.
+		walSegments += 1 + memPart.mergedPartitions
+	}
+	for j := 0; j < walSegments; j++ {
+		if err := s.wal.removeOldest(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to remove oldest WAL segment: %w", err))
+			break
+		}
+	}
+	if len(errs) > 0 {
+		return flushed, &PartialFlushError{Flushed: flushed, Errs: errs}
+	}
+	return flushed, nil
+}
+
+// flushMemoryPartition persists the given memory partition, and swaps it for the disk partition.
+func (s *storage) flushMemoryPartition(memPart *memoryPartition) (FlushedPartitionInfo, error) {
+	// The disk partition will place at where in-memory one existed.
+	dir, err := s.partitionDirPath(memPart.minTimestamp(), memPart.maxTimestamp())
+	if err != nil {
+		return FlushedPartitionInfo{}, err
+	}
+	var newPart partition
+	err = s.retryFlush(func() error {
+		if err := s.flush(dir, memPart); err != nil {
+			return fmt.Errorf("failed to compact memory partition into %s: %w", dir, err)
+		}
+		p, err := s.openDiskPartition(dir)
+		if err != nil && !errors.Is(err, ErrNoDataPoints) {
 			return fmt.Errorf("failed to generate disk partition for %s: %w", dir, err)
 		}
-		if err := s.partitionList.swap(part, newPart); err != nil {
-			return fmt.Errorf("failed to swap partitions: %w", err)
+		newPart = p
+		return err
+	})
+	if err != nil {
+		return FlushedPartitionInfo{}, err
+	}
+	if err := s.partitionList.swap(memPart, newPart); err != nil {
+		return FlushedPartitionInfo{}, fmt.Errorf("failed to swap partitions: %w", err)
+	}
+	atomic.AddInt64(&s.stats.partitionsFlushed, 1)
+	s.hotPartitions.add(memPart)
+	info := newPartitionInfo(newPart)
+	s.recordEvent(PartitionEventFlushed, info, nil)
+	return newFlushedPartitionInfo(info, s.idGenerator != nil), nil
+}
+
+// secondPartition gives back the partition next to the head, or nil if there is none.
+func (s *storage) secondPartition() partition {
+	iterator := s.partitionList.newIterator()
+	if !iterator.next() || !iterator.next() {
+		return nil
+	}
+	return iterator.value()
+}
+
+// splitOlderRows separates rows at or before maxTimestamp from the given rows, keeping their order.
+// Rows without timestamps are regarded as newer, since they get the current time.
+func splitOlderRows(rows []Row, maxTimestamp int64) (newer, older []Row) {
+	newer = make([]Row, 0, len(rows))
+	for i := range rows {
+		if rows[i].Timestamp != 0 && rows[i].Timestamp <= maxTimestamp {
+			older = append(older, rows[i])
+			continue
 		}
+		newer = append(newer, rows[i])
+	}
+	return newer, older
+}
 
-		if err := s.wal.removeOldest(); err != nil {
-			return fmt.Errorf("failed to remove oldest WAL segment: %w", err)
+// newMemoryPartition creates a new memory partition with the options of the storage.
+func (s *storage) newMemoryPartition() *memoryPartition {
+	return newMemoryPartition(s.wal, s.partitionDuration, s.timestampPrecision,
+		withOutOfOrderPolicy(s.outOfOrderPolicy),
+		withDedupeWindow(s.dedupeWindow, s.dedupePolicy),
+		withFlushTrigger(s.flushTrigger),
+		withStats(s.stats),
+		withZeroCopy(s.zeroCopyStrings),
+		withMemoryBudget(s.memoryBudget/(writablePartitionsNum+1)),
+	).(*memoryPartition)
+}
+
+// partitionDirPath gives back the path to the directory the partition with the given time range gets persisted to.
+func (s *storage) partitionDirPath(minTimestamp, maxTimestamp int64) (string, error) {
+	name := fmt.Sprintf("p-%d-%d", minTimestamp, maxTimestamp)
+	if s.idGenerator != nil {
+		id := s.idGenerator()
+		if id == "" || strings.ContainsAny(id, `/\`) {
+			return "", fmt.Errorf("invalid partition ID %q", id)
 		}
+		name += "-" + id
 	}
-	return nil
+	return filepath.Join(s.shardPath(name, minTimestamp), name), nil
+}
+
+// openDiskPartition opens the disk partition placed at dirPath with the options of the storage.
+func (s *storage) openDiskPartition(dirPath string) (partition, error) {
+	p, err := openDiskPartition(s.fsys, dirPath, s.retention, s.useMmap, s.allocator)
+	if err != nil {
+		return nil, err
+	}
+	p.(*diskPartition).stats = s.stats
+	p.(*diskPartition).coldCache = s.coldCache
+	return p, nil
 }
 
 // flush compacts the data points in the given partition and flushes them to the given directory.
+// It refuses an empty partition with errEmptyPartition, and an inconsistent partition whose
+// min timestamp is greater than max timestamp.
 func (s *storage) flush(dirPath string, m *memoryPartition) error {
 	if dirPath == "" {
 		return fmt.Errorf("dir path is required")
 	}
+	if m.size() == 0 {
+		return errEmptyPartition
+	}
+	if m.minTimestamp() > m.maxTimestamp() {
+		return fmt.Errorf("min timestamp %d is greater than max timestamp %d: %w", m.minTimestamp(), m.maxTimestamp(), errInvalidPartition)
+	}
 
-	if err := os.MkdirAll(dirPath, fs.ModePerm); err != nil {
+	if err := mkdirAll(s.fsys, dirPath, s.dirPerm); err != nil {
 		return fmt.Errorf("failed to make directory %q: %w", dirPath, err)
 	}
 
-	f, err := os.Create(filepath.Join(dirPath, dataFileName))
+	f, err := openFile(s.fsys, filepath.Join(dirPath, dataFileName), os.O_RDWR|os.O_CREATE|os.O_TRUNC, s.filePerm)
 	if err != nil {
 		return fmt.Errorf("failed to create file %q: %w", dirPath, err)
 	}
 	defer f.Close()
-	encoder := newSeriesEncoder(f)
-
+	buf := s.allocator.Get(s.flushBufferSize)
+	defer s.allocator.Put(buf)
+	aw := &allocatedWriter{w: f, buf: buf}
+	checksum := crc32.New(checksumTable)
+	w := &offsetWriter{w: io.MultiWriter(aw, checksum)}
+
+	var base int64
+	if s.relativeTimestamps {
+		base = m.minTimestamp()
+	}
 	metrics := map[string]diskMetric{}
-	m.metrics.Range(func(key, value interface{}) bool {
-		mt, ok := value.(*memoryMetric)
-		if !ok {
-			s.logger.Printf("unknown value found\n")
-			return false
+	var (
+		current *memoryMetric
+		be      *blockEncoder
+	)
+	// finishSeries flushes the blocks of the current series, and records where they lie.
+	finishSeries := func() error {
+		if err := be.flush(); err != nil {
+			return fmt.Errorf("failed to flush data points that metric is %q: %w", current.name, err)
 		}
-		offset, err := f.Seek(0, io.SeekCurrent)
-		if err != nil {
-			s.logger.Printf("failed to set file offset of metric %q: %v\n", mt.name, err)
-			return false
+		if len(be.blocks) == 0 {
+			return nil
 		}
-
-		if err := mt.encodeAllPoints(encoder); err != nil {
-			s.logger.Printf("failed to encode a data point that metric is %q: %v\n", mt.name, err)
-			return false
+		// Blocks are in order by timestamp, including the out-of-order points merged by the iterator.
+		metrics[current.name] = diskMetric{
+			Name:          current.name,
+			Offset:        be.blocks[0].Offset,
+			MinTimestamp:  be.blocks[0].MinTimestamp,
+			MaxTimestamp:  be.blocks[len(be.blocks)-1].MaxTimestamp,
+			NumDataPoints: current.size + int64(len(current.outOfOrderPoints)),
+			Blocks:        be.blocks,
 		}
-
-		if err := encoder.flush(); err != nil {
-			s.logger.Printf("failed to flush data points that metric is %q: %v\n", mt.name, err)
-			return false
+		return nil
+	}
+	// Lay out metrics in order by name, so that series of the same metric with different labels
+	// lie next to each other, which keeps reads of them within contiguous bytes.
+	// Data points are streamed from the partition, not to hold a copy of all of them.
+	iterator := m.selectAllIterator()
+	for iterator.next() {
+		if mt := iterator.metric(); mt != current {
+			if current != nil {
+				if err := finishSeries(); err != nil {
+					return err
+				}
+			}
+			current = mt
+			metric, _, _ := unmarshalMetricName(mt.name)
+			codec := s.codecFor(metric)
+			encoder, err := newCodecEncoder(codec, w, base)
+			if err != nil {
+				return fmt.Errorf("failed to make encoder for metric %q: %w", mt.name, err)
+			}
+			be = &blockEncoder{
+				encoder:        encoder,
+				codec:          codec,
+				w:              w,
+				pointsPerBlock: s.pointsPerBlock,
+			}
 		}
-
-		totalNumPoints := mt.size + int64(len(mt.outOfOrderPoints))
-		metrics[mt.name] = diskMetric{
-			Name:          mt.name,
-			Offset:        offset,
-			MinTimestamp:  mt.minTimestamp,
-			MaxTimestamp:  mt.maxTimestamp,
-			NumDataPoints: totalNumPoints,
+		if err := be.encodePoint(iterator.value()); err != nil {
+			return fmt.Errorf("failed to encode a data point that metric is %q: %w", current.name, err)
 		}
-		return true
-	})
+	}
+	if current != nil {
+		if err := finishSeries(); err != nil {
+			return err
+		}
+	}
+
+	if err := aw.flush(); err != nil {
+		return fmt.Errorf("failed to write data file %q: %w", dirPath, err)
+	}
 
 	b, err := json.Marshal(&meta{
-		MinTimestamp:  m.minTimestamp(),
-		MaxTimestamp:  m.maxTimestamp(),
-		NumDataPoints: m.size(),
-		Metrics:       metrics,
-		CreatedAt:     time.Now(),
+		Version:            CurrentFormatVersion,
+		MinTimestamp:       m.minTimestamp(),
+		MaxTimestamp:       m.maxTimestamp(),
+		NumDataPoints:      m.size(),
+		Metrics:            metrics,
+		CreatedAt:          time.Now(),
+		PartitionCreatedAt: m.createdAt,
+		LastWriteAt:        m.lastWriteTime(),
+		Checksum:           checksum.Sum32(),
+		TimestampBase:      base,
 	})
 	if err != nil {
 		return fmt.Errorf("failed to encode metadata: %w", err)
@@ -561,7 +2141,7 @@ func (s *storage) flush(dirPath string, m *memoryPartition) error {
 
 	// It should write the meta file at last because what valid meta file exists proves the disk partition is valid.
 	metaPath := filepath.Join(dirPath, metaFileName)
-	if err := os.WriteFile(metaPath, b, fs.ModePerm); err != nil {
+	if err := writeFile(s.fsys, metaPath, b, s.filePerm); err != nil {
 		return fmt.Errorf("failed to write metadata to %s: %w", metaPath, err)
 	}
 	return nil
@@ -569,28 +2149,44 @@ func (s *storage) flush(dirPath string, m *memoryPartition) error {
 
 func (s *storage) removeExpiredPartitions() error {
 	expiredList := make([]partition, 0)
+	horizon := s.RetentionHorizon()
 	iterator := s.partitionList.newIterator()
 	for iterator.next() {
 		part := iterator.value()
 		if part == nil {
 			return fmt.Errorf("unexpected nil partition found")
 		}
-		if part.expired() {
+		if part.expired() || s.expiredByTimestamp(part, horizon) {
 			expiredList = append(expiredList, part)
 		}
 	}
 
 	for i := range expiredList {
+		if s.retentionCallback != nil {
+			s.retentionCallback(newPartitionInfo(expiredList[i]))
+		}
 		if err := s.partitionList.remove(expiredList[i]); err != nil {
 			return fmt.Errorf("failed to remove expired partition")
 		}
+		atomic.AddInt64(&s.stats.partitionsExpired, 1)
+		s.recordEvent(PartitionEventExpired, newPartitionInfo(expiredList[i]), nil)
 	}
 	return nil
 }
 
+// expiredByTimestamp reports whether the given partition is a disk partition holding only data points older than
+// the given horizon under WithRetentionByTimestamp.
+func (s *storage) expiredByTimestamp(part partition, horizon int64) bool {
+	if !s.retentionByTimestamp {
+		return false
+	}
+	_, ok := part.(*diskPartition)
+	return ok && part.maxTimestamp() < horizon
+}
+
 // recoverWAL inserts all records within the given wal, and then removes all WAL segment files.
 func (s *storage) recoverWAL(walDir string) error {
-	reader, err := newDiskWALReader(walDir)
+	reader, err := newDiskWALReader(s.fsys, walDir)
 	if errors.Is(err, os.ErrNotExist) {
 		return nil
 	}
@@ -605,7 +2201,8 @@ func (s *storage) recoverWAL(walDir string) error {
 	if len(reader.rowsToInsert) == 0 {
 		return nil
 	}
-	if err := s.InsertRows(reader.rowsToInsert); err != nil {
+	// Insert without recording the ingest rates, since they were ingested before.
+	if _, err := s.insertPartitionRows(reader.rowsToInsert); err != nil {
 		return fmt.Errorf("failed to insert rows recovered from WAL: %w", err)
 	}
 	return s.wal.refresh()
@@ -1,7 +1,13 @@
 package tstorage
 
 import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -17,6 +23,29 @@ func BenchmarkStorage_InsertRows(b *testing.B) {
 	}
 }
 
+func BenchmarkStorage_InsertRows_withLabels(b *testing.B) {
+	for _, zeroCopy := range []bool{false, true} {
+		b.Run(fmt.Sprintf("zero-copy=%t", zeroCopy), func(b *testing.B) {
+			storage, err := NewStorage(WithZeroCopyStrings(zeroCopy))
+			require.NoError(b, err)
+			defer storage.Close()
+			rows := make([]Row, b.N)
+			for i := range rows {
+				rows[i] = Row{
+					Metric:    "metric1",
+					Labels:    []Label{{Name: "host", Value: "host-1"}, {Name: "region", Value: "region-1"}},
+					DataPoint: DataPoint{Timestamp: int64(i + 1), Value: 0.1},
+				}
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := range rows {
+				storage.InsertRows(rows[i : i+1])
+			}
+		})
+	}
+}
+
 // Select data points among a thousand data in memory
 func BenchmarkStorage_SelectAmongThousandPoints(b *testing.B) {
 	storage, err := NewStorage()
@@ -46,3 +75,384 @@ func BenchmarkStorage_SelectAmongMillionPoints(b *testing.B) {
 		_, _ = storage.Select("metric1", nil, 10, 100)
 	}
 }
+
+// Select all data points among a hundred thousand data in a disk partition
+func BenchmarkDiskPartition_SelectLargeRange(b *testing.B) {
+	tmpDir, err := os.MkdirTemp("", "tstorage-bench")
+	require.NoError(b, err)
+	defer os.RemoveAll(tmpDir)
+
+	storage, err := NewStorage(
+		WithDataPath(tmpDir),
+		WithPartitionDuration(time.Hour),
+		WithTimestampPrecision(Seconds),
+	)
+	require.NoError(b, err)
+	for i := int64(1); i <= 100000; i++ {
+		err := storage.InsertRows([]Row{
+			{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000000 + i%3600, Value: float64(i)}},
+		})
+		require.NoError(b, err)
+	}
+	require.NoError(b, storage.Close())
+	dirs, err := filepath.Glob(filepath.Join(tmpDir, "p-*"))
+	require.NoError(b, err)
+	require.NotEmpty(b, dirs)
+
+	for _, useMmap := range []bool{true, false} {
+		b.Run(fmt.Sprintf("mmap=%t", useMmap), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				part, err := openDiskPartition(defaultFileSystem, dirs[0], time.Hour, useMmap, defaultAllocator)
+				require.NoError(b, err)
+				_, _ = part.selectDataPoints("metric1", nil, 1600000000, 1600003600)
+			}
+		})
+	}
+}
+
+// Select a minute of data points from a partition holding a day of them.
+func BenchmarkDiskPartition_SelectNarrowRange(b *testing.B) {
+	for _, pointsPerBlock := range []int{0, defaultPointsPerBlock} {
+		b.Run(fmt.Sprintf("pointsPerBlock=%d", pointsPerBlock), func(b *testing.B) {
+			tmpDir, err := os.MkdirTemp("", "tstorage-bench")
+			require.NoError(b, err)
+			defer os.RemoveAll(tmpDir)
+
+			storage, err := NewStorage(
+				WithDataPath(tmpDir),
+				WithPartitionDuration(24*time.Hour),
+				WithTimestampPrecision(Seconds),
+				WithPointsPerBlock(pointsPerBlock),
+			)
+			require.NoError(b, err)
+			for i := int64(0); i < 86400; i++ {
+				err := storage.InsertRows([]Row{
+					{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000000 + i, Value: float64(i)}},
+				})
+				require.NoError(b, err)
+			}
+			require.NoError(b, storage.Close())
+			dirs, err := filepath.Glob(filepath.Join(tmpDir, "p-*"))
+			require.NoError(b, err)
+			require.NotEmpty(b, dirs)
+			part, err := openDiskPartition(defaultFileSystem, dirs[0], 24*time.Hour, true, defaultAllocator)
+			require.NoError(b, err)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, _ = part.selectDataPoints("metric1", nil, 1600080000, 1600080060)
+			}
+		})
+	}
+}
+
+// Count a day of data points on the disk, compared to selecting them.
+func BenchmarkStorage_CountPoints(b *testing.B) {
+	tmpDir, err := os.MkdirTemp("", "tstorage-bench")
+	require.NoError(b, err)
+	defer os.RemoveAll(tmpDir)
+
+	storage, err := NewStorage(
+		WithDataPath(tmpDir),
+		WithPartitionDuration(24*time.Hour),
+		WithTimestampPrecision(Seconds),
+	)
+	require.NoError(b, err)
+	for i := int64(0); i < 86400; i++ {
+		err := storage.InsertRows([]Row{
+			{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000000 + i, Value: float64(i)}},
+		})
+		require.NoError(b, err)
+	}
+	require.NoError(b, storage.Close())
+	storage, err = NewStorage(
+		WithDataPath(tmpDir),
+		WithPartitionDuration(24*time.Hour),
+		WithTimestampPrecision(Seconds),
+	)
+	require.NoError(b, err)
+	defer storage.Close()
+
+	b.Run("count", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, _ = storage.CountPoints("metric1", nil, 1600000000, 1600086400)
+		}
+	})
+	b.Run("select", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			points, _ := storage.Select("metric1", nil, 1600000000, 1600086400)
+			_ = len(points)
+		}
+	})
+}
+
+// Select a hundred thousand data points in the row and columnar forms
+func BenchmarkStorage_SelectRowsVsColumns(b *testing.B) {
+	storage, err := NewStorage()
+	require.NoError(b, err)
+	for i := 1; i < 1000000; i++ {
+		storage.InsertRows([]Row{
+			{Metric: "metric1", DataPoint: DataPoint{Timestamp: int64(i), Value: 0.1}},
+		})
+	}
+	b.Run("rows", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, _ = storage.Select("metric1", nil, 100000, 200000)
+		}
+	})
+	b.Run("columns", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, _, _ = storage.SelectColumns("metric1", nil, 100000, 200000)
+		}
+	})
+}
+
+// Select data points from a few and many disk partitions, serially and in parallel
+func BenchmarkStorage_SelectParallelismThreshold(b *testing.B) {
+	tmpDir, err := os.MkdirTemp("", "tstorage-bench")
+	require.NoError(b, err)
+	defer os.RemoveAll(tmpDir)
+
+	storage, err := NewStorage(
+		WithDataPath(tmpDir),
+		WithPartitionDuration(100*time.Second),
+		WithTimestampPrecision(Seconds),
+	)
+	require.NoError(b, err)
+	for ts := int64(1600000000); ts < 1600003200; ts++ {
+		for i := 0; i < 10; i++ {
+			err := storage.InsertRows([]Row{
+				{Metric: "metric1", DataPoint: DataPoint{Timestamp: ts, Value: float64(i)}},
+			})
+			require.NoError(b, err)
+		}
+	}
+	require.NoError(b, storage.Close())
+
+	for _, threshold := range []int{0, 1} {
+		storage, err := NewStorage(
+			WithDataPath(tmpDir),
+			WithPartitionDuration(100*time.Second),
+			WithTimestampPrecision(Seconds),
+			WithSelectParallelismThreshold(threshold),
+		)
+		require.NoError(b, err)
+		b.Run(fmt.Sprintf("threshold=%d/3 partitions", threshold), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				_, _ = storage.Select("metric1", nil, 1600000000, 1600000300)
+			}
+		})
+		b.Run(fmt.Sprintf("threshold=%d/32 partitions", threshold), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				_, _ = storage.Select("metric1", nil, 1600000000, 1600003200)
+			}
+		})
+	}
+}
+
+// Encode a mix of metrics with each codec, reporting the compression ratio.
+func BenchmarkCodecs_MixedMetrics(b *testing.B) {
+	const n = 1000
+	series := map[string][]*DataPoint{}
+	var ts int64 = 1600000000
+	for i := 0; i < n; i++ {
+		series["counter"] = append(series["counter"], &DataPoint{Timestamp: 1600000000 + int64(i)*15, Value: float64(i * i)})
+		series["gauge"] = append(series["gauge"], &DataPoint{Timestamp: 1600000000 + int64(i)*15, Value: float64(i%7) / 3})
+		// Sampled at irregular intervals.
+		ts += int64(1 + (i*7919)%3600)
+		series["sparse"] = append(series["sparse"], &DataPoint{Timestamp: ts, Value: float64(i % 2)})
+	}
+	for _, codec := range []Codec{CodecGorilla, CodecDelta} {
+		for _, name := range []string{"counter", "gauge", "sparse"} {
+			points := series[name]
+			b.Run(fmt.Sprintf("%s/%s", codec, name), func(b *testing.B) {
+				var buf bytes.Buffer
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					buf.Reset()
+					encoder, err := newCodecEncoder(codec, &buf, 0)
+					require.NoError(b, err)
+					for _, p := range points {
+						require.NoError(b, encoder.encodePoint(p))
+					}
+					require.NoError(b, encoder.flush())
+				}
+				b.ReportMetric(float64(buf.Len())/n, "bytes/point")
+				b.ReportMetric(float64(n*16)/float64(buf.Len()), "ratio")
+			})
+		}
+	}
+}
+
+// Append batches of rows to the WAL with and without compression, reporting the WAL size.
+func BenchmarkDiskWAL_Compression(b *testing.B) {
+	rows := make([]Row, 100)
+	for i := range rows {
+		rows[i] = Row{
+			Metric:    "http_requests_total",
+			Labels:    []Label{{Name: "host", Value: fmt.Sprintf("host-%d", i%10)}},
+			DataPoint: DataPoint{Timestamp: 1600000000 + int64(i), Value: float64(i)},
+		}
+	}
+	for _, compression := range []WALCompression{WALCompressionNone, WALCompressionFlate} {
+		b.Run(string(compression), func(b *testing.B) {
+			tmpDir, err := os.MkdirTemp("", "tstorage-bench")
+			require.NoError(b, err)
+			defer os.RemoveAll(tmpDir)
+			wal, err := newDiskWAL(defaultFileSystem, tmpDir, defaultWALBufferedSize, defaultDirPerm, defaultFilePerm, compression)
+			require.NoError(b, err)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				require.NoError(b, wal.append(operationInsert, rows))
+			}
+			require.NoError(b, wal.flush())
+			b.StopTimer()
+			info, err := wal.(*diskWAL).fd.Stat()
+			require.NoError(b, err)
+			b.ReportMetric(float64(info.Size())/float64(b.N*len(rows)), "bytes/row")
+		})
+	}
+}
+
+// Select data points from disk partitions in parallel, with and without partitions being flushed concurrently.
+// Selects never wait for flushes, so the throughput should be about the same.
+func BenchmarkStorage_SelectDuringFlush(b *testing.B) {
+	for _, flushing := range []bool{false, true} {
+		b.Run(fmt.Sprintf("flushing=%t", flushing), func(b *testing.B) {
+			tmpDir, err := os.MkdirTemp("", "tstorage-bench")
+			require.NoError(b, err)
+			defer os.RemoveAll(tmpDir)
+
+			var flushed int64
+			storage, err := NewStorage(
+				WithDataPath(tmpDir),
+				WithPartitionDuration(100*time.Second),
+				WithTimestampPrecision(Seconds),
+				WithEventHook(func(e PartitionEvent) {
+					if e.Type == PartitionEventFlushed {
+						atomic.AddInt64(&flushed, 1)
+					}
+				}),
+			)
+			require.NoError(b, err)
+			defer storage.Close()
+			ts := int64(1600000000)
+			for ; ts < 1600003200; ts++ {
+				err := storage.InsertRows([]Row{
+					{Metric: "metric1", DataPoint: DataPoint{Timestamp: ts, Value: 0.1}},
+				})
+				require.NoError(b, err)
+			}
+
+			// Count only the flushes while selecting.
+			require.NoError(b, storage.FlushAsync().Wait())
+			atomic.StoreInt64(&flushed, 0)
+
+			// Keep rolling partitions over, each of which makes an older one flushed.
+			stopCh := make(chan struct{})
+			doneCh := make(chan struct{})
+			go func() {
+				defer close(doneCh)
+				if !flushing {
+					return
+				}
+				for ts := ts; ; ts++ {
+					select {
+					case <-stopCh:
+						return
+					default:
+					}
+					_ = storage.InsertRows([]Row{
+						{Metric: "metric2", DataPoint: DataPoint{Timestamp: ts, Value: 0.1}},
+					})
+				}
+			}()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					_, _ = storage.Select("metric1", nil, 1600000000, 1600000300)
+				}
+			})
+			b.StopTimer()
+			close(stopCh)
+			<-doneCh
+			b.ReportMetric(float64(atomic.LoadInt64(&flushed)), "flushes")
+		})
+	}
+}
+
+// Flush a memory partition holding a million data points to see the memory it takes.
+// Data points are streamed into the data file without being copied.
+func BenchmarkStorage_flush(b *testing.B) {
+	tmpDir := b.TempDir()
+	s := &storage{
+		dirPerm:         defaultDirPerm,
+		filePerm:        defaultFilePerm,
+		pointsPerBlock:  defaultPointsPerBlock,
+		allocator:       defaultAllocator,
+		flushBufferSize: defaultFlushBufferSize,
+		fsys:            defaultFileSystem,
+		logger:          &nopLogger{},
+	}
+	m := newMemoryPartition(nil, 0, "").(*memoryPartition)
+	rows := make([]Row, 0, 1000)
+	for i := int64(1); i <= 1000000; i++ {
+		rows = append(rows, Row{Metric: fmt.Sprintf("metric%d", i%10), DataPoint: DataPoint{Timestamp: i, Value: float64(i)}})
+		if len(rows) == cap(rows) {
+			_, err := m.insertRows(rows)
+			require.NoError(b, err)
+			rows = rows[:0]
+		}
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		require.NoError(b, s.flush(filepath.Join(tmpDir, fmt.Sprintf("p-%d", i)), m))
+	}
+}
+
+// Flush a short partition of nanosecond timestamps split into small blocks, reporting the size of the data file.
+func BenchmarkStorage_flushRelativeTimestamps(b *testing.B) {
+	m := newMemoryPartition(nil, 0, "").(*memoryPartition)
+	rows := make([]Row, 0, 10000)
+	for i := int64(0); i < 10000; i++ {
+		rows = append(rows, Row{Metric: fmt.Sprintf("metric%d", i%10), DataPoint: DataPoint{Timestamp: 1600000000000000000 + i*int64(time.Millisecond), Value: float64(i % 7)}})
+	}
+	_, err := m.insertRows(rows)
+	require.NoError(b, err)
+	for _, relative := range []bool{false, true} {
+		b.Run(fmt.Sprintf("relative=%v", relative), func(b *testing.B) {
+			tmpDir := b.TempDir()
+			s := &storage{
+				dirPerm:            defaultDirPerm,
+				filePerm:           defaultFilePerm,
+				pointsPerBlock:     16,
+				relativeTimestamps: relative,
+				allocator:          defaultAllocator,
+				flushBufferSize:    defaultFlushBufferSize,
+				fsys:               defaultFileSystem,
+				logger:             &nopLogger{},
+			}
+			var size int64
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				dir := filepath.Join(tmpDir, fmt.Sprintf("p-%d", i))
+				require.NoError(b, s.flush(dir, m))
+				info, err := os.Stat(filepath.Join(dir, dataFileName))
+				require.NoError(b, err)
+				size = info.Size()
+			}
+			b.ReportMetric(float64(size)/float64(m.size()), "bytes/point")
+		})
+	}
+}
@@ -328,7 +328,7 @@ func ExampleStorage_Select_from_disk() {
 	// Re-open storage from the persisted data
 	storage, err = tstorage.NewStorage(
 		tstorage.WithDataPath(tmpDir),
-		tstorage.WithPartitionDuration(10*time.Second),
+		tstorage.WithPartitionDuration(100*time.Second),
 		tstorage.WithTimestampPrecision(tstorage.Seconds),
 	)
 	if err != nil {
@@ -1,10 +1,25 @@
 package tstorage
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func Test_storage_Select(t *testing.T) {
@@ -38,6 +53,7 @@ func Test_storage_Select(t *testing.T) {
 				return storage{
 					partitionList:  list,
 					workersLimitCh: make(chan struct{}, defaultWorkersLimit),
+					stats:          &storageStats{},
 				}
 			}(),
 			want: []*DataPoint{
@@ -87,6 +103,7 @@ func Test_storage_Select(t *testing.T) {
 				return storage{
 					partitionList:  list,
 					workersLimitCh: make(chan struct{}, defaultWorkersLimit),
+					stats:          &storageStats{},
 				}
 			}(),
 			want: []*DataPoint{
@@ -111,3 +128,1602 @@ func Test_storage_Select(t *testing.T) {
 		})
 	}
 }
+
+func Test_storage_permissions(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("permission bits aren't fully supported on windows")
+	}
+	tmpDir, err := os.MkdirTemp("", "tstorage-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	dataPath := filepath.Join(tmpDir, "data")
+
+	s, err := NewStorage(
+		WithDataPath(dataPath),
+		WithPartitionDuration(2*time.Second),
+		WithTimestampPrecision(Seconds),
+		WithDirPerm(0750),
+		WithFilePerm(0600),
+	)
+	require.NoError(t, err)
+	err = s.InsertRows([]Row{
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000000, Value: 0.1}},
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000001, Value: 0.1}},
+	})
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+
+	assertPerm := func(path string, want fs.FileMode) {
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		assert.Equal(t, want, info.Mode().Perm(), path)
+	}
+	assertPerm(dataPath, 0750)
+	assertPerm(filepath.Join(dataPath, walDirName), 0750)
+	partitionDir := filepath.Join(dataPath, "p-1600000000-1600000001")
+	assertPerm(partitionDir, 0750)
+	assertPerm(filepath.Join(partitionDir, dataFileName), 0600)
+	assertPerm(filepath.Join(partitionDir, metaFileName), 0600)
+}
+
+func Test_storage_InsertRows_withInsertHook(t *testing.T) {
+	s, err := NewStorage(
+		WithTimestampPrecision(Seconds),
+		WithInsertHook(func(rows []Row) ([]Row, error) {
+			kept := make([]Row, 0, len(rows))
+			for _, row := range rows {
+				if row.Metric == "dropped" {
+					continue
+				}
+				row.Labels = append(row.Labels, Label{Name: "tenant", Value: "a"})
+				kept = append(kept, row)
+			}
+			return kept, nil
+		}),
+	)
+	require.NoError(t, err)
+	defer s.Close()
+
+	err = s.InsertRows([]Row{
+		{Metric: "kept", DataPoint: DataPoint{Timestamp: 1600000000, Value: 0.1}},
+		{Metric: "dropped", DataPoint: DataPoint{Timestamp: 1600000000, Value: 0.2}},
+	})
+	require.NoError(t, err)
+
+	got, err := s.Select("kept", []Label{{Name: "tenant", Value: "a"}}, 1600000000, 1600000001)
+	require.NoError(t, err)
+	assert.Equal(t, []*DataPoint{{Timestamp: 1600000000, Value: 0.1}}, got)
+
+	_, err = s.Select("dropped", nil, 1600000000, 1600000001)
+	assert.ErrorIs(t, err, ErrNoDataPoints)
+	_, err = s.Select("dropped", []Label{{Name: "tenant", Value: "a"}}, 1600000000, 1600000001)
+	assert.ErrorIs(t, err, ErrNoDataPoints)
+}
+
+func Test_storage_InsertNow(t *testing.T) {
+	var hooked []Row
+	s, err := NewStorage(
+		WithTimestampPrecision(Seconds),
+		WithInsertHook(func(rows []Row) ([]Row, error) {
+			hooked = append(hooked, rows...)
+			return rows, nil
+		}),
+	)
+	require.NoError(t, err)
+	defer s.Close()
+	s.(*storage).now = func() time.Time { return time.Unix(1600000000, 0) }
+
+	require.NoError(t, s.InsertNow("metric1", []Label{{Name: "host", Value: "a"}}, 0.1))
+
+	// The insert hook sees the timestamp already stamped.
+	require.Len(t, hooked, 1)
+	assert.Equal(t, "metric1", hooked[0].Metric)
+	assert.Equal(t, []Label{{Name: "host", Value: "a"}}, hooked[0].Labels)
+	assert.Equal(t, int64(1600000000), hooked[0].Timestamp)
+
+	got, err := s.Select("metric1", []Label{{Name: "host", Value: "a"}}, 1600000000, 1600000001)
+	require.NoError(t, err)
+	assert.Equal(t, []*DataPoint{{Timestamp: 1600000000, Value: 0.1}}, got)
+}
+
+func Test_storage_removeExpiredPartitions_withRetentionCallback(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tstorage-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	var got []PartitionInfo
+	s, err := NewStorage(
+		WithDataPath(tmpDir),
+		WithTimestampPrecision(Seconds),
+		WithRetention(time.Nanosecond),
+		WithRetentionCallback(func(info PartitionInfo) {
+			// The directory must be still there.
+			_, err := os.Stat(info.DirPath)
+			assert.NoError(t, err)
+			assert.False(t, info.PersistedAt.IsZero())
+			got = append(got, PartitionInfo{
+				MinTimestamp:  info.MinTimestamp,
+				MaxTimestamp:  info.MaxTimestamp,
+				NumDataPoints: info.NumDataPoints,
+				DirPath:       info.DirPath,
+			})
+		}),
+	)
+	require.NoError(t, err)
+	err = s.InsertRows([]Row{
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000000, Value: 0.1}},
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000001, Value: 0.1}},
+	})
+	require.NoError(t, err)
+	// Closing flushes the partition, and then removes it as it's already expired.
+	require.NoError(t, s.Close())
+
+	want := []PartitionInfo{
+		{
+			MinTimestamp:  1600000000,
+			MaxTimestamp:  1600000001,
+			NumDataPoints: 2,
+			DirPath:       filepath.Join(tmpDir, "p-1600000000-1600000001"),
+		},
+	}
+	assert.Equal(t, want, got)
+	_, err = os.Stat(filepath.Join(tmpDir, "p-1600000000-1600000001"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func Test_storage_removeExpiredPartitions_byTimestamp(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tstorage-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	s, err := NewStorage(
+		WithDataPath(tmpDir),
+		WithTimestampPrecision(Seconds),
+		WithPartitionDuration(time.Hour),
+		WithRetention(time.Hour),
+		WithRetentionByTimestamp(true),
+	)
+	require.NoError(t, err)
+	defer s.Close()
+	ss := s.(*storage)
+	assert.True(t, s.Config().RetentionByTimestamp)
+
+	now := time.Now().Unix()
+	old := now - 3*60*60
+	require.NoError(t, s.InsertRows([]Row{
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: old, Value: 0.1}},
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: old + 1, Value: 0.2}},
+	}))
+	require.NoError(t, ss.newPartition(nil, true))
+	require.NoError(t, s.InsertRows([]Row{
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: now, Value: 0.3}},
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: now + 1, Value: 0.4}},
+	}))
+	// Make both partitions flushable.
+	for i := 0; i < writablePartitionsNum; i++ {
+		require.NoError(t, ss.newPartition(nil, true))
+	}
+	flushed, err := s.Flush()
+	require.NoError(t, err)
+	require.Len(t, flushed, 2)
+
+	// Both partitions were just persisted, so only the one holding old data points expires.
+	require.NoError(t, ss.removeExpiredPartitions())
+	assert.Equal(t, int64(1), s.Stats().PartitionsExpired)
+	_, err = os.Stat(flushed[1].DirPath)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	_, err = os.Stat(flushed[0].DirPath)
+	assert.NoError(t, err)
+
+	got, err := s.Select("metric1", nil, old, now+2)
+	require.NoError(t, err)
+	assert.Equal(t, []*DataPoint{{Timestamp: now, Value: 0.3}, {Timestamp: now + 1, Value: 0.4}}, got)
+}
+
+// loadBlockingFileSystem blocks opening data files for reads until proceed gets closed,
+// telling it by closing opening.
+type loadBlockingFileSystem struct {
+	FileSystem
+	opening chan struct{}
+	proceed chan struct{}
+	once    sync.Once
+}
+
+func (f *loadBlockingFileSystem) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	if filepath.Base(name) == dataFileName && flag == os.O_RDONLY {
+		f.once.Do(func() { close(f.opening) })
+		<-f.proceed
+	}
+	return f.FileSystem.OpenFile(name, flag, perm)
+}
+
+func Test_storage_removeExpiredPartitions_byTimestampWhileSelecting(t *testing.T) {
+	tmpDir := t.TempDir()
+	opts := []Option{
+		WithDataPath(tmpDir),
+		WithTimestampPrecision(Seconds),
+		WithPartitionDuration(time.Hour),
+		WithRetention(time.Hour),
+	}
+	old := time.Now().Unix() - 3*60*60
+	s, err := NewStorage(opts...)
+	require.NoError(t, err)
+	want := make([]*DataPoint, 0, 100)
+	for i := int64(0); i < 100; i++ {
+		require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: old + i, Value: 0.1}}}))
+		want = append(want, &DataPoint{Timestamp: old + i, Value: 0.1})
+	}
+	// It's not removed yet since it was just persisted.
+	require.NoError(t, s.Close())
+	dirPath := filepath.Join(tmpDir, fmt.Sprintf("p-%d-%d", old, old+99))
+	require.DirExists(t, dirPath)
+
+	fsys := &loadBlockingFileSystem{FileSystem: defaultFileSystem, opening: make(chan struct{}), proceed: make(chan struct{})}
+	s, err = NewStorage(append(opts, WithRetentionByTimestamp(true), WithFileSystem(fsys))...)
+	require.NoError(t, err)
+	defer s.Close()
+	ss := s.(*storage)
+
+	type result struct {
+		points []*DataPoint
+		err    error
+	}
+	resultCh := make(chan result)
+	go func() {
+		points, err := s.Select("metric1", nil, old, old+100)
+		resultCh <- result{points: points, err: err}
+	}()
+	// Remove it while the select is loading the data file.
+	<-fsys.opening
+	require.NoError(t, ss.removeExpiredPartitions())
+	assert.Equal(t, int64(1), s.Stats().PartitionsExpired)
+	close(fsys.proceed)
+
+	got := <-resultCh
+	require.NoError(t, got.err)
+	assert.Equal(t, want, got.points)
+	// The files are removed once the read is done.
+	assert.NoDirExists(t, dirPath)
+}
+
+func Test_storage_SelectColumns(t *testing.T) {
+	s, err := NewStorage(
+		WithPartitionDuration(10*time.Second),
+		WithTimestampPrecision(Seconds),
+	)
+	require.NoError(t, err)
+	defer s.Close()
+	for ts := int64(1600000000); ts < 1600000020; ts++ {
+		err := s.InsertRows([]Row{
+			{Metric: "metric1", DataPoint: DataPoint{Timestamp: ts, Value: float64(ts % 7)}},
+		})
+		require.NoError(t, err)
+	}
+
+	points, err := s.Select("metric1", nil, 1600000005, 1600000018)
+	require.NoError(t, err)
+	timestamps, values, err := s.SelectColumns("metric1", nil, 1600000005, 1600000018)
+	require.NoError(t, err)
+	require.Len(t, timestamps, len(points))
+	require.Len(t, values, len(points))
+	for i := range points {
+		assert.Equal(t, points[i].Timestamp, timestamps[i])
+		assert.Equal(t, points[i].Value, values[i])
+	}
+
+	_, _, err = s.SelectColumns("unknown", nil, 1600000005, 1600000018)
+	assert.ErrorIs(t, err, ErrNoDataPoints)
+}
+
+func Test_storage_InsertRows_outOfOrderPolicy(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    OutOfOrderPolicy
+		wantErr   error
+		want      []*DataPoint
+		wantStats Stats
+	}{
+		{
+			name:   "accept",
+			policy: OutOfOrderAccept,
+			want: []*DataPoint{
+				{Timestamp: 1600000002, Value: 0.2},
+				{Timestamp: 1600000003, Value: 0.3},
+			},
+			wantStats: Stats{OutOfOrderAccepted: 1, RowsInserted: 4, Selects: 1},
+		},
+		{
+			name:    "reject",
+			policy:  OutOfOrderReject,
+			wantErr: ErrOutOfOrder,
+			want: []*DataPoint{
+				{Timestamp: 1600000002, Value: 0.2},
+			},
+			wantStats: Stats{OutOfOrderRejected: 1, RowsInserted: 2, Selects: 1},
+		},
+		{
+			name:   "drop",
+			policy: OutOfOrderDrop,
+			want: []*DataPoint{
+				{Timestamp: 1600000002, Value: 0.2},
+				{Timestamp: 1600000003, Value: 0.3},
+			},
+			wantStats: Stats{OutOfOrderDropped: 1, RowsInserted: 4, Selects: 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewStorage(
+				WithTimestampPrecision(Seconds),
+				WithOutOfOrderPolicy(tt.policy),
+			)
+			require.NoError(t, err)
+			defer s.Close()
+
+			err = s.InsertRows([]Row{
+				{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000000, Value: 0.1}},
+				{Metric: "metric2", DataPoint: DataPoint{Timestamp: 1600000002, Value: 0.2}},
+			})
+			require.NoError(t, err)
+			err = s.InsertRows([]Row{
+				{Metric: "metric2", DataPoint: DataPoint{Timestamp: 1600000001, Value: 0.1}},
+				{Metric: "metric2", DataPoint: DataPoint{Timestamp: 1600000003, Value: 0.3}},
+			})
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+			}
+			// Out-of-order data points aren't visible until flushed.
+			got, err := s.Select("metric2", nil, 1600000000, 1600000004)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+			stats := s.Stats()
+			// The memory usage and the top metrics are tested separately.
+			stats.MemoryUsage = 0
+			stats.TopMetricsByIngest = nil
+			assert.Equal(t, tt.wantStats, stats)
+		})
+	}
+}
+
+func Test_storage_InsertRows_walFullPolicy(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    WALFullPolicy
+		wantErr   error
+		wantFound bool
+		wantStats Stats
+	}{
+		{
+			name:      "reject writes",
+			policy:    WALFullRejectWrites,
+			wantErr:   ErrWALFull,
+			wantStats: Stats{WALDiskFull: true, Selects: 1},
+		},
+		{
+			name:      "drop WAL and continue",
+			policy:    WALFullDropAndContinue,
+			wantFound: true,
+			wantStats: Stats{WALDiskFull: true, WALRowsDropped: 1, RowsInserted: 1, Selects: 1},
+		},
+		{
+			name:      "force flush",
+			policy:    WALFullForceFlush,
+			wantErr:   ErrWALFull,
+			wantStats: Stats{WALDiskFull: true, Selects: 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st, err := NewStorage(
+				WithTimestampPrecision(Seconds),
+				WithWALFullPolicy(tt.policy),
+			)
+			require.NoError(t, err)
+			defer st.Close()
+			s := st.(*storage)
+			// Inject a WAL whose disk is always full.
+			s.wal = s.newDiskFullWAL(&fakeWAL{
+				appendFunc: func(_ walOperation, _ []Row) error {
+					return &os.PathError{Op: "write", Path: "wal", Err: syscall.ENOSPC}
+				},
+			})
+			require.NoError(t, s.newPartition(nil, false))
+
+			err = s.InsertRows([]Row{
+				{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000000, Value: 0.1}},
+			})
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+			}
+			_, err = s.Select("metric1", nil, 1600000000, 1600000001)
+			assert.Equal(t, tt.wantFound, err == nil)
+			stats := s.Stats()
+			// The memory usage and the top metrics are tested separately.
+			stats.MemoryUsage = 0
+			stats.TopMetricsByIngest = nil
+			assert.Equal(t, tt.wantStats, stats)
+		})
+	}
+}
+
+func Test_storage_SelectChanges(t *testing.T) {
+	s, err := NewStorage(
+		WithPartitionDuration(20*time.Second),
+		WithTimestampPrecision(Seconds),
+	)
+	require.NoError(t, err)
+	defer s.Close()
+	// Long constant runs spanning multiple partitions: 1 x 12, 2 x 3, 1 x 15
+	for ts := int64(1600000000); ts < 1600000030; ts++ {
+		value := 1.0
+		if ts >= 1600000012 && ts < 1600000015 {
+			value = 2.0
+		}
+		err := s.InsertRows([]Row{
+			{Metric: "metric1", DataPoint: DataPoint{Timestamp: ts, Value: value}},
+		})
+		require.NoError(t, err)
+	}
+
+	got, err := s.SelectChanges("metric1", nil, 1600000000, 1600000030)
+	require.NoError(t, err)
+	want := []*DataPoint{
+		{Timestamp: 1600000000, Value: 1},
+		{Timestamp: 1600000012, Value: 2},
+		{Timestamp: 1600000015, Value: 1},
+	}
+	assert.Equal(t, want, got)
+
+	// The first point within the range is always included.
+	got, err = s.SelectChanges("metric1", nil, 1600000020, 1600000030)
+	require.NoError(t, err)
+	assert.Equal(t, []*DataPoint{{Timestamp: 1600000020, Value: 1}}, got)
+}
+
+func Test_storage_SelectLastN(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tstorage-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	s, err := NewStorage(
+		WithDataPath(tmpDir),
+		WithPartitionDuration(10*time.Second),
+		WithTimestampPrecision(Seconds),
+	)
+	require.NoError(t, err)
+	defer s.Close()
+	for ts := int64(1600000000); ts < 1600000025; ts++ {
+		err := s.InsertRows([]Row{
+			{Metric: "metric1", DataPoint: DataPoint{Timestamp: ts, Value: 0.1}},
+		})
+		require.NoError(t, err)
+	}
+
+	tests := []struct {
+		name     string
+		n        int
+		wantFrom int64
+		wantLen  int
+	}{
+		{name: "within the head partition", n: 3, wantFrom: 1600000022, wantLen: 3},
+		{name: "across partitions", n: 12, wantFrom: 1600000013, wantLen: 12},
+		{name: "more than existing", n: 100, wantFrom: 1600000000, wantLen: 25},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := s.SelectLastN("metric1", nil, tt.n)
+			require.NoError(t, err)
+			require.Len(t, got, tt.wantLen)
+			for i, p := range got {
+				assert.Equal(t, tt.wantFrom+int64(i), p.Timestamp)
+			}
+		})
+	}
+
+	_, err = s.SelectLastN("unknown", nil, 1)
+	assert.ErrorIs(t, err, ErrNoDataPoints)
+}
+
+func Test_storage_SelectLastN_stopsEarly(t *testing.T) {
+	tmpDir := t.TempDir()
+	opts := []Option{
+		WithDataPath(tmpDir),
+		WithPartitionDuration(10 * time.Second),
+		WithTimestampPrecision(Seconds),
+		WithPointsPerBlock(2),
+	}
+	s, err := NewStorage(opts...)
+	require.NoError(t, err)
+	for ts := int64(1600000000); ts < 1600000030; ts++ {
+		require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: ts, Value: 0.1}}}))
+	}
+	require.NoError(t, s.Close())
+
+	// Select from disk partitions only.
+	s, err = NewStorage(opts...)
+	require.NoError(t, err)
+	defer s.Close()
+	got, err := s.SelectLastN("metric1", nil, 3)
+	require.NoError(t, err)
+	assert.Equal(t, []*DataPoint{
+		{Timestamp: 1600000027, Value: 0.1},
+		{Timestamp: 1600000028, Value: 0.1},
+		{Timestamp: 1600000029, Value: 0.1},
+	}, got)
+	// Only the newest partition has been read.
+	assert.Equal(t, int64(1), s.Stats().PartitionCacheMisses)
+
+	got, err = s.SelectLastN("metric1", nil, 12)
+	require.NoError(t, err)
+	require.Len(t, got, 12)
+	assert.Equal(t, int64(1600000018), got[0].Timestamp)
+	assert.Equal(t, int64(2), s.Stats().PartitionCacheMisses)
+}
+
+func Test_storage_ListPartitions(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tstorage-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	start := time.Now()
+	s, err := NewStorage(
+		WithDataPath(tmpDir),
+		WithTimestampPrecision(Seconds),
+	)
+	require.NoError(t, err)
+	err = s.InsertRows([]Row{
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000000, Value: 0.1}},
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000001, Value: 0.1}},
+	})
+	require.NoError(t, err)
+
+	infos := s.ListPartitions()
+	require.Len(t, infos, 1)
+	inMemory := infos[0]
+	assert.Equal(t, int64(1600000000), inMemory.MinTimestamp)
+	assert.Equal(t, int64(1600000001), inMemory.MaxTimestamp)
+	assert.Equal(t, 2, inMemory.NumDataPoints)
+	assert.Empty(t, inMemory.DirPath)
+	assert.False(t, inMemory.CreatedAt.Before(start))
+	assert.False(t, inMemory.LastWriteAt.Before(inMemory.CreatedAt))
+	assert.True(t, inMemory.PersistedAt.IsZero())
+	require.NoError(t, s.Close())
+
+	// Re-open storage from the persisted data
+	s, err = NewStorage(
+		WithDataPath(tmpDir),
+		WithTimestampPrecision(Seconds),
+	)
+	require.NoError(t, err)
+	defer s.Close()
+	var onDisk *PartitionInfo
+	for _, info := range s.ListPartitions() {
+		if info.DirPath != "" {
+			info := info
+			onDisk = &info
+		}
+	}
+	require.NotNil(t, onDisk)
+	assert.Equal(t, filepath.Join(tmpDir, "p-1600000000-1600000001"), onDisk.DirPath)
+	assert.True(t, inMemory.CreatedAt.Equal(onDisk.CreatedAt))
+	assert.True(t, inMemory.LastWriteAt.Equal(onDisk.LastWriteAt))
+	assert.False(t, onDisk.PersistedAt.Before(onDisk.LastWriteAt))
+}
+
+func Test_storage_flush(t *testing.T) {
+	tests := []struct {
+		name            string
+		memoryPartition func() *memoryPartition
+		wantErr         error
+	}{
+		{
+			name: "empty partition",
+			memoryPartition: func() *memoryPartition {
+				return newMemoryPartition(nil, time.Hour, Seconds).(*memoryPartition)
+			},
+			wantErr: errEmptyPartition,
+		},
+		{
+			name: "swapped min and max timestamps",
+			memoryPartition: func() *memoryPartition {
+				m := newMemoryPartition(nil, time.Hour, Seconds).(*memoryPartition)
+				_, err := m.insertRows([]Row{
+					{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000000, Value: 0.1}},
+				})
+				require.NoError(t, err)
+				m.minT, m.maxT = 1600000001, 1600000000
+				return m
+			},
+			wantErr: errInvalidPartition,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir, err := os.MkdirTemp("", "tstorage-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(tmpDir)
+			s := &storage{
+				dirPerm:  defaultDirPerm,
+				filePerm: defaultFilePerm,
+				logger:   &nopLogger{},
+			}
+			err = s.flush(filepath.Join(tmpDir, "p-1"), tt.memoryPartition())
+			assert.ErrorIs(t, err, tt.wantErr)
+			_, err = os.Stat(filepath.Join(tmpDir, "p-1", metaFileName))
+			assert.ErrorIs(t, err, os.ErrNotExist)
+		})
+	}
+}
+
+func Test_storage_flush_layout(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tstorage-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	m := newMemoryPartition(nil, time.Hour, Seconds).(*memoryPartition)
+	rows := make([]Row, 0)
+	for ts := int64(1600000000); ts < 1600000010; ts++ {
+		// Interleave metrics in insertion order.
+		for _, host := range []string{"c", "a", "b"} {
+			rows = append(rows,
+				Row{Metric: "metric2", Labels: []Label{{Name: "host", Value: host}}, DataPoint: DataPoint{Timestamp: ts, Value: 2}},
+				Row{Metric: "metric1", Labels: []Label{{Name: "host", Value: host}}, DataPoint: DataPoint{Timestamp: ts, Value: 1}},
+			)
+		}
+	}
+	_, err = m.insertRows(rows)
+	require.NoError(t, err)
+	s := &storage{
+		dirPerm:         defaultDirPerm,
+		filePerm:        defaultFilePerm,
+		pointsPerBlock:  defaultPointsPerBlock,
+		allocator:       defaultAllocator,
+		flushBufferSize: defaultFlushBufferSize,
+		fsys:            defaultFileSystem,
+		logger:          &nopLogger{},
+	}
+	dir := filepath.Join(tmpDir, "p-1600000000-1600000009")
+	require.NoError(t, s.flush(dir, m))
+
+	part, err := openDiskPartition(defaultFileSystem, dir, time.Hour, true, defaultAllocator)
+	require.NoError(t, err)
+	d := part.(*diskPartition)
+	names := make([]string, 0, len(d.meta.Metrics))
+	for name := range d.meta.Metrics {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return d.meta.Metrics[names[i]].Offset < d.meta.Metrics[names[j]].Offset
+	})
+	assert.True(t, sort.StringsAreSorted(names), "metrics must be laid out in order by name: %v", names)
+
+	for _, metric := range []string{"metric1", "metric2"} {
+		for _, host := range []string{"a", "b", "c"} {
+			points, err := d.selectDataPoints(metric, []Label{{Name: "host", Value: host}}, 1600000000, 1600000010)
+			require.NoError(t, err)
+			assert.Len(t, points, 10)
+		}
+	}
+}
+
+func Test_storage_Select_parallel(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tstorage-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	s, err := NewStorage(
+		WithDataPath(tmpDir),
+		WithPartitionDuration(10*time.Second),
+		WithTimestampPrecision(Seconds),
+	)
+	require.NoError(t, err)
+	for ts := int64(1600000000); ts < 1600000100; ts++ {
+		err := s.InsertRows([]Row{
+			{Metric: "metric1", Labels: []Label{{Name: "b", Value: "2"}, {Name: "a", Value: "1"}}, DataPoint: DataPoint{Timestamp: ts, Value: float64(ts)}},
+		})
+		require.NoError(t, err)
+	}
+	require.NoError(t, s.Close())
+
+	selectWith := func(threshold int) []*DataPoint {
+		s, err := NewStorage(
+			WithDataPath(tmpDir),
+			WithPartitionDuration(10*time.Second),
+			WithTimestampPrecision(Seconds),
+			WithSelectParallelismThreshold(threshold),
+		)
+		require.NoError(t, err)
+		defer s.Close()
+		points, err := s.Select("metric1", []Label{{Name: "a", Value: "1"}, {Name: "b", Value: "2"}}, 1600000005, 1600000095)
+		require.NoError(t, err)
+		return points
+	}
+	serial := selectWith(0)
+	require.Len(t, serial, 90)
+	for i, p := range serial {
+		assert.Equal(t, int64(1600000005+i), p.Timestamp)
+	}
+	assert.Equal(t, serial, selectWith(1))
+}
+
+func Test_storage_InsertRows_withWriteBuffer(t *testing.T) {
+	t.Run("flush when full", func(t *testing.T) {
+		s, err := NewStorage(WithWriteBuffer(3, time.Hour))
+		require.NoError(t, err)
+		defer s.Close()
+		for i := int64(1); i <= 2; i++ {
+			require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: i}}}))
+		}
+		_, err = s.Select("metric1", nil, 0, 10)
+		assert.ErrorIs(t, err, ErrNoDataPoints)
+
+		require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 3}}}))
+		got, err := s.Select("metric1", nil, 0, 10)
+		require.NoError(t, err)
+		assert.Equal(t, []*DataPoint{{Timestamp: 1}, {Timestamp: 2}, {Timestamp: 3}}, got)
+	})
+
+	t.Run("flush after delay", func(t *testing.T) {
+		s, err := NewStorage(WithWriteBuffer(100, 10*time.Millisecond))
+		require.NoError(t, err)
+		defer s.Close()
+		require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1}}}))
+		assert.Eventually(t, func() bool {
+			_, err := s.Select("metric1", nil, 0, 10)
+			return err == nil
+		}, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("flush on close", func(t *testing.T) {
+		tmpDir, err := os.MkdirTemp("", "tstorage-test")
+		require.NoError(t, err)
+		defer os.RemoveAll(tmpDir)
+
+		s, err := NewStorage(WithDataPath(tmpDir), WithWriteBuffer(100, time.Hour))
+		require.NoError(t, err)
+		require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1}}}))
+		require.NoError(t, s.Close())
+
+		s, err = NewStorage(WithDataPath(tmpDir))
+		require.NoError(t, err)
+		defer s.Close()
+		got, err := s.Select("metric1", nil, 0, 10)
+		require.NoError(t, err)
+		assert.Equal(t, []*DataPoint{{Timestamp: 1}}, got)
+	})
+}
+
+func Test_storage_SelectStrict(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tstorage-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	for _, ts := range []int64{100, 200, 300} {
+		m := newMemoryPartition(nil, 0, Seconds).(*memoryPartition)
+		_, err := m.insertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: ts, Value: 0.1}}})
+		require.NoError(t, err)
+		s := &storage{dirPerm: defaultDirPerm, filePerm: defaultFilePerm, allocator: defaultAllocator, flushBufferSize: defaultFlushBufferSize, fsys: defaultFileSystem, logger: &nopLogger{}}
+		require.NoError(t, s.flush(filepath.Join(tmpDir, fmt.Sprintf("p-%d-%d", ts, ts)), m))
+	}
+	// Corrupt the index of a partition so that it fails to be read.
+	metaPath := filepath.Join(tmpDir, "p-200-200", metaFileName)
+	b, err := os.ReadFile(metaPath)
+	require.NoError(t, err)
+	var m meta
+	require.NoError(t, json.Unmarshal(b, &m))
+	mt := m.Metrics["metric1"]
+	mt.Blocks[0].Offset = 1 << 30
+	m.Metrics["metric1"] = mt
+	b, err = json.Marshal(&m)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(metaPath, b, 0644))
+	// Remove the meta file of a partition so that it gets skipped when opening.
+	require.NoError(t, os.Remove(filepath.Join(tmpDir, "p-300-300", metaFileName)))
+
+	s, err := NewStorage(WithDataPath(tmpDir), WithTimestampPrecision(Seconds))
+	require.NoError(t, err)
+	defer s.Close()
+
+	_, err = s.Select("metric1", nil, 0, 1000)
+	assert.Error(t, err)
+
+	_, err = s.SelectStrict("metric1", nil, 0, 1000)
+	require.ErrorIs(t, err, ErrPartialResult)
+	var partialErr *PartialResultError
+	require.ErrorAs(t, err, &partialErr)
+	assert.Equal(t, []*DataPoint{{Timestamp: 100, Value: 0.1}}, partialErr.Points)
+	require.Len(t, partialErr.Skipped, 2)
+	assert.Equal(t, filepath.Join(tmpDir, "p-200-200"), partialErr.Skipped[0].DirPath)
+	assert.Equal(t, filepath.Join(tmpDir, "p-300-300"), partialErr.Skipped[1].DirPath)
+	assert.Equal(t, int64(300), partialErr.Skipped[1].MinTimestamp)
+
+	got, err := s.SelectStrict("metric1", nil, 0, 150)
+	require.NoError(t, err)
+	assert.Equal(t, []*DataPoint{{Timestamp: 100, Value: 0.1}}, got)
+}
+
+func Test_storage_CountPoints(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tstorage-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	s, err := NewStorage(WithDataPath(tmpDir), WithTimestampPrecision(Seconds), WithPointsPerBlock(2))
+	require.NoError(t, err)
+	for i := int64(1); i <= 10; i++ {
+		require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: i}}}))
+	}
+	require.NoError(t, s.Close())
+
+	// Points from 1 to 10 are on the disk, and 11 and 12 are in the memory.
+	s, err = NewStorage(WithDataPath(tmpDir), WithTimestampPrecision(Seconds), WithPointsPerBlock(2))
+	require.NoError(t, err)
+	defer s.Close()
+	for i := int64(11); i <= 12; i++ {
+		require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: i}}}))
+	}
+
+	tests := []struct {
+		name   string
+		metric string
+		start  int64
+		end    int64
+		want   int
+	}{
+		{name: "all", metric: "metric1", start: 0, end: 100, want: 12},
+		{name: "within a block", metric: "metric1", start: 3, end: 4, want: 1},
+		{name: "across blocks", metric: "metric1", start: 2, end: 8, want: 6},
+		{name: "across partitions", metric: "metric1", start: 9, end: 13, want: 4},
+		{name: "unknown metric", metric: "unknown", start: 0, end: 100, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := s.CountPoints(tt.metric, nil, tt.start, tt.end)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_storage_InsertRows_withDedupeWindow(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    DedupePolicy
+		want      []*DataPoint
+		wantStats Stats
+	}{
+		{
+			name:   "keep first",
+			policy: DedupeKeepFirst,
+			want: []*DataPoint{
+				{Timestamp: 1000, Value: 1},
+				{Timestamp: 1010, Value: 3},
+				{Timestamp: 1030, Value: 5},
+			},
+			wantStats: Stats{PointsDeduplicated: 2, RowsInserted: 5, Selects: 1},
+		},
+		{
+			name:   "keep last",
+			policy: DedupeKeepLast,
+			want: []*DataPoint{
+				{Timestamp: 1015, Value: 4},
+				{Timestamp: 1030, Value: 5},
+			},
+			wantStats: Stats{PointsDeduplicated: 3, RowsInserted: 5, Selects: 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewStorage(
+				WithTimestampPrecision(Milliseconds),
+				WithDedupeWindow(10*time.Millisecond),
+				WithDedupePolicy(tt.policy),
+			)
+			require.NoError(t, err)
+			defer s.Close()
+			for i, ts := range []int64{1000, 1005, 1010, 1015, 1030} {
+				err := s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: ts, Value: float64(i + 1)}}})
+				require.NoError(t, err)
+			}
+			got, err := s.Select("metric1", nil, 0, 2000)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+			stats := s.Stats()
+			// The memory usage and the top metrics are tested separately.
+			stats.MemoryUsage = 0
+			stats.TopMetricsByIngest = nil
+			assert.Equal(t, tt.wantStats, stats)
+		})
+	}
+}
+
+func Test_storage_InsertRows_withTimestampFunc(t *testing.T) {
+	// Route rows by the event time carried by a label rather than the given timestamp.
+	s, err := NewStorage(
+		WithTimestampPrecision(Seconds),
+		WithTimestampFunc(func(row Row) int64 {
+			for _, l := range row.Labels {
+				if l.Name == "event_time" {
+					ts, _ := strconv.ParseInt(l.Value, 10, 64)
+					return ts
+				}
+			}
+			return row.Timestamp
+		}),
+	)
+	require.NoError(t, err)
+	defer s.Close()
+
+	rows := []Row{
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000010, Value: 0.1}, Labels: []Label{{Name: "event_time", Value: "1600000001"}}},
+		{Metric: "metric2", DataPoint: DataPoint{Timestamp: 1600000010, Value: 0.2}},
+	}
+	require.NoError(t, s.InsertRows(rows))
+	// The given rows must be left as is.
+	assert.Equal(t, int64(1600000010), rows[0].Timestamp)
+
+	got, err := s.Select("metric1", []Label{{Name: "event_time", Value: "1600000001"}}, 1600000000, 1600000002)
+	require.NoError(t, err)
+	assert.Equal(t, []*DataPoint{{Timestamp: 1600000001, Value: 0.1}}, got)
+	got, err = s.Select("metric2", nil, 1600000000, 1600000011)
+	require.NoError(t, err)
+	assert.Equal(t, []*DataPoint{{Timestamp: 1600000010, Value: 0.2}}, got)
+}
+
+func Test_storage_InsertRows_withTimestampAutofill(t *testing.T) {
+	var hooked []Row
+	st, err := NewStorage(
+		WithTimestampPrecision(Seconds),
+		WithTimestampAutofill(true),
+		WithInsertHook(func(rows []Row) ([]Row, error) {
+			hooked = append(hooked, rows...)
+			return rows, nil
+		}),
+	)
+	require.NoError(t, err)
+	defer st.Close()
+	s := st.(*storage)
+	s.now = func() time.Time { return time.Unix(1600000100, 0) }
+
+	rows := []Row{
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000001, Value: 0.1}},
+		{Metric: "metric1", DataPoint: DataPoint{Value: 0.2}},
+		{Metric: "metric2", DataPoint: DataPoint{Value: 0.3}},
+	}
+	require.NoError(t, s.InsertRows(rows))
+	// The given rows must be left as is.
+	assert.Zero(t, rows[1].Timestamp)
+	// Filled before the insert hook.
+	require.Len(t, hooked, 3)
+	assert.Equal(t, int64(1600000100), hooked[1].Timestamp)
+
+	got, err := s.Select("metric1", nil, 1600000000, 1600000101)
+	require.NoError(t, err)
+	assert.Equal(t, []*DataPoint{{Timestamp: 1600000001, Value: 0.1}, {Timestamp: 1600000100, Value: 0.2}}, got)
+	got, err = s.Select("metric2", nil, 1600000000, 1600000101)
+	require.NoError(t, err)
+	assert.Equal(t, []*DataPoint{{Timestamp: 1600000100, Value: 0.3}}, got)
+}
+
+func Test_storage_InsertRows_withFlushTrigger(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tstorage-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	s, err := NewStorage(
+		WithDataPath(tmpDir),
+		WithTimestampPrecision(Seconds),
+		WithFlushTrigger(func(info PartitionInfo) bool {
+			return info.NumDataPoints >= 2
+		}),
+	)
+	require.NoError(t, err)
+	for i := int64(1); i <= 8; i++ {
+		require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: i}}}))
+	}
+	partitions := s.ListPartitions()
+	assert.Len(t, partitions, 4)
+	for _, p := range partitions {
+		assert.Equal(t, 2, p.NumDataPoints)
+	}
+	assert.Eventually(t, func() bool {
+		// The two oldest ones get persisted in the background.
+		partitions := s.ListPartitions()
+		return partitions[len(partitions)-1].DirPath != "" && partitions[len(partitions)-2].DirPath != ""
+	}, time.Second, 10*time.Millisecond)
+	require.NoError(t, s.Close())
+
+	s, err = NewStorage(WithDataPath(tmpDir), WithTimestampPrecision(Seconds))
+	require.NoError(t, err)
+	defer s.Close()
+	got, err := s.Select("metric1", nil, 1, 9)
+	require.NoError(t, err)
+	assert.Len(t, got, 8)
+}
+
+func Test_storage_withMetricNameNormalizer(t *testing.T) {
+	s, err := NewStorage(
+		WithTimestampPrecision(Seconds),
+		WithMetricNameNormalizer(func(metric string) string {
+			return strings.ToLower(strings.NewReplacer(".", "_", "-", "_").Replace(metric))
+		}),
+	)
+	require.NoError(t, err)
+	defer s.Close()
+
+	err = s.InsertRows([]Row{
+		{Metric: "http.requests", DataPoint: DataPoint{Timestamp: 1, Value: 0.1}},
+		{Metric: "http_requests", DataPoint: DataPoint{Timestamp: 2, Value: 0.2}},
+		{Metric: "HTTP-Requests", DataPoint: DataPoint{Timestamp: 3, Value: 0.3}},
+	})
+	require.NoError(t, err)
+
+	want := []*DataPoint{
+		{Timestamp: 1, Value: 0.1},
+		{Timestamp: 2, Value: 0.2},
+		{Timestamp: 3, Value: 0.3},
+	}
+	for _, metric := range []string{"http.requests", "http_requests", "Http-Requests"} {
+		got, err := s.Select(metric, nil, 0, 4)
+		require.NoError(t, err)
+		assert.Equal(t, want, got)
+		n, err := s.CountPoints(metric, nil, 0, 4)
+		require.NoError(t, err)
+		assert.Equal(t, 3, n)
+	}
+}
+
+func Test_storage_Reopen(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tstorage-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	s, err := NewStorage(WithDataPath(tmpDir), WithTimestampPrecision(Seconds))
+	require.NoError(t, err)
+	assert.Error(t, s.Reopen(), "reopening storage not closed yet")
+
+	want := make([]*DataPoint, 0)
+	for i := int64(1); i <= 3; i++ {
+		require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: i, Value: float64(i)}}}))
+		want = append(want, &DataPoint{Timestamp: i, Value: float64(i)})
+		require.NoError(t, s.Close())
+		require.NoError(t, s.Reopen())
+
+		got, err := s.Select("metric1", nil, 0, 10)
+		require.NoError(t, err)
+		assert.Equal(t, want, got)
+	}
+	require.NoError(t, s.Close())
+}
+
+func Test_storage_Close(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tstorage-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	// Rows of all goroutines lie within a partition however far they go apart, so that none are dropped as too old.
+	opts := []Option{WithDataPath(tmpDir), WithTimestampPrecision(Seconds), WithPartitionDuration(100 * 365 * 24 * time.Hour)}
+	s, err := NewStorage(opts...)
+	require.NoError(t, err)
+
+	// Keep inserting while closing; every row accepted must survive.
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		accepted int
+	)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := int64(1); ; j++ {
+				err := s.InsertRows([]Row{{Metric: fmt.Sprintf("metric%d", i), DataPoint: DataPoint{Timestamp: j, Value: 0.1}}})
+				if errors.Is(err, ErrStorageClosed) {
+					return
+				}
+				assert.NoError(t, err)
+				mu.Lock()
+				accepted++
+				mu.Unlock()
+			}
+		}(i)
+	}
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, s.Close())
+	wg.Wait()
+
+	assert.ErrorIs(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1}}}), ErrStorageClosed)
+	assert.ErrorIs(t, s.InsertRowsSync([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1}}}), ErrStorageClosed)
+	_, err = s.InsertRowsDetailed([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1}}})
+	assert.ErrorIs(t, err, ErrStorageClosed)
+	assert.ErrorIs(t, s.Close(), ErrStorageClosed)
+
+	s, err = NewStorage(opts...)
+	require.NoError(t, err)
+	defer s.Close()
+	var got int
+	for i := 0; i < 4; i++ {
+		points, err := s.Select(fmt.Sprintf("metric%d", i), nil, 0, math.MaxInt64)
+		if errors.Is(err, ErrNoDataPoints) {
+			continue
+		}
+		require.NoError(t, err)
+		got += len(points)
+	}
+	assert.Equal(t, accepted, got)
+}
+
+func Test_storage_Close_retry(t *testing.T) {
+	tmpDir := t.TempDir()
+	fsys := &flakyFileSystem{FileSystem: defaultFileSystem, failures: 1, err: syscall.ENOSPC}
+	s, err := NewStorage(WithDataPath(tmpDir), WithTimestampPrecision(Seconds), WithFileSystem(fsys))
+	require.NoError(t, err)
+	require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1, Value: 0.1}}}))
+
+	// Close resumes from the flush failed before.
+	assert.ErrorIs(t, s.Close(), syscall.ENOSPC)
+	assert.ErrorIs(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 2}}}), ErrStorageClosed)
+	require.NoError(t, s.Close())
+	assert.ErrorIs(t, s.Close(), ErrStorageClosed)
+
+	s, err = NewStorage(WithDataPath(tmpDir), WithTimestampPrecision(Seconds))
+	require.NoError(t, err)
+	defer s.Close()
+	points, err := s.Select("metric1", nil, 0, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []*DataPoint{{Timestamp: 1, Value: 0.1}}, points)
+}
+
+func Test_storage_OldestTimestamp(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tstorage-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	s, err := NewStorage(WithDataPath(tmpDir), WithTimestampPrecision(Seconds))
+	require.NoError(t, err)
+	_, ok := s.OldestTimestamp()
+	assert.False(t, ok)
+
+	require.NoError(t, s.InsertRows([]Row{
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000005}},
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000003}},
+	}))
+	require.NoError(t, s.Close())
+
+	// The oldest one is on the disk.
+	s, err = NewStorage(WithDataPath(tmpDir), WithTimestampPrecision(Seconds))
+	require.NoError(t, err)
+	defer s.Close()
+	require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000010}}}))
+	got, ok := s.OldestTimestamp()
+	assert.True(t, ok)
+	assert.Equal(t, int64(1600000003), got)
+}
+
+func Test_storage_InsertRows_withZeroCopyStrings(t *testing.T) {
+	s, err := NewStorage(WithTimestampPrecision(Seconds), WithZeroCopyStrings(true))
+	require.NoError(t, err)
+	defer s.Close()
+	for ts := int64(1); ts <= 3; ts++ {
+		require.NoError(t, s.InsertRows([]Row{
+			{Metric: "metric1", Labels: []Label{{Name: "host", Value: "host-1"}}, DataPoint: DataPoint{Timestamp: ts, Value: 1}},
+			{Metric: "metric1", Labels: []Label{{Name: "host", Value: "host-2"}}, DataPoint: DataPoint{Timestamp: ts, Value: 2}},
+			{Metric: "metric1", DataPoint: DataPoint{Timestamp: ts, Value: 3}},
+		}))
+	}
+	for _, tt := range []struct {
+		labels []Label
+		value  float64
+	}{
+		{labels: []Label{{Name: "host", Value: "host-1"}}, value: 1},
+		{labels: []Label{{Name: "host", Value: "host-2"}}, value: 2},
+		{value: 3},
+	} {
+		points, err := s.Select("metric1", tt.labels, 1, 4)
+		require.NoError(t, err)
+		assert.Equal(t, []*DataPoint{
+			{Timestamp: 1, Value: tt.value},
+			{Timestamp: 2, Value: tt.value},
+			{Timestamp: 3, Value: tt.value},
+		}, points)
+	}
+}
+
+func Test_storage_SelectWhere(t *testing.T) {
+	tmpDir := t.TempDir()
+	opts := []Option{WithDataPath(tmpDir), WithTimestampPrecision(Seconds), WithPartitionDuration(time.Hour)}
+	s, err := NewStorage(opts...)
+	require.NoError(t, err)
+	values := map[int64]float64{1: 10, 5000: 95, 10000: 20, 15000: 99}
+	for _, ts := range []int64{1, 5000, 10000, 15000} {
+		require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: ts, Value: values[ts]}}}))
+	}
+	require.NoError(t, s.Close())
+	s, err = NewStorage(opts...)
+	require.NoError(t, err)
+	defer s.Close()
+	// Some in memory as well.
+	require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 20000, Value: 30}}}))
+	require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 20001, Value: 90}}}))
+
+	got, err := s.SelectWhere("metric1", nil, 1, 20002, func(v float64) bool { return v >= 90 })
+	require.NoError(t, err)
+	assert.Equal(t, []*DataPoint{
+		{Timestamp: 5000, Value: 95},
+		{Timestamp: 15000, Value: 99},
+		{Timestamp: 20001, Value: 90},
+	}, got)
+
+	_, err = s.SelectWhere("metric1", nil, 1, 20002, func(v float64) bool { return v > 100 })
+	assert.ErrorIs(t, err, ErrNoDataPoints)
+	_, err = s.SelectWhere("metric1", nil, 1, 20002, nil)
+	assert.Error(t, err)
+}
+
+func Test_storage_InsertRows_emptyPartitionList(t *testing.T) {
+	s, err := NewStorage(WithTimestampPrecision(Seconds))
+	require.NoError(t, err)
+	defer s.Close()
+	require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1, Value: 0.1}}}))
+
+	// Empty the list as if aggressive retention took place.
+	list := s.(*storage).partitionList
+	for list.size() > 0 {
+		require.NoError(t, list.remove(list.getHead()))
+	}
+
+	require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 2, Value: 0.2}}}))
+	got, err := s.Select("metric1", nil, 1, 3)
+	require.NoError(t, err)
+	assert.Equal(t, []*DataPoint{{Timestamp: 2, Value: 0.2}}, got)
+}
+
+func Test_storage_SelectClamped(t *testing.T) {
+	s, err := NewStorage(WithTimestampPrecision(Seconds))
+	require.NoError(t, err)
+	defer s.Close()
+	_, _, err = s.SelectClamped("metric1", nil, 1, 10)
+	assert.ErrorIs(t, err, ErrNoDataPoints)
+
+	require.NoError(t, s.InsertRows([]Row{
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1, Value: 0.1}},
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 2, Value: 0.2}},
+		{Metric: "metric2", DataPoint: DataPoint{Timestamp: 5, Value: 0.5}},
+	}))
+	latest, ok := s.LatestTimestamp()
+	require.True(t, ok)
+	assert.Equal(t, int64(5), latest)
+
+	tests := []struct {
+		name        string
+		start       int64
+		end         int64
+		want        []*DataPoint
+		wantClamped bool
+		wantErr     error
+	}{
+		{
+			name:  "within the horizon",
+			start: 1,
+			end:   3,
+			want:  []*DataPoint{{Timestamp: 1, Value: 0.1}, {Timestamp: 2, Value: 0.2}},
+		},
+		{
+			name:        "end beyond the horizon",
+			start:       2,
+			end:         100,
+			want:        []*DataPoint{{Timestamp: 2, Value: 0.2}},
+			wantClamped: true,
+		},
+		{
+			name:        "start beyond the horizon",
+			start:       6,
+			end:         100,
+			wantClamped: true,
+			wantErr:     ErrNoDataPoints,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, clamped, err := s.SelectClamped("metric1", nil, tt.start, tt.end)
+			assert.Equal(t, tt.wantClamped, clamped)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_storage_RetentionHorizon(t *testing.T) {
+	s, err := NewStorage(WithTimestampPrecision(Seconds), WithRetention(time.Hour))
+	require.NoError(t, err)
+	defer s.Close()
+	s.(*storage).now = func() time.Time { return time.Unix(1600000000, 0) }
+	assert.Equal(t, int64(1600000000-3600), s.RetentionHorizon())
+}
+
+func Test_storage_InsertRows_withEnforceMonotonicTimestamps(t *testing.T) {
+	s, err := NewStorage(WithTimestampPrecision(Seconds), WithEnforceMonotonicTimestamps(true))
+	require.NoError(t, err)
+	defer s.Close()
+
+	require.NoError(t, s.InsertRows([]Row{
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 10, Value: 1}},
+		{Metric: "metric1", Labels: []Label{{Name: "host", Value: "a"}}, DataPoint: DataPoint{Timestamp: 5, Value: 1}},
+	}))
+	// Older or equal timestamps of the same series are rejected, whereas the others are inserted.
+	err = s.InsertRows([]Row{
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 10, Value: 2}},
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 11, Value: 2}},
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 11, Value: 3}},
+		{Metric: "metric1", Labels: []Label{{Name: "host", Value: "a"}}, DataPoint: DataPoint{Timestamp: 6, Value: 2}},
+	})
+	assert.ErrorIs(t, err, ErrOutOfOrder)
+	assert.Equal(t, int64(2), s.Stats().MonotonicityViolations)
+
+	got, err := s.Select("metric1", nil, 0, 100)
+	require.NoError(t, err)
+	assert.Equal(t, []*DataPoint{{Timestamp: 10, Value: 1}, {Timestamp: 11, Value: 2}}, got)
+	got, err = s.Select("metric1", []Label{{Name: "host", Value: "a"}}, 0, 100)
+	require.NoError(t, err)
+	assert.Equal(t, []*DataPoint{{Timestamp: 5, Value: 1}, {Timestamp: 6, Value: 2}}, got)
+
+	results, err := s.InsertRowsDetailed([]Row{
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 3}},
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 12}},
+	})
+	assert.Error(t, err)
+	assert.ErrorIs(t, results[0].Err, ErrOutOfOrder)
+	assert.True(t, results[1].Accepted)
+	assert.Equal(t, int64(3), s.Stats().MonotonicityViolations)
+}
+
+// walFailingFileSystem fails writes into WAL segments while fails is true.
+type walFailingFileSystem struct {
+	FileSystem
+	files []*failingWriteFile
+}
+
+func (f *walFailingFileSystem) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	file, err := f.FileSystem.OpenFile(name, flag, perm)
+	if err != nil || filepath.Base(filepath.Dir(name)) != "wal" {
+		return file, err
+	}
+	ff := &failingWriteFile{File: file}
+	f.files = append(f.files, ff)
+	return ff, nil
+}
+
+func (f *walFailingFileSystem) setFails(fails bool) {
+	for _, ff := range f.files {
+		ff.fails = fails
+	}
+}
+
+func Test_storage_InsertRows_withEnforceMonotonicTimestamps_failed(t *testing.T) {
+	fsys := &walFailingFileSystem{FileSystem: defaultFileSystem}
+	s, err := NewStorage(
+		WithDataPath(t.TempDir()),
+		WithFileSystem(fsys),
+		WithWALBufferedSize(0),
+		WithTimestampPrecision(Seconds),
+		WithEnforceMonotonicTimestamps(true),
+	)
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Rows failed to be inserted don't get later ones of the same timestamps rejected.
+	fsys.setFails(true)
+	assert.Error(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 10, Value: 1}}}))
+	fsys.setFails(false)
+	require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 10, Value: 2}}}))
+
+	got, err := s.Select("metric1", nil, 0, 100)
+	require.NoError(t, err)
+	assert.Equal(t, []*DataPoint{{Timestamp: 10, Value: 2}}, got)
+	assert.ErrorIs(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 10, Value: 3}}}), ErrOutOfOrder)
+}
+
+func Test_storage_flushPartitions_withMinFlushPoints(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tstorage-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	opts := []Option{WithDataPath(tmpDir), WithTimestampPrecision(Seconds), WithPartitionDuration(time.Hour), WithMinFlushPoints(5)}
+	s, err := NewStorage(opts...)
+	require.NoError(t, err)
+	// A partition takes rows until its range exceeds the duration, so that each has two data points.
+	timestamps := []int64{1, 5000, 10000, 15000, 20000, 25000, 30000}
+	for _, ts := range timestamps {
+		require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: ts}}}))
+	}
+	ss := s.(*storage)
+	ss.flushWg.Wait()
+	require.NoError(t, ss.flushPartitions(false))
+
+	// Small partitions are deferred by getting merged into the newer ones.
+	parts := s.ListPartitions()
+	require.Len(t, parts, 2)
+	assert.Equal(t, PartitionInfo{MinTimestamp: 1, MaxTimestamp: 25000, NumDataPoints: 6}, PartitionInfo{
+		MinTimestamp:  parts[1].MinTimestamp,
+		MaxTimestamp:  parts[1].MaxTimestamp,
+		NumDataPoints: parts[1].NumDataPoints,
+	})
+	for _, p := range parts {
+		assert.Empty(t, p.DirPath)
+	}
+	got, err := s.Select("metric1", nil, 0, 30001)
+	require.NoError(t, err)
+	assert.Len(t, got, len(timestamps))
+
+	// Close persists them regardless of the size, and the WAL no longer has them.
+	require.NoError(t, s.Close())
+	dirs, err := filepath.Glob(filepath.Join(tmpDir, "p-*"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join(tmpDir, "p-1-25000"), filepath.Join(tmpDir, "p-30000-30000")}, dirs)
+
+	s, err = NewStorage(opts...)
+	require.NoError(t, err)
+	defer s.Close()
+	got, err = s.Select("metric1", nil, 0, 30001)
+	require.NoError(t, err)
+	gotTimestamps := make([]int64, 0, len(got))
+	for _, p := range got {
+		gotTimestamps = append(gotTimestamps, p.Timestamp)
+	}
+	assert.Equal(t, timestamps, gotTimestamps)
+}
+
+func Test_storage_negativeTimestamps(t *testing.T) {
+	tmpDir := t.TempDir()
+	opts := []Option{WithDataPath(tmpDir), WithTimestampPrecision(Seconds), WithPartitionDuration(time.Hour)}
+	s, err := NewStorage(opts...)
+	require.NoError(t, err)
+	// They span several partitions, including one straddling zero.
+	timestamps := []int64{-10000, -5000, -1, 1, 5000}
+	for _, ts := range timestamps {
+		require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: ts, Value: float64(ts)}}}))
+	}
+	selectAll := func(s Storage) {
+		points, err := s.Select("metric1", nil, -20000, 20000)
+		require.NoError(t, err)
+		got := make([]int64, 0, len(points))
+		for _, p := range points {
+			got = append(got, p.Timestamp)
+		}
+		assert.Equal(t, timestamps, got)
+
+		points, err = s.Select("metric1", nil, -1, 2)
+		require.NoError(t, err)
+		assert.Equal(t, []*DataPoint{{Timestamp: -1, Value: -1}, {Timestamp: 1, Value: 1}}, points)
+
+		oldest, ok := s.OldestTimestamp()
+		require.True(t, ok)
+		assert.Equal(t, int64(-10000), oldest)
+	}
+	selectAll(s)
+
+	// The same goes for the disk partitions.
+	require.NoError(t, s.Close())
+	s, err = NewStorage(opts...)
+	require.NoError(t, err)
+	defer s.Close()
+	selectAll(s)
+}
+
+func Test_storage_withIDGenerator(t *testing.T) {
+	tmpDir := t.TempDir()
+	var n int
+	s, err := NewStorage(
+		WithDataPath(tmpDir),
+		WithTimestampPrecision(Seconds),
+		WithPartitionDuration(time.Hour),
+		WithIDGenerator(func() string {
+			n++
+			return fmt.Sprintf("id%d", n)
+		}),
+	)
+	require.NoError(t, err)
+	for _, ts := range []int64{1, 5000, 10000} {
+		require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: ts, Value: 0.1}}}))
+	}
+	require.NoError(t, s.Close())
+
+	dirs, err := filepath.Glob(filepath.Join(tmpDir, "p-*"))
+	require.NoError(t, err)
+	var names []string
+	for _, dir := range dirs {
+		names = append(names, filepath.Base(dir))
+	}
+	// Partitions are flushed from the newest one.
+	assert.ElementsMatch(t, []string{"p-10000-10000-id1", "p-1-5000-id2"}, names)
+
+	s, err = NewStorage(WithDataPath(tmpDir), WithTimestampPrecision(Seconds), WithPartitionDuration(time.Hour))
+	require.NoError(t, err)
+	defer s.Close()
+	points, err := s.Select("metric1", nil, 1, 10001)
+	require.NoError(t, err)
+	assert.Len(t, points, 3)
+}
+
+func Test_storage_withInvalidID(t *testing.T) {
+	s, err := NewStorage(WithDataPath(t.TempDir()), WithIDGenerator(func() string { return "../id" }))
+	require.NoError(t, err)
+	require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1, Value: 0.1}}}))
+	assert.Error(t, s.Close())
+}
+
+// syncCountingFileSystem counts how many times files it opens get synced.
+type syncCountingFileSystem struct {
+	FileSystem
+	syncs int32
+}
+
+type syncCountingFile struct {
+	*os.File
+	syncs *int32
+}
+
+func (s *syncCountingFile) Sync() error {
+	atomic.AddInt32(s.syncs, 1)
+	return s.File.Sync()
+}
+
+func (s *syncCountingFileSystem) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	f, err := s.FileSystem.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &syncCountingFile{File: f.(*os.File), syncs: &s.syncs}, nil
+}
+
+func Test_storage_InsertRowsSync(t *testing.T) {
+	dataPath := t.TempDir()
+	fsys := &syncCountingFileSystem{FileSystem: defaultFileSystem}
+	// Big enough to keep rows buffered unless synced.
+	s, err := NewStorage(WithDataPath(dataPath), WithFileSystem(fsys), WithWALBufferedSize(1<<20), WithWriteBuffer(100, 0))
+	require.NoError(t, err)
+	defer s.Close()
+
+	require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1, Value: 0.1}}}))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&fsys.syncs))
+
+	require.NoError(t, s.InsertRowsSync([]Row{
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 2, Value: 0.2}},
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 3, Value: 0.3}},
+	}))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&fsys.syncs))
+
+	// Found in the WAL without closing, while the row given to InsertRows is still in the write buffer.
+	reader, err := newDiskWALReader(defaultFileSystem, WALDir(dataPath))
+	require.NoError(t, err)
+	require.NoError(t, reader.readAll())
+	assert.Equal(t, []Row{
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 2, Value: 0.2}},
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 3, Value: 0.3}},
+	}, reader.rowsToInsert)
+}
+
+func Test_storage_InsertRowsSync_withoutWAL(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+	}{
+		{name: "in-memory mode"},
+		{name: "WAL disabled", opts: []Option{WithDataPath(t.TempDir()), WithWALBufferedSize(-1)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewStorage(tt.opts...)
+			require.NoError(t, err)
+			defer s.Close()
+			err = s.InsertRowsSync([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1, Value: 0.1}}})
+			assert.ErrorIs(t, err, ErrWALDisabled)
+		})
+	}
+}
@@ -0,0 +1,255 @@
+// Package testutil provides helpers to test code using tstorage.
+package testutil
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nakabonne/tstorage"
+)
+
+// MemFileSystem is an in-memory tstorage.FileSystem, which lets a Storage persist data without touching the disk.
+// Give it to tstorage.WithFileSystem. It is goroutine safe.
+type MemFileSystem struct {
+	mu sync.RWMutex
+	// nodes by cleaned slash-separated paths. The root directories are implicit.
+	nodes map[string]*memNode
+}
+
+type memNode struct {
+	name    string
+	dir     bool
+	mode    fs.FileMode
+	data    []byte
+	modTime time.Time
+}
+
+// NewMemFileSystem gives back an empty in-memory file system.
+func NewMemFileSystem() *MemFileSystem {
+	return &MemFileSystem{nodes: make(map[string]*memNode)}
+}
+
+func cleanPath(name string) string {
+	return path.Clean(filepath.ToSlash(name))
+}
+
+// isRoot reports whether the given cleaned path is the root, which always exists.
+func isRoot(name string) bool {
+	return name == "." || name == "/"
+}
+
+// dirExists must be called with mu held.
+func (m *MemFileSystem) dirExists(name string) bool {
+	if isRoot(name) {
+		return true
+	}
+	n, ok := m.nodes[name]
+	return ok && n.dir
+}
+
+func (m *MemFileSystem) OpenFile(name string, flag int, perm fs.FileMode) (tstorage.File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = cleanPath(name)
+	n, ok := m.nodes[name]
+	switch {
+	case ok && n.dir:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	case ok && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	case !ok:
+		if !m.dirExists(path.Dir(name)) {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		}
+		n = &memNode{name: path.Base(name), mode: perm, modTime: time.Now()}
+		m.nodes[name] = n
+	}
+	if flag&os.O_TRUNC != 0 {
+		n.data = nil
+		n.modTime = time.Now()
+	}
+	return &memFile{
+		fs:       m,
+		node:     n,
+		readable: flag&(os.O_WRONLY|os.O_RDWR) != os.O_WRONLY,
+		writable: flag&(os.O_WRONLY|os.O_RDWR) != 0,
+		append:   flag&os.O_APPEND != 0,
+	}, nil
+}
+
+func (m *MemFileSystem) ReadDir(name string) ([]fs.DirEntry, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	name = cleanPath(name)
+	if !m.dirExists(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	entries := make([]fs.DirEntry, 0)
+	for p, n := range m.nodes {
+		if p != name && path.Dir(p) == name {
+			entries = append(entries, fs.FileInfoToDirEntry(n.info()))
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries, nil
+}
+
+func (m *MemFileSystem) Stat(name string) (fs.FileInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	name = cleanPath(name)
+	if isRoot(name) {
+		return (&memNode{name: name, dir: true, mode: fs.ModeDir | 0755}).info(), nil
+	}
+	n, ok := m.nodes[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return n.info(), nil
+}
+
+func (m *MemFileSystem) MkdirAll(name string, perm fs.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = cleanPath(name)
+	for p := name; !isRoot(p); p = path.Dir(p) {
+		n, ok := m.nodes[p]
+		if ok && !n.dir {
+			return &fs.PathError{Op: "mkdir", Path: p, Err: fs.ErrExist}
+		}
+		if !ok {
+			m.nodes[p] = &memNode{name: path.Base(p), dir: true, mode: fs.ModeDir | perm, modTime: time.Now()}
+		}
+	}
+	return nil
+}
+
+func (m *MemFileSystem) Chmod(name string, mode fs.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, ok := m.nodes[cleanPath(name)]
+	if !ok {
+		return &fs.PathError{Op: "chmod", Path: name, Err: fs.ErrNotExist}
+	}
+	n.mode = n.mode&fs.ModeType | mode.Perm()
+	return nil
+}
+
+func (m *MemFileSystem) RemoveAll(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = cleanPath(name)
+	prefix := name + "/"
+	if isRoot(name) {
+		prefix = ""
+	}
+	delete(m.nodes, name)
+	for p := range m.nodes {
+		if strings.HasPrefix(p, prefix) {
+			delete(m.nodes, p)
+		}
+	}
+	return nil
+}
+
+func (n *memNode) info() fs.FileInfo {
+	return &memFileInfo{
+		name:    n.name,
+		size:    int64(len(n.data)),
+		mode:    n.mode,
+		modTime: n.modTime,
+	}
+}
+
+// memFile is a file opened by MemFileSystem.
+type memFile struct {
+	fs       *MemFileSystem
+	node     *memNode
+	offset   int64
+	readable bool
+	writable bool
+	append   bool
+	closed   bool
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	f.fs.mu.RLock()
+	defer f.fs.mu.RUnlock()
+	if f.closed || !f.readable {
+		return 0, fs.ErrClosed
+	}
+	if f.offset >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[f.offset:])
+	f.offset += int64(n)
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.closed || !f.writable {
+		return 0, fs.ErrClosed
+	}
+	if f.append {
+		f.offset = int64(len(f.node.data))
+	}
+	if end := f.offset + int64(len(p)); end > int64(len(f.node.data)) {
+		data := make([]byte, end)
+		copy(data, f.node.data)
+		f.node.data = data
+	}
+	copy(f.node.data[f.offset:], p)
+	f.offset += int64(len(p))
+	f.node.modTime = time.Now()
+	return len(p), nil
+}
+
+func (f *memFile) Close() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.closed {
+		return fs.ErrClosed
+	}
+	f.closed = true
+	return nil
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) {
+	f.fs.mu.RLock()
+	defer f.fs.mu.RUnlock()
+	return f.node.info(), nil
+}
+
+func (f *memFile) Chmod(mode fs.FileMode) error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	f.node.mode = f.node.mode&fs.ModeType | mode.Perm()
+	return nil
+}
+
+type memFileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (i *memFileInfo) Name() string       { return i.name }
+func (i *memFileInfo) Size() int64        { return i.size }
+func (i *memFileInfo) Mode() fs.FileMode  { return i.mode }
+func (i *memFileInfo) ModTime() time.Time { return i.modTime }
+func (i *memFileInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i *memFileInfo) Sys() interface{}   { return nil }
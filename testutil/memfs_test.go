@@ -0,0 +1,43 @@
+package testutil
+
+import (
+	"os"
+	"testing"
+
+	"github.com/nakabonne/tstorage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemFileSystem(t *testing.T) {
+	mem := NewMemFileSystem()
+	dataPath := "/tstorage-memfs-test"
+	opts := []tstorage.Option{
+		tstorage.WithDataPath(dataPath),
+		tstorage.WithFileSystem(mem),
+		tstorage.WithTimestampPrecision(tstorage.Seconds),
+	}
+	s, err := tstorage.NewStorage(opts...)
+	require.NoError(t, err)
+	require.NoError(t, s.InsertRows([]tstorage.Row{
+		{Metric: "metric1", DataPoint: tstorage.DataPoint{Timestamp: 1, Value: 0.1}},
+		{Metric: "metric1", DataPoint: tstorage.DataPoint{Timestamp: 2, Value: 0.2}},
+	}))
+	require.NoError(t, s.Close())
+
+	entries, err := mem.ReadDir(dataPath)
+	require.NoError(t, err)
+	assert.NotEmpty(t, entries)
+	_, err = os.Stat(dataPath)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	s, err = tstorage.NewStorage(opts...)
+	require.NoError(t, err)
+	defer s.Close()
+	points, err := s.Select("metric1", nil, 1, 3)
+	require.NoError(t, err)
+	assert.Equal(t, []*tstorage.DataPoint{
+		{Timestamp: 1, Value: 0.1},
+		{Timestamp: 2, Value: 0.2},
+	}, points)
+}
@@ -0,0 +1,146 @@
+package tstorage
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// The number of metrics given back by Stats().TopMetricsByIngest.
+	topMetricsNum = 10
+	// The number of metrics whose insert rates are tracked. Beyond it, the least inserted one gets replaced.
+	ingestTrackedMetrics = 100
+	// One of every this many rows inserted is counted, weighted by it.
+	ingestSampleRate = 8
+	// The time constant the insert rates decay in.
+	ingestRateWindow = time.Minute
+)
+
+// MetricIngestRate is the estimated insert rate of a metric.
+type MetricIngestRate struct {
+	Metric string
+	// The number of data points inserted per second, averaged over about the last minute.
+	PointsPerSecond float64
+}
+
+// ingestTracker estimates the insert rates of the most inserted metrics.
+// Rows are sampled and counted with exponential decay so that the hot path stays cheap,
+// and the tracked metrics are bounded in the manner of Space-Saving, so that high cardinality doesn't blow up memory.
+type ingestTracker struct {
+	// The number of rows offered so far, which must be accessed atomically.
+	seen uint64
+
+	mu       sync.Mutex
+	counters map[string]*ingestCounter
+}
+
+type ingestCounter struct {
+	// The decayed number of data points as of updatedAt.
+	points    float64
+	updatedAt time.Time
+}
+
+func newIngestTracker() *ingestTracker {
+	return &ingestTracker{counters: make(map[string]*ingestCounter, ingestTrackedMetrics)}
+}
+
+func (c *ingestCounter) decayed(now time.Time) float64 {
+	elapsed := now.Sub(c.updatedAt)
+	if elapsed <= 0 {
+		return c.points
+	}
+	return c.points * math.Exp(-elapsed.Seconds()/ingestRateWindow.Seconds())
+}
+
+// record counts the sampled ones among the given rows.
+func (t *ingestTracker) record(rows []Row, now func() time.Time) {
+	if t == nil || len(rows) == 0 {
+		return
+	}
+	end := atomic.AddUint64(&t.seen, uint64(len(rows)))
+	start := end - uint64(len(rows))
+	// The index of the first row at a multiple of the sample rate, counting rows across calls.
+	first := int((ingestSampleRate - start%ingestSampleRate) % ingestSampleRate)
+	if first >= len(rows) {
+		return
+	}
+	ts := now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := first; i < len(rows); i += ingestSampleRate {
+		t.add(rows[i].Metric, ingestSampleRate, ts)
+	}
+}
+
+// acceptedRows gives back the given rows except as many rows of each metric as the dropped ones, which is enough
+// to record ingest rates since it doesn't matter which rows of a metric are dropped.
+func acceptedRows(rows, dropped []Row) []Row {
+	if len(dropped) == 0 {
+		return rows
+	}
+	droppedNum := make(map[string]int, len(dropped))
+	for i := range dropped {
+		droppedNum[dropped[i].Metric]++
+	}
+	accepted := make([]Row, 0, len(rows)-len(dropped))
+	for i := range rows {
+		if droppedNum[rows[i].Metric] > 0 {
+			droppedNum[rows[i].Metric]--
+			continue
+		}
+		accepted = append(accepted, rows[i])
+	}
+	return accepted
+}
+
+// add must be called with mu held.
+func (t *ingestTracker) add(metric string, n float64, now time.Time) {
+	c, ok := t.counters[metric]
+	if !ok {
+		var floor float64
+		if len(t.counters) >= ingestTrackedMetrics {
+			// Replace the least inserted one, inheriting its count as the upper bound of what may have been missed.
+			var minMetric string
+			floor = math.MaxFloat64
+			for m, c := range t.counters {
+				if p := c.decayed(now); p < floor {
+					minMetric, floor = m, p
+				}
+			}
+			delete(t.counters, minMetric)
+		}
+		// The name may reference the caller's buffer. See WithZeroCopyStrings
+		c = &ingestCounter{points: floor, updatedAt: now}
+		t.counters[strings.Clone(metric)] = c
+	}
+	c.points = c.decayed(now) + n
+	c.updatedAt = now
+}
+
+// top gives back the metrics with the highest insert rates, in descending order.
+func (t *ingestTracker) top(n int, now func() time.Time) []MetricIngestRate {
+	if t == nil {
+		return nil
+	}
+	ts := now()
+	t.mu.Lock()
+	rates := make([]MetricIngestRate, 0, len(t.counters))
+	for m, c := range t.counters {
+		rates = append(rates, MetricIngestRate{Metric: m, PointsPerSecond: c.decayed(ts) / ingestRateWindow.Seconds()})
+	}
+	t.mu.Unlock()
+	sort.Slice(rates, func(i, j int) bool {
+		if rates[i].PointsPerSecond != rates[j].PointsPerSecond {
+			return rates[i].PointsPerSecond > rates[j].PointsPerSecond
+		}
+		return rates[i].Metric < rates[j].Metric
+	})
+	if len(rates) > n {
+		rates = rates[:n]
+	}
+	return rates
+}
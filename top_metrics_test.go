@@ -0,0 +1,128 @@
+package tstorage
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_storage_Stats_topMetricsByIngest(t *testing.T) {
+	s, err := NewStorage(WithTimestampPrecision(Seconds))
+	require.NoError(t, err)
+	defer s.Close()
+
+	for i := 0; i < 1000; i++ {
+		rows := []Row{{Metric: "hot", DataPoint: DataPoint{Timestamp: int64(i + 1)}}}
+		if i%100 == 0 {
+			rows = append(rows, Row{Metric: "cold", DataPoint: DataPoint{Timestamp: int64(i + 1)}})
+		}
+		require.NoError(t, s.InsertRows(rows))
+	}
+
+	top := s.Stats().TopMetricsByIngest
+	require.NotEmpty(t, top)
+	assert.Equal(t, "hot", top[0].Metric)
+	assert.Greater(t, top[0].PointsPerSecond, 0.0)
+	for _, r := range top[1:] {
+		assert.Less(t, r.PointsPerSecond, top[0].PointsPerSecond)
+	}
+}
+
+func Test_storage_Stats_topMetricsByIngest_acceptedOnly(t *testing.T) {
+	dataPath := t.TempDir()
+	// Leave WAL as if the process had crashed.
+	wal, err := newDiskWAL(defaultFileSystem, WALDir(dataPath), 0, defaultDirPerm, defaultFilePerm, WALCompressionNone)
+	require.NoError(t, err)
+	replayed := make([]Row, 0, 100)
+	for i := int64(1); i <= 100; i++ {
+		replayed = append(replayed, Row{Metric: "replayed", DataPoint: DataPoint{Timestamp: i}})
+	}
+	require.NoError(t, wal.append(operationInsert, replayed))
+	require.NoError(t, wal.flush())
+
+	s, err := NewStorage(WithDataPath(dataPath), WithTimestampPrecision(Seconds), WithPartitionDuration(time.Hour),
+		WithRetention(100*365*24*time.Hour))
+	require.NoError(t, err)
+	defer s.Close()
+	ss := s.(*storage)
+	// Make rows older than all writable partitions dropped.
+	for _, ts := range []int64{5000, 10000} {
+		require.NoError(t, ss.newPartition(nil, true))
+		require.NoError(t, s.InsertRows([]Row{{Metric: "accepted", DataPoint: DataPoint{Timestamp: ts}}}))
+	}
+	for i := 0; i < 100; i++ {
+		require.NoError(t, s.InsertRows([]Row{
+			{Metric: "dropped", DataPoint: DataPoint{Timestamp: 1}},
+			{Metric: "accepted", DataPoint: DataPoint{Timestamp: int64(10001 + i)}},
+		}))
+	}
+
+	top := s.Stats().TopMetricsByIngest
+	require.Len(t, top, 1)
+	assert.Equal(t, "accepted", top[0].Metric)
+}
+
+func Test_acceptedRows(t *testing.T) {
+	tests := []struct {
+		name    string
+		rows    []Row
+		dropped []Row
+		want    []Row
+	}{
+		{
+			name: "nothing dropped",
+			rows: []Row{{Metric: "metric1"}, {Metric: "metric2"}},
+			want: []Row{{Metric: "metric1"}, {Metric: "metric2"}},
+		},
+		{
+			name:    "some of a metric dropped",
+			rows:    []Row{{Metric: "metric1"}, {Metric: "metric2"}, {Metric: "metric1"}},
+			dropped: []Row{{Metric: "metric1"}},
+			want:    []Row{{Metric: "metric2"}, {Metric: "metric1"}},
+		},
+		{
+			name:    "all dropped",
+			rows:    []Row{{Metric: "metric1"}, {Metric: "metric2"}},
+			dropped: []Row{{Metric: "metric2"}, {Metric: "metric1"}},
+			want:    []Row{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, acceptedRows(tt.rows, tt.dropped))
+		})
+	}
+}
+
+func Test_ingestTracker_bounded(t *testing.T) {
+	tracker := newIngestTracker()
+	now := time.Unix(0, 0)
+	clock := func() time.Time { return now }
+	for i := 0; i < 10*ingestTrackedMetrics; i++ {
+		rows := make([]Row, ingestSampleRate)
+		for j := range rows {
+			rows[j].Metric = fmt.Sprintf("metric%d", i)
+		}
+		tracker.record(rows, clock)
+	}
+	for i := 0; i < 100; i++ {
+		rows := make([]Row, ingestSampleRate)
+		for j := range rows {
+			rows[j].Metric = "hot"
+		}
+		tracker.record(rows, clock)
+	}
+	assert.Len(t, tracker.counters, ingestTrackedMetrics)
+
+	top := tracker.top(topMetricsNum, clock)
+	require.Len(t, top, topMetricsNum)
+	assert.Equal(t, "hot", top[0].Metric)
+
+	// Rates decay over time.
+	now = now.Add(10 * ingestRateWindow)
+	decayed := tracker.top(1, clock)
+	assert.Less(t, decayed[0].PointsPerSecond, top[0].PointsPerSecond/1000)
+}
@@ -15,16 +15,28 @@ const (
 	   +--------+---------------------+--------+--------------------+----------------+
 	*/
 	operationInsert walOperation = iota
+	// The record format for operationCompressed is as shown below, where the compressed records are
+	// the records for operationInsert compressed all together with DEFLATE:
+	/*
+	   +--------+-------------------------+--------------------+
+	   | op(1b) | len compressed(varints) | compressed records |
+	   +--------+-------------------------+--------------------+
+	*/
+	operationCompressed
 )
 
 // wal represents a write-ahead log, which offers durability guarantees.
 type wal interface {
 	append(op walOperation, rows []Row) error
 	flush() error
+	// sync flushes buffered entries, and then commits them to stable storage.
+	sync() error
 	punctuate() error
 	removeOldest() error
 	removeAll() error
 	refresh() error
+	// discardActive throws away the records in the active segment, and starts a new one in place of it.
+	discardActive() error
 }
 
 type nopWAL struct {
@@ -41,6 +53,10 @@ func (f *nopWAL) flush() error {
 	return nil
 }
 
+func (f *nopWAL) sync() error {
+	return nil
+}
+
 func (f *nopWAL) punctuate() error {
 	return nil
 }
@@ -56,3 +72,7 @@ func (f *nopWAL) removeAll() error {
 func (f *nopWAL) refresh() error {
 	return nil
 }
+
+func (f *nopWAL) discardActive() error {
+	return nil
+}
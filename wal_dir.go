@@ -0,0 +1,48 @@
+package tstorage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// WALDir gives back the directory where the storage opened with the given data path keeps its WAL.
+// The WAL always lives in the "wal" directory right under the data path, next to the partition directories
+// prefixed with "p-", so that its lifecycle is tied to the data path:
+//
+//	./data
+//	├── manifest.json
+//	├── p-1600000001-1600003600
+//	│   ├── data
+//	│   └── meta.json
+//	└── wal
+//	    ├── 0
+//	    └── 1
+//
+// Backups taken while the storage is open may include it to cover data points not yet flushed to partitions,
+// or exclude it to hold only the persisted partitions, which are immutable.
+func WALDir(dataPath string) string {
+	return filepath.Join(dataPath, walDirName)
+}
+
+// WALSegments gives back the paths to the WAL segment files under the given data path, in the order they are written.
+// It gives back an empty slice if there is no WAL.
+func WALSegments(dataPath string) ([]string, error) {
+	walDir := WALDir(dataPath)
+	files, err := os.ReadDir(walDir)
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the WAL dir: %w", err)
+	}
+	sortSegments(files)
+	segments := make([]string, 0, len(files))
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		segments = append(segments, filepath.Join(walDir, file.Name()))
+	}
+	return segments, nil
+}
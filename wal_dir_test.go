@@ -0,0 +1,26 @@
+package tstorage
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWALSegments(t *testing.T) {
+	tmpDir := t.TempDir()
+	segments, err := WALSegments(tmpDir)
+	require.NoError(t, err)
+	assert.Empty(t, segments)
+
+	s, err := NewStorage(WithDataPath(tmpDir), WithWALBufferedSize(0))
+	require.NoError(t, err)
+	defer s.Close()
+	require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000000, Value: 0.1}}}))
+
+	assert.Equal(t, filepath.Join(tmpDir, "wal"), WALDir(tmpDir))
+	segments, err = WALSegments(tmpDir)
+	require.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join(tmpDir, "wal", "0")}, segments)
+}
@@ -0,0 +1,83 @@
+package tstorage
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// DumpWAL writes all records in the WAL under the given data directory to w in a human-readable form,
+// without replaying them into a storage. It is read-only and meant for debugging recovery.
+//
+// Each record is printed as a line like:
+//
+//	<segment>: <metric>{<label name>="<label value>", ...} <timestamp> <value>
+//
+// A segment ending with a broken record, typically truncated by a crash while writing,
+// doesn't make it fail; instead the reason is printed and dumping moves on to the next segment.
+func DumpWAL(dataPath string, w io.Writer) error {
+	segments, err := WALSegments(dataPath)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	for _, path := range segments {
+		if err := dumpSegment(path, bw); err != nil {
+			return err
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("failed to write dump: %w", err)
+	}
+	return nil
+}
+
+func dumpSegment(path string, w io.Writer) error {
+	fd, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open WAL segment file: %w", err)
+	}
+	segment := &segment{
+		file: fd,
+		r:    bufio.NewReader(fd),
+	}
+	defer segment.close()
+
+	name := filepath.Base(path)
+	var n int
+	for segment.next() {
+		rec := segment.record()
+		if _, err := fmt.Fprintf(w, "%s: %s %d %v\n", name, formatMetricName(rec.row.Metric), rec.row.Timestamp, rec.row.Value); err != nil {
+			return fmt.Errorf("failed to write dump: %w", err)
+		}
+		n++
+	}
+	if err := segment.error(); err != nil {
+		kind := "broken"
+		if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+			kind = "truncated"
+		}
+		if _, err := fmt.Fprintf(w, "%s: %s record after %d records: %v\n", name, kind, n, err); err != nil {
+			return fmt.Errorf("failed to write dump: %w", err)
+		}
+	}
+	return nil
+}
+
+// formatMetricName formats the name built by marshalMetricName in the Prometheus text format.
+func formatMetricName(name string) string {
+	metric, labels, ok := unmarshalMetricName(name)
+	if !ok || len(labels) == 0 {
+		return metric
+	}
+	pairs := make([]string, 0, len(labels))
+	for _, l := range labels {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", l.Name, strconv.Quote(l.Value)))
+	}
+	return metric + "{" + strings.Join(pairs, ", ") + "}"
+}
@@ -0,0 +1,46 @@
+package tstorage
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDumpWAL(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tstorage-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	wal, err := newDiskWAL(defaultFileSystem, filepath.Join(tmpDir, walDirName), 0, defaultDirPerm, defaultFilePerm, WALCompressionNone)
+	require.NoError(t, err)
+	err = wal.append(operationInsert, []Row{
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000000, Value: 0.1}},
+		{Metric: "metric1", Labels: []Label{{Name: "host", Value: "host-1"}}, DataPoint: DataPoint{Timestamp: 1600000001, Value: 0.2}},
+	})
+	require.NoError(t, err)
+	require.NoError(t, wal.punctuate())
+	err = wal.append(operationInsert, []Row{
+		{Metric: "metric2", DataPoint: DataPoint{Timestamp: 1600000002, Value: 0.3}},
+		{Metric: "metric2", DataPoint: DataPoint{Timestamp: 1600000003, Value: 0.4}},
+	})
+	require.NoError(t, err)
+
+	// Truncate the tail of the last segment in the middle of the last record.
+	lastSegment := filepath.Join(tmpDir, walDirName, "1")
+	info, err := os.Stat(lastSegment)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(lastSegment, info.Size()-3))
+
+	var buf bytes.Buffer
+	require.NoError(t, DumpWAL(tmpDir, &buf))
+	want := `0: metric1 1600000000 0.1
+0: metric1{host="host-1"} 1600000001 0.2
+1: metric2 1600000002 0.3
+1: truncated record after 1 records: failed to read value: unexpected EOF
+`
+	assert.Equal(t, want, buf.String())
+}
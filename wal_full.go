@@ -0,0 +1,64 @@
+package tstorage
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"syscall"
+)
+
+// diskFullWAL wraps a wal to handle disk-full errors according to the policy.
+type diskFullWAL struct {
+	wal
+	policy WALFullPolicy
+	// forceFlush is called to free disk space under WALFullForceFlush.
+	forceFlush func() error
+	stats      *storageStats
+}
+
+func (s *storage) newDiskFullWAL(w wal) wal {
+	return &diskFullWAL{
+		wal:        w,
+		policy:     s.walFullPolicy,
+		forceFlush: func() error { return s.flushPartitions(true) },
+		stats:      s.stats,
+	}
+}
+
+func (w *diskFullWAL) append(op walOperation, rows []Row) error {
+	err := w.wal.append(op, rows)
+	if !errors.Is(err, syscall.ENOSPC) {
+		if err == nil {
+			atomic.StoreInt32(&w.stats.walDiskFull, 0)
+		}
+		return err
+	}
+	atomic.StoreInt32(&w.stats.walDiskFull, 1)
+
+	switch w.policy {
+	case WALFullDropAndContinue:
+		atomic.AddInt64(&w.stats.walRowsDropped, int64(len(rows)))
+		return nil
+	case WALFullForceFlush:
+		if ferr := w.forceFlush(); ferr != nil {
+			return fmt.Errorf("%w: failed to flush partitions: %v", ErrWALFull, ferr)
+		}
+		err = w.wal.append(op, rows)
+		if err == nil {
+			atomic.StoreInt32(&w.stats.walDiskFull, 0)
+			return nil
+		}
+		if !errors.Is(err, syscall.ENOSPC) {
+			return err
+		}
+	}
+	return fmt.Errorf("%w: %v", ErrWALFull, err)
+}
+
+// sync reports ErrWALFull while the disk is full, since rows may have been dropped under WALFullDropAndContinue.
+func (w *diskFullWAL) sync() error {
+	if atomic.LoadInt32(&w.stats.walDiskFull) == 1 {
+		return ErrWALFull
+	}
+	return w.wal.sync()
+}
@@ -0,0 +1,85 @@
+package tstorage
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+)
+
+func (s *storage) Warm(metrics []string, start, end int64) error {
+	if start >= end {
+		return fmt.Errorf("the given start is greater than end")
+	}
+	names := make(map[string]struct{}, len(metrics))
+	for _, metric := range metrics {
+		names[s.normalizeMetricName(metric)] = struct{}{}
+	}
+	parts, release, err := s.pinnedPartitions(start, end)
+	if err != nil {
+		return err
+	}
+	defer release()
+	for _, p := range parts {
+		d, ok := p.(*diskPartition)
+		if !ok || d.expired() {
+			continue
+		}
+		if err := d.warm(names, start, end); err != nil {
+			return fmt.Errorf("failed to warm partition %s: %w", d.dirPath, err)
+		}
+	}
+	return nil
+}
+
+// warm loads the data file if any series of the given metric names lies within the given range,
+// and then reads the blocks of them overlapping the range in advance if the data file is memory-mapped.
+func (d *diskPartition) warm(names map[string]struct{}, start, end int64) error {
+	var blocks []diskBlock
+	for name, mt := range d.meta.Metrics {
+		metric, _, _ := unmarshalMetricName(name)
+		if _, ok := names[metric]; !ok {
+			continue
+		}
+		blocks = append(blocks, overlappingBlocks(mt.blocks(), start, end)...)
+	}
+	if len(blocks) == 0 {
+		return nil
+	}
+	d.ensureLoaded()
+	data, release, err := d.acquire()
+	if err != nil {
+		return err
+	}
+	defer release()
+	if !d.mmapped {
+		// Already read into the heap entirely.
+		return nil
+	}
+	// Read a byte per page so that the pages get read into the page cache.
+	pageSize := os.Getpagesize()
+	for _, b := range blocks {
+		size, err := d.blockSize(data, b.Offset)
+		if err != nil {
+			return err
+		}
+		pages, sum := touchPages(data[b.Offset:b.Offset+size], pageSize)
+		// Keep the sum so that the compiler can't drop the reads.
+		atomic.AddUint32(&warmSink, uint32(sum))
+		if d.stats != nil {
+			atomic.AddInt64(&d.stats.pagesWarmed, int64(pages))
+		}
+	}
+	return nil
+}
+
+// warmSink receives the bytes read by warm.
+var warmSink uint32
+
+// touchPages reads a byte per page of the given data, and gives back the number of the pages and the sum of the bytes.
+func touchPages(data []byte, pageSize int) (pages int, sum byte) {
+	for off := 0; off < len(data); off += pageSize {
+		sum += data[off]
+		pages++
+	}
+	return pages, sum
+}
@@ -0,0 +1,84 @@
+package tstorage
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_storage_Warm(t *testing.T) {
+	tmpDir := t.TempDir()
+	s, err := NewStorage(
+		WithDataPath(tmpDir),
+		WithTimestampPrecision(Seconds),
+		WithPartitionDuration(time.Hour),
+	)
+	require.NoError(t, err)
+	for _, ts := range []int64{1, 5000, 10000, 15000, 20000, 25000, 30000} {
+		require.NoError(t, s.InsertRows([]Row{
+			{Metric: "metric1", DataPoint: DataPoint{Timestamp: ts, Value: 0.1}},
+			{Metric: "metric2", Labels: []Label{{Name: "host", Value: "a"}}, DataPoint: DataPoint{Timestamp: ts, Value: 0.2}},
+		}))
+	}
+	require.NoError(t, s.Close())
+
+	s, err = NewStorage(
+		WithDataPath(tmpDir),
+		WithTimestampPrecision(Seconds),
+		WithPartitionDuration(time.Hour),
+		WithRetention(100*365*24*time.Hour),
+	)
+	require.NoError(t, err)
+	defer s.Close()
+	// Labeled series are warmed by the metric name.
+	require.NoError(t, s.Warm([]string{"metric2"}, 1, 5001))
+	assert.Equal(t, int64(0), s.Stats().PartitionCacheHits)
+	assert.Equal(t, int64(0), s.Stats().PartitionCacheMisses)
+	// The pages of the blocks have been read.
+	stats := s.(*storage).stats
+	warmed := atomic.LoadInt64(&stats.pagesWarmed)
+	assert.Greater(t, warmed, int64(0))
+
+	// The data file of the warmed partition has been loaded, regardless of the metric.
+	_, err = s.Select("metric1", nil, 1, 5001)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), s.Stats().PartitionCacheHits)
+	assert.Equal(t, int64(0), s.Stats().PartitionCacheMisses)
+
+	_, err = s.Select("metric1", nil, 10000, 15001)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), s.Stats().PartitionCacheHits)
+	assert.Equal(t, int64(1), s.Stats().PartitionCacheMisses)
+
+	// Warming metrics not in the range loads nothing.
+	require.NoError(t, s.Warm([]string{"unknown"}, 20000, 25001))
+	assert.Equal(t, warmed, atomic.LoadInt64(&stats.pagesWarmed))
+	_, err = s.Select("metric1", nil, 20000, 25001)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), s.Stats().PartitionCacheHits)
+	assert.Equal(t, int64(2), s.Stats().PartitionCacheMisses)
+}
+
+func Test_touchPages(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      []byte
+		pageSize  int
+		wantPages int
+		wantSum   byte
+	}{
+		{name: "empty", data: nil, pageSize: 4, wantPages: 0, wantSum: 0},
+		{name: "within a page", data: []byte{1, 2, 3}, pageSize: 4, wantPages: 1, wantSum: 1},
+		{name: "across pages", data: []byte{1, 2, 3, 4, 5, 6, 7, 8, 9}, pageSize: 4, wantPages: 3, wantSum: 1 + 5 + 9},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pages, sum := touchPages(tt.data, tt.pageSize)
+			assert.Equal(t, tt.wantPages, pages)
+			assert.Equal(t, tt.wantSum, sum)
+		})
+	}
+}
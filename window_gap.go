@@ -0,0 +1,86 @@
+package tstorage
+
+import "fmt"
+
+// WindowGapPolicy represents where to put rows falling in the gap between the write windows of partitions,
+// that is, rows older than a writable partition but newer than the window of the next older one.
+// See WithWindowGapPolicy
+type WindowGapPolicy string
+
+const (
+	// WindowGapExtendOlder puts them into the older partition, which extends its time range beyond its window.
+	WindowGapExtendOlder WindowGapPolicy = "extend-older"
+	// WindowGapNewPartition puts them into a new memory partition placed between the two partitions.
+	WindowGapNewPartition WindowGapPolicy = "new-partition"
+)
+
+// WithWindowGapPolicy specifies where to put rows falling in the gap between the write windows of partitions.
+//
+// Each row given to InsertRows is routed to the newest writable partition whose window contains its timestamp,
+// where the window of a partition spans the partition duration from its minimum timestamp. The head partition
+// takes any rows newer than its minimum timestamp until it gets full. A row contained by no window but older
+// than a writable partition, such as one arriving late after a burst of newer ones opened a new partition,
+// gets routed according to this policy. Under WindowGapNewPartition, the new partition becomes one of the two
+// writable partitions, so that the oldest writable one stops accepting rows and gets persisted by the next flush.
+//
+// Defaults to WindowGapExtendOlder.
+func WithWindowGapPolicy(policy WindowGapPolicy) Option {
+	return func(s *storage) {
+		s.windowGapPolicy = policy
+	}
+}
+
+// insertGapRows inserts the rows falling in the gap between the window of older and newer, which is the next
+// newer partition, into the partition between them, which gets created if none. rows must be older than newer.
+// It gives back the rest of rows to be inserted into older.
+func (s *storage) insertGapRows(newer, older partition, rows []Row) ([]Row, error) {
+	m, ok := older.(*memoryPartition)
+	if !ok || m.size() == 0 {
+		return rows, nil
+	}
+	windowEnd := m.minTimestamp() + m.partitionDuration
+	var gapRows, rest []Row
+	for i := range rows {
+		if rows[i].Timestamp >= windowEnd {
+			gapRows = append(gapRows, rows[i])
+		} else {
+			rest = append(rest, rows[i])
+		}
+	}
+	if len(gapRows) == 0 {
+		return rows, nil
+	}
+
+	s.gapMu.Lock()
+	defer s.gapMu.Unlock()
+	var next partition
+	iterator := s.partitionList.newIterator()
+	for iterator.next() {
+		if iterator.value() == newer {
+			if iterator.next() {
+				next = iterator.value()
+			}
+			break
+		}
+	}
+	if _, ok := next.(*memoryPartition); ok && next != older {
+		// Created by another insert in the meantime.
+		outdatedRows, err := next.insertRows(gapRows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to insert rows: %w", err)
+		}
+		return append(rest, outdatedRows...), nil
+	}
+
+	gap := s.newMemoryPartition()
+	// Its rows are written to the WAL segment of the active partition, so that it has no segment of its own.
+	gap.mergedPartitions = -1
+	if _, err := gap.insertRows(gapRows); err != nil {
+		return nil, fmt.Errorf("failed to insert rows: %w", err)
+	}
+	if err := s.partitionList.insertAfter(newer, gap); err != nil {
+		return nil, fmt.Errorf("failed to insert partition: %w", err)
+	}
+	s.recordEvent(PartitionEventCreated, newPartitionInfo(gap), nil)
+	return rest, nil
+}
@@ -0,0 +1,64 @@
+package tstorage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_storage_withWindowGapPolicy(t *testing.T) {
+	type window struct {
+		min, max int64
+	}
+	tests := []struct {
+		name   string
+		policy WindowGapPolicy
+		want   []window
+	}{
+		{
+			name:   "extend the older partition by default",
+			policy: "",
+			want:   []window{{min: 10000, max: 10000}, {min: 1, max: 8000}},
+		},
+		{
+			name:   "extend the older partition",
+			policy: WindowGapExtendOlder,
+			want:   []window{{min: 10000, max: 10000}, {min: 1, max: 8000}},
+		},
+		{
+			name:   "create a new partition",
+			policy: WindowGapNewPartition,
+			want:   []window{{min: 10000, max: 10000}, {min: 7000, max: 8000}, {min: 1, max: 5000}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := []Option{WithTimestampPrecision(Seconds), WithPartitionDuration(time.Hour)}
+			if tt.policy != "" {
+				opts = append(opts, WithWindowGapPolicy(tt.policy))
+			}
+			s, err := NewStorage(opts...)
+			require.NoError(t, err)
+			defer s.Close()
+			// The window of the first partition spans from 1 to 3600, while it takes 5000 as the head.
+			for _, ts := range []int64{1, 5000, 10000} {
+				require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: ts}}}))
+			}
+			// Between the windows of the two partitions.
+			require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 7000}}}))
+			require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 8000}}}))
+
+			var got []window
+			for _, p := range s.ListPartitions() {
+				got = append(got, window{min: p.MinTimestamp, max: p.MaxTimestamp})
+			}
+			assert.Equal(t, tt.want, got)
+
+			points, err := s.Select("metric1", nil, 0, 10000)
+			require.NoError(t, err)
+			assert.Equal(t, []*DataPoint{{Timestamp: 1}, {Timestamp: 5000}, {Timestamp: 7000}, {Timestamp: 8000}}, points)
+		})
+	}
+}
@@ -0,0 +1,239 @@
+package tstorage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+)
+
+const (
+	// The number of rows InsertFrom inserts at once.
+	wireBatchSize = 1024
+	// The maximum byte size of a single frame, which protects from allocating a huge buffer
+	// because of a corrupted length.
+	maxWireFrameSize = 1 << 20
+)
+
+var (
+	// ErrInvalidWireFormat is returned if the stream given to InsertFrom isn't valid.
+	ErrInvalidWireFormat = errors.New("invalid wire format")
+
+	wireCRCTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// WireCodec encodes and decodes rows to and from a binary stream.
+type WireCodec interface {
+	// ReadRow decodes a single row from r into dst.
+	// It must return io.EOF only if r ends exactly at a row boundary.
+	ReadRow(r *bufio.Reader, dst *Row) error
+	// WriteRow encodes a single row into w.
+	WriteRow(w io.Writer, row *Row) error
+}
+
+// BinaryWireCodec is a compact and self-framing WireCodec.
+// Each row is encoded into a frame as shown below:
+/*
+   +-------------------+---------+------------+
+   | len body(varints) |  body   | crc32c(4b) |
+   +-------------------+---------+------------+
+
+   The body is:
+   +---------------------+--------+-------------------------+--------+--------------------+-----------------+
+   | len metric(varints) | metric | num labels(varints)     | labels | timestamp(varints) | value(8b, LE)   |
+   +---------------------+--------+-------------------------+--------+--------------------+-----------------+
+
+   Each label is:
+   +-------------------+------+--------------------+-------+
+   | len name(varints) | name | len value(varints) | value |
+   +-------------------+------+--------------------+-------+
+*/
+// The checksum is the CRC-32 of the body with the Castagnoli polynomial, in little endian.
+var BinaryWireCodec WireCodec = &binaryWireCodec{}
+
+type binaryWireCodec struct{}
+
+func (c *binaryWireCodec) WriteRow(w io.Writer, row *Row) error {
+	body := make([]byte, 0, len(row.Metric)+binary.MaxVarintLen64*3+8)
+	body = appendWireString(body, row.Metric)
+	body = binary.AppendUvarint(body, uint64(len(row.Labels)))
+	for _, l := range row.Labels {
+		body = appendWireString(body, l.Name)
+		body = appendWireString(body, l.Value)
+	}
+	body = binary.AppendVarint(body, row.Timestamp)
+	body = binary.LittleEndian.AppendUint64(body, math.Float64bits(row.Value))
+
+	frame := make([]byte, 0, len(body)+binary.MaxVarintLen64+4)
+	frame = binary.AppendUvarint(frame, uint64(len(body)))
+	frame = append(frame, body...)
+	frame = binary.LittleEndian.AppendUint32(frame, crc32.Checksum(body, wireCRCTable))
+	if _, err := w.Write(frame); err != nil {
+		return fmt.Errorf("failed to write frame: %w", err)
+	}
+	return nil
+}
+
+func (c *binaryWireCodec) ReadRow(r *bufio.Reader, dst *Row) error {
+	size, err := binary.ReadUvarint(r)
+	if errors.Is(err, io.EOF) {
+		return io.EOF
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read the length of frame: %w", err)
+	}
+	if size > maxWireFrameSize {
+		return fmt.Errorf("%w: too large frame size %d", ErrInvalidWireFormat, size)
+	}
+	buf := make([]byte, size+4)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return fmt.Errorf("failed to read frame: %w", err)
+	}
+	body, sum := buf[:size], binary.LittleEndian.Uint32(buf[size:])
+	if crc32.Checksum(body, wireCRCTable) != sum {
+		return fmt.Errorf("%w: checksum mismatch", ErrInvalidWireFormat)
+	}
+
+	d := &wireDecoder{b: body}
+	row := Row{}
+	row.Metric = d.string()
+	numLabels := d.uvarint()
+	if numLabels > uint64(len(body)) {
+		return fmt.Errorf("%w: too many labels %d", ErrInvalidWireFormat, numLabels)
+	}
+	if numLabels > 0 {
+		row.Labels = make([]Label, numLabels)
+		for i := range row.Labels {
+			row.Labels[i].Name = d.string()
+			row.Labels[i].Value = d.string()
+		}
+	}
+	row.Timestamp = d.varint()
+	row.Value = math.Float64frombits(d.uint64())
+	if d.err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidWireFormat, d.err)
+	}
+	if len(d.b) != 0 {
+		return fmt.Errorf("%w: %d trailing bytes in frame", ErrInvalidWireFormat, len(d.b))
+	}
+	*dst = row
+	return nil
+}
+
+func appendWireString(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// wireDecoder reads values off a frame body. Once it faces an error, all subsequent reads are no-op.
+type wireDecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *wireDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.err = fmt.Errorf("malformed varint")
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *wireDecoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.b)
+	if n <= 0 {
+		d.err = fmt.Errorf("malformed varint")
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *wireDecoder) uint64() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	if len(d.b) < 8 {
+		d.err = fmt.Errorf("short value")
+		return 0
+	}
+	v := binary.LittleEndian.Uint64(d.b)
+	d.b = d.b[8:]
+	return v
+}
+
+func (d *wireDecoder) string() string {
+	n := d.uvarint()
+	if d.err != nil {
+		return ""
+	}
+	if n > uint64(len(d.b)) {
+		d.err = fmt.Errorf("short string")
+		return ""
+	}
+	s := string(d.b[:n])
+	d.b = d.b[n:]
+	return s
+}
+
+func (s *storage) InsertFrom(r io.Reader, codec WireCodec) (int, error) {
+	if codec == nil {
+		codec = BinaryWireCodec
+	}
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+
+	var inserted int
+	rows := make([]Row, 0, wireBatchSize)
+	flush := func() error {
+		if len(rows) == 0 {
+			return nil
+		}
+		if err := s.InsertRows(rows); err != nil {
+			return err
+		}
+		inserted += len(rows)
+		rows = rows[:0]
+		return nil
+	}
+	for {
+		var row Row
+		err := codec.ReadRow(br, &row)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			// Insert rows that have been decoded successfully before the broken one.
+			if ferr := flush(); ferr != nil {
+				return inserted, ferr
+			}
+			return inserted, fmt.Errorf("failed to decode row %d: %w", inserted, err)
+		}
+		rows = append(rows, row)
+		if len(rows) == wireBatchSize {
+			if err := flush(); err != nil {
+				return inserted, err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return inserted, err
+	}
+	return inserted, nil
+}
@@ -0,0 +1,78 @@
+package tstorage
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_storage_InsertFrom(t *testing.T) {
+	rows := []Row{
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000000, Value: 0.1}},
+		{Metric: "metric1", Labels: []Label{{Name: "host", Value: "host-1"}}, DataPoint: DataPoint{Timestamp: 1600000001, Value: -2.5}},
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000002, Value: 0.3}},
+	}
+	buf := &bytes.Buffer{}
+	for i := range rows {
+		require.NoError(t, BinaryWireCodec.WriteRow(buf, &rows[i]))
+	}
+	encoded := buf.Bytes()
+
+	tests := []struct {
+		name         string
+		input        []byte
+		wantInserted int
+		wantErr      error
+		want         []*DataPoint
+	}{
+		{
+			name:         "valid stream",
+			input:        encoded,
+			wantInserted: 3,
+			want: []*DataPoint{
+				{Timestamp: 1600000000, Value: 0.1},
+				{Timestamp: 1600000002, Value: 0.3},
+			},
+		},
+		{
+			name:         "truncated stream",
+			input:        encoded[:len(encoded)-3],
+			wantInserted: 2,
+			wantErr:      io.ErrUnexpectedEOF,
+			want: []*DataPoint{
+				{Timestamp: 1600000000, Value: 0.1},
+			},
+		},
+		{
+			name: "corrupted stream",
+			input: func() []byte {
+				b := append([]byte{}, encoded...)
+				b[3] ^= 0xff
+				return b
+			}(),
+			wantInserted: 0,
+			wantErr:      ErrInvalidWireFormat,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewStorage(WithPartitionDuration(time.Hour), WithTimestampPrecision(Seconds))
+			require.NoError(t, err)
+			defer s.Close()
+
+			got, err := s.InsertFrom(bytes.NewReader(tt.input), nil)
+			assert.Equal(t, tt.wantInserted, got)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+			}
+			points, _ := s.Select("metric1", nil, 1600000000, 1600000003)
+			assert.Equal(t, tt.want, points)
+		})
+	}
+}
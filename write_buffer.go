@@ -0,0 +1,112 @@
+package tstorage
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// writeBuffer holds rows given by InsertRows to insert them into partitions at once.
+type writeBuffer struct {
+	maxRows  int
+	maxDelay time.Duration
+
+	mu   sync.Mutex
+	rows []Row
+
+	// stopCh gets closed to stop the background goroutine, and doneCh gets closed once it stops.
+	stopCh chan struct{}
+	doneCh chan struct{}
+}
+
+func newWriteBuffer(maxRows int, maxDelay time.Duration) *writeBuffer {
+	return &writeBuffer{
+		maxRows:  maxRows,
+		maxDelay: maxDelay,
+		rows:     make([]Row, 0, maxRows),
+		stopCh:   make(chan struct{}),
+		doneCh:   make(chan struct{}),
+	}
+}
+
+// take gives back all buffered rows and empties the buffer.
+// If full is true, it gives back nothing unless the buffer holds maxRows or more rows.
+func (b *writeBuffer) take(full bool) []Row {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.rows) == 0 || (full && len(b.rows) < b.maxRows) {
+		return nil
+	}
+	rows := b.rows
+	b.rows = make([]Row, 0, b.maxRows)
+	return rows
+}
+
+// bufferRows appends the given rows to the write buffer.
+// Once the buffer gets full, the caller inserts all buffered rows including those given by others.
+func (s *storage) bufferRows(rows []Row) error {
+	b := s.writeBuffer
+	b.mu.Lock()
+	b.rows = append(b.rows, rows...)
+	b.mu.Unlock()
+
+	if rows := b.take(true); rows != nil {
+		return s.insertRows(rows)
+	}
+	return nil
+}
+
+// flushWriteBuffer inserts all buffered rows into partitions.
+func (s *storage) flushWriteBuffer() error {
+	rows := s.writeBuffer.take(false)
+	if rows == nil {
+		return nil
+	}
+	if err := s.insertRows(rows); err != nil {
+		return fmt.Errorf("failed to flush write buffer: %w", err)
+	}
+	return nil
+}
+
+// startWriteBuffer starts a goroutine that periodically flushes the write buffer, if enabled.
+func (s *storage) startWriteBuffer() {
+	b := s.writeBuffer
+	if b == nil {
+		return
+	}
+	if b.maxDelay <= 0 {
+		close(b.doneCh)
+		return
+	}
+	go func() {
+		defer close(b.doneCh)
+		ticker := time.NewTicker(b.maxDelay)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-b.stopCh:
+				return
+			case <-ticker.C:
+				if err := s.recovered(s.flushWriteBuffer); err != nil {
+					s.logger.Printf("%v\n", err)
+				}
+			}
+		}
+	}()
+}
+
+// stopWriteBuffer stops the background goroutine and then drains the write buffer, if enabled.
+func (s *storage) stopWriteBuffer() error {
+	b := s.writeBuffer
+	if b == nil {
+		return nil
+	}
+	select {
+	case <-b.doneCh:
+		// Already stopped by the Close failed before.
+	default:
+		close(b.stopCh)
+		<-b.doneCh
+	}
+	return s.flushWriteBuffer()
+}